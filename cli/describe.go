@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+	"github.com/bazel-contrib/target-determinator/version"
+)
+
+// Description describes the capabilities of a binary, so that systems orchestrating several
+// versions of it can tell which features each supports.
+type Description struct {
+	// Tool is the name of the binary, e.g. "target-determinator".
+	Tool string `json:"tool"`
+	// Version is the version of the tool.
+	Version string `json:"version"`
+	// SnapshotSchemaVersions are the versions of persisted hash files the tool can read.
+	SnapshotSchemaVersions []int `json:"snapshot_schema_versions"`
+	// SnapshotSchemaVersion is the version of persisted hash files the tool writes.
+	SnapshotSchemaVersion int `json:"snapshot_schema_version"`
+	// SnapshotHashFunction is the hash function the tool computes the hashes in persisted hash
+	// files with. Hashes computed with different functions can't be compared.
+	SnapshotHashFunction string `json:"snapshot_hash_function"`
+	// OutputFormats are the formats the tool can output its results in.
+	OutputFormats []string `json:"output_formats"`
+	// Flags are all of the flags the tool accepts, sorted by name.
+	Flags []FlagDescription `json:"flags"`
+}
+
+// FlagDescription describes a single flag.
+type FlagDescription struct {
+	Name    string `json:"name"`
+	Default string `json:"default"`
+	Usage   string `json:"usage"`
+	// IsBool is whether the flag can be passed without a value.
+	IsBool bool `json:"is_bool,omitempty"`
+}
+
+// Describe returns the Description of the binary called commandName, whose flags have all been
+// registered.
+func Describe(commandName string, outputFormats []string) *Description {
+	description := &Description{
+		Tool:                   commandName,
+		Version:                version.Version,
+		SnapshotSchemaVersions: pkg.SupportedPersistedHashesSchemaVersions,
+		SnapshotSchemaVersion:  pkg.SnapshotSchemaVersion,
+		SnapshotHashFunction:   pkg.PersistedHashFunction,
+		OutputFormats:          outputFormats,
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		isBool := false
+		if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); ok {
+			isBool = boolFlag.IsBoolFlag()
+		}
+		description.Flags = append(description.Flags, FlagDescription{
+			Name:    f.Name,
+			Default: f.DefValue,
+			Usage:   f.Usage,
+			IsBool:  isBool,
+		})
+	})
+	return description
+}
+
+// PrintDescription prints the Description of the binary called commandName as JSON, for
+// --describe. Binaries which don't register the common flags should register their own --describe.
+func PrintDescription(commandName string, outputFormats []string) error {
+	content, err := json.MarshalIndent(Describe(commandName, outputFormats), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal description: %w", err)
+	}
+	fmt.Println(string(content))
+	return nil
+}
@@ -1,11 +1,14 @@
 package cli
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/bazel-contrib/target-determinator/common"
 	"github.com/bazel-contrib/target-determinator/pkg"
@@ -67,6 +70,7 @@ func (e *EnforceCleanFlag) Set(value string) error {
 
 type CommonFlags struct {
 	Version                                bool
+	Describe                               bool
 	WorkingDirectory                       *string
 	BazelPath                              *string
 	BazelStartupOpts                       *MultipleStrings
@@ -79,6 +83,41 @@ type CommonFlags struct {
 	AnalysisCacheClearStrategy             *string
 	CompareQueriesAroundAnalysisCacheClear bool
 	FilterIncompatibleTargets              bool
+	ToolchainResolutionChanges             *string
+	IgnoreHostToolchains                   bool
+	HostToolchainRepositories              *MultipleStrings
+	MaxBeforeRevisionAge                   time.Duration
+	MaxBeforeRevisionCommits               int
+	StaleBeforeRevisionBehavior            *string
+	WarnBeforeRevisionAge                  time.Duration
+	WarnBeforeRevisionCommits              int
+	ConfigurationEnumeration               *string
+	WorktreeCacheDir                       *string
+	CleanCachedWorktrees                   bool
+	ProcessRevisionsConcurrently           bool
+	HashingWorkers                         int
+	QueryChunkSize                         int
+	BeforeBazelOutputBase                  *string
+	ManualTargets                          *string
+	KeepGoing                              bool
+	InfraFilesConfig                       *string
+	PolicyMarkers                          bool
+	GazelleCheck                           *string
+	GazelleTarget                          *string
+	HeartbeatInterval                      time.Duration
+	HeartbeatFile                          *string
+	BazelServer                            *string
+	BazelServerMaxHeap                     *string
+	ShutdownBazelAfter                     bool
+	Quiet                                  bool
+	NoColor                                bool
+	// OutputFormats are the formats the binary can output its results in, for --describe.
+	// They should be set by the binary before calling ValidateCommonFlags.
+	OutputFormats []string
+	// DefaultBeforeRevision, if set, is used as the before revision if no positional argument is
+	// given, for modes of the binary which don't compare against one. It should be set by the
+	// binary before calling ValidateCommonFlags.
+	DefaultBeforeRevision string
 }
 
 func StrPtr() *string {
@@ -89,6 +128,7 @@ func StrPtr() *string {
 func RegisterCommonFlags() *CommonFlags {
 	commonFlags := CommonFlags{
 		Version:                                false,
+		Describe:                               false,
 		WorkingDirectory:                       StrPtr(),
 		BazelPath:                              StrPtr(),
 		BazelStartupOpts:                       &MultipleStrings{},
@@ -101,18 +141,51 @@ func RegisterCommonFlags() *CommonFlags {
 		AnalysisCacheClearStrategy:             StrPtr(),
 		CompareQueriesAroundAnalysisCacheClear: false,
 		FilterIncompatibleTargets:              true,
+		ToolchainResolutionChanges:             StrPtr(),
+		IgnoreHostToolchains:                   false,
+		HostToolchainRepositories:              &MultipleStrings{},
+		MaxBeforeRevisionAge:                   0,
+		MaxBeforeRevisionCommits:               0,
+		StaleBeforeRevisionBehavior:            StrPtr(),
+		WarnBeforeRevisionAge:                  0,
+		WarnBeforeRevisionCommits:              0,
+		ConfigurationEnumeration:               StrPtr(),
+		WorktreeCacheDir:                       StrPtr(),
+		CleanCachedWorktrees:                   false,
+		ProcessRevisionsConcurrently:           false,
+		HashingWorkers:                         0,
+		QueryChunkSize:                         0,
+		BeforeBazelOutputBase:                  StrPtr(),
+		ManualTargets:                          StrPtr(),
+		KeepGoing:                              false,
+		InfraFilesConfig:                       StrPtr(),
+		PolicyMarkers:                          true,
+		GazelleCheck:                           StrPtr(),
+		GazelleTarget:                          StrPtr(),
+		HeartbeatInterval:                      0,
+		HeartbeatFile:                          StrPtr(),
+		BazelServer:                            StrPtr(),
+		BazelServerMaxHeap:                     StrPtr(),
+		ShutdownBazelAfter:                     false,
+		Quiet:                                  false,
+		NoColor:                                false,
 	}
 	flag.BoolVar(&commonFlags.Version, "version", false, "Print the version of the tool and exit.")
+	flag.BoolVar(&commonFlags.Describe, "describe", false, "Print a JSON document describing the tool's version, supported hash file schema versions, output formats and flags, and exit.")
 	flag.StringVar(commonFlags.WorkingDirectory, "working-directory", ".", "Working directory to query.")
 	flag.StringVar(commonFlags.BazelPath, "bazel", "bazel",
 		"Bazel binary (basename on $PATH, or absolute or relative path) to run.")
-	flag.Var(commonFlags.BazelStartupOpts, "bazel-startup-opts", "Startup options to pass to Bazel. Options such as '--bazelrc' should use relative paths for files under the repository to avoid issues (TD may check out the repository in a temporary directory).")
+	flag.Var(commonFlags.BazelStartupOpts, "bazel-startup-opts", "Startup options to pass to Bazel. Options such as '--bazelrc' should use relative paths for files under the repository to avoid issues (TD may check out the repository in a temporary directory). --output_base and --output_user_root are resolved relative to --working-directory and used for every Bazel invocation, including those in worktrees; the output base of the before revision is derived from them when processing revisions concurrently.")
 	flag.Var(commonFlags.BazelOpts, "bazel-opts", "Options to pass to Bazel. Assumed to apply to build and cquery. Options should use relative paths for repository files (see --bazel-startup-opts).")
 	flag.Var(&commonFlags.EnforceCleanRepo, "enforce-clean",
 		fmt.Sprintf("Pass --enforce-clean=%v to fail if the repository is unclean, or --enforce-clean=%v to allow ignored untracked files (the default).",
 			EnforceClean.String(), AllowIgnored.String()))
 	flag.BoolVar(&commonFlags.DeleteCachedWorktree, "delete-cached-worktree", false,
 		"Delete created worktrees after use when created. Keeping them can make subsequent invocations faster.")
+	flag.StringVar(commonFlags.WorktreeCacheDir, "worktree-cache-dir", "",
+		"Directory to create git worktrees in when needed. Defaults to ~/.cache/target-determinator.")
+	flag.BoolVar(&commonFlags.CleanCachedWorktrees, "clean-cached-worktrees", false,
+		"Remove cached worktrees which aren't in use by a running invocation (e.g. left behind by crashed runs) from --worktree-cache-dir, and exit.")
 	flag.Var(commonFlags.IgnoredFiles, "ignore-file",
 		"Files to ignore for git operations, relative to the working-directory. These files shan't affect the Bazel graph.")
 	flag.StringVar(commonFlags.BeforeQueryErrorBehavior, "before-query-error-behavior", "ignore-and-build-all", "How to behave if the 'before' revision query fails. Accepted values: fatal,ignore-and-build-all")
@@ -121,13 +194,93 @@ func RegisterCommonFlags() *CommonFlags {
 	flag.StringVar(commonFlags.AnalysisCacheClearStrategy, "analysis-cache-clear-strategy", "skip", "Strategy for clearing the analysis cache. Accepted values: skip,shutdown,discard.")
 	flag.BoolVar(&commonFlags.CompareQueriesAroundAnalysisCacheClear, "compare-queries-around-analysis-cache-clear", false, "Whether to check for query result differences before and after analysis cache clears. This is a temporary flag for performing real-world analysis.")
 	flag.BoolVar(&commonFlags.FilterIncompatibleTargets, "filter-incompatible-targets", true, "Whether to filter out incompatible targets from the candidate set of affected targets.")
+	flag.BoolVar(&commonFlags.IgnoreHostToolchains, "ignore-host-toolchains", false, "Whether to ignore the contents of external repositories which are detected from the host machine (see --host-toolchain-repository) when hashing. Useful when builds actually run on remote executors with pinned toolchains.")
+	flag.Var(commonFlags.HostToolchainRepositories, "host-toolchain-repository", fmt.Sprintf("External repository to ignore when --ignore-host-toolchains is set; may be repeated. Defaults to %v.", DefaultHostToolchainRepositories))
+	flag.DurationVar(&commonFlags.MaxBeforeRevisionAge, "max-before-revision-age", 0, "Maximum difference in commit time between the before revision and the current revision (e.g. 72h). Zero means unlimited. See --stale-before-revision-behavior.")
+	flag.IntVar(&commonFlags.MaxBeforeRevisionCommits, "max-before-revision-commits", 0, "Maximum number of commits between the before revision and the current revision. Zero means unlimited. See --stale-before-revision-behavior.")
+	flag.StringVar(commonFlags.StaleBeforeRevisionBehavior, "stale-before-revision-behavior", "fatal", "How to behave if the before revision exceeds --max-before-revision-age or --max-before-revision-commits. Accepted values: fatal,build-all")
+	flag.DurationVar(&commonFlags.WarnBeforeRevisionAge, "warn-before-revision-age", 0, "Log a warning if the difference in commit time between the before revision and the current revision exceeds this (e.g. 168h). Zero means never warn.")
+	flag.IntVar(&commonFlags.WarnBeforeRevisionCommits, "warn-before-revision-commits", 0, "Log a warning if the number of commits between the before revision and the current revision exceeds this. Zero means never warn.")
+	flag.StringVar(commonFlags.ToolchainResolutionChanges, "toolchain-resolution-changes", "include", "How to handle targets only affected by changes to config_setting, platform, constraint_setting, constraint_value and toolchain_type targets. include treats them like any other affected target, report also lists them separately, and exclude doesn't report them as affected. Accepted values: include,report,exclude")
+	flag.StringVar(commonFlags.ConfigurationEnumeration, "configuration-enumeration", "top-level", "Which configurations of each matching target to consider. top-level only considers the configurations targets are requested in, include-exec also considers exec configurations they are depended on in, all considers every configuration they are depended on in. Accepted values: top-level,include-exec,all")
+	flag.BoolVar(&commonFlags.ProcessRevisionsConcurrently, "process-revisions-concurrently", false, "Whether to process the before revision at the same time as the current revision, in a git worktree with its own Bazel output base. This is faster, but needs roughly twice the disk space, memory and CPU.")
+	flag.IntVar(&commonFlags.HashingWorkers, "hashing-workers", 0, "Number of workers to hash targets with, shared between both revisions if they are processed concurrently. Zero means to use the TD_WORKER_COUNT environment variable if set, or eight times the number of CPUs.")
+	flag.IntVar(&commonFlags.QueryChunkSize, "query-chunk-size", 0, "If set, the maximum number of targets to analyze in a single cquery. If --targets matches more targets than this, they are split into chunks of neighbouring packages which are queried one after another and merged, which keeps Bazel's memory use down for huge repositories at the cost of some repeated analysis of shared dependencies. Zero means to query all targets at once.")
+	flag.StringVar(commonFlags.BeforeBazelOutputBase, "before-output-base", "", "If set, a Bazel output base to process the before revision in, so that the analysis cache of the current revision's output base is kept. This uses more disk space, but can save a lot of time when analysis is slow.")
+	flag.StringVar(commonFlags.ManualTargets, "manual-targets", "include", "How to treat targets tagged manual. include considers them like any other target, exclude-unless-listed matches Bazel's wildcard behaviour by only considering them if they're listed explicitly in --targets. Accepted values: include,exclude-unless-listed")
+	flag.BoolVar(&commonFlags.KeepGoing, "keep-going", false, "If set, carries on when some packages fail to load or analyze, rather than failing. The packages which failed are read from Bazel's build event protocol output, and as which of their targets are affected is unknown, a <package>:all target pattern is output for each of them after the affected targets.")
+	flag.StringVar(commonFlags.InfraFilesConfig, "infra-files-config", "", "If set, a JSON file listing policies for infrastructure files (e.g. MODULE.bazel, .bazelrc, CI configs) whose changes may affect targets in ways the build graph doesn't show. Each policy has a pattern, an action (all, targets or ignore) and, for the targets action, a list of targets. The last matching policy applies to each changed file.")
+	flag.BoolVar(&commonFlags.PolicyMarkers, "policy-markers", true, "Whether to apply policies declared in .td-policy files in the repository. Each is a JSON object declaring how changes to the directory containing it are handled, with an action of affected-when-touched (all targets in the directory are affected when any file in it changes), ignore (targets in the directory are never affected) or targets (the listed targets are affected when any file in it changes).")
+	flag.StringVar(commonFlags.GazelleCheck, "gazelle-check", "off", "Whether to run gazelle in diff mode on the directories containing changed files first, to detect BUILD files which are out of date. Stale BUILD files can make the results silently wrong, e.g. when Go or Python code moves between packages. Accepted values: off,warn,fail")
+	flag.StringVar(commonFlags.GazelleTarget, "gazelle-target", "//:gazelle", "The gazelle target to run for --gazelle-check.")
+	flag.DurationVar(&commonFlags.HeartbeatInterval, "heartbeat-interval", 0, "If set (e.g. 1m), logs a heartbeat line to stderr at this interval while running, so that CI watchdogs which kill jobs without output can tell a slow run from a hung one. Zero means no heartbeat.")
+	flag.StringVar(commonFlags.HeartbeatFile, "heartbeat-file", "", "If set with --heartbeat-interval, also writes the current time to this file at each heartbeat, for watchdogs which check a file's modification time.")
+	flag.StringVar(commonFlags.BazelServer, "bazel-server", "reuse", "Which Bazel server to use. reuse uses the server of the workspace's default output base, sharing its analysis cache with other builds; own uses a server with an output base dedicated to TD next to the default one, so that other builds' servers aren't disturbed. Accepted values: reuse,own")
+	flag.StringVar(commonFlags.BazelServerMaxHeap, "bazel-server-max-heap", "", "If set, the maximum Java heap size of the Bazel servers TD uses (e.g. 4g), passed as --host_jvm_args=-Xmx<size>. Note that a running server started with different startup options will be restarted.")
+	flag.BoolVar(&commonFlags.ShutdownBazelAfter, "shutdown-bazel-after", false, "Whether to shut down the Bazel servers TD used (including the before revision's output base with --before-output-base or --process-revisions-concurrently) when it finishes, so that they don't keep holding memory on shared machines.")
+	flag.BoolVar(&commonFlags.Quiet, "quiet", false, "If set, only warnings and errors are logged, rather than progress and summaries, e.g. for log collectors. Results are output as usual.")
+	flag.BoolVar(&commonFlags.NoColor, "no-color", false, "If set, human-facing output (e.g. of -diff-snapshots) is never colored. Otherwise it's colored when written to a terminal, unless the NO_COLOR environment variable is set.")
 	return &commonFlags
 }
 
+// ApplyOutputFlags configures logging according to flags. It should be called as soon as flags are
+// parsed, so that --quiet applies to everything logged afterwards.
+func ApplyOutputFlags(flags *CommonFlags) {
+	pkg.SetQuiet(flags.Quiet)
+}
+
+// DefaultHostToolchainRepositories are the repositories ignored by --ignore-host-toolchains if no
+// --host-toolchain-repository flags are passed.
+var DefaultHostToolchainRepositories = []string{
+	"local_config_cc",
+	"local_config_cc_toolchains",
+	"local_config_python",
+	"local_config_sh",
+	"local_jdk",
+}
+
+func cleanCachedWorktrees(cacheDir string) error {
+	if cacheDir == "" {
+		var err error
+		if cacheDir, err = pkg.DefaultWorktreeCacheDir(); err != nil {
+			return err
+		}
+	}
+	removed, err := pkg.CleanWorktreeCache(cacheDir)
+	for _, path := range removed {
+		fmt.Printf("Removed %s\n", path)
+	}
+	return err
+}
+
+// checkGazelle logs a warning, or returns an error if fail is set, if gazelle would change any BUILD
+// files in directories containing files changed since beforeRev.
+func checkGazelle(context *pkg.Context, beforeRev pkg.LabelledGitRev, gazelleTarget string, fail bool) error {
+	changedFiles, err := pkg.ChangedFilesSince(context.WorkspacePath, beforeRev)
+	if err != nil {
+		return err
+	}
+	staleFiles, err := pkg.StaleBuildFiles(context, gazelleTarget, pkg.ChangedDirectories(context.WorkspacePath, changedFiles))
+	if err != nil {
+		return err
+	}
+	if len(staleFiles) == 0 {
+		return nil
+	}
+	message := fmt.Sprintf("BUILD files are out of date according to %s, so affected targets may be missed: %s", gazelleTarget, strings.Join(staleFiles, ", "))
+	if fail {
+		return errors.New(message)
+	}
+	log.Printf("WARN: %s", message)
+	return nil
+}
+
 type CommonConfig struct {
 	Context        *pkg.Context
 	RevisionBefore pkg.LabelledGitRev
 	Targets        pkg.TargetsList
+	// ShutdownBazelAfter is whether the binary should call pkg.ShutdownBazelServers when it finishes.
+	ShutdownBazelAfter bool
 }
 
 // ValidateCommonFlags ensures that the argument follow the right format
@@ -137,7 +290,74 @@ func ValidateCommonFlags(commandName string, flags *CommonFlags) (targetPattern
 		os.Exit(0)
 	}
 
+	if flags.Describe {
+		if err := PrintDescription(commandName, flags.OutputFormats); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to describe %s: %v\n", commandName, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if flags.CleanCachedWorktrees {
+		if err := cleanCachedWorktrees(*flags.WorktreeCacheDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to clean cached worktrees: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	switch *flags.ToolchainResolutionChanges {
+	case "include", "report", "exclude":
+	default:
+		return "", fmt.Errorf("unexpected value for flag -toolchain-resolution-changes - allowed values: include|report|exclude, saw: %s", *flags.ToolchainResolutionChanges)
+	}
+
+	if *flags.StaleBeforeRevisionBehavior != "fatal" && *flags.StaleBeforeRevisionBehavior != "build-all" {
+		return "", fmt.Errorf("unexpected value for flag -stale-before-revision-behavior - allowed values: fatal|build-all, saw: %s", *flags.StaleBeforeRevisionBehavior)
+	}
+
+	switch *flags.ConfigurationEnumeration {
+	case "top-level", "include-exec", "all":
+	default:
+		return "", fmt.Errorf("unexpected value for flag -configuration-enumeration - allowed values: top-level|include-exec|all, saw: %s", *flags.ConfigurationEnumeration)
+	}
+
+	if *flags.ManualTargets != "include" && *flags.ManualTargets != "exclude-unless-listed" {
+		return "", fmt.Errorf("unexpected value for flag -manual-targets - allowed values: include|exclude-unless-listed, saw: %s", *flags.ManualTargets)
+	}
+
+	switch *flags.GazelleCheck {
+	case "off", "warn", "fail":
+	default:
+		return "", fmt.Errorf("unexpected value for flag -gazelle-check - allowed values: off|warn|fail, saw: %s", *flags.GazelleCheck)
+	}
+
+	if flags.HeartbeatInterval < 0 {
+		return "", fmt.Errorf("unexpected value for flag -heartbeat-interval - must not be negative, saw: %v", flags.HeartbeatInterval)
+	}
+	if *flags.HeartbeatFile != "" && flags.HeartbeatInterval == 0 {
+		return "", fmt.Errorf("-heartbeat-file can only be used with -heartbeat-interval")
+	}
+
+	if flags.QueryChunkSize < 0 {
+		return "", fmt.Errorf("unexpected value for flag -query-chunk-size - must not be negative, saw: %d", flags.QueryChunkSize)
+	}
+
+	switch *flags.BazelServer {
+	case "reuse", "own":
+	default:
+		return "", fmt.Errorf("unexpected value for flag -bazel-server - allowed values: reuse|own, saw: %s", *flags.BazelServer)
+	}
+	if *flags.BazelServerMaxHeap != "" {
+		if _, err := pkg.BazelServerMaxHeapStartupOpt(*flags.BazelServerMaxHeap); err != nil {
+			return "", fmt.Errorf("unexpected value for flag -bazel-server-max-heap: %w", err)
+		}
+	}
+
 	positional := flag.Args()
+	if len(positional) == 0 && flags.DefaultBeforeRevision != "" {
+		return flags.DefaultBeforeRevision, nil
+	}
 	if len(positional) != 1 {
 		return "", fmt.Errorf("expected one positional argument, <before-revision>, but got %d", len(positional))
 	}
@@ -146,6 +366,10 @@ func ValidateCommonFlags(commandName string, flags *CommonFlags) (targetPattern
 }
 
 func ResolveCommonConfig(commonFlags *CommonFlags, beforeRevStr string) (*CommonConfig, error) {
+	if commonFlags.HeartbeatInterval > 0 {
+		// The heartbeat runs until the process exits.
+		pkg.StartHeartbeat(commonFlags.HeartbeatInterval, *commonFlags.HeartbeatFile)
+	}
 
 	// Context attributes
 
@@ -164,16 +388,39 @@ func ResolveCommonConfig(commonFlags *CommonFlags, beforeRevStr string) (*Common
 		return nil, fmt.Errorf("failed to resolve the \"after\" (i.e. original) git revision: %w", err)
 	}
 
+	startupOpts, requestedOutputOpts, err := pkg.NormalizeOutputStartupOpts(workingDirectory, *commonFlags.BazelStartupOpts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -bazel-startup-opts: %w", err)
+	}
+	if requestedOutputOpts.OutputBase != "" && *commonFlags.BazelServer == "own" {
+		return nil, fmt.Errorf("-bazel-server=own can't be used with an --output_base startup option")
+	}
+
 	bazelCmd := pkg.DefaultBazelCmd{
 		BazelPath:        *commonFlags.BazelPath,
-		BazelStartupOpts: *commonFlags.BazelStartupOpts,
+		BazelStartupOpts: startupOpts,
 		BazelOpts:        *commonFlags.BazelOpts,
 	}
+	if *commonFlags.BazelServerMaxHeap != "" {
+		maxHeapOpt, err := pkg.BazelServerMaxHeapStartupOpt(*commonFlags.BazelServerMaxHeap)
+		if err != nil {
+			return nil, err
+		}
+		bazelCmd.BazelStartupOpts = append(append([]string(nil), bazelCmd.BazelStartupOpts...), maxHeapOpt)
+	}
 
-	outputBase, err := pkg.BazelOutputBase(workingDirectory, bazelCmd)
+	var outputBase string
+	if *commonFlags.BazelServer == "own" {
+		outputBase, err = pkg.OwnBazelOutputBase(workingDirectory, bazelCmd)
+	} else {
+		outputBase, err = pkg.BazelOutputBase(workingDirectory, bazelCmd)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to resolve the bazel output base: %w", err)
 	}
+	if err := pkg.CheckOutputBase(outputBase, requestedOutputOpts); err != nil {
+		return nil, err
+	}
 
 	context := &pkg.Context{
 		WorkspacePath:                          workingDirectory,
@@ -187,6 +434,49 @@ func ResolveCommonConfig(commonFlags *CommonFlags, beforeRevStr string) (*Common
 		CompareQueriesAroundAnalysisCacheClear: commonFlags.CompareQueriesAroundAnalysisCacheClear,
 		FilterIncompatibleTargets:              commonFlags.FilterIncompatibleTargets,
 		EnforceCleanRepo:                       commonFlags.EnforceCleanRepo == EnforceClean,
+		ToolchainResolutionChanges:             *commonFlags.ToolchainResolutionChanges,
+		MaxBeforeRevisionAge:                   commonFlags.MaxBeforeRevisionAge,
+		MaxBeforeRevisionCommits:               commonFlags.MaxBeforeRevisionCommits,
+		StaleBeforeRevisionBehavior:            *commonFlags.StaleBeforeRevisionBehavior,
+		WarnBeforeRevisionAge:                  commonFlags.WarnBeforeRevisionAge,
+		WarnBeforeRevisionCommits:              commonFlags.WarnBeforeRevisionCommits,
+		ConfigurationEnumeration:               *commonFlags.ConfigurationEnumeration,
+		WorktreeCacheDir:                       *commonFlags.WorktreeCacheDir,
+		ProcessRevisionsConcurrently:           commonFlags.ProcessRevisionsConcurrently,
+		HashingWorkers:                         commonFlags.HashingWorkers,
+		QueryChunkSize:                         commonFlags.QueryChunkSize,
+		ManualTargets:                          *commonFlags.ManualTargets,
+		KeepGoing:                              commonFlags.KeepGoing,
+		DegradedPackages:                       &pkg.DegradedPackages{},
+	}
+
+	if *commonFlags.BeforeBazelOutputBase != "" {
+		// Bazel requires output bases to be absolute.
+		if context.BeforeBazelOutputBase, err = filepath.Abs(*commonFlags.BeforeBazelOutputBase); err != nil {
+			return nil, fmt.Errorf("failed to get absolute path of before output base %v: %w", *commonFlags.BeforeBazelOutputBase, err)
+		}
+		if filepath.Clean(context.BeforeBazelOutputBase) == filepath.Clean(outputBase) {
+			return nil, fmt.Errorf("-before-output-base must differ from the output base of the current revision, %s", outputBase)
+		}
+	}
+
+	if *commonFlags.InfraFilesConfig != "" {
+		if context.InfraFilePolicies, err = pkg.LoadInfraFilePolicies(*commonFlags.InfraFilesConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	if commonFlags.PolicyMarkers {
+		if context.PolicyMarkers, err = pkg.LoadPolicyMarkers(workingDirectory); err != nil {
+			return nil, err
+		}
+	}
+
+	if commonFlags.IgnoreHostToolchains {
+		context.IgnoredRepositories = DefaultHostToolchainRepositories
+		if len(*commonFlags.HostToolchainRepositories) > 0 {
+			context.IgnoredRepositories = *commonFlags.HostToolchainRepositories
+		}
 	}
 
 	// Non-context attributes
@@ -196,15 +486,22 @@ func ResolveCommonConfig(commonFlags *CommonFlags, beforeRevStr string) (*Common
 		return nil, fmt.Errorf("failed to resolve the \"before\" git revision: %w", err)
 	}
 
+	if *commonFlags.GazelleCheck != "off" {
+		if err := checkGazelle(context, beforeRev, *commonFlags.GazelleTarget, *commonFlags.GazelleCheck == "fail"); err != nil {
+			return nil, err
+		}
+	}
+
 	targetsList, err := pkg.ParseTargetsList(*commonFlags.TargetsFlag)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse targets: %w", err)
 	}
 
 	return &CommonConfig{
-		Context:        context,
-		RevisionBefore: beforeRev,
-		Targets:        targetsList,
+		Context:            context,
+		RevisionBefore:     beforeRev,
+		Targets:            targetsList,
+		ShutdownBazelAfter: commonFlags.ShutdownBazelAfter,
 	}, nil
 }
 
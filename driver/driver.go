@@ -29,6 +29,8 @@ type driverFlags struct {
 	revisionBefore          string
 	manualTestMode          string
 	forceUseOfBuildForTests bool
+	canaryPercent           float64
+	excludeExternalTargets  bool
 }
 
 type config struct {
@@ -39,6 +41,13 @@ type config struct {
 	ManualTestMode          string
 	TargetPatternFile       string
 	forceUseOfBuildForTests bool
+	// CanaryPercent is the percentage of commits for which all of Targets are run, rather than only
+	// the affected ones.
+	CanaryPercent float64
+	// ShutdownBazelAfter is whether to shut down the Bazel servers used before exiting.
+	ShutdownBazelAfter bool
+	// ExcludeExternalTargets is whether to skip affected targets in external repositories.
+	ExcludeExternalTargets bool
 }
 
 func main() {
@@ -62,11 +71,14 @@ func main() {
 	targetsSet := make(map[gazelle_label.Label]struct{})
 	commandVerb := "build"
 
-	log.Println("Discovering affected targets")
+	pkg.Progressf("Discovering affected targets")
 	callback := func(label gazelle_label.Label, differences []pkg.Difference, configuredTarget *analysis.ConfiguredTarget) {
 		if config.ManualTestMode == "skip" && isTaggedManual(configuredTarget) {
 			return
 		}
+		if config.ExcludeExternalTargets && label.Repo != "" {
+			return
+		}
 		if _, seen := targetsSet[label]; seen {
 			return
 		}
@@ -86,13 +98,20 @@ func main() {
 		callback); err != nil {
 		log.Fatal(err)
 	}
+	// All targets in packages which failed to load or analyze may be affected.
+	degradedPatterns := config.Context.DegradedPackages.Patterns()
+	if len(degradedPatterns) > 0 {
+		log.Printf("Running all targets in %d packages which failed to load or analyze", len(degradedPatterns))
+	}
 
-	if len(targets) == 0 {
-		log.Println("No targets were affected, not running Bazel")
+	canary := pkg.InCanaryFraction(config.Context.OriginalRevision.GitRevision.Sha, config.CanaryPercent)
+	if len(targets) == 0 && len(degradedPatterns) == 0 && !canary {
+		pkg.Progressf("No targets were affected, not running Bazel")
+		shutdownBazel(config)
 		os.Exit(0)
 	}
 
-	log.Printf("Discovered %d affected targets", len(targets))
+	pkg.Progressf("Discovered %d affected targets", len(targets))
 
 	var targetPatternFile *os.File
 	if config.TargetPatternFile != "" {
@@ -106,8 +125,13 @@ func main() {
 			log.Fatalf("Failed to create temporary file for target patterns: %v", err)
 		}
 	}
+	patterns := make([]string, 0, len(targets)+len(degradedPatterns))
 	for _, target := range targets {
-		if _, err := targetPatternFile.WriteString(target.String()); err != nil {
+		patterns = append(patterns, target.String())
+	}
+	patterns = append(patterns, degradedPatterns...)
+	for _, pattern := range patterns {
+		if _, err := targetPatternFile.WriteString(pattern); err != nil {
 			log.Fatalf("Failed to write target pattern to target pattern file: %v", err)
 		}
 		if _, err := targetPatternFile.WriteString("\n"); err != nil {
@@ -121,16 +145,77 @@ func main() {
 		log.Fatalf("Failed to close target pattern file: %v", err)
 	}
 
-	log.Printf("Running %s on %d targets", commandVerb, len(targets))
+	if canary {
+		runCanary(config)
+		return
+	}
+
+	pkg.Progressf("Running %s on %d targets", commandVerb, len(targets))
 	result, err := config.Context.BazelCmd.Execute(
 		pkg.BazelCmdConfig{Dir: config.Context.WorkspacePath, Stdout: os.Stdout, Stderr: os.Stderr},
 		nil, commandVerb, "--target_pattern_file", targetPatternFile.Name())
+	shutdownBazel(config)
 
 	if result != 0 || err != nil {
 		log.Fatal(err)
 	}
 }
 
+// runCanary tests all of config.Targets, rather than only the affected ones, so that failures in
+// targets which weren't determined to be affected show up. As when the targets are listed with a
+// pattern, manual targets are skipped unless config.ManualTestMode is "run", and incompatible
+// targets are always skipped.
+func runCanary(config *config) {
+	pkg.Progressf("Canary run for %v%% of commits: running all targets matching %s rather than only the affected ones, which were written to %s", config.CanaryPercent, config.Targets.String(), config.TargetPatternFile)
+	allTargetsFile, err := os.CreateTemp("", "")
+	if err != nil {
+		log.Fatalf("Failed to create temporary file for target patterns: %v", err)
+	}
+	defer os.Remove(allTargetsFile.Name())
+	result, err := config.Context.BazelCmd.Execute(
+		pkg.BazelCmdConfig{Dir: config.Context.WorkspacePath, Stdout: allTargetsFile, Stderr: os.Stderr},
+		nil, "query", "--output=label", canaryQuery(config))
+	if closeErr := allTargetsFile.Close(); err == nil {
+		err = closeErr
+	}
+	if result != 0 || err != nil {
+		log.Fatalf("Failed to query all targets matching %s: %v", config.Targets.String(), err)
+	}
+
+	commandVerb := "test"
+	if config.forceUseOfBuildForTests {
+		commandVerb = "build"
+	}
+	pkg.Progressf("Running %s on all targets", commandVerb)
+	result, err = config.Context.BazelCmd.Execute(
+		pkg.BazelCmdConfig{Dir: config.Context.WorkspacePath, Stdout: os.Stdout, Stderr: os.Stderr},
+		nil, commandVerb, "--skip_incompatible_explicit_targets", "--target_pattern_file", allTargetsFile.Name())
+	shutdownBazel(config)
+	// Exit code 4 means that the build succeeded but there were no tests to run.
+	if result != 0 && result != 4 {
+		log.Fatal(err)
+	}
+}
+
+// canaryQuery returns the query for the targets runCanary runs. They're passed to Bazel explicitly,
+// so manual targets, which Bazel only skips when they match a pattern, are excluded by the query.
+func canaryQuery(config *config) string {
+	if config.ManualTestMode == "skip" {
+		return fmt.Sprintf(`(%s) except attr(tags, "\bmanual\b", %s)`, config.Targets.String(), config.Targets.String())
+	}
+	return config.Targets.String()
+}
+
+// shutdownBazel shuts down the Bazel servers used, if requested with --shutdown-bazel-after.
+func shutdownBazel(config *config) {
+	if !config.ShutdownBazelAfter {
+		return
+	}
+	if err := pkg.ShutdownBazelServers(config.Context); err != nil {
+		log.Printf("WARN: %v", err)
+	}
+}
+
 func isTaggedManual(target *analysis.ConfiguredTarget) bool {
 	for _, attr := range target.GetTarget().GetRule().GetAttribute() {
 		if attr.GetName() == "tags" {
@@ -147,10 +232,21 @@ func isTaggedManual(target *analysis.ConfiguredTarget) bool {
 func parseFlags() (*driverFlags, error) {
 	var flags driverFlags
 	flags.commonFlags = cli.RegisterCommonFlags()
+	flags.commonFlags.OutputFormats = []string{"target-pattern-file"}
 	flag.StringVar(&flags.manualTestMode, "manual-test-mode", "skip", "How to handle affected tests tagged manual. Possible values: run|skip")
 	flag.StringVar(&flags.targetPatternFile, "target-pattern-file", "", "If defined, stores the list of affected targets in the given file.")
 	flag.BoolVar(&flags.forceUseOfBuildForTests, "force-use-of-build-for-tests", false, "Provide as argument to force bazel subcommand to be \"build\" irrespective of target type. By default, \"build\" or \"test\" is selected based on the target's rule")
+	flag.BoolVar(&flags.excludeExternalTargets, "exclude-external-targets", false, "If set, affected targets in external repositories aren't run, as they can't usefully be built or tested by CI. Changes to them still cause the targets in the main repository which depend on them to be affected.")
+	flag.Float64Var(&flags.canaryPercent, "canary-percent", 0, "Percentage of commits (chosen by hashing the commit, so re-runs of the same commit agree) for which all targets matching --targets are run rather than only the affected ones, to validate that the skipped targets were really unaffected. The affected targets are still written to --target-pattern-file, which is required, so that they can be compared with the results of running all of the targets.")
 	flag.Parse()
+	cli.ApplyOutputFlags(flags.commonFlags)
+
+	if flags.canaryPercent < 0 || flags.canaryPercent > 100 {
+		return nil, fmt.Errorf("unexpected value for flag -canary-percent - must be between 0 and 100, saw: %v", flags.canaryPercent)
+	}
+	if flags.canaryPercent > 0 && flags.targetPatternFile == "" {
+		return nil, fmt.Errorf("-canary-percent requires -target-pattern-file, to record the affected targets which canary runs don't run")
+	}
 
 	if flags.manualTestMode != "run" && flags.manualTestMode != "skip" {
 		return nil, fmt.Errorf("unexpected value for flag -manual-test-mode - allowed values: run|skip, saw: %s", flags.manualTestMode)
@@ -178,5 +274,8 @@ func resolveConfig(flags driverFlags) (*config, error) {
 		ManualTestMode:          flags.manualTestMode,
 		TargetPatternFile:       flags.targetPatternFile,
 		forceUseOfBuildForTests: flags.forceUseOfBuildForTests,
+		CanaryPercent:           flags.canaryPercent,
+		ShutdownBazelAfter:      commonArgs.ShutdownBazelAfter,
+		ExcludeExternalTargets:  flags.excludeExternalTargets,
 	}, nil
 }
@@ -0,0 +1,188 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// BackfillCommits returns the commits to write hash files for when backfilling history: since, and
+// the commits after it on the first-parent history of until, oldest first, keeping every every'th
+// one counting from since. If mergesOnly is set, only merge commits are counted, and since is only
+// included if it is one. Counting from since means the same commits are chosen however far until
+// has moved on, so a backfill can be extended later without changing which commits it covers.
+func BackfillCommits(workspacePath string, since string, until string, every int, mergesOnly bool) ([]string, error) {
+	if every < 1 {
+		return nil, fmt.Errorf("can't backfill every %d commits, must be at least 1", every)
+	}
+	sinceSha, err := GitRevParse(workspacePath, since, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", since, err)
+	}
+	args := []string{"rev-list", "--first-parent", "--reverse"}
+	if mergesOnly {
+		args = append(args, "--merges")
+	}
+	commits, err := runToLines(workspacePath, "git", append(args, sinceSha+".."+until)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list commits between %s and %s: %w", since, until, err)
+	}
+	if mergesOnly {
+		parents, err := runToLines(workspacePath, "git", "rev-list", "--parents", "-n", "1", sinceSha)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list parents of %s: %w", since, err)
+		}
+		// Each line is the commit followed by its parents.
+		if len(parents) == 1 && len(strings.Fields(parents[0])) > 2 {
+			commits = append([]string{sinceSha}, commits...)
+		}
+	} else {
+		commits = append([]string{sinceSha}, commits...)
+	}
+	var selected []string
+	for i, commit := range commits {
+		if i%every == 0 {
+			selected = append(selected, commit)
+		}
+	}
+	return selected, nil
+}
+
+// BackfillHashStore writes a hash file for each of commits to store, at StoredHashesLocation, so
+// that they can be found with FindStoredHashes, and returns the locations it wrote. Commits which
+// already have a hash file are skipped, so an interrupted backfill is resumed by running it again.
+// Each commit is processed in turn with context, as the before revision is, so the same Bazel
+// output base and cached worktree are reused for all of them. The hash files are written as for
+// Context.AfterHashesOutputFile, e.g. in Context.HashesOutputFormat.
+func BackfillHashStore(context *Context, store string, commits []string, targets TargetsList) ([]string, error) {
+	hashStore := HashStoreFor(store)
+	var written []string
+	for i, commit := range commits {
+		location := StoredHashesLocation(store, commit)
+		exists, err := hashStore.Exists(location)
+		if err != nil {
+			return written, fmt.Errorf("failed to check for hashes at %s: %w", location, err)
+		}
+		if exists {
+			Progressf("Skipping %s (%d of %d), which already has hashes at %s", commit, i+1, len(commits), location)
+			continue
+		}
+		rev, err := NewLabelledGitRev(context.WorkspacePath, commit, "backfill")
+		if err != nil {
+			return written, err
+		}
+		Progressf("Processing %s (%d of %d)", rev, i+1, len(commits))
+		queryInfo, err := fullyProcessRevision(context, rev, targets)
+		if err != nil {
+			return written, fmt.Errorf("failed to process %s: %w", rev, err)
+		}
+		if err := persistHashes(context, rev, queryInfo, location); err != nil {
+			return written, err
+		}
+		written = append(written, location)
+	}
+	return written, nil
+}
+
+// WatchBranch polls remote every interval for new commits on the first-parent history of branch,
+// and writes a hash file for each to store with BackfillHashStore, appending them to the index at
+// StoredCommitIndexLocation, so that baseline hashes are kept up to date without a CI job for
+// every commit. It stops after polls polls, or never if polls is zero.
+// The first poll writes hash files for the commits since since, as for BackfillCommits, if it is
+// set, and otherwise for those after the last commit in the index, or only the branch's tip if
+// there is no index. If mergesOnly is set, only merge commits get hash files, as for
+// BackfillCommits. Polls which fail, e.g. because the remote couldn't be fetched, are logged and
+// retried by the next poll.
+func WatchBranch(context *Context, store string, remote string, branch string, since string, mergesOnly bool, interval time.Duration, polls int, targets TargetsList) error {
+	index, err := LoadStoredCommitIndex(store, branch)
+	if err != nil {
+		return err
+	}
+	if since == "" && len(index) > 0 {
+		since = index[len(index)-1]
+	}
+	watcher := &branchWatcher{
+		context:    context,
+		store:      store,
+		remote:     remote,
+		branch:     branch,
+		since:      since,
+		mergesOnly: mergesOnly,
+		targets:    targets,
+		index:      index,
+	}
+	for poll := 1; polls == 0 || poll <= polls; poll++ {
+		if poll > 1 {
+			time.Sleep(interval)
+		}
+		if _, err := watcher.poll(); err != nil {
+			log.Printf("WARN: Failed to write hashes for new commits on %s: %v", branch, err)
+		}
+	}
+	return nil
+}
+
+// branchWatcher writes hash files for the new commits on a branch each time it is polled.
+type branchWatcher struct {
+	context *Context
+	store   string
+	remote  string
+	branch  string
+	// since is the commit to write hash files for, along with those after it, as for
+	// BackfillCommits: the branch's tip when it was last polled, or the commit to start from before
+	// the first poll. If it's empty, only the branch's tip gets a hash file.
+	since      string
+	mergesOnly bool
+	targets    TargetsList
+	// index is the commits of the branch which have hash files, oldest first.
+	index []string
+}
+
+// poll fetches the branch, writes hash files for its new commits, and adds them to the index,
+// returning the locations it wrote.
+func (w *branchWatcher) poll() ([]string, error) {
+	ref := fmt.Sprintf("refs/remotes/%s/%s", w.remote, w.branch)
+	if _, err := runToLines(w.context.WorkspacePath, "git", "fetch", "--quiet", w.remote, fmt.Sprintf("+refs/heads/%s:%s", w.branch, ref)); err != nil {
+		return nil, fmt.Errorf("failed to fetch %s from %s: %w", w.branch, w.remote, err)
+	}
+	tip, err := GitRevParse(w.context.WorkspacePath, ref, false)
+	if err != nil {
+		return nil, err
+	}
+	if w.since == tip {
+		Progressf("No new commits on %s since %s", w.branch, tip)
+		return nil, nil
+	}
+	since := w.since
+	if since == "" {
+		since = tip
+	}
+	commits, err := BackfillCommits(w.context.WorkspacePath, since, tip, 1, w.mergesOnly)
+	if err != nil {
+		return nil, err
+	}
+	written, err := BackfillHashStore(w.context, w.store, commits, w.targets)
+	if err != nil {
+		return written, err
+	}
+
+	indexed := make(map[string]bool, len(w.index))
+	for _, commit := range w.index {
+		indexed[commit] = true
+	}
+	index := w.index
+	for _, commit := range commits {
+		if !indexed[commit] {
+			index = append(index, commit)
+		}
+	}
+	location := StoredCommitIndexLocation(w.store, w.branch)
+	if err := HashStoreFor(w.store).Put(location, []byte(strings.Join(index, "\n")+"\n")); err != nil {
+		return written, fmt.Errorf("failed to write commit index to %s: %w", location, err)
+	}
+	w.index = index
+	w.since = tip
+	Progressf("Wrote hashes for %d new commits on %s, up to %s", len(written), w.branch, tip)
+	return written, nil
+}
@@ -0,0 +1,201 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackfillCommits(t *testing.T) {
+	dir, original := newGitRepository(t, map[string]string{"a.txt": "1"}, map[string]string{"a.txt": "2"}, map[string]string{"a.txt": "3"}, map[string]string{"a.txt": "4"}, map[string]string{"a.txt": "5"})
+	// A merge commit, whose second parent's commit isn't on the first-parent history.
+	runGit(t, dir, "checkout", "-q", "-b", "feature")
+	if err := os.WriteFile(filepath.Join(dir, "b.txt"), []byte("1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "add", ".")
+	runGit(t, dir, "commit", "-q", "-m", "feature")
+	runGit(t, dir, "checkout", "-q", original.GitRevision.Sha)
+	runGit(t, dir, "merge", "-q", "--no-ff", "-m", "merge", "feature")
+	commits := strings.Fields(runGit(t, dir, "rev-list", "--first-parent", "--reverse", "HEAD"))
+	feature := strings.TrimSpace(runGit(t, dir, "rev-parse", "feature"))
+
+	for name, tc := range map[string]struct {
+		since      string
+		every      int
+		mergesOnly bool
+		want       []string
+	}{
+		"every commit": {since: commits[1], every: 1, want: commits[1:]},
+		"every other":  {since: commits[0], every: 2, want: []string{commits[0], commits[2], commits[4]}},
+		"merges":       {since: commits[0], every: 1, mergesOnly: true, want: []string{commits[5]}},
+		"merge since":  {since: commits[5], every: 1, mergesOnly: true, want: []string{commits[5]}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := BackfillCommits(dir, tc.since, "HEAD", tc.every, tc.mergesOnly)
+			if err != nil {
+				t.Fatalf("Error listing commits to backfill: %v", err)
+			}
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("Wrong commits to backfill: want %v got %v", tc.want, got)
+			}
+			for _, commit := range got {
+				if commit == feature {
+					t.Fatalf("Wrong commits to backfill: want only first-parent history, got %s from a merged branch", feature)
+				}
+			}
+		})
+	}
+
+	if _, err := BackfillCommits(dir, commits[0], "HEAD", 0, false); err == nil {
+		t.Fatalf("Expected an error backfilling every 0 commits")
+	}
+}
+
+func TestBackfillHashStore(t *testing.T) {
+	dir, original := newGitRepository(t, map[string]string{"a.txt": "1"}, map[string]string{"a.txt": "2"}, map[string]string{"a.txt": "3"})
+	commits := strings.Fields(runGit(t, dir, "rev-list", "--reverse", "HEAD"))
+	targets, err := ParseTargetsList("//...")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := t.TempDir()
+	// The first commit was already backfilled, e.g. by an interrupted run.
+	existing := StoredHashesLocation(store, commits[0])
+	if err := os.WriteFile(existing, []byte("existing"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bazelCmd := &platformSourceFileBazelCmd{sourceFiles: map[string]string{"": "a.txt"}}
+	context := &Context{
+		WorkspacePath:              dir,
+		OriginalRevision:           original,
+		BazelCmd:                   bazelCmd,
+		BazelOutputBase:            filepath.Join(t.TempDir(), "output_base"),
+		BeforeQueryErrorBehavior:   "fatal",
+		AnalysisCacheClearStrategy: "skip",
+		WorktreeCacheDir:           t.TempDir(),
+		HashingWorkers:             1,
+	}
+	written, err := BackfillHashStore(context, store, commits, targets)
+	if err != nil {
+		t.Fatalf("Error backfilling: %v", err)
+	}
+	if want := []string{StoredHashesLocation(store, commits[1]), StoredHashesLocation(store, commits[2])}; !reflect.DeepEqual(want, written) {
+		t.Fatalf("Wrong hash files written: want %v got %v", want, written)
+	}
+	queried := make(map[string]bool)
+	for _, cquery := range bazelCmd.cqueries {
+		queried[strings.TrimSpace(cquery)] = true
+	}
+	if want := map[string]bool{"2": true, "3": true}; !reflect.DeepEqual(want, queried) {
+		t.Fatalf("Wrong commits queried: want only those without hashes, with a.txt of %v, got %v", want, queried)
+	}
+	for _, commit := range commits[1:] {
+		data, err := LoadPersistedHashes(StoredHashesLocation(store, commit), "fail")
+		if err != nil {
+			t.Fatalf("Error loading backfilled hashes: %v", err)
+		}
+		if data.Revision != commit {
+			t.Fatalf("Wrong revision of backfilled hashes: want %s got %s", commit, data.Revision)
+		}
+		if _, ok := data.Hashes["//:a.txt"]; !ok {
+			t.Fatalf("Wrong backfilled hashes for %s: want //:a.txt got %v", commit, data.Hashes)
+		}
+	}
+	if content, err := os.ReadFile(existing); err != nil || string(content) != "existing" {
+		t.Fatalf("Wrong content of the hash file which already existed: want it untouched got %q (%v)", content, err)
+	}
+
+	// Running again resumes, and so has nothing left to do.
+	written, err = BackfillHashStore(context, store, commits, targets)
+	if err != nil {
+		t.Fatalf("Error resuming backfill: %v", err)
+	}
+	if len(written) != 0 {
+		t.Fatalf("Wrong hash files written when resuming: want none got %v", written)
+	}
+}
+
+func TestWatchBranch(t *testing.T) {
+	upstream, _ := newGitRepository(t, map[string]string{"a.txt": "1"}, map[string]string{"a.txt": "2"})
+	runGit(t, upstream, "branch", "watched")
+	dir := filepath.Join(t.TempDir(), "workspace")
+	runGit(t, upstream, "clone", "-q", upstream, dir)
+	original, err := NewLabelledGitRev(dir, "HEAD", "original")
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err := ParseTargetsList("//...")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := t.TempDir()
+	context := &Context{
+		WorkspacePath:              dir,
+		OriginalRevision:           original,
+		BazelCmd:                   &platformSourceFileBazelCmd{sourceFiles: map[string]string{"": "a.txt"}},
+		BazelOutputBase:            filepath.Join(t.TempDir(), "output_base"),
+		BeforeQueryErrorBehavior:   "fatal",
+		AnalysisCacheClearStrategy: "skip",
+		WorktreeCacheDir:           t.TempDir(),
+		HashingWorkers:             1,
+	}
+	watcher := &branchWatcher{context: context, store: store, remote: "origin", branch: "watched", targets: targets}
+	commitUpstream := func(content string) string {
+		runGit(t, upstream, "checkout", "-q", "watched")
+		if err := os.WriteFile(filepath.Join(upstream, "a.txt"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, upstream, "commit", "-q", "-am", content)
+		return strings.TrimSpace(runGit(t, upstream, "rev-parse", "HEAD"))
+	}
+	wantIndex := func(want []string) {
+		t.Helper()
+		got, err := LoadStoredCommitIndex(store, "watched")
+		if err != nil {
+			t.Fatalf("Error loading commit index: %v", err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong commit index: want %v got %v", want, got)
+		}
+	}
+
+	// Without an index, only the tip gets hashes.
+	tip := strings.TrimSpace(runGit(t, upstream, "rev-parse", "watched"))
+	written, err := watcher.poll()
+	if err != nil {
+		t.Fatalf("Error polling: %v", err)
+	}
+	if want := []string{StoredHashesLocation(store, tip)}; !reflect.DeepEqual(want, written) {
+		t.Fatalf("Wrong hash files written: want %v got %v", want, written)
+	}
+	wantIndex([]string{tip})
+
+	// New commits each get hashes.
+	first := commitUpstream("3")
+	second := commitUpstream("4")
+	if written, err = watcher.poll(); err != nil {
+		t.Fatalf("Error polling: %v", err)
+	}
+	if want := []string{StoredHashesLocation(store, first), StoredHashesLocation(store, second)}; !reflect.DeepEqual(want, written) {
+		t.Fatalf("Wrong hash files written: want %v got %v", want, written)
+	}
+	wantIndex([]string{tip, first, second})
+	if written, err = watcher.poll(); err != nil || len(written) != 0 {
+		t.Fatalf("Wrong hash files written without new commits: want none got %v (error %v)", written, err)
+	}
+
+	// Restarting resumes from the index.
+	third := commitUpstream("5")
+	if err := WatchBranch(context, store, "origin", "watched", "", false, time.Millisecond, 1, targets); err != nil {
+		t.Fatalf("Error watching branch: %v", err)
+	}
+	wantIndex([]string{tip, first, second, third})
+	if _, err := LoadPersistedHashes(StoredHashesLocation(store, third), "fail"); err != nil {
+		t.Fatalf("Error loading hashes written after restarting: %v", err)
+	}
+}
@@ -101,3 +101,26 @@ func (c DefaultBazelCmd) Cquery(bazelRelease string, config BazelCmdConfig, star
 
 	return exitCode, err
 }
+
+// bazelCmdWithExtraOpts wraps a BazelCmd, adding extra options to all build-like commands.
+type bazelCmdWithExtraOpts struct {
+	inner     BazelCmd
+	extraOpts []string
+}
+
+// WithExtraBazelOpts returns a BazelCmd which behaves like bazelCmd, except that extraOpts are also
+// passed to all build-like commands (e.g. build and cquery).
+func WithExtraBazelOpts(bazelCmd BazelCmd, extraOpts ...string) BazelCmd {
+	return bazelCmdWithExtraOpts{inner: bazelCmd, extraOpts: extraOpts}
+}
+
+func (c bazelCmdWithExtraOpts) Execute(config BazelCmdConfig, startupArgs []string, command string, args ...string) (int, error) {
+	if _, ok := _buildLikeCommands[command]; ok {
+		args = append(append([]string{}, c.extraOpts...), args...)
+	}
+	return c.inner.Execute(config, startupArgs, command, args...)
+}
+
+func (c bazelCmdWithExtraOpts) Cquery(bazelRelease string, config BazelCmdConfig, startupArgs []string, args ...string) (int, error) {
+	return c.inner.Cquery(bazelRelease, config, startupArgs, append(append([]string{}, c.extraOpts...), args...)...)
+}
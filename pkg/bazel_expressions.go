@@ -0,0 +1,31 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BazelExpressions formats labels as Bazel query expressions, e.g. set(//a:b //c:d), which can be
+// passed directly to bazel build, test or query.
+// If chunkSize is positive, labels are split across expressions of at most chunkSize labels each,
+// so that each fits within command line length limits. If rdepsDepth is positive, each expression
+// also includes the reverse dependencies of its labels in universe (a target pattern, e.g. //...)
+// up to rdepsDepth edges away. No expressions are returned if there are no labels.
+func BazelExpressions(labels []string, chunkSize int, universe string, rdepsDepth int) []string {
+	if chunkSize <= 0 {
+		chunkSize = len(labels)
+	}
+	var expressions []string
+	for start := 0; start < len(labels); start += chunkSize {
+		end := start + chunkSize
+		if end > len(labels) {
+			end = len(labels)
+		}
+		expression := "set(" + strings.Join(labels[start:end], " ") + ")"
+		if rdepsDepth > 0 {
+			expression = fmt.Sprintf("rdeps(%s, %s, %d)", universe, expression, rdepsDepth)
+		}
+		expressions = append(expressions, expression)
+	}
+	return expressions
+}
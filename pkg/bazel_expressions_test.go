@@ -0,0 +1,35 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBazelExpressions(t *testing.T) {
+	labels := []string{"//java/example:GreetingLib", "//java/example:GreetingTest", "//go/example:lib_test"}
+	for name, tc := range map[string]struct {
+		chunkSize  int
+		rdepsDepth int
+		want       []string
+	}{
+		"one set": {
+			want: []string{"set(//java/example:GreetingLib //java/example:GreetingTest //go/example:lib_test)"},
+		},
+		"chunked": {
+			chunkSize: 2,
+			want:      []string{"set(//java/example:GreetingLib //java/example:GreetingTest)", "set(//go/example:lib_test)"},
+		},
+		"rdeps": {
+			chunkSize:  3,
+			rdepsDepth: 2,
+			want:       []string{"rdeps(//..., set(//java/example:GreetingLib //java/example:GreetingTest //go/example:lib_test), 2)"},
+		},
+	} {
+		if got := BazelExpressions(labels, tc.chunkSize, "//...", tc.rdepsDepth); !reflect.DeepEqual(tc.want, got) {
+			t.Fatalf("Wrong expressions %s: want %v got %v", name, tc.want, got)
+		}
+	}
+	if got := BazelExpressions(nil, 2, "//...", 1); len(got) != 0 {
+		t.Fatalf("Wrong expressions without labels: want none got %v", got)
+	}
+}
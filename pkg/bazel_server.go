@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// OwnBazelOutputBase returns an output base dedicated to TD next to the default output base of the
+// workspace in workingDirectory, so that TD starts its own Bazel server rather than reusing (and
+// possibly restarting, if startup options differ) the one used by other builds of the workspace.
+// The default output base is found with a --batch invocation so that no server is left running.
+func OwnBazelOutputBase(workingDirectory string, bazelCmd BazelCmd) (string, error) {
+	var stdoutBuf, stderrBuf bytes.Buffer
+	result, err := bazelCmd.Execute(
+		BazelCmdConfig{Dir: workingDirectory, Stdout: &stdoutBuf, Stderr: &stderrBuf},
+		[]string{"--batch"}, "info", "output_base")
+	if result != 0 || err != nil {
+		return "", fmt.Errorf("failed to get the Bazel output_base: %w. Stderr:\n%v", err, stderrBuf.String())
+	}
+	return strings.TrimRight(stdoutBuf.String(), "\n") + "-td", nil
+}
+
+var bazelServerMaxHeapRegexp = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+
+// BazelServerMaxHeapStartupOpt returns the startup option limiting the Java heap of the Bazel server
+// to maxHeap, which is a size as accepted by -Xmx (e.g. 4g).
+func BazelServerMaxHeapStartupOpt(maxHeap string) (string, error) {
+	if !bazelServerMaxHeapRegexp.MatchString(maxHeap) {
+		return "", fmt.Errorf("invalid Bazel server heap size %q: must be a number of bytes, optionally followed by k, m or g", maxHeap)
+	}
+	return "--host_jvm_args=-Xmx" + maxHeap, nil
+}
+
+// BazelServerOutputBases returns the output bases whose Bazel servers may have been started while
+// processing with context.
+func BazelServerOutputBases(context *Context) []string {
+	outputBases := []string{context.BazelOutputBase}
+	if context.BeforeBazelOutputBase != "" {
+		outputBases = append(outputBases, context.BeforeBazelOutputBase)
+	} else if context.ProcessRevisionsConcurrently {
+		outputBases = append(outputBases, concurrentBeforeOutputBase(context))
+	}
+	return outputBases
+}
+
+// ShutdownBazelServers shuts down the Bazel servers of each of BazelServerOutputBases(context)
+// which exists, so that they don't hold on to memory after TD finishes.
+func ShutdownBazelServers(context *Context) error {
+	var errs []error
+	for _, outputBase := range BazelServerOutputBases(context) {
+		if _, err := os.Stat(outputBase); os.IsNotExist(err) {
+			continue
+		}
+		var stderr bytes.Buffer
+		result, err := context.BazelCmd.Execute(
+			BazelCmdConfig{Dir: context.WorkspacePath, Stderr: &stderr},
+			[]string{"--output_base", outputBase}, "shutdown")
+		if result != 0 || err != nil {
+			errs = append(errs, fmt.Errorf("failed to shut down the Bazel server for output base %s: %w. Stderr:\n%v", outputBase, err, stderr.String()))
+			continue
+		}
+		Progressf("Shut down the Bazel server for output base %s", outputBase)
+	}
+	return errors.Join(errs...)
+}
+
+// concurrentBeforeOutputBase is the output base the before revision is processed in when
+// processing revisions concurrently without a --before-output-base.
+func concurrentBeforeOutputBase(context *Context) string {
+	return context.BazelOutputBase + "-td-before"
+}
@@ -0,0 +1,37 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBazelServerMaxHeapStartupOpt(t *testing.T) {
+	got, err := BazelServerMaxHeapStartupOpt("4g")
+	if err != nil {
+		t.Fatalf("Error getting startup option: %v", err)
+	}
+	if want := "--host_jvm_args=-Xmx4g"; got != want {
+		t.Fatalf("Wrong startup option: want %v got %v", want, got)
+	}
+	for _, invalid := range []string{"", "4gb", "-Xmx4g", "4 g"} {
+		if _, err := BazelServerMaxHeapStartupOpt(invalid); err == nil {
+			t.Fatalf("Expected an error for heap size %q", invalid)
+		}
+	}
+}
+
+func TestBazelServerOutputBases(t *testing.T) {
+	for _, tc := range []struct {
+		context Context
+		want    []string
+	}{
+		{Context{BazelOutputBase: "/ob"}, []string{"/ob"}},
+		{Context{BazelOutputBase: "/ob", BeforeBazelOutputBase: "/before"}, []string{"/ob", "/before"}},
+		{Context{BazelOutputBase: "/ob", ProcessRevisionsConcurrently: true}, []string{"/ob", "/ob-td-before"}},
+		{Context{BazelOutputBase: "/ob", BeforeBazelOutputBase: "/before", ProcessRevisionsConcurrently: true}, []string{"/ob", "/before"}},
+	} {
+		if got := BazelServerOutputBases(&tc.context); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("Wrong output bases: want %v got %v", tc.want, got)
+		}
+	}
+}
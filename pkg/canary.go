@@ -0,0 +1,21 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// InCanaryFraction returns whether the run keyed by key (e.g. a commit hash) is one of the percent
+// percent of runs which should be canaries. The same key always gives the same answer, and keys are
+// spread evenly, so roughly percent percent of distinct keys are canaries.
+func InCanaryFraction(key string, percent float64) bool {
+	if percent <= 0 {
+		return false
+	}
+	if percent >= 100 {
+		return true
+	}
+	digest := sha256.Sum256([]byte(key))
+	bucket := binary.BigEndian.Uint64(digest[:8]) % 10000
+	return float64(bucket) < percent*100
+}
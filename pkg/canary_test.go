@@ -0,0 +1,25 @@
+package pkg
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestInCanaryFraction(t *testing.T) {
+	for _, percent := range []float64{0, 10, 50, 100} {
+		canaries := 0
+		for i := 0; i < 10000; i++ {
+			key := fmt.Sprintf("%040x", i)
+			canary := InCanaryFraction(key, percent)
+			if canary != InCanaryFraction(key, percent) {
+				t.Fatalf("Wrong canary decision for %s: not stable", key)
+			}
+			if canary {
+				canaries++
+			}
+		}
+		if want, got := percent, float64(canaries)/100; got < want-2 || got > want+2 {
+			t.Fatalf("Wrong canary percentage: want %v got %v", want, got)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// codeOwnersLocations are where a CODEOWNERS file is looked for, relative to the workspace root, in
+// the order GitHub looks for them.
+var codeOwnersLocations = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"}
+
+// UnownedShard is the owner of targets which no CODEOWNERS rule assigns an owner to.
+const UnownedShard = "unowned"
+
+// CodeOwners assigns owners to paths according to the rules of a CODEOWNERS file.
+type CodeOwners struct {
+	rules []codeOwnersRule
+}
+
+type codeOwnersRule struct {
+	pattern *regexp.Regexp
+	owners  []string
+}
+
+// LoadCodeOwners reads the CODEOWNERS file of the workspace at workspacePath, from the first of
+// .github/CODEOWNERS, CODEOWNERS and docs/CODEOWNERS which exists.
+func LoadCodeOwners(workspacePath string) (*CodeOwners, error) {
+	for _, location := range codeOwnersLocations {
+		content, err := os.ReadFile(filepath.Join(workspacePath, filepath.FromSlash(location)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", location, err)
+		}
+		codeOwners, err := ParseCodeOwners(string(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", location, err)
+		}
+		return codeOwners, nil
+	}
+	return nil, fmt.Errorf("no CODEOWNERS file found in %s (looked for %s)", workspacePath, strings.Join(codeOwnersLocations, ", "))
+}
+
+// ParseCodeOwners parses the content of a CODEOWNERS file: a pattern per line, in gitignore syntax,
+// followed by its owners. Blank lines and comments starting with # are ignored.
+func ParseCodeOwners(content string) (*CodeOwners, error) {
+	var codeOwners CodeOwners
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		pattern, err := codeOwnersPattern(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q on line %d: %w", fields[0], lineNumber, err)
+		}
+		rule := codeOwnersRule{pattern: pattern}
+		if len(fields) > 1 {
+			rule.owners = fields[1:]
+		}
+		codeOwners.rules = append(codeOwners.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &codeOwners, nil
+}
+
+// codeOwnersPattern converts a CODEOWNERS pattern to a regexp matching the slash-separated paths,
+// relative to the workspace root, which it applies to. Patterns containing a slash other than at
+// their end are relative to the root, others match at any depth, and patterns matching a directory
+// apply to everything in it.
+func codeOwnersPattern(pattern string) (*regexp.Regexp, error) {
+	anchored := strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+	onlyDirectories := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "/"), "/")
+
+	var expression strings.Builder
+	if anchored {
+		expression.WriteString("^")
+	} else {
+		expression.WriteString("^(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expression.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expression.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			expression.WriteString("[^/]*")
+		case pattern[i] == '?':
+			expression.WriteString("[^/]")
+		default:
+			expression.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	if onlyDirectories {
+		expression.WriteString("/.*$")
+	} else {
+		expression.WriteString("(?:/.*)?$")
+	}
+	return regexp.Compile(expression.String())
+}
+
+// Owners returns the owners of the slash-separated path, relative to the workspace root, according
+// to the last rule matching it, or nil if no rule matches or the last one has no owners.
+func (c *CodeOwners) Owners(filePath string) []string {
+	for i := len(c.rules) - 1; i >= 0; i-- {
+		if c.rules[i].pattern.MatchString(filePath) {
+			return c.rules[i].owners
+		}
+	}
+	return nil
+}
+
+// ShardFor returns the owner whose shard the target l belongs in: the first owner of its source
+// file, for source files, or otherwise of its package's BUILD file, or UnownedShard if it has none
+// or is in an external repository.
+func (c *CodeOwners) ShardFor(l label.Label, configuredTarget *analysis.ConfiguredTarget) string {
+	if l.Repo != "" {
+		return UnownedShard
+	}
+	filePath := path.Join(l.Pkg, "BUILD")
+	if configuredTarget.GetTarget().GetType() == build.Target_SOURCE_FILE {
+		filePath = path.Join(l.Pkg, l.Name)
+	}
+	if owners := c.Owners(filePath); len(owners) > 0 {
+		return owners[0]
+	}
+	return UnownedShard
+}
+
+// ShardMatrixEntry is an entry of the matrix written by WriteShards, for a CI job per shard.
+type ShardMatrixEntry struct {
+	Owner string `json:"owner"`
+	// TargetsFile is the name of the file in the shard directory listing the shard's targets.
+	TargetsFile string `json:"targets_file"`
+	Count       int    `json:"count"`
+	// ClosestDistance is the distance of the shard's closest target to a directly changed target,
+	// if WriteShards was given distances. See DependencyDistances.
+	ClosestDistance *int `json:"closest_distance,omitempty"`
+}
+
+var unsafeShardFileCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// WriteShards writes a file to dir for each owner in shards, listing its targets one per line,
+// sorted, and a matrix.json file with an entry per shard under "include", in the format of a GitHub
+// Actions matrix, so that each owner's CI job can run exactly its own affected targets.
+// If distances is non-nil, each shard's targets are instead sorted by SortByDistance, and the
+// matrix lists the shards with the closest targets first, so that CI surfaces failures sooner.
+func WriteShards(dir string, shards map[string]map[string]bool, distances map[string]int) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	owners := make([]string, 0, len(shards))
+	for owner := range shards {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	entries := make([]ShardMatrixEntry, 0, len(owners))
+	usedNames := make(map[string]bool)
+	for _, owner := range owners {
+		name := strings.Trim(unsafeShardFileCharacters.ReplaceAllString(owner, "_"), "_")
+		if name == "" {
+			name = "owner"
+		}
+		// Different owners may have the same safe name, e.g. @org/team and org_team.
+		for candidate, i := name, 2; ; i++ {
+			if !usedNames[candidate] {
+				name = candidate
+				break
+			}
+			candidate = fmt.Sprintf("%s_%d", name, i)
+		}
+		usedNames[name] = true
+
+		labels := make([]string, 0, len(shards[owner]))
+		for l := range shards[owner] {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+		var closestDistance *int
+		if distances != nil && len(labels) > 0 {
+			SortByDistance(labels, distances)
+			if d, ok := distances[labels[0]]; ok {
+				closestDistance = &d
+			}
+		}
+		targetsFile := name + ".txt"
+		var content strings.Builder
+		for _, l := range labels {
+			content.WriteString(l + "\n")
+		}
+		if err := os.WriteFile(filepath.Join(dir, targetsFile), []byte(content.String()), 0644); err != nil {
+			return fmt.Errorf("failed to write targets of %s: %w", owner, err)
+		}
+		entries = append(entries, ShardMatrixEntry{Owner: owner, TargetsFile: targetsFile, Count: len(labels), ClosestDistance: closestDistance})
+	}
+	if distances != nil {
+		sort.SliceStable(entries, func(i, j int) bool {
+			if (entries[i].ClosestDistance == nil) != (entries[j].ClosestDistance == nil) {
+				return entries[i].ClosestDistance != nil
+			}
+			return entries[i].ClosestDistance != nil && *entries[i].ClosestDistance < *entries[j].ClosestDistance
+		})
+	}
+	matrix, err := json.MarshalIndent(map[string][]ShardMatrixEntry{"include": entries}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal shard matrix: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "matrix.json"), append(matrix, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write shard matrix: %w", err)
+	}
+	return nil
+}
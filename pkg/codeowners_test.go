@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+)
+
+func TestCodeOwners(t *testing.T) {
+	codeOwners, err := ParseCodeOwners(`# Default owners
+*                     @org/everyone
+/java/                @org/java @alice
+**/testdata/**        @org/qa
+*.proto               @org/api
+/java/example/legacy/ # No owners
+docs/*                @org/docs
+`)
+	if err != nil {
+		t.Fatalf("Error parsing CODEOWNERS: %v", err)
+	}
+	for filePath, want := range map[string][]string{
+		"README.md":                       {"@org/everyone"},
+		"java/BUILD":                      {"@org/java", "@alice"},
+		"java/example/Greeting.java":      {"@org/java", "@alice"},
+		"go/java/BUILD":                   {"@org/everyone"},
+		"java/example/testdata/a.txt":     {"@org/qa"},
+		"testdata/a.txt":                  {"@org/qa"},
+		"java/example/api.proto":          {"@org/api"},
+		"api/v1/api.proto":                {"@org/api"},
+		"java/example/legacy/BUILD":       nil,
+		"docs/index.md":                   {"@org/docs"},
+		"java/example/legacy.proto/BUILD": {"@org/api"},
+	} {
+		if got := codeOwners.Owners(filePath); !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong owners of %s: want %v got %v", filePath, want, got)
+		}
+	}
+
+	for _, tc := range []struct {
+		label      string
+		targetType build.Target_Discriminator
+		want       string
+	}{
+		{"//java/example:GreetingLib", build.Target_RULE, "@org/java"},
+		{"//java/example:schema.proto", build.Target_SOURCE_FILE, "@org/api"},
+		{"//java/example/legacy:lib", build.Target_RULE, UnownedShard},
+		{"@rules_java//java:toolchain", build.Target_RULE, UnownedShard},
+	} {
+		configuredTarget := &analysis.ConfiguredTarget{Target: &build.Target{Type: tc.targetType.Enum()}}
+		if got := codeOwners.ShardFor(mustParseLabel(tc.label), configuredTarget); got != tc.want {
+			t.Fatalf("Wrong shard for %s: want %v got %v", tc.label, tc.want, got)
+		}
+	}
+}
+
+func TestWriteShards(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "shards")
+	err := WriteShards(dir, map[string]map[string]bool{
+		"@org/java":  {"//java:b": true, "//java:a": true},
+		"org_java":   {"//other:c": true},
+		UnownedShard: {"//tools:d": true},
+	}, nil)
+	if err != nil {
+		t.Fatalf("Error writing shards: %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "matrix.json"))
+	if err != nil {
+		t.Fatalf("Error reading matrix: %v", err)
+	}
+	var matrix struct {
+		Include []ShardMatrixEntry `json:"include"`
+	}
+	if err := json.Unmarshal(content, &matrix); err != nil {
+		t.Fatalf("Error parsing matrix: %v", err)
+	}
+	want := []ShardMatrixEntry{
+		{Owner: "@org/java", TargetsFile: "org_java.txt", Count: 2},
+		{Owner: "org_java", TargetsFile: "org_java_2.txt", Count: 1},
+		{Owner: UnownedShard, TargetsFile: "unowned.txt", Count: 1},
+	}
+	if !reflect.DeepEqual(want, matrix.Include) {
+		t.Fatalf("Wrong matrix: want %v got %v", want, matrix.Include)
+	}
+	targets, err := os.ReadFile(filepath.Join(dir, "org_java.txt"))
+	if err != nil {
+		t.Fatalf("Error reading targets: %v", err)
+	}
+	if want, got := "//java:a\n//java:b\n", string(targets); want != got {
+		t.Fatalf("Wrong targets: want %q got %q", want, got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "unowned.txt")); err != nil {
+		t.Fatalf("Missing unowned targets: %v", err)
+	}
+
+	orderedDir := filepath.Join(t.TempDir(), "ordered")
+	err = WriteShards(orderedDir, map[string]map[string]bool{
+		"@org/java":  {"//java:b": true, "//java:a": true, "//java:c": true},
+		"@org/go":    {"//go:d": true},
+		UnownedShard: {"//tools:e": true},
+	}, map[string]int{"//java:a": 2, "//java:b": 1, "//go:d": 0})
+	if err != nil {
+		t.Fatalf("Error writing ordered shards: %v", err)
+	}
+	content, err = os.ReadFile(filepath.Join(orderedDir, "matrix.json"))
+	if err != nil {
+		t.Fatalf("Error reading ordered matrix: %v", err)
+	}
+	var orderedMatrix struct {
+		Include []ShardMatrixEntry `json:"include"`
+	}
+	if err := json.Unmarshal(content, &orderedMatrix); err != nil {
+		t.Fatalf("Error parsing ordered matrix: %v", err)
+	}
+	var gotOwners []string
+	for _, entry := range orderedMatrix.Include {
+		gotOwners = append(gotOwners, entry.Owner)
+	}
+	if want := []string{"@org/go", "@org/java", UnownedShard}; !reflect.DeepEqual(want, gotOwners) {
+		t.Fatalf("Wrong order of shards: want %v got %v", want, gotOwners)
+	}
+	if want, got := 1, orderedMatrix.Include[1].ClosestDistance; got == nil || *got != want {
+		t.Fatalf("Wrong closest distance: want %v got %v", want, got)
+	}
+	targets, err = os.ReadFile(filepath.Join(orderedDir, "org_java.txt"))
+	if err != nil {
+		t.Fatalf("Error reading ordered targets: %v", err)
+	}
+	if want, got := "//java:b\n//java:a\n//java:c\n", string(targets); want != got {
+		t.Fatalf("Wrong order of targets: want %q got %q", want, got)
+	}
+}
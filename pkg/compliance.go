@@ -0,0 +1,51 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// ComplianceConfig declares which targets are compliance-relevant, e.g. because changes to them
+// need legal or license review.
+type ComplianceConfig struct {
+	// Kinds are the rule kinds of compliance-relevant targets, which may contain wildcards as for
+	// RuleKindMatches, e.g. "*_license".
+	Kinds []string `json:"kinds,omitempty"`
+	// Packages are target patterns matching compliance-relevant targets, as for
+	// NewTargetPatternFilter, e.g. "//third_party/...".
+	Packages []string `json:"packages,omitempty"`
+
+	packages *TargetPatternFilter
+}
+
+// LoadComplianceConfig reads a ComplianceConfig from the JSON file at path.
+func LoadComplianceConfig(path string) (*ComplianceConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compliance config from %s: %w", path, err)
+	}
+	var config ComplianceConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse compliance config from %s: %w", path, err)
+	}
+	if len(config.Kinds) == 0 && len(config.Packages) == 0 {
+		return nil, fmt.Errorf("compliance config %s must have kinds or packages", path)
+	}
+	if config.packages, err = NewTargetPatternFilter(config.Packages); err != nil {
+		return nil, fmt.Errorf("invalid packages in compliance config %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// Matches returns whether the target l, configured as configuredTarget, is compliance-relevant:
+// whether it's a rule whose kind matches any of c.Kinds, or is matched by c.Packages.
+func (c *ComplianceConfig) Matches(l label.Label, configuredTarget *analysis.ConfiguredTarget) bool {
+	if RuleKindMatches(configuredTarget, c.Kinds) {
+		return true
+	}
+	return len(c.Packages) > 0 && c.packages.Matches(l)
+}
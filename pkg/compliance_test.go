@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestComplianceConfigMatches(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "compliance.json")
+	content := `{"kinds": ["*_license"], "packages": ["//third_party/...", "-//third_party/docs/..."]}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadComplianceConfig(path)
+	if err != nil {
+		t.Fatalf("Error loading compliance config: %v", err)
+	}
+	rule := func(kind string) *analysis.ConfiguredTarget {
+		return &analysis.ConfiguredTarget{Target: &build.Target{
+			Type: build.Target_RULE.Enum(),
+			Rule: &build.Rule{Name: proto.String("//x:y"), RuleClass: proto.String(kind)},
+		}}
+	}
+	for _, tc := range []struct {
+		label string
+		kind  string
+		want  bool
+	}{
+		{"//java/example:license", "java_license", true},
+		{"//third_party/guava:guava", "java_import", true},
+		{"//third_party/docs:readme", "filegroup", false},
+		{"//java/example:GreetingLib", "java_library", false},
+	} {
+		l, err := label.Parse(tc.label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := config.Matches(l, rule(tc.kind)); tc.want != got {
+			t.Fatalf("Wrong compliance relevance of %s (%s): want %v got %v", tc.label, tc.kind, tc.want, got)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadComplianceConfig(path); err == nil {
+		t.Fatalf("Wrong result loading empty compliance config: want error got nil")
+	}
+}
@@ -0,0 +1,157 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// ErrDecompressedTooLarge is returned by Decompress if content decompresses to more than the
+// maximum size.
+var ErrDecompressedTooLarge = errors.New("decompressed content is too large")
+
+// CompressionForPath returns the compression implied by the extension of path: "gzip" for .gz,
+// "zstd" for .zst, and "none" otherwise.
+func CompressionForPath(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return "gzip"
+	case strings.HasSuffix(path, ".zst"):
+		return "zstd"
+	}
+	return "none"
+}
+
+// compress compresses content with compression, which is one of "none", "gzip" or "zstd".
+func compress(content []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "none":
+		return content, nil
+	case "gzip":
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(content); err != nil {
+			return nil, fmt.Errorf("failed to gzip: %w", err)
+		}
+		if err := writer.Close(); err != nil {
+			return nil, fmt.Errorf("failed to gzip: %w", err)
+		}
+		return buf.Bytes(), nil
+	case "zstd":
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to zstd: %w", err)
+		}
+		defer encoder.Close()
+		return encoder.EncodeAll(content, nil), nil
+	}
+	return nil, fmt.Errorf("unknown compression %s - allowed values: none|gzip|zstd", compression)
+}
+
+// decompress decompresses content if it starts with the magic bytes of gzip or zstd, and otherwise
+// returns it unchanged.
+func decompress(content []byte) ([]byte, error) {
+	return Decompress(content, 0)
+}
+
+// Decompress decompresses content like decompress, but returns ErrDecompressedTooLarge rather than
+// decompressing more than maxSize bytes, if maxSize is positive, so that content from untrusted
+// sources can't exhaust memory however well it compresses. Uncompressed content is returned
+// unchanged, whatever its size.
+func Decompress(content []byte, maxSize int64) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(content, gzipMagic):
+		reader, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to gunzip: %w", err)
+		}
+		defer reader.Close()
+		var limited io.Reader = reader
+		if maxSize > 0 {
+			limited = io.LimitReader(reader, maxSize+1)
+		}
+		decompressed, err := io.ReadAll(limited)
+		if err != nil {
+			return nil, fmt.Errorf("failed to gunzip: %w", err)
+		}
+		if maxSize > 0 && int64(len(decompressed)) > maxSize {
+			return nil, fmt.Errorf("failed to gunzip: %w: more than %d bytes", ErrDecompressedTooLarge, maxSize)
+		}
+		return decompressed, nil
+	case bytes.HasPrefix(content, zstdMagic):
+		options := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if maxSize > 0 {
+			options = append(options, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+		}
+		decoder, err := zstd.NewReader(nil, options...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unzstd: %w", err)
+		}
+		defer decoder.Close()
+		decompressed, err := decoder.DecodeAll(content, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+			return nil, fmt.Errorf("failed to unzstd: %w: more than %d bytes", ErrDecompressedTooLarge, maxSize)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to unzstd: %w", err)
+		}
+		return decompressed, nil
+	}
+	return content, nil
+}
+
+// openDecompressed opens the local file at path for reading, decompressing it as it is read if it
+// starts with the magic bytes of gzip or zstd, so that large files needn't be held in memory.
+func openDecompressed(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	buffered := bufio.NewReader(f)
+	magic, err := buffered.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		reader, err := gzip.NewReader(buffered)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to gunzip: %w", err)
+		}
+		return readCloser{Reader: reader, close: f.Close}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(buffered, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to unzstd: %w", err)
+		}
+		return readCloser{Reader: decoder, close: func() error {
+			decoder.Close()
+			return f.Close()
+		}}, nil
+	}
+	return readCloser{Reader: buffered, close: f.Close}, nil
+}
+
+// readCloser is an io.ReadCloser which reads from Reader and closes with close.
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error {
+	return r.close()
+}
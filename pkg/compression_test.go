@@ -0,0 +1,33 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecompressLimit(t *testing.T) {
+	content := bytes.Repeat([]byte("target-determinator "), 1000)
+	for _, compression := range []string{"gzip", "zstd"} {
+		compressed, err := compress(content, compression)
+		if err != nil {
+			t.Fatalf("Failed to compress with %s: %v", compression, err)
+		}
+		for _, maxSize := range []int64{0, int64(len(content))} {
+			got, err := Decompress(compressed, maxSize)
+			if err != nil {
+				t.Fatalf("Failed to decompress %s with limit %d: %v", compression, maxSize, err)
+			}
+			if !reflect.DeepEqual(content, got) {
+				t.Fatalf("Wrong %s content decompressed with limit %d", compression, maxSize)
+			}
+		}
+		if _, err := Decompress(compressed, int64(len(content)-1)); !errors.Is(err, ErrDecompressedTooLarge) {
+			t.Fatalf("Wrong error decompressing %s over the limit: want %v got %v", compression, ErrDecompressedTooLarge, err)
+		}
+	}
+	if got, err := Decompress(content, 1); err != nil || !reflect.DeepEqual(content, got) {
+		t.Fatalf("Wrong result decompressing uncompressed content: want it unchanged got %v", err)
+	}
+}
@@ -84,3 +84,81 @@ func getConfigurationDetails(context *Context) (map[Configuration]singleConfigur
 	}
 	return m, nil
 }
+
+// summarizedConfigurationFlags are the options, other than those with their own field, whose values
+// are recorded in a PersistedConfiguration, as they commonly distinguish configurations.
+var summarizedConfigurationFlags = map[string]bool{
+	"copt":     true,
+	"cxxopt":   true,
+	"define":   true,
+	"features": true,
+	"javacopt": true,
+	"linkopt":  true,
+	"stamp":    true,
+}
+
+// summarizeConfiguration returns the PersistedConfiguration summarizing c's options.
+func summarizeConfiguration(c singleConfigurationOutput) (PersistedConfiguration, error) {
+	var summary PersistedConfiguration
+	if len(c.FragmentOptions) == 0 {
+		return summary, nil
+	}
+	var fragmentOptions []struct {
+		Name    string
+		Options map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(c.FragmentOptions, &fragmentOptions); err != nil {
+		return summary, fmt.Errorf("failed to parse options of configuration %v: %w", c.ConfigHash, err)
+	}
+	for _, fragment := range fragmentOptions {
+		for name, rawValue := range fragment.Options {
+			// Options are normally strings, but fall back to their JSON encoding in case they aren't.
+			value := string(rawValue)
+			var stringValue string
+			if err := json.Unmarshal(rawValue, &stringValue); err == nil {
+				value = stringValue
+			}
+			if value == "" || value == "[]" || value == "null" {
+				continue
+			}
+			switch name {
+			case "platforms":
+				summary.Platforms = value
+			case "compilation_mode":
+				summary.CompilationMode = value
+			case "cpu":
+				summary.CPU = value
+			default:
+				if summarizedConfigurationFlags[name] {
+					if summary.Flags == nil {
+						summary.Flags = make(map[string]string)
+					}
+					summary.Flags[name] = value
+				}
+			}
+		}
+	}
+	return summary, nil
+}
+
+// addPersistedConfiguration records the summary of configuration, from configurations, in data, if
+// it isn't already there. Configurations without details, e.g. that of source files, are skipped.
+func addPersistedConfiguration(data *PersistedHashData, configurations map[Configuration]singleConfigurationOutput, configuration Configuration) error {
+	key := configuration.String()
+	if _, ok := data.Configurations[key]; ok {
+		return nil
+	}
+	details, ok := configurations[configuration]
+	if !ok {
+		return nil
+	}
+	summary, err := summarizeConfiguration(details)
+	if err != nil {
+		return err
+	}
+	if data.Configurations == nil {
+		data.Configurations = make(map[string]PersistedConfiguration)
+	}
+	data.Configurations[key] = summary
+	return nil
+}
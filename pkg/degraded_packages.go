@@ -0,0 +1,173 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	ss "github.com/bazel-contrib/target-determinator/common/sorted_set"
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// DegradedPackages records the packages which failed to load or analyze when Context.KeepGoing is
+// set. Their targets are unknown, so aren't reported as affected targets, but all of them should be
+// considered affected.
+type DegradedPackages struct {
+	mu       sync.Mutex
+	packages map[string]bool
+}
+
+// add records packages, formatted like "//foo/bar".
+func (d *DegradedPackages) add(packages []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.packages == nil {
+		d.packages = make(map[string]bool)
+	}
+	for _, p := range packages {
+		d.packages[p] = true
+	}
+}
+
+// Packages returns the recorded packages, formatted like "//foo/bar", or like "//foo/..." if the
+// packages beneath a target pattern couldn't be loaded, sorted.
+func (d *DegradedPackages) Packages() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	packages := make([]string, 0, len(d.packages))
+	for p := range d.packages {
+		packages = append(packages, p)
+	}
+	return ss.NewSortedSet(packages).SortedSlice()
+}
+
+// Patterns returns a target pattern matching all of the targets of each of the recorded packages,
+// e.g. "//foo/bar:all", sorted.
+func (d *DegradedPackages) Patterns() []string {
+	packages := d.Packages()
+	patterns := make([]string, 0, len(packages))
+	for _, p := range packages {
+		patterns = append(patterns, p+":all")
+	}
+	return patterns
+}
+
+// Contains returns whether l is in one of the recorded packages. A nil DegradedPackages contains
+// nothing.
+func (d *DegradedPackages) Contains(l label.Label) bool {
+	if d == nil {
+		return false
+	}
+	labelPackage := "//" + l.Pkg
+	if l.Repo != "" {
+		labelPackage = "@" + l.Repo + labelPackage
+	}
+	for _, p := range d.Packages() {
+		if p == labelPackage {
+			return true
+		}
+		if prefix, recursive := strings.CutSuffix(p, "..."); recursive && strings.HasPrefix(labelPackage+"/", prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordDegradedPackages records the packages which failed in queryInfo in context.DegradedPackages.
+func recordDegradedPackages(context *Context, queryInfo *QueryResults) error {
+	if len(queryInfo.DegradedPackages) == 0 {
+		return nil
+	}
+	if context.DegradedPackages == nil {
+		return fmt.Errorf("packages failed to load or analyze, but there's nowhere to report them: %s", strings.Join(queryInfo.DegradedPackages, ", "))
+	}
+	context.DegradedPackages.add(queryInfo.DegradedPackages)
+	return nil
+}
+
+// buildEvent is the part of a Build Event Protocol event, as written by --build_event_json_file,
+// needed to find the packages which failed to load or analyze.
+// See https://github.com/bazelbuild/bazel/blob/master/src/main/java/com/google/devtools/build/lib/buildeventstream/proto/build_event_stream.proto
+type buildEvent struct {
+	ID struct {
+		Pattern           *buildEventPattern `json:"pattern"`
+		PatternSkipped    *buildEventPattern `json:"patternSkipped"`
+		TargetConfigured  *buildEventLabel   `json:"targetConfigured"`
+		UnconfiguredLabel *buildEventLabel   `json:"unconfiguredLabel"`
+		ConfiguredLabel   *buildEventLabel   `json:"configuredLabel"`
+	} `json:"id"`
+	Aborted *struct {
+		Reason string `json:"reason"`
+	} `json:"aborted"`
+}
+
+type buildEventPattern struct {
+	Pattern []string `json:"pattern"`
+}
+
+type buildEventLabel struct {
+	Label string `json:"label"`
+}
+
+// failedPackagesFromBuildEvents returns the packages which Bazel reported as having failed to load
+// or analyze in the Build Event Protocol JSON file at path, formatted like "//foo/bar", sorted.
+// Failed target patterns which match several packages, e.g. //foo/..., are returned as they are.
+func failedPackagesFromBuildEvents(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open build events: %w", err)
+	}
+	defer f.Close()
+
+	var normalizer Normalizer
+	packages := ss.NewSortedSet([]string{})
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var event buildEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("failed to parse build event: %w", err)
+		}
+		if event.Aborted == nil || (event.Aborted.Reason != "LOADING_FAILURE" && event.Aborted.Reason != "ANALYSIS_FAILURE") {
+			continue
+		}
+		var patterns []string
+		for _, pattern := range []*buildEventPattern{event.ID.Pattern, event.ID.PatternSkipped} {
+			if pattern != nil {
+				patterns = append(patterns, pattern.Pattern...)
+			}
+		}
+		for _, l := range []*buildEventLabel{event.ID.TargetConfigured, event.ID.UnconfiguredLabel, event.ID.ConfiguredLabel} {
+			if l != nil {
+				patterns = append(patterns, l.Label)
+			}
+		}
+		for _, pattern := range patterns {
+			if recursive, _, _ := strings.Cut(pattern, ":"); strings.HasSuffix(recursive, "...") {
+				for _, mainRepository := range []string{"@@//", "@//"} {
+					if strings.HasPrefix(recursive, mainRepository) {
+						recursive = "//" + strings.TrimPrefix(recursive, mainRepository)
+					}
+				}
+				packages.Add(recursive)
+				continue
+			}
+			l, err := normalizer.ParseCanonicalLabel(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse label %q of build event: %w", pattern, err)
+			}
+			if l.Repo != "" {
+				packages.Add(fmt.Sprintf("@%s//%s", l.Repo, l.Pkg))
+			} else {
+				packages.Add("//" + l.Pkg)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read build events: %w", err)
+	}
+	return packages.SortedSlice(), nil
+}
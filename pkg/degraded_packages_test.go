@@ -0,0 +1,58 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFailedPackagesFromBuildEvents(t *testing.T) {
+	const buildEvents = `{"id":{"started":{}},"started":{"command":"cquery"}}
+{"id":{"pattern":{"pattern":["//broken/..."]}},"aborted":{"reason":"LOADING_FAILURE","description":"error loading package under directory 'broken'"}}
+{"id":{"unconfiguredLabel":{"label":"@@//java/missing:lib"}},"aborted":{"reason":"LOADING_FAILURE","description":"no such package 'java/missing'"}}
+{"id":{"targetConfigured":{"label":"//java/example:example"}},"aborted":{"reason":"ANALYSIS_FAILURE","description":"Analysis of target '//java/example:example' failed"}}
+{"id":{"configuredLabel":{"label":"@@rules_foo~//foo:bar","configuration":{"id":"abc"}}},"aborted":{"reason":"ANALYSIS_FAILURE"}}
+{"id":{"targetConfigured":{"label":"//java/fine:fine"}},"configured":{"targetKind":"java_library rule"}}
+{"id":{"targetCompleted":{"label":"//java/skipped:skipped"}},"aborted":{"reason":"SKIPPED"}}
+`
+	path := filepath.Join(t.TempDir(), "build_events.json")
+	if err := os.WriteFile(path, []byte(buildEvents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := failedPackagesFromBuildEvents(path)
+	if err != nil {
+		t.Fatalf("Error reading build events: %v", err)
+	}
+	want := []string{"//broken/...", "//java/example", "//java/missing", "@rules_foo~//foo"}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong failed packages: want %v got %v", want, got)
+	}
+}
+
+func TestDegradedPackages(t *testing.T) {
+	var degradedPackages DegradedPackages
+	degradedPackages.add([]string{"//java/example", "//broken/..."})
+	degradedPackages.add([]string{"//java/example"})
+
+	if want, got := []string{"//broken/...:all", "//java/example:all"}, degradedPackages.Patterns(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong patterns: want %v got %v", want, got)
+	}
+	for l, want := range map[string]bool{
+		"//java/example:example":  true,
+		"//java/example/sub:sub":  false,
+		"//java/other:other":      false,
+		"//broken:broken":         true,
+		"//broken/deeper:deeper":  true,
+		"//brokenness:brokenness": false,
+		"@other//java/example:ex": false,
+	} {
+		if got := degradedPackages.Contains(mustParseLabel(l)); got != want {
+			t.Errorf("Wrong result for whether %s is in a degraded package: want %v got %v", l, want, got)
+		}
+	}
+	var none *DegradedPackages
+	if none.Contains(mustParseLabel("//java/example:example")) {
+		t.Fatalf("Wrong result for a nil DegradedPackages: want false got true")
+	}
+}
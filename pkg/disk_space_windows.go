@@ -0,0 +1,8 @@
+package pkg
+
+import "fmt"
+
+// freeDiskSpace isn't implemented on Windows, so disk space checks are skipped.
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("checking free disk space isn't supported on windows")
+}
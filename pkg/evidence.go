@@ -0,0 +1,222 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// EvidenceManifest records why targets were, and weren't, considered affected by a change, so that
+// it can be attached to audit records.
+type EvidenceManifest struct {
+	// BeforeRevision and AfterRevision are the commits which were compared. AfterDirty is whether
+	// there were local changes on top of AfterRevision.
+	BeforeRevision string `json:"before_revision"`
+	AfterRevision  string `json:"after_revision"`
+	AfterDirty     bool   `json:"after_dirty,omitempty"`
+	// ChangedFiles are all of the files which changed between the revisions.
+	ChangedFiles []EvidenceFile `json:"changed_files"`
+	// AffectedTargets maps each affected target to the differences which caused it to be affected.
+	AffectedTargets map[string][]string `json:"affected_targets"`
+	// LoadClosureChanges maps each target which was affected because of how it's defined (e.g. its
+	// attributes or rule implementation changed) to the changed BUILD and .bzl files in the load
+	// closure of its package, so that rule maintainers can see the blast radius of macro edits.
+	LoadClosureChanges map[string][]string `json:"load_closure_changes,omitempty"`
+}
+
+// EvidenceFile is a file which changed between the revisions compared.
+type EvidenceFile struct {
+	// Path is relative to the workspace root.
+	Path string `json:"path"`
+	// Diff is the unified diff of the file, for files which define the build graph (BUILD files,
+	// .bzl files, and workspace and module files). It is omitted for other files, whose effects are
+	// captured by the hashes of their contents.
+	Diff string `json:"diff,omitempty"`
+}
+
+// NewEvidenceManifest collects the files changed in the workspace in context since revBefore, and
+// the diffs of those which define the build graph. affectedTargets maps each affected target to
+// the differences which caused it to be affected.
+func NewEvidenceManifest(context *Context, revBefore LabelledGitRev, affectedTargets map[string][]string) (*EvidenceManifest, error) {
+	changedFiles, err := ChangedFilesSince(context.WorkspacePath, revBefore)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(changedFiles)
+	uncleanStatuses, err := GitStatusFiltered(context.WorkspacePath, context.IgnoredFiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check whether the repository is clean: %w", err)
+	}
+	manifest := &EvidenceManifest{
+		BeforeRevision:  revBefore.GitRevision.Sha,
+		AfterRevision:   context.OriginalRevision.GitRevision.Sha,
+		AfterDirty:      len(uncleanStatuses) > 0,
+		AffectedTargets: affectedTargets,
+	}
+	changedBuildGraphFiles := make(map[string]bool)
+	for _, changedFile := range changedFiles {
+		file := EvidenceFile{Path: changedFile}
+		if definesBuildGraph(changedFile) {
+			if file.Diff, err = fileDiff(context.WorkspacePath, revBefore, changedFile); err != nil {
+				return nil, err
+			}
+			changedBuildGraphFiles[changedFile] = true
+		}
+		manifest.ChangedFiles = append(manifest.ChangedFiles, file)
+	}
+	if len(changedBuildGraphFiles) > 0 {
+		manifest.LoadClosureChanges = loadClosureChanges(context, affectedTargets, changedBuildGraphFiles)
+	}
+	return manifest, nil
+}
+
+// loadClosureCategories are the categories of differences which may be caused by a change to a
+// BUILD or .bzl file in the load closure of a target's package.
+var loadClosureCategories = map[string]bool{
+	"AddedTarget":               true,
+	"AttributeAdded":            true,
+	"AttributeChanged":          true,
+	"AttributeRemoved":          true,
+	"DependsOnChangedFile":      true,
+	"NewTarget":                 true,
+	"RuleImplementationChanged": true,
+	"RuleImplementedChanged":    true,
+	"RuleKindChanged":           true,
+	"TargetTypeChanged":         true,
+}
+
+// differenceCategory returns the category of a difference formatted by Difference.String.
+func differenceCategory(difference string) string {
+	if i := strings.IndexAny(difference, "[ "); i >= 0 {
+		return difference[:i]
+	}
+	return difference
+}
+
+// loadClosureChanges returns, for each of affectedTargets in the main repository with a difference
+// in loadClosureCategories, the files in changedFiles which are in the load closure of its package,
+// as reported by bazel query's buildfiles function. Packages which can't be queried (e.g. because
+// they were deleted) are skipped with a warning, as the report is only informational.
+func loadClosureChanges(context *Context, affectedTargets map[string][]string, changedFiles map[string]bool) map[string][]string {
+	targetsByPackage := make(map[string][]string)
+	for target, differences := range affectedTargets {
+		l, err := label.Parse(target)
+		if err != nil || l.Repo != "" {
+			continue
+		}
+		for _, difference := range differences {
+			if loadClosureCategories[differenceCategory(difference)] {
+				targetsByPackage[l.Pkg] = append(targetsByPackage[l.Pkg], target)
+				break
+			}
+		}
+	}
+
+	changes := make(map[string][]string)
+	for pkg, targets := range targetsByPackage {
+		buildFiles, err := queryBuildFiles(context, pkg)
+		if err != nil {
+			log.Printf("WARN: %v", err)
+			continue
+		}
+		closureChanges := changedLoadClosureFiles(buildFiles, changedFiles)
+		if len(closureChanges) == 0 {
+			continue
+		}
+		for _, target := range targets {
+			changes[target] = closureChanges
+		}
+	}
+	return changes
+}
+
+// queryBuildFiles returns the labels of the BUILD and .bzl files in the load closure of pkg.
+func queryBuildFiles(context *Context, pkg string) ([]string, error) {
+	var stdout, stderr bytes.Buffer
+	expression := fmt.Sprintf("buildfiles(//%s:*)", pkg)
+	returnVal, err := context.BazelCmd.Execute(
+		BazelCmdConfig{Dir: context.WorkspacePath, Stdout: &stdout, Stderr: &stderr},
+		[]string{"--output_base", context.BazelOutputBase},
+		"query", "--output=label", expression)
+	if returnVal != 0 || err != nil {
+		return nil, fmt.Errorf("failed to query %s: %w. Stderr:\n%v", expression, err, stderr.String())
+	}
+	return strings.Fields(stdout.String()), nil
+}
+
+// changedLoadClosureFiles returns the sorted paths, relative to the workspace root, of the files in
+// buildFiles (labels of BUILD and .bzl files) which are in changedFiles. Files in other
+// repositories are ignored, as they can't have changed in the workspace.
+func changedLoadClosureFiles(buildFiles []string, changedFiles map[string]bool) []string {
+	var changed []string
+	for _, buildFile := range buildFiles {
+		l, err := label.Parse(buildFile)
+		if err != nil || l.Repo != "" {
+			continue
+		}
+		if filePath := path.Join(l.Pkg, l.Name); changedFiles[filePath] {
+			changed = append(changed, filePath)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// WriteEvidenceManifest writes manifest to path as JSON.
+func WriteEvidenceManifest(path string, manifest *EvidenceManifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal evidence manifest: %w", err)
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("failed to write evidence manifest to %s: %w", path, err)
+	}
+	return nil
+}
+
+// definesBuildGraph returns whether the file at changedFile (relative to the workspace root) is one
+// which defines the build graph, rather than an input to it.
+func definesBuildGraph(changedFile string) bool {
+	switch base := path.Base(changedFile); base {
+	case "BUILD", "BUILD.bazel", "WORKSPACE", "WORKSPACE.bazel", "WORKSPACE.bzlmod", "MODULE.bazel":
+		return true
+	default:
+		return strings.HasSuffix(base, ".bzl")
+	}
+}
+
+// fileDiff returns the unified diff of changedFile between rev and the working directory, treating
+// untracked files as new.
+func fileDiff(workspacePath string, rev LabelledGitRev, changedFile string) (string, error) {
+	lines, err := runToLines(workspacePath, "git", "diff", rev.GitRevision.Sha, "--", changedFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to diff %s since %s: %w", changedFile, rev, err)
+	}
+	if len(lines) > 0 {
+		return strings.Join(lines, "\n") + "\n", nil
+	}
+	// git diff doesn't show untracked files.
+	content, err := os.ReadFile(filepath.Join(workspacePath, changedFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read %s: %w", changedFile, err)
+	}
+	var diff strings.Builder
+	fmt.Fprintf(&diff, "--- /dev/null\n+++ b/%s\n", changedFile)
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		if line != "" {
+			diff.WriteString("+" + strings.TrimSuffix(line, "\n") + "\n")
+		}
+	}
+	return diff.String(), nil
+}
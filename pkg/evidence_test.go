@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewEvidenceManifest(t *testing.T) {
+	workspace := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = workspace
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=td", "GIT_AUTHOR_EMAIL=td@example.com", "GIT_COMMITTER_NAME=td", "GIT_COMMITTER_EMAIL=td@example.com")
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("Failed to run git %v: %v. Output: %s", args, err, output)
+		}
+		return strings.TrimSpace(string(output))
+	}
+	write := func(path, content string) {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(workspace, path)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(workspace, path), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init", "-q")
+	write("java/BUILD.bazel", "java_library(name = \"lib\")\n")
+	write("java/Lib.java", "class Lib {}\n")
+	git("add", ".")
+	git("commit", "-q", "-m", "before")
+	write("java/BUILD.bazel", "java_library(name = \"lib\", srcs = [\"Lib.java\"])\n")
+	write("java/Lib.java", "class Lib { int x; }\n")
+	write("defs.bzl", "X = 1\n")
+
+	revBefore, err := NewLabelledGitRev(workspace, "HEAD", "before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := &Context{WorkspacePath: workspace, OriginalRevision: revBefore}
+	affected := map[string][]string{"//java:lib": {"RuleInputChanged"}}
+	manifest, err := NewEvidenceManifest(context, revBefore, affected)
+	if err != nil {
+		t.Fatalf("Failed to create evidence manifest: %v", err)
+	}
+
+	if !manifest.AfterDirty {
+		t.Fatalf("Wrong dirtiness: want %v got %v", true, manifest.AfterDirty)
+	}
+	var paths []string
+	for _, file := range manifest.ChangedFiles {
+		paths = append(paths, file.Path)
+		switch file.Path {
+		case "java/BUILD.bazel":
+			if !strings.Contains(file.Diff, "+java_library(name = \"lib\", srcs = [\"Lib.java\"])") {
+				t.Fatalf("Wrong diff of %s: %v", file.Path, file.Diff)
+			}
+		case "defs.bzl":
+			if want := "--- /dev/null\n+++ b/defs.bzl\n+X = 1\n"; want != file.Diff {
+				t.Fatalf("Wrong diff of %s: want %q got %q", file.Path, want, file.Diff)
+			}
+		default:
+			if file.Diff != "" {
+				t.Fatalf("Wrong diff of %s: want none got %v", file.Path, file.Diff)
+			}
+		}
+	}
+	if want, got := "defs.bzl java/BUILD.bazel java/Lib.java", strings.Join(paths, " "); want != got {
+		t.Fatalf("Wrong changed files: want %v got %v", want, got)
+	}
+}
+
+func TestChangedLoadClosureFiles(t *testing.T) {
+	buildFiles := []string{"//java:BUILD.bazel", "//tools/rules:defs.bzl", "//tools/rules:private/impl.bzl", "//:unchanged.bzl", "@rules_java//java:defs.bzl"}
+	changedFiles := map[string]bool{
+		"tools/rules/private/impl.bzl": true,
+		"java/BUILD.bazel":             true,
+		"java/Lib.java":                true,
+		"other/BUILD.bazel":            true,
+		"java/defs.bzl":                true,
+	}
+	want := []string{"java/BUILD.bazel", "tools/rules/private/impl.bzl"}
+	if got := changedLoadClosureFiles(buildFiles, changedFiles); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("Wrong changed load closure files: want %v got %v", want, got)
+	}
+}
+
+func TestDifferenceCategory(t *testing.T) {
+	for difference, want := range map[string]string{
+		"NewTarget": "NewTarget",
+		"AttributeChanged[srcs] Before: a After: b": "AttributeChanged",
+		"ChangedConfiguration Before: x":            "ChangedConfiguration",
+	} {
+		if got := differenceCategory(difference); got != want {
+			t.Fatalf("Wrong category of %q: want %v got %v", difference, want, got)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// SnapshotRow is a row of an exported hash file: the hash of a single target in a single
+// configuration.
+type SnapshotRow struct {
+	Revision      string   `json:"revision"`
+	Repository    string   `json:"repository"`
+	Package       string   `json:"package"`
+	Name          string   `json:"name"`
+	Label         string   `json:"label"`
+	Configuration string   `json:"configuration"`
+	Hash          string   `json:"hash"`
+	Kind          string   `json:"kind"`
+	Tags          []string `json:"tags"`
+	TestOnly      bool     `json:"testonly"`
+}
+
+var snapshotColumns = []exportColumn{
+	{"revision", "VARCHAR"},
+	{"repository", "VARCHAR"},
+	{"package", "VARCHAR"},
+	{"name", "VARCHAR"},
+	{"label", "VARCHAR"},
+	{"configuration", "VARCHAR"},
+	{"hash", "VARCHAR"},
+	{"kind", "VARCHAR"},
+	{"tags", "VARCHAR[]"},
+	{"testonly", "BOOLEAN"},
+}
+
+// ResultRow is a row of exported results: a single affected target.
+type ResultRow struct {
+	Repository string `json:"repository"`
+	Package    string `json:"package"`
+	Name       string `json:"name"`
+	Label      string `json:"label"`
+}
+
+var resultColumns = []exportColumn{
+	{"repository", "VARCHAR"},
+	{"package", "VARCHAR"},
+	{"name", "VARCHAR"},
+	{"label", "VARCHAR"},
+}
+
+type exportColumn struct {
+	name string
+	// typ is the DuckDB type of the column.
+	typ string
+}
+
+// SnapshotRows flattens data into one row per target and configuration, sorted by label and
+// configuration.
+func SnapshotRows(data *PersistedHashData) ([]SnapshotRow, error) {
+	labels := make([]string, 0, len(data.Hashes))
+	for labelString := range data.Hashes {
+		labels = append(labels, labelString)
+	}
+	sort.Strings(labels)
+	var rows []SnapshotRow
+	for _, labelString := range labels {
+		l, err := label.Parse(labelString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label %s: %w", labelString, err)
+		}
+		info := data.Targets[labelString]
+		tags := info.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+		for _, configuration := range sortedUnion(data.Hashes[labelString], nil) {
+			rows = append(rows, SnapshotRow{
+				Revision:      data.Revision,
+				Repository:    l.Repo,
+				Package:       l.Pkg,
+				Name:          l.Name,
+				Label:         labelString,
+				Configuration: configuration,
+				Hash:          data.Hashes[labelString][configuration],
+				Kind:          info.Kind,
+				Tags:          tags,
+				TestOnly:      info.TestOnly,
+			})
+		}
+	}
+	return rows, nil
+}
+
+// ResultRows returns a row for each of targets, sorted by label.
+func ResultRows(targets []string) ([]ResultRow, error) {
+	sorted := append([]string(nil), targets...)
+	sort.Strings(sorted)
+	rows := make([]ResultRow, 0, len(sorted))
+	for _, target := range sorted {
+		l, err := label.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label %s: %w", target, err)
+		}
+		rows = append(rows, ResultRow{Repository: l.Repo, Package: l.Pkg, Name: l.Name, Label: target})
+	}
+	return rows, nil
+}
+
+// ExportSnapshot writes the rows of data to path. See exportRows.
+func ExportSnapshot(path string, data *PersistedHashData) error {
+	rows, err := SnapshotRows(data)
+	if err != nil {
+		return err
+	}
+	return exportRows(path, rows, snapshotColumns)
+}
+
+// ExportResults writes a row for each of targets to path. See exportRows.
+func ExportResults(path string, targets []string) error {
+	rows, err := ResultRows(targets)
+	if err != nil {
+		return err
+	}
+	return exportRows(path, rows, resultColumns)
+}
+
+// ExportsParquet is whether exporting to path writes Parquet, which needs the duckdb command.
+func ExportsParquet(path string) bool {
+	return strings.HasSuffix(path, ".parquet")
+}
+
+// exportRows writes rows to path as Parquet if path ends in .parquet, and otherwise as
+// newline-delimited JSON with one flat object per row, which e.g. BigQuery can load directly.
+// Parquet files are converted from JSON by the duckdb command, which must be on the PATH, using
+// columns as the schema.
+func exportRows[T any](path string, rows []T, columns []exportColumn) error {
+	jsonPath := path
+	if ExportsParquet(path) {
+		tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.json")
+		if err != nil {
+			return fmt.Errorf("failed to create temporary file to export to %s: %w", path, err)
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		jsonPath = tmp.Name()
+	}
+
+	var content []byte
+	for _, row := range rows {
+		line, err := json.Marshal(row)
+		if err != nil {
+			return fmt.Errorf("failed to marshal row: %w", err)
+		}
+		content = append(append(content, line...), '\n')
+	}
+	if err := os.WriteFile(jsonPath, content, 0644); err != nil {
+		return fmt.Errorf("failed to export to %s: %w", jsonPath, err)
+	}
+	if jsonPath == path {
+		return nil
+	}
+
+	columnTypes := make([]string, 0, len(columns))
+	for _, column := range columns {
+		columnTypes = append(columnTypes, fmt.Sprintf("%s: '%s'", column.name, column.typ))
+	}
+	query := fmt.Sprintf("COPY (SELECT * FROM read_json(%s, format = 'newline_delimited', columns = {%s})) TO %s (FORMAT parquet)",
+		sqlString(jsonPath), strings.Join(columnTypes, ", "), sqlString(path))
+	if _, err := runWithStdin(nil, "duckdb", "-c", query); err != nil {
+		return fmt.Errorf("failed to convert export to Parquet: %w", err)
+	}
+	return nil
+}
+
+// sqlString quotes s as a SQL string literal.
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
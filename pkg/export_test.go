@@ -0,0 +1,73 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshotRows(t *testing.T) {
+	data := &PersistedHashData{
+		Revision: "0123456789abcdef0123456789abcdef01234567",
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib":   {configurationChecksum: "aabbcc"},
+			"//java/example:Greeting.java": {"": "ddeeff"},
+		},
+		Targets: map[string]PersistedTargetInfo{
+			"//java/example:GreetingLib": {Kind: "java_library", Tags: []string{"manual"}},
+		},
+	}
+	want := []SnapshotRow{
+		{
+			Revision: data.Revision,
+			Package:  "java/example",
+			Name:     "Greeting.java",
+			Label:    "//java/example:Greeting.java",
+			Hash:     "ddeeff",
+			Tags:     []string{},
+		},
+		{
+			Revision:      data.Revision,
+			Package:       "java/example",
+			Name:          "GreetingLib",
+			Label:         "//java/example:GreetingLib",
+			Configuration: configurationChecksum,
+			Hash:          "aabbcc",
+			Kind:          "java_library",
+			Tags:          []string{"manual"},
+		},
+	}
+	got, err := SnapshotRows(data)
+	if err != nil {
+		t.Fatalf("Failed to get snapshot rows: %v", err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong snapshot rows: want %+v got %+v", want, got)
+	}
+}
+
+func TestExportResults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.json")
+	if err := ExportResults(path, []string{"//foo:bar", "@other//baz:qux"}); err != nil {
+		t.Fatalf("Failed to export results: %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"repository":"","package":"foo","name":"bar","label":"//foo:bar"}
+{"repository":"other","package":"baz","name":"qux","label":"@other//baz:qux"}
+`
+	if string(content) != want {
+		t.Fatalf("Wrong exported results: want %q got %q", want, string(content))
+	}
+}
+
+func TestExportsParquet(t *testing.T) {
+	for path, want := range map[string]bool{"out.parquet": true, "out.json": false, "parquet.ndjson": false} {
+		if got := ExportsParquet(path); got != want {
+			t.Fatalf("Wrong ExportsParquet for %s: want %v got %v", path, want, got)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// externalDependencyFiles are the files, at the root of the workspace, which the external
+// dependencies recorded in hash files are read from.
+var externalDependencyFiles = []string{"MODULE.bazel.lock", "go.mod", "go.sum"}
+
+// collectExternalDependencies returns the external dependencies of the workspace at rev, keyed by
+// repository name: the Bazel modules resolved in MODULE.bazel.lock, and the Go modules required by
+// go.mod, named by the conventions of gazelle (see goRepositoryName), with their go.sum hashes.
+// Workspaces with none of these files have no external dependencies recorded.
+func collectExternalDependencies(workspacePath string, rev LabelledGitRev) (map[string]PersistedExternalDependency, error) {
+	contents, err := readExternalDependencyFiles(workspacePath, rev)
+	if err != nil {
+		return nil, err
+	}
+	dependencies := make(map[string]PersistedExternalDependency)
+	if content, ok := contents["MODULE.bazel.lock"]; ok {
+		modules, err := parseModuleLockfile(content)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse MODULE.bazel.lock at %s: %w", rev, err)
+		}
+		for name, dependency := range modules {
+			dependencies[name] = dependency
+		}
+	}
+	if content, ok := contents["go.mod"]; ok {
+		for name, dependency := range parseGoModules(content, contents["go.sum"]) {
+			dependencies[name] = dependency
+		}
+	}
+	if len(dependencies) == 0 {
+		return nil, nil
+	}
+	return dependencies, nil
+}
+
+// readExternalDependencyFiles returns the content of each of externalDependencyFiles which exists
+// at rev, read from the working directory if rev is CurrentWorkingDirState.
+func readExternalDependencyFiles(workspacePath string, rev LabelledGitRev) (map[string]string, error) {
+	contents := make(map[string]string)
+	if rev.GitRevision == CurrentWorkingDirState {
+		for _, file := range externalDependencyFiles {
+			content, err := os.ReadFile(filepath.Join(workspacePath, file))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", file, err)
+			}
+			contents[file] = string(content)
+		}
+		return contents, nil
+	}
+	existing, err := runToLines(workspacePath, "git", append([]string{"ls-tree", "--name-only", rev.GitRevision.Sha, "--"}, externalDependencyFiles...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list external dependency files at %s: %w", rev, err)
+	}
+	for _, file := range existing {
+		lines, err := runToLines(workspacePath, "git", "show", rev.GitRevision.Sha+":"+file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s at %s: %w", file, rev, err)
+		}
+		contents[file] = strings.Join(lines, "\n")
+	}
+	return contents, nil
+}
+
+// parseModuleLockfile returns the Bazel modules resolved in a MODULE.bazel.lock file. Lockfiles
+// written by Bazel 7.2 and later only record the hashes of the registry files they read, so a
+// module's version is taken from the path of its source.json, and its integrity is the hash of
+// that file, which contains the integrity of its archive. Older lockfiles record the resolved
+// module graph, with the integrity of each archive. The root module isn't included.
+func parseModuleLockfile(content string) (map[string]PersistedExternalDependency, error) {
+	var lockfile struct {
+		RegistryFileHashes map[string]string `json:"registryFileHashes"`
+		ModuleDepGraph     map[string]struct {
+			Name     string `json:"name"`
+			Version  string `json:"version"`
+			RepoSpec struct {
+				Attributes map[string]any `json:"attributes"`
+			} `json:"repoSpec"`
+		} `json:"moduleDepGraph"`
+	}
+	if err := json.Unmarshal([]byte(content), &lockfile); err != nil {
+		return nil, err
+	}
+	modules := make(map[string]PersistedExternalDependency)
+	for url, hash := range lockfile.RegistryFileHashes {
+		parts := strings.Split(url, "/")
+		if len(parts) < 4 || parts[len(parts)-1] != "source.json" || parts[len(parts)-4] != "modules" || hash == "not found" {
+			continue
+		}
+		modules[parts[len(parts)-3]] = PersistedExternalDependency{Version: parts[len(parts)-2], Integrity: "sha256:" + hash}
+	}
+	for key, module := range lockfile.ModuleDepGraph {
+		if key == "<root>" {
+			continue
+		}
+		integrity, _ := module.RepoSpec.Attributes["integrity"].(string)
+		modules[module.Name] = PersistedExternalDependency{Version: module.Version, Integrity: integrity}
+	}
+	return modules, nil
+}
+
+// parseGoModules returns the Go modules required by goMod, keyed by the names gazelle gives their
+// repositories, with the hashes of their content from goSum, if it has them.
+func parseGoModules(goMod string, goSum string) map[string]PersistedExternalDependency {
+	sums := make(map[string]string)
+	for _, line := range strings.Split(goSum, "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 {
+			sums[fields[0]+" "+fields[1]] = fields[2]
+		}
+	}
+	modules := make(map[string]PersistedExternalDependency)
+	inRequireBlock := false
+	for _, line := range strings.Split(goMod, "\n") {
+		line, _, _ = strings.Cut(line, "//")
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case inRequireBlock && fields[0] == ")":
+			inRequireBlock = false
+			continue
+		case len(fields) == 2 && fields[0] == "require" && fields[1] == "(":
+			inRequireBlock = true
+			continue
+		case fields[0] == "require":
+			fields = fields[1:]
+		case !inRequireBlock:
+			continue
+		}
+		if len(fields) != 2 {
+			continue
+		}
+		if name := goRepositoryName(strings.Join(fields, " ")); name != "" {
+			modules[name] = PersistedExternalDependency{Version: fields[1], Integrity: sums[fields[0]+" "+fields[1]]}
+		}
+	}
+	return modules
+}
@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseModuleLockfile(t *testing.T) {
+	for name, tc := range map[string]struct {
+		content string
+		want    map[string]PersistedExternalDependency
+	}{
+		"registry file hashes": {
+			content: `{
+  "lockFileVersion": 13,
+  "registryFileHashes": {
+    "https://bcr.bazel.build/bazel_registry.json": "aa",
+    "https://bcr.bazel.build/modules/rules_go/0.41.0/MODULE.bazel": "bb",
+    "https://bcr.bazel.build/modules/rules_go/0.46.0/MODULE.bazel": "cc",
+    "https://bcr.bazel.build/modules/rules_go/0.46.0/source.json": "dd",
+    "https://example.com/registry/modules/rules_go/0.46.0/source.json": "not found",
+    "https://bcr.bazel.build/modules/gazelle/0.35.0/source.json": "ee"
+  }
+}`,
+			want: map[string]PersistedExternalDependency{
+				"rules_go": {Version: "0.46.0", Integrity: "sha256:dd"},
+				"gazelle":  {Version: "0.35.0", Integrity: "sha256:ee"},
+			},
+		},
+		"module graph": {
+			content: `{
+  "lockFileVersion": 3,
+  "moduleDepGraph": {
+    "<root>": {"name": "target-determinator", "version": ""},
+    "rules_go@0.46.0": {
+      "name": "rules_go",
+      "version": "0.46.0",
+      "repoSpec": {"attributes": {"integrity": "sha256-abc=", "strip_prefix": ""}}
+    }
+  }
+}`,
+			want: map[string]PersistedExternalDependency{
+				"rules_go": {Version: "0.46.0", Integrity: "sha256-abc="},
+			},
+		},
+	} {
+		got, err := parseModuleLockfile(tc.content)
+		if err != nil {
+			t.Fatalf("Error parsing lockfile with %s: %v", name, err)
+		}
+		if !reflect.DeepEqual(tc.want, got) {
+			t.Fatalf("Wrong modules with %s: want %v got %v", name, tc.want, got)
+		}
+	}
+}
+
+func TestParseGoModules(t *testing.T) {
+	goMod := `module github.com/bazel-contrib/target-determinator
+
+go 1.24
+
+require github.com/google/uuid v1.3.0
+
+require (
+	github.com/hashicorp/go-version v1.6.0
+	golang.org/x/sys v0.26.0 // indirect
+)
+
+replace github.com/google/uuid => ../uuid
+`
+	goSum := `github.com/google/uuid v1.3.0 h1:uuid=
+github.com/google/uuid v1.3.0/go.mod h1:uuidmod=
+github.com/hashicorp/go-version v1.5.0 h1:old=
+github.com/hashicorp/go-version v1.6.0 h1:version=
+`
+	want := map[string]PersistedExternalDependency{
+		"com_github_google_uuid":          {Version: "v1.3.0", Integrity: "h1:uuid="},
+		"com_github_hashicorp_go_version": {Version: "v1.6.0", Integrity: "h1:version="},
+		"org_golang_x_sys":                {Version: "v0.26.0"},
+	}
+	if got := parseGoModules(goMod, goSum); !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong modules: want %v got %v", want, got)
+	}
+}
@@ -0,0 +1,110 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// FederationConfig describes several repositories whose affected targets are determined together,
+// and the dependencies between them which Bazel doesn't know about.
+type FederationConfig struct {
+	Repositories []FederatedRepository `json:"repositories"`
+	Dependencies []FederatedDependency `json:"dependencies"`
+}
+
+// FederatedRepository is one of the repositories in a FederationConfig.
+type FederatedRepository struct {
+	// Name qualifies the labels of targets in this repository, as @Name//package:target.
+	Name string `json:"name"`
+	// Path is the path to the repository. Relative paths are relative to the config file.
+	Path string `json:"path"`
+	// BeforeRevision is the revision to compare the current state of the repository against.
+	BeforeRevision string `json:"before_revision"`
+	// Args are any additional arguments to pass when determining the affected targets in this
+	// repository, e.g. "-targets".
+	Args []string `json:"args,omitempty"`
+}
+
+// FederatedDependency declares that Target depends on DependsOn, where both are repository-qualified
+// labels. DependsOn may also be a pattern ending in "...", e.g. "@backend//api/...", to depend on
+// every target in a package and its subpackages.
+type FederatedDependency struct {
+	Target    string `json:"target"`
+	DependsOn string `json:"depends_on"`
+}
+
+// LoadFederationConfig reads a FederationConfig from the JSON file at path.
+func LoadFederationConfig(path string) (*FederationConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read federation config from %s: %w", path, err)
+	}
+	var config FederationConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse federation config from %s: %w", path, err)
+	}
+	names := make(map[string]bool, len(config.Repositories))
+	for i, repository := range config.Repositories {
+		if repository.Name == "" || repository.Path == "" || repository.BeforeRevision == "" {
+			return nil, fmt.Errorf("repository %d in federation config %s must have a name, path and before_revision", i, path)
+		}
+		if names[repository.Name] {
+			return nil, fmt.Errorf("repository %s appears more than once in federation config %s", repository.Name, path)
+		}
+		names[repository.Name] = true
+		if !filepath.IsAbs(repository.Path) {
+			config.Repositories[i].Path = filepath.Join(filepath.Dir(path), repository.Path)
+		}
+	}
+	return &config, nil
+}
+
+// CombineFederatedResults qualifies the affected targets of each repository (keyed by repository
+// name) with the repository name, and adds the targets which depend on them according to the
+// dependencies in config, transitively. It returns the combined affected targets, sorted.
+func CombineFederatedResults(config *FederationConfig, affected map[string][]string) []string {
+	combined := make(map[string]bool)
+	for name, targets := range affected {
+		for _, target := range targets {
+			combined["@"+name+target] = true
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, dependency := range config.Dependencies {
+			if combined[dependency.Target] {
+				continue
+			}
+			for target := range combined {
+				if federatedLabelMatches(dependency.DependsOn, target) {
+					combined[dependency.Target] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	result := make([]string, 0, len(combined))
+	for target := range combined {
+		result = append(result, target)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func federatedLabelMatches(pattern string, target string) bool {
+	prefix, isWildcard := strings.CutSuffix(pattern, "...")
+	if !isWildcard {
+		return pattern == target
+	}
+	if strings.HasSuffix(prefix, "//") {
+		return strings.HasPrefix(target, prefix)
+	}
+	// "@repo//foo/..." matches "@repo//foo:bar" and "@repo//foo/baz:qux" but not "@repo//foobar:baz".
+	prefix = strings.TrimSuffix(prefix, "/")
+	return strings.HasPrefix(target, prefix+":") || strings.HasPrefix(target, prefix+"/")
+}
@@ -0,0 +1,46 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCombineFederatedResults(t *testing.T) {
+	config := &FederationConfig{
+		Dependencies: []FederatedDependency{
+			{Target: "@frontend//app:deploy", DependsOn: "@backend//api/..."},
+			{Target: "@mobile//app:release", DependsOn: "@frontend//app:deploy"},
+			{Target: "@frontend//unrelated:deploy", DependsOn: "@backend//apiclient:lib"},
+		},
+	}
+	affected := map[string][]string{
+		"backend":  {"//api/v1:proto"},
+		"frontend": {"//web:lib"},
+		"mobile":   nil,
+	}
+
+	want := []string{"@backend//api/v1:proto", "@frontend//app:deploy", "@frontend//web:lib", "@mobile//app:release"}
+	if got := CombineFederatedResults(config, affected); !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong combined results: want %v got %v", want, got)
+	}
+}
+
+func TestFederatedLabelMatches(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		target  string
+		want    bool
+	}{
+		{"@backend//api:proto", "@backend//api:proto", true},
+		{"@backend//api:proto", "@backend//api:other", false},
+		{"@backend//...", "@backend//api:proto", true},
+		{"@backend//...", "@frontend//api:proto", false},
+		{"@backend//api/...", "@backend//api:proto", true},
+		{"@backend//api/...", "@backend//api/v1:proto", true},
+		{"@backend//api/...", "@backend//apiclient:lib", false},
+	} {
+		if got := federatedLabelMatches(tc.pattern, tc.target); tc.want != got {
+			t.Fatalf("Wrong match of %s against %s: want %v got %v", tc.pattern, tc.target, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ChangedDirectories returns the directories (relative to the workspace root) containing
+// changedFiles which still exist in workspacePath, sorted. The workspace root is ".".
+func ChangedDirectories(workspacePath string, changedFiles []string) []string {
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, changedFile := range changedFiles {
+		dir := path.Dir(changedFile)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		if info, err := os.Stat(filepath.Join(workspacePath, dir)); err == nil && info.IsDir() {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// StaleBuildFiles runs gazelleTarget (e.g. "//:gazelle") in diff mode on dirs, and returns the BUILD
+// files (relative to the workspace root) which gazelle would change, sorted.
+// BUILD files which don't match what gazelle would generate can make the target determinator
+// silently miss affected targets, e.g. when a Go or Python file moves between packages.
+func StaleBuildFiles(context *Context, gazelleTarget string, dirs []string) ([]string, error) {
+	if len(dirs) == 0 {
+		return nil, nil
+	}
+	var stdout, stderr bytes.Buffer
+	args := append([]string{gazelleTarget, "--", "-mode=diff"}, dirs...)
+	result, err := context.BazelCmd.Execute(
+		BazelCmdConfig{Dir: context.WorkspacePath, Stdout: &stdout, Stderr: &stderr},
+		[]string{"--output_base", context.BazelOutputBase}, "run", args...)
+	staleFiles := parseGazelleDiff(context.WorkspacePath, stdout.String())
+	// gazelle exits non-zero in diff mode when there are differences, so only fail if it didn't
+	// tell us what they were.
+	if (result != 0 || err != nil) && len(staleFiles) == 0 {
+		return nil, fmt.Errorf("failed to run %s in diff mode: %w. Stderr:\n%v", gazelleTarget, err, stderr.String())
+	}
+	return staleFiles, nil
+}
+
+// parseGazelleDiff returns the files (relative to workspacePath) changed in a unified diff output
+// by gazelle, sorted.
+func parseGazelleDiff(workspacePath string, diff string) []string {
+	seen := make(map[string]bool)
+	var files []string
+	for _, line := range strings.Split(diff, "\n") {
+		var file string
+		if rest, ok := strings.CutPrefix(line, "--- "); ok {
+			file = rest
+		} else if rest, ok := strings.CutPrefix(line, "+++ "); ok {
+			file = rest
+		} else {
+			continue
+		}
+		file, _, _ = strings.Cut(file, "\t")
+		if file == "/dev/null" {
+			continue
+		}
+		if rel, err := filepath.Rel(workspacePath, file); err == nil && filepath.IsAbs(file) {
+			file = filepath.ToSlash(rel)
+		}
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
@@ -0,0 +1,42 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseGazelleDiff(t *testing.T) {
+	diff := `--- /ws/go/lib/BUILD.bazel	1970-01-01 00:00:00.000000000 +0000
++++ /ws/go/lib/BUILD.bazel	1970-01-01 00:00:00.000000000 +0000
+@@ -3,6 +3,7 @@
+     srcs = [
+         "lib.go",
++        "moved.go",
+     ],
+--- /dev/null	1970-01-01 00:00:00.000000000 +0000
++++ /ws/go/new/BUILD.bazel	1970-01-01 00:00:00.000000000 +0000
+@@ -0,0 +1,3 @@
++load("@rules_go//go:def.bzl", "go_library")
+`
+	want := []string{"go/lib/BUILD.bazel", "go/new/BUILD.bazel"}
+	if got := parseGazelleDiff("/ws", diff); !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong stale files: want %v got %v", want, got)
+	}
+}
+
+func TestChangedDirectories(t *testing.T) {
+	workspace := t.TempDir()
+	for _, dir := range []string{"go/lib", "python"} {
+		if err := os.MkdirAll(filepath.Join(workspace, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changedFiles := []string{"python/main.py", "go/lib/lib.go", "go/lib/moved.go", "deleted/file.go", "README.md"}
+	want := []string{".", "go/lib", "python"}
+	if got := ChangedDirectories(workspace, changedFiles); !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong changed directories: want %v got %v", want, got)
+	}
+}
@@ -0,0 +1,190 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// GitHubActionEnvironment describes the workflow run a GitHub Actions step is determining affected
+// targets for, as read from the environment variables and event payload GitHub Actions provides.
+type GitHubActionEnvironment struct {
+	// Repository is the owner and name of the repository, e.g. bazel-contrib/target-determinator.
+	Repository string
+	// SHA is the commit to determine affected targets for, which must be checked out: for
+	// pull_request events, the merge commit of the pull request's head into its base, and for
+	// pull_request_target events, which run on the base branch, the pull request's head.
+	SHA string
+	// BeforeSHA is the commit to compare SHA with: for pull requests, the head of their base
+	// branch, and for pushes, the commit the branch pointed at before the push.
+	BeforeSHA string
+	// PullRequest is the number of the pull request the workflow runs for, or 0 if it doesn't.
+	PullRequest int
+	// OutputFile is where to write step outputs, if set.
+	OutputFile string
+	// APIURL is the URL of the GitHub API, and Token, if set, authenticates with it.
+	APIURL string
+	Token  string
+}
+
+// LoadGitHubActionEnvironment reads the GitHubActionEnvironment from the variables returned by
+// getenv (e.g. os.Getenv): GITHUB_REPOSITORY, GITHUB_SHA, GITHUB_OUTPUT, GITHUB_API_URL and
+// GITHUB_TOKEN (which workflows must pass explicitly), and the event payload at GITHUB_EVENT_PATH.
+// Only pull_request, pull_request_target and push events are supported. See
+// CheckGitHubActionCheckout.
+func LoadGitHubActionEnvironment(getenv func(string) string) (*GitHubActionEnvironment, error) {
+	env := &GitHubActionEnvironment{
+		Repository: getenv("GITHUB_REPOSITORY"),
+		SHA:        getenv("GITHUB_SHA"),
+		OutputFile: getenv("GITHUB_OUTPUT"),
+		APIURL:     strings.TrimSuffix(getenv("GITHUB_API_URL"), "/"),
+		Token:      getenv("GITHUB_TOKEN"),
+	}
+	if env.APIURL == "" {
+		env.APIURL = "https://api.github.com"
+	}
+	if env.Repository == "" || env.SHA == "" {
+		return nil, fmt.Errorf("GITHUB_REPOSITORY and GITHUB_SHA must be set; is this running in GitHub Actions?")
+	}
+	eventPath := getenv("GITHUB_EVENT_PATH")
+	content, err := os.ReadFile(eventPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read GitHub event from %s: %w", eventPath, err)
+	}
+	var event struct {
+		Before      string `json:"before"`
+		PullRequest struct {
+			Number int `json:"number"`
+			Base   struct {
+				SHA string `json:"sha"`
+			} `json:"base"`
+			Head struct {
+				SHA string `json:"sha"`
+			} `json:"head"`
+		} `json:"pull_request"`
+	}
+	if err := json.Unmarshal(content, &event); err != nil {
+		return nil, fmt.Errorf("failed to parse GitHub event from %s: %w", eventPath, err)
+	}
+	switch eventName := getenv("GITHUB_EVENT_NAME"); eventName {
+	case "pull_request":
+		env.PullRequest = event.PullRequest.Number
+		env.BeforeSHA = event.PullRequest.Base.SHA
+	case "pull_request_target":
+		// GITHUB_SHA is the head of the base branch, so comparing it with the base would never find
+		// any affected targets.
+		if event.PullRequest.Head.SHA == "" {
+			return nil, fmt.Errorf("GitHub event from %s has no pull request head to determine affected targets for", eventPath)
+		}
+		env.PullRequest = event.PullRequest.Number
+		env.SHA = event.PullRequest.Head.SHA
+		env.BeforeSHA = event.PullRequest.Base.SHA
+	case "push":
+		env.BeforeSHA = event.Before
+	default:
+		return nil, fmt.Errorf("unsupported GitHub event %q - supported events: pull_request|pull_request_target|push", eventName)
+	}
+	// Pushes which create a branch have no previous commit.
+	if env.BeforeSHA == "" || strings.Trim(env.BeforeSHA, "0") == "" {
+		return nil, fmt.Errorf("GitHub event from %s has no commit to compare %s with", eventPath, env.SHA)
+	}
+	return env, nil
+}
+
+// CheckGitHubActionCheckout returns an error if the commit checked out in workspacePath isn't
+// env.SHA, which would silently compare the wrong commit, e.g. for pull_request_target events if the
+// pull request's head wasn't checked out with "ref: ${{ github.event.pull_request.head.sha }}".
+func CheckGitHubActionCheckout(workspacePath string, env *GitHubActionEnvironment) error {
+	head, err := GitRevParse(workspacePath, "HEAD", false)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the checked out commit: %w", err)
+	}
+	if head != env.SHA {
+		return fmt.Errorf("the checked out commit is %s, but the GitHub event is for %s, which must be checked out (e.g. with actions/checkout's \"ref\" input) to determine its affected targets", head, env.SHA)
+	}
+	return nil
+}
+
+// gitHubOutputDelimiter ends the multi-line value of the affected-targets step output.
+const gitHubOutputDelimiter = "TARGET_DETERMINATOR_EOF"
+
+// WriteGitHubOutputs appends the step outputs for targets to path, in the format of GITHUB_OUTPUT:
+// affected-targets, with one target per line, and affected-count.
+func WriteGitHubOutputs(path string, targets []string) error {
+	var content strings.Builder
+	fmt.Fprintf(&content, "affected-targets<<%s\n", gitHubOutputDelimiter)
+	for _, target := range targets {
+		fmt.Fprintln(&content, target)
+	}
+	fmt.Fprintln(&content, gitHubOutputDelimiter)
+	fmt.Fprintf(&content, "affected-count=%d\n", len(targets))
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open GitHub outputs file %s: %w", path, err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content.String()); err != nil {
+		return fmt.Errorf("failed to write GitHub outputs to %s: %w", path, err)
+	}
+	return nil
+}
+
+// maxGitHubCommentTargets is the most targets listed in a summary comment.
+const maxGitHubCommentTargets = 100
+
+// GitHubSummaryComment formats a Markdown comment summarizing targets, the targets affected between
+// before and after.
+func GitHubSummaryComment(targets []string, before string, after string) string {
+	var comment strings.Builder
+	fmt.Fprintf(&comment, "### Affected targets\n\n**%d** targets affected between %s and %s.\n", len(targets), shortSHA(before), shortSHA(after))
+	if len(targets) == 0 {
+		return comment.String()
+	}
+	comment.WriteString("\n<details><summary>Targets</summary>\n\n```\n")
+	for i, target := range targets {
+		if i == maxGitHubCommentTargets {
+			fmt.Fprintf(&comment, "... and %d more\n", len(targets)-maxGitHubCommentTargets)
+			break
+		}
+		fmt.Fprintln(&comment, target)
+	}
+	comment.WriteString("```\n\n</details>\n")
+	return comment.String()
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
+
+// PostGitHubComment posts body as a comment on the pull request env is running for.
+func PostGitHubComment(env *GitHubActionEnvironment, body string) error {
+	content, err := json.Marshal(map[string]string{"body": body})
+	if err != nil {
+		return fmt.Errorf("failed to marshal comment: %w", err)
+	}
+	url := fmt.Sprintf("%s/repos/%s/issues/%d/comments", env.APIURL, env.Repository, env.PullRequest)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("failed to create request to %s: %w", url, err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+env.Token)
+	req.Header.Set("Content-Type", "application/json")
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post comment to %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to post comment to %s: got status %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadGitHubActionEnvironment(t *testing.T) {
+	dir := t.TempDir()
+	pullRequestEvent := filepath.Join(dir, "pull_request.json")
+	pushEvent := filepath.Join(dir, "push.json")
+	newBranchEvent := filepath.Join(dir, "new_branch.json")
+	for path, content := range map[string]string{
+		pullRequestEvent: `{"number": 7, "pull_request": {"number": 7, "base": {"sha": "base123"}, "head": {"sha": "head123"}}}`,
+		pushEvent:        `{"before": "before123", "after": "after123"}`,
+		newBranchEvent:   `{"before": "0000000000000000000000000000000000000000", "after": "after123"}`,
+	} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	getenv := func(eventName string, eventPath string) func(string) string {
+		return func(name string) string {
+			return map[string]string{
+				"GITHUB_REPOSITORY": "bazel-contrib/target-determinator",
+				"GITHUB_SHA":        "after123",
+				"GITHUB_OUTPUT":     "/tmp/output",
+				"GITHUB_TOKEN":      "token",
+				"GITHUB_EVENT_NAME": eventName,
+				"GITHUB_EVENT_PATH": eventPath,
+			}[name]
+		}
+	}
+
+	got, err := LoadGitHubActionEnvironment(getenv("pull_request", pullRequestEvent))
+	if err != nil {
+		t.Fatalf("Error loading pull request environment: %v", err)
+	}
+	want := &GitHubActionEnvironment{
+		Repository:  "bazel-contrib/target-determinator",
+		SHA:         "after123",
+		BeforeSHA:   "base123",
+		PullRequest: 7,
+		OutputFile:  "/tmp/output",
+		APIURL:      "https://api.github.com",
+		Token:       "token",
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong pull request environment: want %+v got %+v", want, got)
+	}
+
+	// pull_request_target events run on the base branch, so GITHUB_SHA is the base.
+	got, err = LoadGitHubActionEnvironment(getenv("pull_request_target", pullRequestEvent))
+	if err != nil {
+		t.Fatalf("Error loading pull request target environment: %v", err)
+	}
+	if got.SHA != "head123" || got.BeforeSHA != "base123" || got.PullRequest != 7 {
+		t.Fatalf("Wrong pull request target environment: want head123 compared with base123 for #7 got %+v", got)
+	}
+
+	got, err = LoadGitHubActionEnvironment(getenv("push", pushEvent))
+	if err != nil {
+		t.Fatalf("Error loading push environment: %v", err)
+	}
+	if got.BeforeSHA != "before123" || got.PullRequest != 0 {
+		t.Fatalf("Wrong push environment: want before before123 and no pull request got %+v", got)
+	}
+
+	for name, env := range map[string]func(string) string{
+		"new branch":        getenv("push", newBranchEvent),
+		"target without pr": getenv("pull_request_target", pushEvent),
+		"unsupported event": getenv("workflow_dispatch", pushEvent),
+		"outside actions":   func(string) string { return "" },
+	} {
+		if _, err := LoadGitHubActionEnvironment(env); err == nil {
+			t.Fatalf("Wrong result loading environment with %s: want error got nil", name)
+		}
+	}
+}
+
+func TestWriteGitHubOutputs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output")
+	if err := os.WriteFile(path, []byte("existing=1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteGitHubOutputs(path, []string{"//java/example:GreetingLib", "//go/example:lib_test"}); err != nil {
+		t.Fatalf("Error writing GitHub outputs: %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "existing=1\naffected-targets<<TARGET_DETERMINATOR_EOF\n//java/example:GreetingLib\n//go/example:lib_test\nTARGET_DETERMINATOR_EOF\naffected-count=2\n"
+	if got := string(content); want != got {
+		t.Fatalf("Wrong GitHub outputs: want %q got %q", want, got)
+	}
+}
+
+func TestGitHubSummaryComment(t *testing.T) {
+	want := "### Affected targets\n\n**0** targets affected between 0123456789ab and abc.\n"
+	if got := GitHubSummaryComment(nil, "0123456789abcdef", "abc"); want != got {
+		t.Fatalf("Wrong comment without targets: want %q got %q", want, got)
+	}
+	targets := make([]string, maxGitHubCommentTargets+2)
+	for i := range targets {
+		targets[i] = "//java/example:Target"
+	}
+	comment := GitHubSummaryComment(targets, "a", "b")
+	if !strings.Contains(comment, "**102** targets") || !strings.Contains(comment, "... and 2 more\n") || strings.Count(comment, "//java/example:Target") != maxGitHubCommentTargets {
+		t.Fatalf("Wrong comment with too many targets to list: %q", comment)
+	}
+}
+
+func TestPostGitHubComment(t *testing.T) {
+	var gotPath, gotAuthorization, gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuthorization = r.Header.Get("Authorization")
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Error decoding comment: %v", err)
+		}
+		gotBody = body["body"]
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	env := &GitHubActionEnvironment{Repository: "bazel-contrib/target-determinator", PullRequest: 7, APIURL: server.URL, Token: "token"}
+	if err := PostGitHubComment(env, "hello"); err != nil {
+		t.Fatalf("Error posting comment: %v", err)
+	}
+	if gotPath != "/repos/bazel-contrib/target-determinator/issues/7/comments" || gotAuthorization != "Bearer token" || gotBody != "hello" {
+		t.Fatalf("Wrong request: got path %s, authorization %s and body %s", gotPath, gotAuthorization, gotBody)
+	}
+
+	env.Repository = "missing/repository"
+	server.Config.Handler = http.NotFoundHandler()
+	if err := PostGitHubComment(env, "hello"); err == nil {
+		t.Fatalf("Wrong result posting comment to missing repository: want error got nil")
+	}
+}
+
+func TestCheckGitHubActionCheckout(t *testing.T) {
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"-c", "user.name=td", "-c", "user.email=td@example.com", "commit", "-q", "--allow-empty", "-m", "first"},
+	} {
+		if output, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("Failed to run git %v: %v. Output: %s", args, err, output)
+		}
+	}
+	head, err := GitRevParse(dir, "HEAD", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckGitHubActionCheckout(dir, &GitHubActionEnvironment{SHA: head}); err != nil {
+		t.Fatalf("Wrong result checking out the event's commit: want nil got %v", err)
+	}
+	if err := CheckGitHubActionCheckout(dir, &GitHubActionEnvironment{SHA: "0123456789012345678901234567890123456789"}); err == nil {
+		t.Fatalf("Wrong result checking out another commit: want error got nil")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -70,6 +71,10 @@ type TargetHashCache struct {
 
 	normalizer *Normalizer
 
+	// ignoredRepositories are the names of external repositories whose targets are treated as
+	// opaque when hashing, e.g. because they are resolved from the host machine.
+	ignoredRepositories []string
+
 	frozen bool
 
 	cacheLock sync.Mutex
@@ -97,6 +102,20 @@ var notComputedBeforeFrozen = fmt.Errorf("TargetHashCache has already been froze
 //     mixed into the hash, even if only one of the configurations is actually relevant.
 //     See https://github.com/bazelbuild/bazel/issues/14610
 func (thc *TargetHashCache) Hash(labelAndConfiguration LabelAndConfiguration) ([]byte, error) {
+	return thc.hash(labelAndConfiguration, false)
+}
+
+// HashIgnoringToolchainResolution hashes a given LabelAndConfiguration like Hash, except that
+// targets which only take part in toolchain resolution and select() evaluation (e.g.
+// `config_setting`, `platform` and `toolchain` targets) are treated as opaque: their labels are
+// mixed in, but their contents are not.
+// If Hash differs across two revisions but HashIgnoringToolchainResolution doesn't, the target was
+// only affected through changes to those targets.
+func (thc *TargetHashCache) HashIgnoringToolchainResolution(labelAndConfiguration LabelAndConfiguration) ([]byte, error) {
+	return thc.hash(labelAndConfiguration, true)
+}
+
+func (thc *TargetHashCache) hash(labelAndConfiguration LabelAndConfiguration, ignoreToolchainResolution bool) ([]byte, error) {
 	thc.cacheLock.Lock()
 	_, ok := thc.cache[labelAndConfiguration.Label]
 	if !ok {
@@ -115,17 +134,21 @@ func (thc *TargetHashCache) Hash(labelAndConfiguration LabelAndConfiguration) ([
 	thc.cacheLock.Unlock()
 	entry.hashLock.Lock()
 	defer entry.hashLock.Unlock()
-	if entry.hash == nil {
+	cached := &entry.hash
+	if ignoreToolchainResolution {
+		cached = &entry.toolchainResolutionInsensitiveHash
+	}
+	if *cached == nil {
 		if thc.frozen {
 			return nil, fmt.Errorf("didn't have cache value for label %s in configuration %s: %w", labelAndConfiguration.Label, labelAndConfiguration.Configuration, notComputedBeforeFrozen)
 		}
-		hash, err := hashTarget(thc, labelAndConfiguration)
+		hash, err := hashTarget(thc, labelAndConfiguration, ignoreToolchainResolution)
 		if err != nil {
 			return nil, err
 		}
-		entry.hash = hash
+		*cached = hash
 	}
-	return entry.hash, nil
+	return *cached, nil
 }
 
 // KnownConfigurations returns the configurations in which a Label is known to be configured.
@@ -145,6 +168,23 @@ func (thc *TargetHashCache) Freeze() {
 	thc.frozen = true
 }
 
+// IgnoreRepositories makes targets in the named external repositories hash to a constant value.
+// Names are matched against both apparent and canonical repository names, so "local_config_cc"
+// will also match e.g. "bazel_tools+cc_configure_extension+local_config_cc".
+// It must be called before any hashes are computed.
+func (thc *TargetHashCache) IgnoreRepositories(repositories []string) {
+	thc.ignoredRepositories = repositories
+}
+
+func (thc *TargetHashCache) isInIgnoredRepository(label gazelle_label.Label) bool {
+	for _, repository := range thc.ignoredRepositories {
+		if label.Repo == repository || strings.HasSuffix(label.Repo, "+"+repository) || strings.HasSuffix(label.Repo, "~"+repository) {
+			return true
+		}
+	}
+	return false
+}
+
 func (thc *TargetHashCache) ParseCanonicalLabel(label string) (gazelle_label.Label, error) {
 	return thc.normalizer.ParseCanonicalLabel(label)
 }
@@ -443,12 +483,15 @@ func sortKeys(attributes map[string]*build.Attribute) []string {
 	return keys
 }
 
-func hashTarget(thc *TargetHashCache, labelAndConfiguration LabelAndConfiguration) ([]byte, error) {
+func hashTarget(thc *TargetHashCache, labelAndConfiguration LabelAndConfiguration, ignoreToolchainResolution bool) ([]byte, error) {
 	label := labelAndConfiguration.Label
 	configurationMap, ok := thc.context[label]
 	if !ok {
 		return nil, fmt.Errorf("label %s not found in contxt: %w", label, labelNotFound)
 	}
+	if thc.isInIgnoredRepository(label) {
+		return make([]byte, 0), nil
+	}
 	configuration := labelAndConfiguration.Configuration
 	configuredTarget, ok := configurationMap[configuration]
 	if !ok {
@@ -481,7 +524,7 @@ func hashTarget(thc *TargetHashCache, labelAndConfiguration LabelAndConfiguratio
 		}
 		return hash, nil
 	case build.Target_RULE:
-		return hashRule(thc, target.Rule, configuredTarget.Configuration)
+		return hashRule(thc, target.Rule, configuredTarget.Configuration, ignoreToolchainResolution)
 	case build.Target_GENERATED_FILE:
 		hasher := sha256.New()
 		generatingLabel, err := thc.ParseCanonicalLabel(*target.GeneratedFile.GeneratingRule)
@@ -489,7 +532,7 @@ func hashTarget(thc *TargetHashCache, labelAndConfiguration LabelAndConfiguratio
 			return nil, fmt.Errorf("failed to parse generated file generating rule label %s: %w", *target.GeneratedFile.GeneratingRule, err)
 		}
 		writeLabel(hasher, generatingLabel)
-		hash, err := thc.Hash(LabelAndConfiguration{Label: generatingLabel, Configuration: configuration})
+		hash, err := thc.hash(LabelAndConfiguration{Label: generatingLabel, Configuration: configuration}, ignoreToolchainResolution)
 		if err != nil {
 			return nil, err
 		}
@@ -503,8 +546,8 @@ func hashTarget(thc *TargetHashCache, labelAndConfiguration LabelAndConfiguratio
 	}
 }
 
-// If this function changes, so should WalkDiffs.
-func hashRule(thc *TargetHashCache, rule *build.Rule, configuration *analysis.Configuration) ([]byte, error) {
+// If this function changes, so should WalkDiffs and Breakdown.
+func hashRule(thc *TargetHashCache, rule *build.Rule, configuration *analysis.Configuration, ignoreToolchainResolution bool) ([]byte, error) {
 	hasher := sha256.New()
 	// Mix in the Bazel version, because Bazel versions changes may cause differences to how rules
 	// are evaluated even if the rules themselves haven't changed.
@@ -539,13 +582,17 @@ func hashRule(thc *TargetHashCache, rule *build.Rule, configuration *analysis.Co
 	for _, ruleInputLabelAndConfigurations := range labelsAndConfigurations {
 		for _, ruleInputConfiguration := range ruleInputLabelAndConfigurations.Configurations {
 			ruleInputLabel := ruleInputLabelAndConfigurations.Label
-			ruleInputHash, err := thc.Hash(LabelAndConfiguration{Label: ruleInputLabel, Configuration: ruleInputConfiguration})
+			ruleInputLabelAndConfiguration := LabelAndConfiguration{Label: ruleInputLabel, Configuration: ruleInputConfiguration}
+			writeLabel(hasher, ruleInputLabel)
+			hasher.Write(ruleInputConfiguration.ForHashing())
+			if ignoreToolchainResolution && thc.isToolchainResolutionTarget(ruleInputLabelAndConfiguration) {
+				continue
+			}
+
+			ruleInputHash, err := thc.hash(ruleInputLabelAndConfiguration, ignoreToolchainResolution)
 			if err != nil {
 				return nil, fmt.Errorf("failed to hash configuredRuleInput %s %s which is a dependency of %s %s: %w", ruleInputLabel, ruleInputConfiguration, rule.GetName(), configuration.GetChecksum(), err)
 			}
-
-			writeLabel(hasher, ruleInputLabel)
-			hasher.Write(ruleInputConfiguration.ForHashing())
 			hasher.Write(ruleInputHash)
 		}
 	}
@@ -553,6 +600,144 @@ func hashRule(thc *TargetHashCache, rule *build.Rule, configuration *analysis.Co
 	return hasher.Sum(nil), nil
 }
 
+// Breakdown returns the components which the hash of labelAndConfiguration is computed from, as
+// hashRule computes it, or nil if it isn't a rule (or is in an ignored repository).
+func (thc *TargetHashCache) Breakdown(labelAndConfiguration LabelAndConfiguration) (*PersistedHashBreakdown, error) {
+	configuredTarget, ok := thc.context[labelAndConfiguration.Label][labelAndConfiguration.Configuration]
+	if !ok {
+		return nil, fmt.Errorf("label %s configuration %s not found in contxt: %w", labelAndConfiguration.Label, labelAndConfiguration.Configuration, labelNotFound)
+	}
+	rule := configuredTarget.GetTarget().GetRule()
+	if rule == nil || thc.isInIgnoredRepository(labelAndConfiguration.Label) {
+		return nil, nil
+	}
+
+	implementationHasher := sha256.New()
+	implementationHasher.Write([]byte(thc.bazelRelease))
+	implementationHasher.Write([]byte(rule.GetRuleClass()))
+	implementationHasher.Write([]byte(rule.GetSkylarkEnvironmentHashCode()))
+
+	attributesHasher := sha256.New()
+	for _, attr := range rule.GetAttribute() {
+		protoBytes, err := proto.Marshal(thc.AttributeForSerialization(attr))
+		if err != nil {
+			return nil, err
+		}
+		attributesHasher.Write(protoBytes)
+	}
+
+	breakdown := &PersistedHashBreakdown{
+		RuleImplementation: hex.EncodeToString(implementationHasher.Sum(nil)),
+		Attributes:         hex.EncodeToString(attributesHasher.Sum(nil)),
+	}
+	ownConfiguration := NormalizeConfiguration(configuredTarget.GetConfiguration().GetChecksum())
+	labelsAndConfigurations, err := getConfiguredRuleInputs(thc, rule, ownConfiguration)
+	if err != nil {
+		return nil, err
+	}
+	for _, ruleInputLabelAndConfigurations := range labelsAndConfigurations {
+		ruleInputLabel := ruleInputLabelAndConfigurations.Label
+		for _, ruleInputConfiguration := range ruleInputLabelAndConfigurations.Configurations {
+			ruleInputHash, err := thc.Hash(LabelAndConfiguration{Label: ruleInputLabel, Configuration: ruleInputConfiguration})
+			if err != nil {
+				return nil, fmt.Errorf("failed to hash configuredRuleInput %s %s which is a dependency of %s %s: %w", ruleInputLabel, ruleInputConfiguration, rule.GetName(), ownConfiguration, err)
+			}
+			if thc.context[ruleInputLabel][ruleInputConfiguration].GetTarget().GetType() == build.Target_SOURCE_FILE {
+				if breakdown.Sources == nil {
+					breakdown.Sources = make(map[string]string)
+				}
+				breakdown.Sources[ruleInputLabel.String()] = hex.EncodeToString(ruleInputHash)
+				continue
+			}
+			if breakdown.Dependencies == nil {
+				breakdown.Dependencies = make(map[string]map[string]string)
+			}
+			if breakdown.Dependencies[ruleInputLabel.String()] == nil {
+				breakdown.Dependencies[ruleInputLabel.String()] = make(map[string]string)
+			}
+			breakdown.Dependencies[ruleInputLabel.String()][ruleInputConfiguration.String()] = hex.EncodeToString(ruleInputHash)
+		}
+	}
+	return breakdown, nil
+}
+
+// SourceFileHashes returns the hex-encoded hashes of the source files in the main repository which
+// the hash of labelAndConfiguration depends on, directly or through other targets, by label. If it
+// depends on more than limit of them, nil is returned instead.
+func (thc *TargetHashCache) SourceFileHashes(labelAndConfiguration LabelAndConfiguration, limit int) (map[string]string, error) {
+	hashes := make(map[string]string)
+	visited := make(map[LabelAndConfiguration]bool)
+	// visit returns false once more than limit source files have been found.
+	var visit func(labelAndConfiguration LabelAndConfiguration) (bool, error)
+	visit = func(labelAndConfiguration LabelAndConfiguration) (bool, error) {
+		if visited[labelAndConfiguration] || thc.isInIgnoredRepository(labelAndConfiguration.Label) {
+			return true, nil
+		}
+		visited[labelAndConfiguration] = true
+		configuredTarget, ok := thc.context[labelAndConfiguration.Label][labelAndConfiguration.Configuration]
+		if !ok {
+			return false, fmt.Errorf("label %s configuration %s not found in contxt: %w", labelAndConfiguration.Label, labelAndConfiguration.Configuration, labelNotFound)
+		}
+		target := configuredTarget.GetTarget()
+		switch target.GetType() {
+		case build.Target_SOURCE_FILE:
+			if labelAndConfiguration.Label.Repo != "" {
+				return true, nil
+			}
+			hash, err := thc.Hash(labelAndConfiguration)
+			if err != nil {
+				return false, err
+			}
+			hashes[labelAndConfiguration.Label.String()] = hex.EncodeToString(hash)
+			return len(hashes) <= limit, nil
+		case build.Target_GENERATED_FILE:
+			generatingLabel, err := thc.ParseCanonicalLabel(target.GetGeneratedFile().GetGeneratingRule())
+			if err != nil {
+				return false, fmt.Errorf("failed to parse generated file generating rule label %s: %w", target.GetGeneratedFile().GetGeneratingRule(), err)
+			}
+			return visit(LabelAndConfiguration{Label: generatingLabel, Configuration: labelAndConfiguration.Configuration})
+		case build.Target_RULE:
+			labelsAndConfigurations, err := getConfiguredRuleInputs(thc, target.GetRule(), labelAndConfiguration.Configuration)
+			if err != nil {
+				return false, err
+			}
+			for _, ruleInputLabelAndConfigurations := range labelsAndConfigurations {
+				for _, ruleInputConfiguration := range ruleInputLabelAndConfigurations.Configurations {
+					if withinLimit, err := visit(LabelAndConfiguration{Label: ruleInputLabelAndConfigurations.Label, Configuration: ruleInputConfiguration}); !withinLimit || err != nil {
+						return false, err
+					}
+				}
+			}
+		}
+		return true, nil
+	}
+	if withinLimit, err := visit(labelAndConfiguration); !withinLimit || err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// toolchainResolutionRuleClasses are the rule classes of targets which only influence other targets
+// by taking part in toolchain resolution or select() evaluation.
+// toolchain targets aren't included: although they take part in toolchain resolution, they also
+// point at the toolchain implementation, so changing one can change what's built.
+var toolchainResolutionRuleClasses = map[string]struct{}{
+	"config_setting":     {},
+	"constraint_setting": {},
+	"constraint_value":   {},
+	"platform":           {},
+	"toolchain_type":     {},
+}
+
+func (thc *TargetHashCache) isToolchainResolutionTarget(labelAndConfiguration LabelAndConfiguration) bool {
+	configuredTarget, ok := thc.context[labelAndConfiguration.Label][labelAndConfiguration.Configuration]
+	if !ok {
+		return false
+	}
+	_, ok = toolchainResolutionRuleClasses[configuredTarget.GetTarget().GetRule().GetRuleClass()]
+	return ok
+}
+
 func getConfiguredRuleInputs(thc *TargetHashCache, rule *build.Rule, ownConfiguration Configuration) ([]LabelAndConfigurations, error) {
 	labelsAndConfigurations := make([]LabelAndConfigurations, 0)
 	if thc.bazelVersionSupportsConfiguredRuleInputs {
@@ -642,6 +827,9 @@ type fileHashCache struct {
 type cacheEntry struct {
 	hashLock sync.Mutex
 	hash     []byte
+	// toolchainResolutionInsensitiveHash is only populated for target cache entries, and only if
+	// requested via HashIgnoringToolchainResolution.
+	toolchainResolutionInsensitiveHash []byte
 }
 
 // Hash computes the digest of the contents of a file at the given path, and caches the result.
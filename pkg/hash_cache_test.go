@@ -281,6 +281,108 @@ func TestDigestTree(t *testing.T) {
 	}
 }
 
+func TestHashIgnoringToolchainResolution(t *testing.T) {
+	labelAndConfiguration := LabelAndConfiguration{
+		Label:         mustParseLabel("//HelloWorld:HelloWorld"),
+		Configuration: NormalizeConfiguration(configurationChecksum),
+	}
+
+	withConfigSetting := func(value string) *TargetHashCache {
+		_, cqueryResult := layoutProject(t)
+		greetingLib := cqueryResult.Results[1].GetTarget().GetRule()
+		greetingLib.RuleInput = append(greetingLib.RuleInput, "//HelloWorld:is_linux")
+		cqueryResult.Results = append(cqueryResult.Results, &analysis.ConfiguredTarget{
+			Target: &build.Target{
+				Type: build.Target_RULE.Enum(),
+				Rule: &build.Rule{
+					Name:      proto.String("//HelloWorld:is_linux"),
+					RuleClass: proto.String("config_setting"),
+					Attribute: []*build.Attribute{
+						{
+							Name:            proto.String("constraint_values"),
+							Type:            build.Attribute_LABEL_LIST.Enum(),
+							StringListValue: []string{value},
+						},
+					},
+				},
+			},
+			Configuration: cqueryResult.Results[0].Configuration,
+		})
+		return parseResult(t, cqueryResult, "release 5.1.1")
+	}
+
+	before := withConfigSetting("@platforms//os:linux")
+	after := withConfigSetting("@platforms//os:android")
+
+	hashBefore, err := before.Hash(labelAndConfiguration)
+	if err != nil {
+		t.Fatalf("Failed to get hash before: %v", err)
+	}
+	hashAfter, err := after.Hash(labelAndConfiguration)
+	if err != nil {
+		t.Fatalf("Failed to get hash after: %v", err)
+	}
+	if areHashesEqual(hashBefore, hashAfter) {
+		t.Fatalf("Wanted hashes to differ when a config_setting changed but were same: %v", hex.EncodeToString(hashBefore))
+	}
+
+	insensitiveHashBefore, err := before.HashIgnoringToolchainResolution(labelAndConfiguration)
+	if err != nil {
+		t.Fatalf("Failed to get toolchain resolution insensitive hash before: %v", err)
+	}
+	insensitiveHashAfter, err := after.HashIgnoringToolchainResolution(labelAndConfiguration)
+	if err != nil {
+		t.Fatalf("Failed to get toolchain resolution insensitive hash after: %v", err)
+	}
+	if !areHashesEqual(insensitiveHashBefore, insensitiveHashAfter) {
+		t.Fatalf("Wanted toolchain resolution insensitive hashes to be the same but were different: %v and %v", hex.EncodeToString(insensitiveHashBefore), hex.EncodeToString(insensitiveHashAfter))
+	}
+}
+
+func TestHashBreakdown(t *testing.T) {
+	configuration := NormalizeConfiguration(configurationChecksum)
+	_, cqueryResult := layoutProject(t)
+	thc := parseResult(t, cqueryResult, "release 5.1.1")
+
+	hexHash := func(labelAndConfiguration LabelAndConfiguration) string {
+		hash, err := thc.Hash(labelAndConfiguration)
+		if err != nil {
+			t.Fatalf("Failed to hash %s: %v", labelAndConfiguration.Label, err)
+		}
+		return hex.EncodeToString(hash)
+	}
+
+	breakdown, err := thc.Breakdown(LabelAndConfiguration{Label: mustParseLabel("//HelloWorld:HelloWorld"), Configuration: configuration})
+	if err != nil {
+		t.Fatalf("Failed to get breakdown: %v", err)
+	}
+	if breakdown == nil || breakdown.RuleImplementation == "" || breakdown.Attributes == "" {
+		t.Fatalf("Wrong breakdown: want rule implementation and attribute hashes got %+v", breakdown)
+	}
+	wantSources := map[string]string{
+		"//HelloWorld:HelloWorld.java": hexHash(LabelAndConfiguration{Label: mustParseLabel("//HelloWorld:HelloWorld.java")}),
+	}
+	if !reflect.DeepEqual(wantSources, breakdown.Sources) {
+		t.Fatalf("Wrong breakdown sources: want %v got %v", wantSources, breakdown.Sources)
+	}
+	wantDependencies := map[string]map[string]string{
+		"//HelloWorld:GreetingLib": {
+			configuration.String(): hexHash(LabelAndConfiguration{Label: mustParseLabel("//HelloWorld:GreetingLib"), Configuration: configuration}),
+		},
+	}
+	if !reflect.DeepEqual(wantDependencies, breakdown.Dependencies) {
+		t.Fatalf("Wrong breakdown dependencies: want %v got %v", wantDependencies, breakdown.Dependencies)
+	}
+
+	sourceBreakdown, err := thc.Breakdown(LabelAndConfiguration{Label: mustParseLabel("//HelloWorld:HelloWorld.java")})
+	if err != nil {
+		t.Fatalf("Failed to get breakdown of source file: %v", err)
+	}
+	if sourceBreakdown != nil {
+		t.Fatalf("Wrong breakdown of source file: want nil got %+v", sourceBreakdown)
+	}
+}
+
 // layoutProject setup a canned project layout in a temp directory it creates.
 func layoutProject(t *testing.T) (string, *analysis.CqueryResult) {
 	dir, err := ioutil.TempDir("", "")
@@ -452,3 +554,21 @@ func Test_getUserPermission(t *testing.T) {
 		})
 	}
 }
+
+func TestIsInIgnoredRepository(t *testing.T) {
+	thc := NewTargetHashCache(nil, &Normalizer{}, "release 7.0.0")
+	thc.IgnoreRepositories([]string{"local_config_cc"})
+	for l, want := range map[string]bool{
+		"@local_config_cc//:toolchain":                                     true,
+		"@@bazel_tools+cc_configure_extension+local_config_cc//:toolchain": true,
+		"@@bazel_tools~cc_configure_extension~local_config_cc//:toolchain": true,
+		"@local_config_cc_toolchains//:all":                                false,
+		"//local_config_cc:toolchain":                                      false,
+	} {
+		t.Run(l, func(t *testing.T) {
+			if got := thc.isInIgnoredRepository(mustParseLabel(l)); got != want {
+				t.Fatalf("Incorrect isInIgnoredRepository: want %v got %v", want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package pkg
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// lastChangeLinearScanLength is how many of the most recent hash files LastChange compares in turn
+// before bisecting the rest, so that recent changes are found exactly without assuming anything
+// about older ones.
+const lastChangeLinearScanLength = 8
+
+// HashHistory is the hash files in a hash store for the commits of a first-parent history, as
+// written by BackfillHashStore or -after-hashes-output, for finding when targets' hashes changed.
+type HashHistory struct {
+	// Commits are the commits which have hash files in the store, oldest first.
+	Commits []string
+
+	workspacePath  string
+	store          string
+	conflictPolicy string
+	verifyKey      ed25519.PublicKey
+}
+
+// HashChange is a change to a target's hashes between two commits of a HashHistory.
+type HashChange struct {
+	// Before is the last commit with the target's previous hashes, and After the first with its new
+	// ones. The change was made by one of the commits after Before, up to and including After, on
+	// the first-parent history, which is exactly After if there are no commits without hash files
+	// between them.
+	Before string
+	After  string
+	// BeforeHashes and AfterHashes are the target's hashes at Before and After, by configuration.
+	// Either is nil if the target didn't exist at that commit.
+	BeforeHashes map[string]string
+	AfterHashes  map[string]string
+	// BazelReleaseChanged is whether the hash files of Before and After were computed with different
+	// Bazel releases, which generally changes every hash.
+	BazelReleaseChanged bool
+}
+
+// Configurations returns the configurations the target's hash changed in, was added to, or was
+// removed from, sorted. The empty configuration is that of targets without one, e.g. source files.
+func (c HashChange) Configurations() []string {
+	var configurations []string
+	for configuration, beforeHash := range c.BeforeHashes {
+		if afterHash, ok := c.AfterHashes[configuration]; !ok || afterHash != beforeHash {
+			configurations = append(configurations, configuration)
+		}
+	}
+	for configuration := range c.AfterHashes {
+		if _, ok := c.BeforeHashes[configuration]; !ok {
+			configurations = append(configurations, configuration)
+		}
+	}
+	sort.Strings(configurations)
+	return configurations
+}
+
+// NewHashHistory finds the commits on the first-parent history of until which have hash files in
+// store, at StoredHashesLocation. If since is set, only commits made after it are considered; it may
+// be a date, or anything else git rev-list --since accepts, e.g. "2024-01-01" or "3 months ago".
+// Hash files are loaded as for LoadVerifiedPersistedHashes with conflictPolicy and verifyKey.
+func NewHashHistory(workspacePath string, store string, until string, since string, conflictPolicy string, verifyKey ed25519.PublicKey) (*HashHistory, error) {
+	args := []string{"rev-list", "--first-parent", "--reverse"}
+	if since != "" {
+		args = append(args, "--since="+since)
+	}
+	commits, err := runToLines(workspacePath, "git", append(args, until)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ancestors of %s: %w", until, err)
+	}
+	history := &HashHistory{
+		workspacePath:  workspacePath,
+		store:          store,
+		conflictPolicy: conflictPolicy,
+		verifyKey:      verifyKey,
+	}
+	hashStore := HashStoreFor(store)
+	for _, commit := range commits {
+		location := StoredHashesLocation(store, commit)
+		exists, err := hashStore.Exists(location)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for hashes at %s: %w", location, err)
+		}
+		if exists {
+			history.Commits = append(history.Commits, commit)
+		}
+	}
+	Progressf("Found hashes for %d of %d commits in %s", len(history.Commits), len(commits), store)
+	return history, nil
+}
+
+// load loads the hash file for the commit Commits[i].
+func (h *HashHistory) load(i int) (*PersistedHashData, error) {
+	location := StoredHashesLocation(h.store, h.Commits[i])
+	data, err := LoadVerifiedPersistedHashes(location, h.conflictPolicy, h.verifyKey)
+	if err != nil {
+		return nil, err
+	}
+	if data.AnonymizationSaltDigest != "" {
+		return nil, fmt.Errorf("hashes at %s are anonymized, so targets can't be found in them by label", location)
+	}
+	return data, nil
+}
+
+// TargetChanges returns every change to the hashes of the target labelString between consecutive
+// hash files, oldest first, including it being added and removed. Every hash file is loaded, so
+// for only the most recent change, LastChange is much faster.
+func (h *HashHistory) TargetChanges(labelString string) ([]HashChange, error) {
+	key, err := historyLabelKey(labelString)
+	if err != nil {
+		return nil, err
+	}
+	var changes []HashChange
+	var previous *PersistedHashData
+	for i := range h.Commits {
+		data, err := h.load(i)
+		if err != nil {
+			return nil, err
+		}
+		if previous != nil && !reflect.DeepEqual(previous.Hashes[key], data.Hashes[key]) {
+			changes = append(changes, *h.change(key, i-1, previous, i, data))
+		}
+		previous = data
+	}
+	return changes, nil
+}
+
+// LastChange returns the most recent change to the hashes of the target labelString, or nil if its
+// hashes are the same in every hash file, or there are none.
+// The most recent hash files are compared in turn, and if the change isn't among them, the rest
+// are bisected, so only a logarithmic number of them are loaded however dense the history is.
+// Bisecting assumes that the target's hashes didn't change and then change back, as is the case
+// for all but reverted changes; if they did, the change found may not be the most recent one.
+func (h *HashHistory) LastChange(labelString string) (*HashChange, error) {
+	key, err := historyLabelKey(labelString)
+	if err != nil {
+		return nil, err
+	}
+	if len(h.Commits) == 0 {
+		return nil, nil
+	}
+	after := len(h.Commits) - 1
+	afterData, err := h.load(after)
+	if err != nil {
+		return nil, err
+	}
+	wantHashes := afterData.Hashes[key]
+	hashesAt := func(i int) (*PersistedHashData, bool, error) {
+		data, err := h.load(i)
+		if err != nil {
+			return nil, false, err
+		}
+		return data, reflect.DeepEqual(data.Hashes[key], wantHashes), nil
+	}
+
+	for before := after - 1; before >= 0; before-- {
+		beforeData, same, err := hashesAt(before)
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			return h.change(key, before, beforeData, after, afterData), nil
+		}
+		after, afterData = before, beforeData
+		if len(h.Commits)-1-before < lastChangeLinearScanLength || before == 0 {
+			continue
+		}
+
+		// Commits[after] has the latest hashes; bisect the older commits for the last which doesn't.
+		Progressf("Bisecting %d older commits for the last change to %s", after, key)
+		oldestData, same, err := hashesAt(0)
+		if err != nil {
+			return nil, err
+		}
+		if same {
+			return nil, nil
+		}
+		lo, loData := 0, oldestData
+		for after-lo > 1 {
+			mid := lo + (after-lo)/2
+			midData, same, err := hashesAt(mid)
+			if err != nil {
+				return nil, err
+			}
+			if same {
+				after, afterData = mid, midData
+			} else {
+				lo, loData = mid, midData
+			}
+		}
+		return h.change(key, lo, loData, after, afterData), nil
+	}
+	return nil, nil
+}
+
+// change returns the change to the hashes of the target key between Commits[before] and
+// Commits[after].
+func (h *HashHistory) change(key string, before int, beforeData *PersistedHashData, after int, afterData *PersistedHashData) *HashChange {
+	return &HashChange{
+		Before:              h.Commits[before],
+		After:               h.Commits[after],
+		BeforeHashes:        beforeData.Hashes[key],
+		AfterHashes:         afterData.Hashes[key],
+		BazelReleaseChanged: beforeData.BazelRelease != afterData.BazelRelease,
+	}
+}
+
+// NoisyTarget is a target whose hashes often changed between consecutive hash files of a
+// HashHistory without any file under its package changing, which suggests that its hash depends on
+// nondeterministic or over-broad inputs.
+type NoisyTarget struct {
+	Label string
+	// Comparisons is how many pairs of consecutive hash files both had the target, Changes how many
+	// of those its hashes differed in, and UnexplainedChanges how many of those no file under its
+	// package changed in.
+	Comparisons        int
+	Changes            int
+	UnexplainedChanges int
+	// Causes are the suggested causes of the unexplained changes, with how many of them each
+	// applies to, most frequent first.
+	Causes []NoisyTargetCause
+}
+
+// NoisyTargetCause is a suggested cause of the unexplained changes to a NoisyTarget's hashes.
+type NoisyTargetCause struct {
+	Description string
+	Changes     int
+}
+
+// NoisyTargets returns the targets in the main repository whose hashes changed without any file
+// under their package changing in at least minPercent percent of the pairs of consecutive hash
+// files which had them, and at least minChanges times, most often first. For a store with a hash
+// file for every commit, that is the percentage of commits which changed them.
+// Pairs of hash files computed with different Bazel releases or hash functions, which generally
+// change every hash, are skipped. Causes are suggested from the breakdowns of the targets' hashes,
+// which are only recorded in hash files written with -include-breakdown.
+func (h *HashHistory) NoisyTargets(minPercent int, minChanges int) ([]NoisyTarget, error) {
+	targets := make(map[string]*NoisyTarget)
+	causes := make(map[string]map[string]int)
+	var previous *PersistedHashData
+	for i := range h.Commits {
+		data, err := h.load(i)
+		if err != nil {
+			return nil, err
+		}
+		if previous == nil {
+			previous = data
+			continue
+		}
+		before, after := previous, data
+		previous = data
+		if before.BazelRelease != after.BazelRelease || before.EffectiveHashFunction() != after.EffectiveHashFunction() {
+			Progressf("Skipping %s..%s, whose hashes were computed with different Bazel releases or hash functions", h.Commits[i-1], h.Commits[i])
+			continue
+		}
+		changedDirectories, err := h.changedDirectories(h.Commits[i-1], h.Commits[i])
+		if err != nil {
+			return nil, err
+		}
+		for key, afterHashes := range after.Hashes {
+			beforeHashes, ok := before.Hashes[key]
+			if !ok {
+				continue
+			}
+			l, err := label.Parse(key)
+			if err != nil || (l.Repo != "" && l.Repo != "@") {
+				// Files in other repositories aren't in the history.
+				continue
+			}
+			target, ok := targets[key]
+			if !ok {
+				target = &NoisyTarget{Label: key}
+				targets[key] = target
+				causes[key] = make(map[string]int)
+			}
+			target.Comparisons++
+			if reflect.DeepEqual(beforeHashes, afterHashes) {
+				continue
+			}
+			target.Changes++
+			if changedDirectories[l.Pkg] {
+				continue
+			}
+			target.UnexplainedChanges++
+			change := HashChange{BeforeHashes: beforeHashes, AfterHashes: afterHashes}
+			for _, cause := range unexplainedChangeCauses(before.Targets[key], after.Targets[key], change.Configurations()) {
+				causes[key][cause]++
+			}
+		}
+	}
+
+	var noisy []NoisyTarget
+	for key, target := range targets {
+		if target.UnexplainedChanges < minChanges || target.UnexplainedChanges*100 < minPercent*target.Comparisons {
+			continue
+		}
+		for description, changes := range causes[key] {
+			target.Causes = append(target.Causes, NoisyTargetCause{Description: description, Changes: changes})
+		}
+		sort.Slice(target.Causes, func(i, j int) bool {
+			if target.Causes[i].Changes != target.Causes[j].Changes {
+				return target.Causes[i].Changes > target.Causes[j].Changes
+			}
+			return target.Causes[i].Description < target.Causes[j].Description
+		})
+		if target.Changes == target.Comparisons {
+			target.Causes = append([]NoisyTargetCause{{Description: "its hash changed between every pair of hash files, which suggests a nondeterministic input, e.g. a timestamp, stamping or an unpinned external dependency", Changes: target.UnexplainedChanges}}, target.Causes...)
+		}
+		noisy = append(noisy, *target)
+	}
+	sort.Slice(noisy, func(i, j int) bool {
+		// Compare the fractions of unexplained changes without dividing.
+		left := noisy[i].UnexplainedChanges * noisy[j].Comparisons
+		right := noisy[j].UnexplainedChanges * noisy[i].Comparisons
+		if left != right {
+			return left > right
+		}
+		return noisy[i].Label < noisy[j].Label
+	})
+	return noisy, nil
+}
+
+// changedDirectories returns the directories containing, directly or indirectly, the files which
+// differ between the commits before and after, relative to the workspace root, which is "".
+func (h *HashHistory) changedDirectories(before string, after string) (map[string]bool, error) {
+	changedFiles, err := runToLines(h.workspacePath, "git", "diff", "--name-only", "--no-renames", before, after)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files changed between %s and %s: %w", before, after, err)
+	}
+	directories := map[string]bool{}
+	for _, file := range changedFiles {
+		for dir := path.Dir(file); !directories[dir]; dir = path.Dir(dir) {
+			directories[dir] = true
+			if dir == "." {
+				break
+			}
+		}
+	}
+	directories[""] = directories["."]
+	return directories, nil
+}
+
+// unexplainedChangeCauses suggests causes of the hashes of a target with before and after
+// information changing in configurations, when no file under its package changed.
+func unexplainedChangeCauses(before PersistedTargetInfo, after PersistedTargetInfo, configurations []string) []string {
+	causes := make(map[string]bool)
+	for _, configuration := range configurations {
+		beforeBreakdown, inBefore := before.Breakdowns[configuration]
+		afterBreakdown, inAfter := after.Breakdowns[configuration]
+		if !inBefore || !inAfter {
+			if len(before.Breakdowns) == 0 || len(after.Breakdowns) == 0 {
+				causes["unknown, as the breakdown of its hash wasn't recorded (see -include-breakdown)"] = true
+			} else {
+				causes["the configurations it's built in changed, e.g. because of a flag change"] = true
+			}
+			continue
+		}
+		if beforeBreakdown.RuleImplementation != afterBreakdown.RuleImplementation {
+			causes["its rule implementation changed, e.g. the .bzl files defining its rule"] = true
+		}
+		if beforeBreakdown.Attributes != afterBreakdown.Attributes {
+			causes["its attributes changed without its BUILD file changing, e.g. values computed by a macro or select() from volatile inputs"] = true
+		}
+		for source, afterDigest := range afterBreakdown.Sources {
+			if beforeDigest, ok := beforeBreakdown.Sources[source]; ok && beforeDigest != afterDigest {
+				causes[fmt.Sprintf("source file %s, outside its package, changed", source)] = true
+			}
+		}
+		for dependency, afterHashes := range afterBreakdown.Dependencies {
+			if beforeHashes, ok := beforeBreakdown.Dependencies[dependency]; ok && !reflect.DeepEqual(beforeHashes, afterHashes) {
+				causes[fmt.Sprintf("dependency %s changed, which may itself be noisy, or an over-broad dependency", dependency)] = true
+			}
+		}
+		if len(beforeBreakdown.Sources) != len(afterBreakdown.Sources) || len(beforeBreakdown.Dependencies) != len(afterBreakdown.Dependencies) {
+			causes["its direct inputs were added or removed without its BUILD file changing, e.g. by a glob or macro"] = true
+		}
+	}
+	var sorted []string
+	for cause := range causes {
+		sorted = append(sorted, cause)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// historyLabelKey returns the key hash files record the hashes of the target labelString under.
+func historyLabelKey(labelString string) (string, error) {
+	l, err := label.Parse(labelString)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse label %s: %w", labelString, err)
+	}
+	if l.Relative {
+		return "", fmt.Errorf("label %s must be absolute, e.g. //foo:bar", labelString)
+	}
+	return l.String(), nil
+}
@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newHashHistoryRepository returns a git repository with a commit for each of hashes, and its
+// commits, oldest first. Each commit has a hash file in store in which //foo:bar has the hash
+// hashes[i] in configurationChecksum, unless it is "" (it doesn't exist) or "-" (no hash file).
+func newHashHistoryRepository(t *testing.T, store string, hashes []string) (string, []string) {
+	var contents []map[string]string
+	for i := range hashes {
+		contents = append(contents, map[string]string{"a.txt": fmt.Sprint(i)})
+	}
+	dir, _ := newGitRepository(t, contents...)
+	commits := strings.Fields(runGit(t, dir, "rev-list", "--reverse", "HEAD"))
+	for i, hash := range hashes {
+		if hash == "-" {
+			continue
+		}
+		data := &PersistedHashData{
+			SchemaVersion: PersistedHashesSchemaVersion,
+			Revision:      commits[i],
+			BazelRelease:  "release 7.1.0",
+			Hashes:        map[string]map[string]string{"//foo:baz": {configurationChecksum: "00"}},
+		}
+		if hash != "" {
+			data.Hashes["//foo:bar"] = map[string]string{configurationChecksum: hash}
+		}
+		if err := PersistHashes(StoredHashesLocation(store, commits[i]), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, commits
+}
+
+func TestHashHistoryLastChange(t *testing.T) {
+	for name, tc := range map[string]struct {
+		hashes []string
+		// wantBefore and wantAfter are the indices of the commits the change is between, or -1 if
+		// there's no change.
+		wantBefore int
+		wantAfter  int
+	}{
+		"recent":    {hashes: []string{"01", "01", "01", "01", "01", "01", "01", "01", "01", "01", "02", "02"}, wantBefore: 9, wantAfter: 10},
+		"bisected":  {hashes: []string{"01", "01", "02", "02", "02", "02", "02", "02", "02", "02", "02", "02"}, wantBefore: 1, wantAfter: 2},
+		"gaps":      {hashes: []string{"01", "-", "-", "-", "-", "02", "-", "-", "-", "-", "-", "02"}, wantBefore: 0, wantAfter: 5},
+		"added":     {hashes: []string{"", "", "", "01", "01", "01", "01", "01", "01", "01", "01", "01"}, wantBefore: 2, wantAfter: 3},
+		"removed":   {hashes: []string{"01", "01", "01", "01", "01", "01", "01", "01", "01", "01", "01", ""}, wantBefore: 10, wantAfter: 11},
+		"unchanged": {hashes: []string{"01", "01", "01", "01", "01", "01", "01", "01", "01", "01", "01", "01"}, wantBefore: -1, wantAfter: -1},
+		"no hashes": {hashes: []string{"-", "-"}, wantBefore: -1, wantAfter: -1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := t.TempDir()
+			dir, commits := newHashHistoryRepository(t, store, tc.hashes)
+			history, err := NewHashHistory(dir, store, "HEAD", "", "fail", nil)
+			if err != nil {
+				t.Fatalf("Error finding hash files: %v", err)
+			}
+			got, err := history.LastChange("//foo:bar")
+			if err != nil {
+				t.Fatalf("Error finding last change: %v", err)
+			}
+			if tc.wantBefore < 0 {
+				if got != nil {
+					t.Fatalf("Wrong last change: want none got %+v", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("Wrong last change: want %d..%d got none", tc.wantBefore, tc.wantAfter)
+			}
+			if got.Before != commits[tc.wantBefore] || got.After != commits[tc.wantAfter] {
+				t.Fatalf("Wrong last change: want %s..%s got %s..%s", commits[tc.wantBefore], commits[tc.wantAfter], got.Before, got.After)
+			}
+			if want := []string{configurationChecksum}; !reflect.DeepEqual(want, got.Configurations()) {
+				t.Fatalf("Wrong changed configurations: want %v got %v", want, got.Configurations())
+			}
+		})
+	}
+}
+
+func TestHashHistoryTargetChanges(t *testing.T) {
+	store := t.TempDir()
+	dir, commits := newHashHistoryRepository(t, store, []string{"", "01", "-", "01", "02", "02", "01", ""})
+	history, err := NewHashHistory(dir, store, "HEAD", "", "fail", nil)
+	if err != nil {
+		t.Fatalf("Error finding hash files: %v", err)
+	}
+	changes, err := history.TargetChanges("//foo:bar")
+	if err != nil {
+		t.Fatalf("Error finding changes: %v", err)
+	}
+	var got []string
+	for _, change := range changes {
+		got = append(got, fmt.Sprintf("%s..%s %v->%v", change.Before, change.After, change.BeforeHashes[configurationChecksum], change.AfterHashes[configurationChecksum]))
+	}
+	want := []string{
+		fmt.Sprintf("%s..%s ->01", commits[0], commits[1]),
+		fmt.Sprintf("%s..%s 01->02", commits[3], commits[4]),
+		fmt.Sprintf("%s..%s 02->01", commits[5], commits[6]),
+		fmt.Sprintf("%s..%s 01->", commits[6], commits[7]),
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong changes: want %v got %v", want, got)
+	}
+}
+
+func TestHashHistoryNoisyTargets(t *testing.T) {
+	dir, _ := newGitRepository(t, map[string]string{"other.txt": "0"})
+	if err := os.Mkdir(filepath.Join(dir, "foo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Only the fourth commit changes a file under //foo.
+	for i, file := range []string{"foo/BUILD", "other.txt", "other.txt", "foo/BUILD", "other.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, file), []byte(fmt.Sprint(i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		runGit(t, dir, "add", ".")
+		runGit(t, dir, "commit", "-q", "-m", fmt.Sprintf("commit %d", i))
+	}
+	commits := strings.Fields(runGit(t, dir, "rev-list", "--reverse", "HEAD"))[1:]
+
+	store := t.TempDir()
+	for i, commit := range commits {
+		explained := "00"
+		if i >= 3 {
+			explained = "01"
+		}
+		data := &PersistedHashData{
+			SchemaVersion: PersistedHashesSchemaVersion,
+			Revision:      commit,
+			BazelRelease:  "release 7.1.0",
+			Hashes: map[string]map[string]string{
+				"//foo:noisy":     {configurationChecksum: fmt.Sprintf("%02d", i)},
+				"//foo:stable":    {configurationChecksum: "00"},
+				"//foo:explained": {configurationChecksum: explained},
+				"@ext//:lib":      {configurationChecksum: fmt.Sprintf("%02d", i)},
+			},
+			Targets: map[string]PersistedTargetInfo{
+				"//foo:noisy": {
+					Kind: "genrule",
+					Breakdowns: map[string]PersistedHashBreakdown{
+						configurationChecksum: {RuleImplementation: "aa", Attributes: fmt.Sprintf("%02d", i)},
+					},
+				},
+			},
+		}
+		if err := PersistHashes(StoredHashesLocation(store, commit), data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history, err := NewHashHistory(dir, store, "HEAD", "", "fail", nil)
+	if err != nil {
+		t.Fatalf("Error finding hash files: %v", err)
+	}
+
+	got, err := history.NoisyTargets(50, 3)
+	if err != nil {
+		t.Fatalf("Error finding noisy targets: %v", err)
+	}
+	want := []NoisyTarget{{
+		Label:              "//foo:noisy",
+		Comparisons:        4,
+		Changes:            4,
+		UnexplainedChanges: 3,
+		Causes: []NoisyTargetCause{
+			{Description: "its hash changed between every pair of hash files, which suggests a nondeterministic input, e.g. a timestamp, stamping or an unpinned external dependency", Changes: 3},
+			{Description: "its attributes changed without its BUILD file changing, e.g. values computed by a macro or select() from volatile inputs", Changes: 3},
+		},
+	}}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong noisy targets: want %+v got %+v", want, got)
+	}
+
+	if got, err := history.NoisyTargets(80, 1); err != nil || len(got) != 0 {
+		t.Fatalf("Wrong noisy targets changing in at least 80%% of comparisons: want none got %+v (error %v)", got, err)
+	}
+}
+
+func TestHashHistoryRejectsRelativeLabels(t *testing.T) {
+	store := t.TempDir()
+	dir, _ := newHashHistoryRepository(t, store, []string{"01"})
+	history, err := NewHashHistory(dir, store, "HEAD", "", "fail", nil)
+	if err != nil {
+		t.Fatalf("Error finding hash files: %v", err)
+	}
+	if _, err := history.LastChange(":bar"); err == nil {
+		t.Fatalf("Expected an error finding the last change to a relative label")
+	}
+}
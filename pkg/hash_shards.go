@@ -0,0 +1,139 @@
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// PersistedHashesShardedSchemaVersion is the version of shard index files written by
+// PersistShardedHashesAs, which older versions would misread as snapshots without any targets.
+// Version 6 is version 3 with the changes of PersistedHashesSchemaVersion 4.
+const PersistedHashesShardedSchemaVersion = 6
+
+// PersistShardedHashesAs is PersistSignedHashesAs, which, if shards is more than 1, splits the
+// hashes of data deterministically (by a hash of each label) into that many shard files, and writes
+// an index of them to path, so that huge snapshots can be written and uploaded in parallel-friendly
+// pieces. Shards are written alongside path, with -NNNNN-of-NNNNN inserted before its extension.
+// The index holds all of data other than its hashes and targets, and each shard is signed in the
+// same way as the index. LoadPersistedHashes reads sharded snapshots transparently.
+func PersistShardedHashesAs(path string, data *PersistedHashData, shards int, format string, compression string, signingKey ed25519.PrivateKey) error {
+	if shards <= 1 {
+		return PersistSignedHashesAs(path, data, format, compression, signingKey)
+	}
+	if compression == "auto" || compression == "" {
+		compression = CompressionForPath(path)
+	}
+	shardData := make([]PersistedHashData, shards)
+	for i := range shardData {
+		shardData[i] = PersistedHashData{
+			SchemaVersion:            PersistedHashesSchemaVersion,
+			HashFunction:             data.HashFunction,
+			Revision:                 data.Revision,
+			Dirty:                    data.Dirty,
+			BazelRelease:             data.BazelRelease,
+			ConfigurationEnumeration: data.ConfigurationEnumeration,
+			Hashes:                   make(map[string]map[string]string),
+		}
+	}
+	for labelString, hashes := range data.Hashes {
+		shard := &shardData[shardForLabel(labelString, shards)]
+		shard.Hashes[labelString] = hashes
+		if info, ok := data.Targets[labelString]; ok {
+			if shard.Targets == nil {
+				shard.Targets = make(map[string]PersistedTargetInfo)
+			}
+			shard.Targets[labelString] = info
+		}
+	}
+
+	index := *data
+	index.SchemaVersion = PersistedHashesShardedSchemaVersion
+	index.Hashes = make(map[string]map[string]string)
+	index.Targets = nil
+	index.Shards = make([]string, 0, shards)
+	// Write the shards first, so that the index never refers to shards which don't exist.
+	for i := range shardData {
+		location := shardLocation(path, i, shards)
+		if err := PersistSignedHashesAs(location, &shardData[i], format, compression, signingKey); err != nil {
+			return err
+		}
+		relativeLocation, err := relativeBaseLocation(path, location)
+		if err != nil {
+			return err
+		}
+		index.Shards = append(index.Shards, relativeLocation)
+	}
+	return PersistSignedHashesAs(path, &index, format, compression, signingKey)
+}
+
+// shardForLabel returns which of shards the hashes of labelString are written to.
+func shardForLabel(labelString string, shards int) int {
+	sum := sha256.Sum256([]byte(labelString))
+	return int(binary.BigEndian.Uint32(sum[:4]) % uint32(shards))
+}
+
+// shardLocation returns the location of shard of shards for the index at path, e.g.
+// hashes-00001-of-00004.json.gz for hashes.json.gz.
+func shardLocation(path string, shard int, shards int) string {
+	dir, base := "", path
+	if i := strings.LastIndexAny(path, "/"+string(filepath.Separator)); i >= 0 {
+		dir, base = path[:i+1], path[i+1:]
+	}
+	name, extension := base, ""
+	if i := strings.Index(base, "."); i > 0 {
+		name, extension = base[:i], base[i:]
+	}
+	return fmt.Sprintf("%s%s-%05d-of-%05d%s", dir, name, shard, shards, extension)
+}
+
+// loadPersistedHashesLocation is loadPersistedHashesFile, which, if the file at path is a shard
+// index written by PersistShardedHashesAs, also reads its shards and merges them into the returned
+// data. Labels in more than one shard are handled according to conflictPolicy.
+func loadPersistedHashesLocation(path string, conflictPolicy string, verifyKey ed25519.PublicKey) (*PersistedHashData, error) {
+	data, err := loadPersistedHashesFile(path, conflictPolicy, verifyKey)
+	if err != nil || len(data.Shards) == 0 {
+		return data, err
+	}
+	merged := *data
+	merged.Shards = nil
+	merged.Hashes = make(map[string]map[string]string)
+	merged.Targets = nil
+	if merged.Base != "" {
+		merged.SchemaVersion = PersistedHashesDeltaSchemaVersion
+	} else {
+		merged.SchemaVersion = PersistedHashesSchemaVersion
+	}
+	for _, shard := range data.Shards {
+		shardData, err := loadPersistedHashesFile(resolveBaseLocation(path, shard), conflictPolicy, verifyKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load shard of hashes from %s: %w", path, err)
+		}
+		if len(shardData.Shards) > 0 || shardData.Base != "" {
+			return nil, fmt.Errorf("failed to load hashes from %s: its shard %s is itself a shard index or delta", path, shard)
+		}
+		if got, want := shardData.EffectiveHashFunction(), data.EffectiveHashFunction(); got != want {
+			return nil, fmt.Errorf("failed to load hashes from %s: its shard %s was computed with hash function %s, but the index with %s", path, shard, got, want)
+		}
+		for labelString, hashes := range shardData.Hashes {
+			if _, ok := merged.Hashes[labelString]; !ok {
+				merged.Hashes[labelString] = make(map[string]string)
+			}
+			for configuration, hash := range hashes {
+				if err := addPersistedHash(merged.Hashes, labelString, configuration, hash, conflictPolicy); err != nil {
+					return nil, fmt.Errorf("failed to load hashes from %s: %w", path, err)
+				}
+			}
+		}
+		for labelString, info := range shardData.Targets {
+			if merged.Targets == nil {
+				merged.Targets = make(map[string]PersistedTargetInfo)
+			}
+			merged.Targets[labelString] = info
+		}
+	}
+	return &merged, nil
+}
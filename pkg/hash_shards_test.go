@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPersistShardedHashesRoundTrips(t *testing.T) {
+	want := &PersistedHashData{
+		SchemaVersion: PersistedHashesSchemaVersion,
+		HashFunction:  PersistedHashFunction,
+		Revision:      "0123456789abcdef0123456789abcdef01234567",
+		Hashes:        make(map[string]map[string]string),
+		Targets:       make(map[string]PersistedTargetInfo),
+	}
+	for i := 0; i < 20; i++ {
+		labelString := fmt.Sprintf("//java/example:Lib%d", i)
+		want.Hashes[labelString] = map[string]string{configurationChecksum: fmt.Sprintf("%06x", i)}
+		want.Targets[labelString] = PersistedTargetInfo{Kind: "java_library"}
+	}
+	want.Hashes["//java/example:Lib.java"] = map[string]string{"": "aabbcc"}
+
+	for _, format := range []string{"json", "proto"} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "hashes."+format+".gz")
+		if err := PersistShardedHashesAs(path, want, 4, format, "auto", nil); err != nil {
+			t.Fatalf("Failed to persist sharded hashes: %v", err)
+		}
+		for i := 0; i < 4; i++ {
+			shardPath := filepath.Join(dir, fmt.Sprintf("hashes-%05d-of-00004.%s.gz", i, format))
+			shard, err := LoadPersistedHashes(shardPath, "fail")
+			if err != nil {
+				t.Fatalf("Failed to load shard %s: %v", shardPath, err)
+			}
+			if len(shard.Hashes) == 0 || len(shard.Hashes) == len(want.Hashes) {
+				t.Fatalf("Wrong number of hashes in shard %s: %d of %d", shardPath, len(shard.Hashes), len(want.Hashes))
+			}
+		}
+		got, err := LoadPersistedHashes(path, "fail")
+		if err != nil {
+			t.Fatalf("Failed to load sharded hashes: %v", err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong hashes from %s shards: want %+v got %+v", format, want, got)
+		}
+	}
+}
+
+func TestLoadPersistedHashesWithShardedBase(t *testing.T) {
+	dir := t.TempDir()
+	base := &PersistedHashData{
+		SchemaVersion: PersistedHashesSchemaVersion,
+		Revision:      "0123456789abcdef0123456789abcdef01234567",
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib":   {configurationChecksum: "aabbcc"},
+			"//java/example:Greeting.java": {"": "ddeeff"},
+			"//java/example:Removed":       {configurationChecksum: "001122"},
+		},
+	}
+	if err := PersistShardedHashesAs(filepath.Join(dir, "base.json"), base, 2, "json", "none", nil); err != nil {
+		t.Fatalf("Failed to persist sharded base: %v", err)
+	}
+	want := &PersistedHashData{
+		SchemaVersion: PersistedHashesSchemaVersion,
+		Revision:      "89abcdef0123456789abcdef0123456789abcdef",
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib":   {configurationChecksum: "aabbcc"},
+			"//java/example:Greeting.java": {"": "334455"},
+		},
+	}
+	path := filepath.Join(dir, "delta.json")
+	if err := PersistHashes(path, want.DeltaFrom(base, "base.json")); err != nil {
+		t.Fatalf("Failed to persist delta: %v", err)
+	}
+	got, err := LoadPersistedHashes(path, "fail")
+	if err != nil {
+		t.Fatalf("Failed to load delta against sharded base: %v", err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong hashes: want %+v got %+v", want, got)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "base-00001-of-00002.json")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPersistedHashes(path, "fail"); err == nil {
+		t.Fatalf("Expected an error loading hashes with a missing shard")
+	}
+}
+
+func TestShardLocation(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/tmp/hashes.json.gz", "/tmp/hashes-00002-of-00010.json.gz"},
+		{"hashes", "hashes-00002-of-00010"},
+		{"gs://bucket/dir.d/hashes.pb", "gs://bucket/dir.d/hashes-00002-of-00010.pb"},
+	} {
+		if got := shardLocation(tc.path, 2, 10); got != tc.want {
+			t.Fatalf("Wrong shard location for %s: want %v got %v", tc.path, tc.want, got)
+		}
+	}
+}
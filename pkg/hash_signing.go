@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SignatureLocation returns where the signature of the hash file at location is stored: alongside
+// it, with a .sig suffix.
+func SignatureLocation(location string) string {
+	return location + ".sig"
+}
+
+// LoadSigningKey reads an ed25519 private key from a PEM file in PKCS #8 form, as written by
+// `openssl genpkey -algorithm ed25519`.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key from %s: %w", path, err)
+	}
+	ed25519Key, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key in %s is a %T, but only ed25519 keys are supported", path, key)
+	}
+	return ed25519Key, nil
+}
+
+// LoadVerifyKey reads an ed25519 public key from a PEM file in PKIX form, as written by
+// `openssl pkey -pubout`.
+func LoadVerifyKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse verify key from %s: %w", path, err)
+	}
+	ed25519Key, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("verify key in %s is a %T, but only ed25519 keys are supported", path, key)
+	}
+	return ed25519Key, nil
+}
+
+func readPEM(path string, blockType string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key from %s: %w", path, err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("failed to read key from %s: expected a PEM %s block", path, blockType)
+	}
+	return block.Bytes, nil
+}
+
+// signHashFile stores the signature by key of content, which is the stored content of the hash file
+// at location, at SignatureLocation(location). The signature is base64 encoded, as cosign's
+// detached signatures are.
+func signHashFile(location string, content []byte, key ed25519.PrivateKey) error {
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, content)) + "\n"
+	sigLocation := SignatureLocation(location)
+	if err := HashStoreFor(sigLocation).Put(sigLocation, []byte(signature)); err != nil {
+		return fmt.Errorf("failed to write signature of %s: %w", location, err)
+	}
+	return nil
+}
+
+// verifyHashFile returns an error unless content, which was read from the hash file at location,
+// has a valid signature by key at SignatureLocation(location).
+func verifyHashFile(location string, content []byte, key ed25519.PublicKey) error {
+	sigLocation := SignatureLocation(location)
+	encoded, err := HashStoreFor(sigLocation).Get(sigLocation)
+	if err != nil {
+		return fmt.Errorf("failed to read signature of %s: %w", location, err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return fmt.Errorf("failed to decode signature of %s: %w", location, err)
+	}
+	if !ed25519.Verify(key, content, signature) {
+		return fmt.Errorf("signature of %s is invalid: it may have been tampered with, or signed with a different key", location)
+	}
+	return nil
+}
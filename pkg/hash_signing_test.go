@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSignedHashesRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	signingKeyPath := writePEMKey(t, dir, "signing.pem", "PRIVATE KEY", mustDER(x509.MarshalPKCS8PrivateKey(privateKey)))
+	verifyKeyPath := writePEMKey(t, dir, "verify.pem", "PUBLIC KEY", mustDER(x509.MarshalPKIXPublicKey(publicKey)))
+
+	signingKey, err := LoadSigningKey(signingKeyPath)
+	if err != nil {
+		t.Fatalf("Error loading signing key: %v", err)
+	}
+	verifyKey, err := LoadVerifyKey(verifyKeyPath)
+	if err != nil {
+		t.Fatalf("Error loading verify key: %v", err)
+	}
+
+	want := &PersistedHashData{
+		SchemaVersion: PersistedHashesSchemaVersion,
+		Revision:      "0123456789abcdef0123456789abcdef01234567",
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib": {configurationChecksum: "aabbcc"},
+		},
+	}
+	path := filepath.Join(dir, "hashes.json")
+	if err := PersistSignedHashesAs(path, want, "json", "none", signingKey); err != nil {
+		t.Fatalf("Error persisting hashes: %v", err)
+	}
+	got, err := LoadVerifiedPersistedHashes(path, "fail", verifyKey)
+	if err != nil {
+		t.Fatalf("Error loading signed hashes: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Wrong hashes: want %v got %v", want, got)
+	}
+
+	otherPublicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	if _, err := LoadVerifiedPersistedHashes(path, "fail", otherPublicKey); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("Expected an invalid signature error verifying with a different key, got %v", err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading hashes: %v", err)
+	}
+	tampered := strings.Replace(string(content), "aabbcc", "ddeeff", 1)
+	if err := os.WriteFile(path, []byte(tampered), 0644); err != nil {
+		t.Fatalf("Error writing hashes: %v", err)
+	}
+	if _, err := LoadVerifiedPersistedHashes(path, "fail", verifyKey); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("Expected an invalid signature error for tampered hashes, got %v", err)
+	}
+
+	unsignedPath := filepath.Join(dir, "unsigned.json")
+	if err := PersistHashesAs(unsignedPath, want, "json", "none"); err != nil {
+		t.Fatalf("Error persisting hashes: %v", err)
+	}
+	if _, err := LoadVerifiedPersistedHashes(unsignedPath, "fail", verifyKey); err == nil {
+		t.Fatalf("Expected an error verifying unsigned hashes")
+	}
+}
+
+func TestLoadSigningKeyRejectsPublicKeys(t *testing.T) {
+	dir := t.TempDir()
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	path := writePEMKey(t, dir, "verify.pem", "PUBLIC KEY", mustDER(x509.MarshalPKIXPublicKey(publicKey)))
+	if _, err := LoadSigningKey(path); err == nil {
+		t.Fatalf("Expected an error loading a public key as a signing key")
+	}
+}
+
+func writePEMKey(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+	return path
+}
+
+func mustDER(der []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return der
+}
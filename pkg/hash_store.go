@@ -0,0 +1,240 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// HashStore is somewhere persisted hash files can be stored, so that e.g. CI jobs can share them.
+type HashStore interface {
+	// Get returns the content of the file at location.
+	Get(location string) ([]byte, error)
+	// Put stores content as the file at location, replacing any existing file.
+	Put(location string, content []byte) error
+	// Exists returns whether there is a file at location.
+	Exists(location string) (bool, error)
+}
+
+// HashStoreFor returns the HashStore for location, which is either a local path, an s3:// URI or a
+// gs:// URI.
+func HashStoreFor(location string) HashStore {
+	switch {
+	case strings.HasPrefix(location, "s3://"):
+		return S3HashStore{AWSPath: "aws"}
+	case strings.HasPrefix(location, "gs://"):
+		return GCSHashStore{GcloudPath: "gcloud"}
+	}
+	return LocalHashStore{}
+}
+
+// LocalHashStore stores hash files on the local filesystem.
+type LocalHashStore struct{}
+
+func (LocalHashStore) Get(location string) ([]byte, error) {
+	return os.ReadFile(location)
+}
+
+func (LocalHashStore) Put(location string, content []byte) error {
+	// Write to a temporary file and rename it into place, so that an interrupted write never leaves
+	// a partial file for Exists to find.
+	f, err := os.CreateTemp(filepath.Dir(location), "."+filepath.Base(location)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), location)
+}
+
+func (LocalHashStore) Exists(location string) (bool, error) {
+	if _, err := os.Stat(location); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// S3HashStore stores hash files in S3 using the AWS CLI, so that the usual AWS credentials and
+// configuration apply.
+type S3HashStore struct {
+	// AWSPath is the aws binary to run.
+	AWSPath string
+}
+
+func (s S3HashStore) Get(location string) ([]byte, error) {
+	return runWithStdin(nil, s.AWSPath, "s3", "cp", "--only-show-errors", location, "-")
+}
+
+func (s S3HashStore) Put(location string, content []byte) error {
+	_, err := runWithStdin(content, s.AWSPath, "s3", "cp", "--only-show-errors", "-", location)
+	return err
+}
+
+func (s S3HashStore) Exists(location string) (bool, error) {
+	// aws s3 ls lists everything with location as a prefix, and exits 1 without any output if there's
+	// nothing. Anything else, e.g. missing credentials, is an error rather than a missing file.
+	listing, stderr, err := runCommand(nil, s.AWSPath, "s3", "ls", location)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && len(bytes.TrimSpace(listing)) == 0 && len(bytes.TrimSpace(stderr)) == 0 {
+			return false, nil
+		}
+		return false, commandError(s.AWSPath, []string{"s3", "ls", location}, err, stderr)
+	}
+	name := path.Base(location)
+	for _, line := range strings.Split(string(listing), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[len(fields)-1] == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GCSHashStore stores hash files in Google Cloud Storage using the gcloud CLI, so that the usual
+// gcloud credentials and configuration apply.
+type GCSHashStore struct {
+	// GcloudPath is the gcloud binary to run.
+	GcloudPath string
+}
+
+func (s GCSHashStore) Get(location string) ([]byte, error) {
+	return runWithStdin(nil, s.GcloudPath, "storage", "cat", location)
+}
+
+func (s GCSHashStore) Put(location string, content []byte) error {
+	_, err := runWithStdin(content, s.GcloudPath, "storage", "cp", "-", location)
+	return err
+}
+
+func (s GCSHashStore) Exists(location string) (bool, error) {
+	// gcloud storage ls exits non-zero, saying that the URL "matched no objects", if nothing matches.
+	// Anything else, e.g. missing credentials, is an error rather than a missing file.
+	listing, stderr, err := runCommand(nil, s.GcloudPath, "storage", "ls", location)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && bytes.Contains(stderr, []byte("matched no objects")) {
+			return false, nil
+		}
+		return false, commandError(s.GcloudPath, []string{"storage", "ls", location}, err, stderr)
+	}
+	return strings.TrimSpace(string(listing)) == location, nil
+}
+
+// FindStoredHashes looks for a hash file for rev, or the closest of its first-parent ancestors
+// which has one, in store, where the hash file for a commit is <store>/<sha>.json. At most
+// maxAncestors ancestors are considered, or all of them if maxAncestors is zero.
+// It returns the commit the hash file is for and its location, or empty strings if there is none.
+func FindStoredHashes(workspacePath string, store string, rev string, maxAncestors int) (sha string, location string, err error) {
+	args := []string{"rev-list", "--first-parent"}
+	if maxAncestors > 0 {
+		args = append(args, fmt.Sprintf("--max-count=%d", maxAncestors+1))
+	}
+	commits, err := runToLines(workspacePath, "git", append(args, rev)...)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to list ancestors of %s: %w", rev, err)
+	}
+	hashStore := HashStoreFor(store)
+	for _, commit := range commits {
+		location := StoredHashesLocation(store, commit)
+		exists, err := hashStore.Exists(location)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to check for hashes at %s: %w", location, err)
+		}
+		if exists {
+			return commit, location, nil
+		}
+	}
+	return "", "", nil
+}
+
+// StoredHashesLocation is the location of the hash file for the commit sha in store.
+func StoredHashesLocation(store string, sha string) string {
+	if HashStoreFor(store) == (LocalHashStore{}) {
+		return filepath.Join(store, sha+".json")
+	}
+	return strings.TrimSuffix(store, "/") + "/" + sha + ".json"
+}
+
+// StoredCommitIndexLocation is the location of the index of the commits of branch which have hash
+// files in store, maintained by WatchBranch: their shas, one per line, oldest first.
+func StoredCommitIndexLocation(store string, branch string) string {
+	name := url.PathEscape(branch) + ".commits"
+	if HashStoreFor(store) == (LocalHashStore{}) {
+		return filepath.Join(store, name)
+	}
+	return strings.TrimSuffix(store, "/") + "/" + name
+}
+
+// LoadStoredCommitIndex returns the commits in the index of branch in store, oldest first, or nil if
+// there is no index.
+func LoadStoredCommitIndex(store string, branch string) ([]string, error) {
+	location := StoredCommitIndexLocation(store, branch)
+	hashStore := HashStoreFor(store)
+	exists, err := hashStore.Exists(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for commit index at %s: %w", location, err)
+	}
+	if !exists {
+		return nil, nil
+	}
+	content, err := hashStore.Get(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read commit index from %s: %w", location, err)
+	}
+	return strings.Fields(string(content)), nil
+}
+
+// RequireCommand returns an error saying that user, e.g. a flag, needs command if it isn't on the
+// PATH, so that invocations fail before doing any work rather than once they need it.
+func RequireCommand(command string, user string) error {
+	if _, err := exec.LookPath(command); err != nil {
+		return fmt.Errorf("%s requires the %s command, which isn't on the PATH: %w", user, command, err)
+	}
+	return nil
+}
+
+// runWithStdin runs arg0 with args, passing stdin as its standard input, and returns its standard
+// output.
+func runWithStdin(stdin []byte, arg0 string, args ...string) ([]byte, error) {
+	stdout, stderr, err := runCommand(stdin, arg0, args...)
+	if err != nil {
+		return nil, commandError(arg0, args, err, stderr)
+	}
+	return stdout, nil
+}
+
+// runCommand runs arg0 with args, passing stdin as its standard input, and returns its standard
+// output and standard error, and the error of running it, unwrapped, so that callers can tell how
+// it failed.
+func runCommand(stdin []byte, arg0 string, args ...string) ([]byte, []byte, error) {
+	cmd := exec.Command(arg0, args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// commandError describes err, the error of running arg0 with args, which wrote stderr.
+func commandError(arg0 string, args []string, err error, stderr []byte) error {
+	return fmt.Errorf("failed to run %s %s: %w. Stderr: %v", arg0, strings.Join(args, " "), err, string(stderr))
+}
@@ -0,0 +1,178 @@
+package pkg
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestHashStoreFor(t *testing.T) {
+	for location, want := range map[string]HashStore{
+		"/tmp/hashes.json":            LocalHashStore{},
+		"hashes.json.gz":              LocalHashStore{},
+		"s3://bucket/hashes.json":     S3HashStore{AWSPath: "aws"},
+		"gs://bucket/dir/hashes.json": GCSHashStore{GcloudPath: "gcloud"},
+	} {
+		if got := HashStoreFor(location); !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong hash store for %s: want %#v got %#v", location, want, got)
+		}
+	}
+}
+
+func TestS3HashStoreRoundTrips(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake aws command is a shell script")
+	}
+	dir := t.TempDir()
+	bucket := filepath.Join(dir, "bucket")
+	// Fakes `aws s3 cp --only-show-errors <src> <dst>` by mapping s3://bucket/ to a local directory.
+	script := `#!/bin/sh
+src="$4"
+dst="$5"
+if [ "$src" = "-" ]; then
+  cat > "` + bucket + `/${dst#s3://bucket/}"
+else
+  cat "` + bucket + `/${src#s3://bucket/}"
+fi
+`
+	aws := filepath.Join(dir, "aws")
+	if err := os.WriteFile(aws, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(bucket, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	store := S3HashStore{AWSPath: aws}
+	if err := store.Put("s3://bucket/hashes.json", []byte("content")); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	got, err := store.Get("s3://bucket/hashes.json")
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	if want := "content"; want != string(got) {
+		t.Fatalf("Wrong content: want %v got %v", want, string(got))
+	}
+	if _, err := store.Get("s3://bucket/missing.json"); err == nil {
+		t.Fatalf("Expected error getting missing file")
+	}
+}
+
+func TestHashStoreExists(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake aws and gcloud commands are shell scripts")
+	}
+	dir := t.TempDir()
+	// Each fake prints its arguments' last element's listing, as aws s3 ls and gcloud storage ls
+	// would, or fails as they do when there's nothing to list or they can't list anything.
+	fake := func(name string, script string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	aws := fake("aws", `case "$3" in
+  s3://bucket/present.json) echo "2024-01-01 00:00:00       1234 present.json" ;;
+  s3://bucket/missing.json) exit 1 ;;
+  *) echo "An error occurred (AccessDenied) when calling the ListObjectsV2 operation: Access Denied" >&2; exit 1 ;;
+esac
+`)
+	gcloud := fake("gcloud", `case "$3" in
+  gs://bucket/present.json) echo "$3" ;;
+  gs://bucket/missing.json) echo "ERROR: (gcloud.storage.ls) One or more URLs matched no objects." >&2; exit 1 ;;
+  *) echo "ERROR: (gcloud.storage.ls) There was a problem refreshing your current auth tokens" >&2; exit 1 ;;
+esac
+`)
+
+	for name, tc := range map[string]struct {
+		store    HashStore
+		location string
+		want     bool
+		wantErr  bool
+	}{
+		"s3 present":         {store: S3HashStore{AWSPath: aws}, location: "s3://bucket/present.json", want: true},
+		"s3 missing":         {store: S3HashStore{AWSPath: aws}, location: "s3://bucket/missing.json", want: false},
+		"s3 access denied":   {store: S3HashStore{AWSPath: aws}, location: "s3://other/hashes.json", wantErr: true},
+		"s3 no binary":       {store: S3HashStore{AWSPath: filepath.Join(dir, "no-aws")}, location: "s3://bucket/present.json", wantErr: true},
+		"gcs present":        {store: GCSHashStore{GcloudPath: gcloud}, location: "gs://bucket/present.json", want: true},
+		"gcs missing":        {store: GCSHashStore{GcloudPath: gcloud}, location: "gs://bucket/missing.json", want: false},
+		"gcs expired tokens": {store: GCSHashStore{GcloudPath: gcloud}, location: "gs://other/hashes.json", wantErr: true},
+		"gcs no binary":      {store: GCSHashStore{GcloudPath: filepath.Join(dir, "no-gcloud")}, location: "gs://bucket/present.json", wantErr: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := tc.store.Exists(tc.location)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error checking for %s, got %v", tc.location, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error checking for %s: %v", tc.location, err)
+			}
+			if tc.want != got {
+				t.Fatalf("Wrong existence of %s: want %v got %v", tc.location, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFindStoredHashes(t *testing.T) {
+	workspace := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = workspace
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=td", "GIT_AUTHOR_EMAIL=td@example.com", "GIT_COMMITTER_NAME=td", "GIT_COMMITTER_EMAIL=td@example.com")
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("Failed to run git %v: %v. Output: %s", args, err, output)
+		}
+		return strings.TrimSpace(string(output))
+	}
+	git("init", "-q")
+	var commits []string
+	for _, message := range []string{"first", "second", "third"} {
+		git("commit", "-q", "--allow-empty", "-m", message)
+		commits = append(commits, git("rev-parse", "HEAD"))
+	}
+
+	store := t.TempDir()
+	if err := os.WriteFile(StoredHashesLocation(store, commits[0]), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sha, location, err := FindStoredHashes(workspace, store, commits[2], 0)
+	if err != nil {
+		t.Fatalf("Failed to find stored hashes: %v", err)
+	}
+	if want := commits[0]; want != sha {
+		t.Fatalf("Wrong commit with stored hashes: want %v got %v", want, sha)
+	}
+	if want := filepath.Join(store, commits[0]+".json"); want != location {
+		t.Fatalf("Wrong location of stored hashes: want %v got %v", want, location)
+	}
+
+	if sha, _, err := FindStoredHashes(workspace, store, commits[2], 1); err != nil || sha != "" {
+		t.Fatalf("Expected no stored hashes within one ancestor, got %v (error: %v)", sha, err)
+	}
+}
+
+func TestRequireCommand(t *testing.T) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RequireCommand(executable, "-flag"); err != nil {
+		t.Fatalf("Wrong result requiring existing command: want nil got %v", err)
+	}
+	err = RequireCommand("target-determinator-no-such-command", "-flag")
+	if err == nil || !strings.Contains(err.Error(), "-flag requires the target-determinator-no-such-command command") {
+		t.Fatalf("Wrong error requiring missing command: got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package pkg
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// StartHeartbeat logs a line every interval until stop is called, so that CI watchdogs which kill
+// jobs which produce no output for a while can tell a slow run from a hung one. If file is set,
+// the current time is also written to it immediately and then every interval, for watchdogs which
+// check a file's modification time instead.
+func StartHeartbeat(interval time.Duration, file string) (stop func()) {
+	start := time.Now()
+	done := make(chan struct{})
+	warned := false
+	touch := func(now time.Time) {
+		if file == "" {
+			return
+		}
+		if err := os.WriteFile(file, []byte(now.UTC().Format(time.RFC3339)+"\n"), 0644); err != nil && !warned {
+			log.Printf("WARN: Failed to write heartbeat file %s: %v", file, err)
+			warned = true
+		}
+	}
+	touch(start)
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				Progressf("Heartbeat: still running after %v", now.Sub(start).Round(time.Second))
+				touch(now)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStartHeartbeatWritesFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "heartbeat")
+	stop := StartHeartbeat(10*time.Millisecond, file)
+	defer stop()
+
+	first, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Expected heartbeat file to be written immediately: %v", err)
+	}
+	if _, err := time.Parse(time.RFC3339, string(first[:len(first)-1])); err != nil {
+		t.Fatalf("Wrong heartbeat file content: want an RFC3339 time got %q", string(first))
+	}
+
+	stop()
+	// Stopping twice is fine.
+	stop()
+}
@@ -0,0 +1,185 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// InfraFilePolicy describes how changes to infrastructure files, whose effects on targets may not
+// be visible in the build graph, are handled.
+type InfraFilePolicy struct {
+	// Pattern matches paths relative to the workspace root. Patterns without a "/" match file names
+	// in any directory, e.g. "*.bzl". Patterns ending in "/**" match everything under a directory,
+	// e.g. "tools/ci/**". Other patterns are matched against the whole path with path.Match.
+	Pattern string `json:"pattern"`
+	// Action is what to do when a matching file changes:
+	// - "all" - consider all targets affected.
+	// - "targets" - consider Targets affected.
+	// - "subtree" - consider all targets in packages under Subtree affected.
+	// - "ignore" - do nothing, e.g. to override a broader pattern.
+	// - "exclude-subtree" - do nothing, and never consider targets in packages under Subtree
+	//   affected.
+	Action string `json:"action"`
+	// Targets are the labels to consider affected for the "targets" action.
+	Targets []string `json:"targets,omitempty"`
+	// Subtree is the package path, e.g. "java/example", for the "subtree" and "exclude-subtree"
+	// actions. An empty Subtree is the whole workspace.
+	Subtree string `json:"subtree,omitempty"`
+}
+
+// DefaultInfraFilePolicies are the policies used when none are configured.
+var DefaultInfraFilePolicies = []InfraFilePolicy{
+	{Pattern: "WORKSPACE", Action: "all"},
+	{Pattern: "WORKSPACE.bazel", Action: "all"},
+	{Pattern: "WORKSPACE.bzlmod", Action: "all"},
+	{Pattern: "MODULE.bazel", Action: "all"},
+	{Pattern: "MODULE.bazel.lock", Action: "all"},
+	{Pattern: ".bazelrc", Action: "all"},
+	{Pattern: ".bazelversion", Action: "all"},
+	{Pattern: "*.bzl", Action: "all"},
+}
+
+// infraFilePolicies returns the policies to apply in single-revision mode.
+func infraFilePolicies(context *Context) []InfraFilePolicy {
+	policies := context.InfraFilePolicies
+	if policies == nil {
+		policies = DefaultInfraFilePolicies
+	}
+	return append(append([]InfraFilePolicy{}, policies...), context.PolicyMarkers...)
+}
+
+// preciseInfraFilePolicies returns the policies to apply on top of comparing hashes, which are
+// only those which were explicitly configured.
+func preciseInfraFilePolicies(context *Context) []InfraFilePolicy {
+	return append(append([]InfraFilePolicy{}, context.InfraFilePolicies...), context.PolicyMarkers...)
+}
+
+// excludingSubtrees wraps callback so that it isn't called for targets under subtrees.
+func excludingSubtrees(subtrees []string, callback WalkCallback) WalkCallback {
+	if len(subtrees) == 0 {
+		return callback
+	}
+	return func(l label.Label, differences []Difference, configuredTarget *analysis.ConfiguredTarget) {
+		for _, subtree := range subtrees {
+			if isInSubtree(l, subtree) {
+				return
+			}
+		}
+		callback(l, differences, configuredTarget)
+	}
+}
+
+// LoadInfraFilePolicies reads a JSON list of InfraFilePolicy from path.
+func LoadInfraFilePolicies(path string) ([]InfraFilePolicy, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read infra file policies from %s: %w", path, err)
+	}
+	var policies []InfraFilePolicy
+	if err := json.Unmarshal(content, &policies); err != nil {
+		return nil, fmt.Errorf("failed to parse infra file policies from %s: %w", path, err)
+	}
+	var labels labelValidator
+	for i, policy := range policies {
+		switch policy.Action {
+		case "all", "ignore", "subtree", "exclude-subtree":
+		case "targets":
+			for j, target := range policy.Targets {
+				labels.parse(fmt.Sprintf("[%d] (%s) targets[%d]", i, policy.Pattern, j), target)
+			}
+		default:
+			return nil, fmt.Errorf("unexpected action for infra file policy %s - allowed values: all|targets|subtree|ignore|exclude-subtree, saw: %s", policy.Pattern, policy.Action)
+		}
+	}
+	if err := labels.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse infra file policies from %s: %w", path, err)
+	}
+	return policies, nil
+}
+
+// InfraFileEffect is the combined effect of the policies matching some changed files.
+type InfraFileEffect struct {
+	// AllAffectedBecause is a changed file which causes all targets to be affected, if any.
+	AllAffectedBecause string
+	// Targets are the labels which are affected because of changed files.
+	Targets []label.Label
+	// Subtrees are the package paths under which all targets are affected because of changed files.
+	Subtrees []string
+}
+
+// ApplyInfraFilePolicies determines the effect of changedFiles (relative to the workspace root)
+// according to policies. Where several policies match a file, the last one applies, so more
+// specific overrides should come after general policies.
+func ApplyInfraFilePolicies(policies []InfraFilePolicy, changedFiles []string) (InfraFileEffect, error) {
+	var effect InfraFileEffect
+	for _, changedFile := range changedFiles {
+		var matching *InfraFilePolicy
+		for i := range policies {
+			if matchesInfraFilePattern(policies[i].Pattern, changedFile) {
+				matching = &policies[i]
+			}
+		}
+		if matching == nil {
+			continue
+		}
+		switch matching.Action {
+		case "all":
+			if effect.AllAffectedBecause == "" {
+				effect.AllAffectedBecause = changedFile
+			}
+		case "targets":
+			for _, target := range matching.Targets {
+				l, err := label.Parse(target)
+				if err != nil {
+					return effect, fmt.Errorf("failed to parse target %s of infra file policy %s: %w", target, matching.Pattern, err)
+				}
+				effect.Targets = append(effect.Targets, l)
+			}
+		case "subtree":
+			effect.Subtrees = append(effect.Subtrees, matching.Subtree)
+		}
+	}
+	return effect, nil
+}
+
+// ExcludedSubtrees returns the package paths under which targets should never be considered
+// affected according to policies.
+func ExcludedSubtrees(policies []InfraFilePolicy) []string {
+	var subtrees []string
+	for _, policy := range policies {
+		if policy.Action == "exclude-subtree" {
+			subtrees = append(subtrees, policy.Subtree)
+		}
+	}
+	return subtrees
+}
+
+// isInSubtree returns whether l is in a package under the package path subtree in the main
+// repository.
+func isInSubtree(l label.Label, subtree string) bool {
+	if l.Repo != "" {
+		return false
+	}
+	return subtree == "" || l.Pkg == subtree || strings.HasPrefix(l.Pkg, subtree+"/")
+}
+
+func matchesInfraFilePattern(pattern string, changedFile string) bool {
+	if pattern == "**" {
+		return true
+	}
+	if dir, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return strings.HasPrefix(changedFile, dir+"/")
+	}
+	if !strings.Contains(pattern, "/") {
+		matched, _ := path.Match(pattern, path.Base(changedFile))
+		return matched
+	}
+	matched, _ := path.Match(pattern, changedFile)
+	return matched
+}
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+func TestApplyInfraFilePolicies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "infra.json")
+	content := `[
+		{"pattern": "*.bzl", "action": "all"},
+		{"pattern": "tools/lint/*.bzl", "action": "ignore"},
+		{"pattern": ".github/**", "action": "targets", "targets": ["//ci:checks"]}
+	]`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write policies: %v", err)
+	}
+	policies, err := LoadInfraFilePolicies(path)
+	if err != nil {
+		t.Fatalf("Failed to load policies: %v", err)
+	}
+
+	for name, tc := range map[string]struct {
+		changedFiles []string
+		want         InfraFileEffect
+	}{
+		"unmatched": {
+			changedFiles: []string{"java/example/Greeting.java"},
+			want:         InfraFileEffect{},
+		},
+		"overridden": {
+			changedFiles: []string{"tools/lint/defs.bzl"},
+			want:         InfraFileEffect{},
+		},
+		"all": {
+			changedFiles: []string{"tools/lint/defs.bzl", "java/defs.bzl"},
+			want:         InfraFileEffect{AllAffectedBecause: "java/defs.bzl"},
+		},
+		"targets": {
+			changedFiles: []string{".github/workflows/ci.yaml"},
+			want:         InfraFileEffect{Targets: []label.Label{mustParseLabel("//ci:checks")}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := ApplyInfraFilePolicies(policies, tc.changedFiles)
+			if err != nil {
+				t.Fatalf("Failed to apply policies: %v", err)
+			}
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("Wrong effect: want %+v got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestLoadInfraFilePoliciesRejectsUnknownAction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "infra.json")
+	if err := os.WriteFile(path, []byte(`[{"pattern": "*.bzl", "action": "everything"}]`), 0644); err != nil {
+		t.Fatalf("Failed to write policies: %v", err)
+	}
+	if _, err := LoadInfraFilePolicies(path); err == nil {
+		t.Fatalf("Expected unknown action to be rejected")
+	}
+}
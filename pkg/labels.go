@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// InvalidLabel is an entry of an input which isn't a valid label.
+type InvalidLabel struct {
+	// Location is where the entry is in its input, e.g. "line 3".
+	Location string
+	Label    string
+	Err      error
+}
+
+// InvalidLabelsError reports every invalid label in an input at once, so that they can all be fixed
+// together, rather than one per run.
+type InvalidLabelsError struct {
+	Invalid []InvalidLabel
+}
+
+func (e *InvalidLabelsError) Error() string {
+	var b strings.Builder
+	if len(e.Invalid) == 1 {
+		b.WriteString("1 invalid label:")
+	} else {
+		fmt.Fprintf(&b, "%d invalid labels:", len(e.Invalid))
+	}
+	for _, invalid := range e.Invalid {
+		fmt.Fprintf(&b, "\n  %s: %q: %v", invalid.Location, invalid.Label, invalid.Err)
+	}
+	return b.String()
+}
+
+// labelValidator parses and normalizes the labels read from an input, collecting any invalid ones
+// to report together.
+type labelValidator struct {
+	invalid []InvalidLabel
+}
+
+// parse parses labelString, found at location in the input, returning false if it is invalid.
+// Different spellings of the same label (e.g. "//foo" and "//foo:foo") are normalized to the same
+// label.
+func (v *labelValidator) parse(location string, labelString string) (label.Label, bool) {
+	l, err := label.Parse(labelString)
+	if err != nil {
+		v.invalid = append(v.invalid, InvalidLabel{Location: location, Label: labelString, Err: err})
+		return label.NoLabel, false
+	}
+	return l, true
+}
+
+// Err returns an *InvalidLabelsError listing the invalid labels parsed, or nil if there were none.
+func (v *labelValidator) Err() error {
+	if len(v.invalid) == 0 {
+		return nil
+	}
+	return &InvalidLabelsError{Invalid: v.invalid}
+}
+
+// jsonLocation describes the location in the JSON document content of the token at offset, or
+// preceded by the separators at offset, for errors.
+func jsonLocation(content []byte, offset int64) string {
+	for offset < int64(len(content)) && strings.IndexByte(" \t\r\n,:", content[offset]) >= 0 {
+		offset++
+	}
+	before := content[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Sprintf("line %d, column %d", line, column)
+}
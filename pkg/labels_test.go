@@ -0,0 +1,54 @@
+package pkg
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func invalidLabelLocations(t *testing.T, err error) []string {
+	var invalidLabels *InvalidLabelsError
+	if !errors.As(err, &invalidLabels) {
+		t.Fatalf("Wrong error: want an InvalidLabelsError got %v", err)
+	}
+	var locations []string
+	for _, invalid := range invalidLabels.Invalid {
+		locations = append(locations, invalid.Location+" "+invalid.Label)
+	}
+	return locations
+}
+
+func TestLoadResultsReportsAllInvalidLabels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.txt")
+	if err := os.WriteFile(path, []byte("//java/example:GreetingLib\n//java/example:a:b\n\n//java/example:GreetingTest\n//java/example:x:y extra\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadResults(path)
+	want := []string{"line 2 //java/example:a:b", "line 5 //java/example:x:y"}
+	if got := invalidLabelLocations(t, err); !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong invalid labels: want %v got %v", want, got)
+	}
+}
+
+func TestLoadPersistedHashesReportsAllInvalidLabels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.json")
+	content := `{
+  "revision": "0123456789abcdef0123456789abcdef01234567",
+  "hashes": {
+    "//java/example:GreetingLib": {"cfg": "aa"},
+    "//java/example:a:b": {"cfg": "bb"},
+    "//java/example:c:d": {"cfg": "cc"}
+  },
+  "removed": ["//java/example:e:f"]
+}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadPersistedHashes(path, "fail")
+	want := []string{"line 5, column 5 //java/example:a:b", "line 6, column 5 //java/example:c:d", "removed[0] //java/example:e:f"}
+	if got := invalidLabelLocations(t, err); !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong invalid labels: want %v got %v", want, got)
+	}
+}
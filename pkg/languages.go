@@ -0,0 +1,40 @@
+package pkg
+
+import (
+	"strings"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+)
+
+// languageRulePrefixes maps prefixes of rule kinds to the language of rules of that kind.
+var languageRulePrefixes = map[string]string{
+	"cc_":     "cc",
+	"go_":     "go",
+	"java_":   "java",
+	"kt_":     "kotlin",
+	"proto_":  "proto",
+	"py_":     "python",
+	"rust_":   "rust",
+	"scala_":  "scala",
+	"sh_":     "shell",
+	"swift_":  "swift",
+	"ts_":     "typescript",
+	"js_":     "javascript",
+	"nodejs_": "javascript",
+}
+
+// OtherLanguage is the language of targets whose language isn't recognised.
+const OtherLanguage = "other"
+
+// LanguageOf classifies configuredTarget by language, according to the prefix of its rule kind,
+// e.g. go_library and go_test are "go". Targets which aren't rules, or whose kind isn't recognised,
+// are OtherLanguage.
+func LanguageOf(configuredTarget *analysis.ConfiguredTarget) string {
+	ruleClass := configuredTarget.GetTarget().GetRule().GetRuleClass()
+	for prefix, language := range languageRulePrefixes {
+		if strings.HasPrefix(ruleClass, prefix) {
+			return language
+		}
+	}
+	return OtherLanguage
+}
@@ -0,0 +1,36 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestLanguageOf(t *testing.T) {
+	for ruleClass, want := range map[string]string{
+		"go_library":    "go",
+		"java_test":     "java",
+		"py_binary":     "python",
+		"genrule":       OtherLanguage,
+		"golden_test":   OtherLanguage,
+		"proto_library": "proto",
+	} {
+		configuredTarget := &analysis.ConfiguredTarget{Target: &build.Target{
+			Type: build.Target_RULE.Enum(),
+			Rule: &build.Rule{Name: proto.String("//foo:bar"), RuleClass: proto.String(ruleClass)},
+		}}
+		if got := LanguageOf(configuredTarget); want != got {
+			t.Fatalf("Wrong language for %s: want %v got %v", ruleClass, want, got)
+		}
+	}
+
+	sourceFile := &analysis.ConfiguredTarget{Target: &build.Target{
+		Type:       build.Target_SOURCE_FILE.Enum(),
+		SourceFile: &build.SourceFile{Name: proto.String("//foo:bar.go")},
+	}}
+	if got := LanguageOf(sourceFile); got != OtherLanguage {
+		t.Fatalf("Wrong language for source file: want %v got %v", OtherLanguage, got)
+	}
+}
@@ -0,0 +1,84 @@
+package pkg
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ChangedExternalRepositories maps the changes to package manager files among changedFiles since
+// rev to the names of the external repositories generated from them, by the conventions of gazelle
+// (go.mod and go.sum) and rules_python (requirements*.txt and requirements*.lock).
+// The names are apparent repository names, which should be matched with repositoryNameMatches.
+func ChangedExternalRepositories(workspacePath string, rev LabelledGitRev, changedFiles []string) ([]string, error) {
+	var repositories []string
+	for _, changedFile := range changedFiles {
+		var nameOf func(line string) string
+		base := path.Base(changedFile)
+		switch {
+		case base == "go.mod" || base == "go.sum":
+			nameOf = goRepositoryName
+		case strings.HasPrefix(base, "requirements") && (strings.HasSuffix(base, ".txt") || strings.HasSuffix(base, ".lock")):
+			nameOf = pipRepositoryName
+		default:
+			continue
+		}
+		lines, err := runToLines(workspacePath, "git", "diff", "--unified=0", rev.GitRevision.Sha, "--", changedFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to diff %s since %s: %w", changedFile, rev, err)
+		}
+		for _, line := range lines {
+			if strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---") || (!strings.HasPrefix(line, "+") && !strings.HasPrefix(line, "-")) {
+				continue
+			}
+			if name := nameOf(line[1:]); name != "" {
+				repositories = append(repositories, name)
+			}
+		}
+	}
+	return repositories, nil
+}
+
+// goRepositoryName returns the name gazelle gives the repository for the module required on a
+// line of go.mod or go.sum, e.g. "github.com/foo/bar v1.2.3" is "com_github_foo_bar".
+func goRepositoryName(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) > 0 && fields[0] == "require" {
+		fields = fields[1:]
+	}
+	if len(fields) < 2 || !strings.HasPrefix(fields[1], "v") {
+		return ""
+	}
+	modulePath := fields[0]
+	segments := strings.Split(modulePath, "/")
+	hostSegments := strings.Split(segments[0], ".")
+	for i, j := 0, len(hostSegments)-1; i < j; i, j = i+1, j-1 {
+		hostSegments[i], hostSegments[j] = hostSegments[j], hostSegments[i]
+	}
+	name := strings.Join(append(hostSegments, segments[1:]...), "_")
+	return strings.ToLower(nonRepositoryNameCharacters.ReplaceAllString(name, "_"))
+}
+
+var (
+	nonRepositoryNameCharacters = regexp.MustCompile(`[^A-Za-z0-9_]`)
+	requirementPattern          = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9._-]*)(\[[^\]]*\])?\s*==`)
+)
+
+// pipRepositoryName returns the normalized name rules_python uses in the name of the repository for
+// the package pinned on a line of a requirements file, e.g. "Foo.Bar==1.0" is "foo_bar".
+func pipRepositoryName(line string) string {
+	match := requirementPattern.FindStringSubmatch(strings.TrimSpace(line))
+	if match == nil {
+		return ""
+	}
+	return strings.ToLower(nonRepositoryNameCharacters.ReplaceAllString(match[1], "_"))
+}
+
+// repositoryNameMatches returns whether the repository named repo (which may be a canonical name)
+// was generated for the package whose repository name is name.
+// rules_python prefixes the names of the repositories it generates with the name of the hub, so
+// suffixes after an underscore also match.
+func repositoryNameMatches(repo string, name string) bool {
+	return repo == name || strings.HasSuffix(repo, "+"+name) || strings.HasSuffix(repo, "~"+name) || strings.HasSuffix(repo, "_"+name)
+}
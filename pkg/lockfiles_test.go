@@ -0,0 +1,33 @@
+package pkg
+
+import "testing"
+
+func TestGoRepositoryName(t *testing.T) {
+	for line, want := range map[string]string{
+		"github.com/google/uuid v1.6.0 h1:abc=":               "com_github_google_uuid",
+		"github.com/google/uuid v1.6.0/go.mod h1:abc=":        "com_github_google_uuid",
+		"\tgolang.org/x/sys v0.20.0 // indirect":              "org_golang_x_sys",
+		"require github.com/hashicorp/go-version v1.6.0":      "com_github_hashicorp_go_version",
+		"github.com/Foo/bar/v2 v2.0.0":                        "com_github_foo_bar_v2",
+		"go 1.21":                                             "",
+		"module github.com/bazel-contrib/target-determinator": "",
+	} {
+		if got := goRepositoryName(line); want != got {
+			t.Fatalf("Wrong repository name for %q: want %v got %v", line, want, got)
+		}
+	}
+}
+
+func TestPipRepositoryName(t *testing.T) {
+	for line, want := range map[string]string{
+		"requests==2.31.0":            "requests",
+		"Typing.Extensions==4.0.0 \\": "typing_extensions",
+		"uvicorn[standard]==0.29.0":   "uvicorn",
+		"    --hash=sha256:abc":       "",
+		"# via -r requirements.in":    "",
+	} {
+		if got := pipRepositoryName(line); want != got {
+			t.Fatalf("Wrong repository name for %q: want %v got %v", line, want, got)
+		}
+	}
+}
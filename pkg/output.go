@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// ANSI escape codes to color human-facing output written to terminals with. See ShouldColor.
+const (
+	ColorRed    = "\x1b[31m"
+	ColorGreen  = "\x1b[32m"
+	ColorYellow = "\x1b[33m"
+	colorReset  = "\x1b[0m"
+)
+
+// Colorize returns s wrapped in the escape codes to show it in color, or s itself if color is "".
+func Colorize(s string, color string) string {
+	if color == "" {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// ShouldColor returns whether to color human-facing output written to f: only if it is a terminal,
+// and neither noColor nor the NO_COLOR environment variable (see https://no-color.org) is set.
+func ShouldColor(f *os.File, noColor bool) bool {
+	if noColor || os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// quiet is whether Progressf drops messages. See SetQuiet.
+var quiet atomic.Bool
+
+// SetQuiet sets whether progress messages and summaries logged with Progressf are dropped, e.g. for
+// --quiet. Everything logged with the log package directly, i.e. warnings and errors, including
+// those of log.Fatal, is always logged.
+func SetQuiet(q bool) {
+	quiet.Store(q)
+}
+
+// Progressf logs a progress message or summary like log.Printf, unless SetQuiet(true) was called.
+// Warnings and errors should be logged with the log package instead, so that they're never dropped.
+func Progressf(format string, args ...any) {
+	if quiet.Load() {
+		return
+	}
+	log.Output(2, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// OutputStartupOpts are the --output_base and --output_user_root startup options passed to Bazel,
+// if any.
+type OutputStartupOpts struct {
+	OutputBase     string
+	OutputUserRoot string
+}
+
+// NormalizeOutputStartupOpts returns startupOpts with any --output_base and --output_user_root
+// options (in either --flag=value or --flag value form) rewritten as --flag=value with absolute
+// paths, resolving relative paths against workingDirectory. This matters because TD runs Bazel in
+// other directories too (e.g. git worktrees for the before revision), where relative paths would
+// refer to different output bases. It returns an error if either option is given more than once
+// with different values.
+func NormalizeOutputStartupOpts(workingDirectory string, startupOpts []string) ([]string, OutputStartupOpts, error) {
+	var requested OutputStartupOpts
+	normalized := make([]string, 0, len(startupOpts))
+	for i := 0; i < len(startupOpts); i++ {
+		opt := startupOpts[i]
+		var target *string
+		var name string
+		for _, candidate := range []struct {
+			name   string
+			target *string
+		}{
+			{"--output_base", &requested.OutputBase},
+			{"--output_user_root", &requested.OutputUserRoot},
+		} {
+			if opt == candidate.name || strings.HasPrefix(opt, candidate.name+"=") {
+				name, target = candidate.name, candidate.target
+			}
+		}
+		if target == nil {
+			normalized = append(normalized, opt)
+			continue
+		}
+		value, hasValue := strings.CutPrefix(opt, name+"=")
+		if !hasValue {
+			if i+1 == len(startupOpts) {
+				return nil, OutputStartupOpts{}, fmt.Errorf("startup option %s is missing a value", name)
+			}
+			i++
+			value = startupOpts[i]
+		}
+		if value == "" {
+			return nil, OutputStartupOpts{}, fmt.Errorf("startup option %s must not be empty", name)
+		}
+		if !filepath.IsAbs(value) {
+			value = filepath.Join(workingDirectory, value)
+		}
+		value = filepath.Clean(value)
+		if *target != "" && *target != value {
+			return nil, OutputStartupOpts{}, fmt.Errorf("startup option %s was given more than once, with different values %s and %s", name, *target, value)
+		}
+		*target = value
+		normalized = append(normalized, name+"="+value)
+	}
+	return normalized, requested, nil
+}
+
+// CheckOutputBase returns an error if outputBase, as reported by Bazel, isn't consistent with the
+// requested output startup options, e.g. because a wrapper script overrode them.
+func CheckOutputBase(outputBase string, requested OutputStartupOpts) error {
+	resolved := canonicalPath(outputBase)
+	if requested.OutputBase != "" && resolved != canonicalPath(requested.OutputBase) {
+		return fmt.Errorf("bazel is using output base %s, but --output_base=%s was requested", outputBase, requested.OutputBase)
+	}
+	if requested.OutputUserRoot != "" && requested.OutputBase == "" {
+		if rel, err := filepath.Rel(canonicalPath(requested.OutputUserRoot), resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("bazel is using output base %s, which isn't under the requested --output_user_root=%s", outputBase, requested.OutputUserRoot)
+		}
+	}
+	return nil
+}
+
+// canonicalPath resolves symlinks in path if it exists, so that e.g. paths through a symlink to a
+// tmpfs compare equal to the paths Bazel reports.
+func canonicalPath(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return filepath.Clean(path)
+}
@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeOutputStartupOpts(t *testing.T) {
+	got, requested, err := NormalizeOutputStartupOpts("/workspace", []string{
+		"--host_jvm_args=-Xmx1g", "--output_base", "../ob", "--output_user_root=/tmpfs/root/", "--output_base=/ob",
+	})
+	if err != nil {
+		t.Fatalf("Error normalizing startup options: %v", err)
+	}
+	want := []string{"--host_jvm_args=-Xmx1g", "--output_base=/ob", "--output_user_root=/tmpfs/root", "--output_base=/ob"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Wrong startup options: want %v got %v", want, got)
+	}
+	wantRequested := OutputStartupOpts{OutputBase: "/ob", OutputUserRoot: "/tmpfs/root"}
+	if requested != wantRequested {
+		t.Fatalf("Wrong requested options: want %v got %v", wantRequested, requested)
+	}
+}
+
+func TestNormalizeOutputStartupOptsRejectsInconsistentOptions(t *testing.T) {
+	for _, opts := range [][]string{
+		{"--output_base=/a", "--output_base=/b"},
+		{"--output_user_root"},
+		{"--output_base="},
+	} {
+		if _, _, err := NormalizeOutputStartupOpts("/workspace", opts); err == nil {
+			t.Fatalf("Expected an error for %v", opts)
+		}
+	}
+}
+
+func TestCheckOutputBase(t *testing.T) {
+	dir := t.TempDir()
+	outputBase := filepath.Join(dir, "root", "0123abcd")
+	if err := os.MkdirAll(outputBase, 0755); err != nil {
+		t.Fatalf("Error creating output base: %v", err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(filepath.Join(dir, "root"), link); err != nil {
+		t.Fatalf("Error creating symlink: %v", err)
+	}
+
+	for _, tc := range []struct {
+		requested OutputStartupOpts
+		wantErr   bool
+	}{
+		{OutputStartupOpts{}, false},
+		{OutputStartupOpts{OutputBase: outputBase}, false},
+		{OutputStartupOpts{OutputBase: filepath.Join(link, "0123abcd")}, false},
+		{OutputStartupOpts{OutputBase: filepath.Join(dir, "other")}, true},
+		{OutputStartupOpts{OutputUserRoot: link}, false},
+		{OutputStartupOpts{OutputUserRoot: filepath.Join(dir, "other")}, true},
+	} {
+		if err := CheckOutputBase(outputBase, tc.requested); (err != nil) != tc.wantErr {
+			t.Fatalf("Wrong result checking %s against %v: want error %v got %v", outputBase, tc.requested, tc.wantErr, err)
+		}
+	}
+}
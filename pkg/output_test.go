@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestProgressfQuiet(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+		SetQuiet(false)
+	}()
+
+	Progressf("Processing revision %s", "abc")
+	SetQuiet(true)
+	Progressf("Finished after %v", "1s")
+	log.Printf("WARN: Failed to write summary: %v", "disk full")
+	want := "Processing revision abc\nWARN: Failed to write summary: disk full\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("Wrong quiet log: want %q got %q", want, got)
+	}
+}
+
+func TestQuietFatal(t *testing.T) {
+	if os.Getenv("TD_TEST_QUIET_FATAL") != "" {
+		SetQuiet(true)
+		Progressf("Processing revision %s", "abc")
+		log.Fatalf("%d target hashes differ from %s", 3, "hashes.json")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestQuietFatal$")
+	cmd.Env = append(os.Environ(), "TD_TEST_QUIET_FATAL=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err == nil {
+		t.Fatalf("Expected log.Fatalf to exit non-zero")
+	}
+	if !strings.Contains(stderr.String(), "3 target hashes differ from hashes.json") {
+		t.Fatalf("Wrong stderr: want the fatal message got %q", stderr.String())
+	}
+	if strings.Contains(stderr.String(), "Processing revision") {
+		t.Fatalf("Wrong stderr: want no progress messages got %q", stderr.String())
+	}
+}
+
+func TestColorize(t *testing.T) {
+	if got := Colorize("+ //foo:bar", ""); got != "+ //foo:bar" {
+		t.Fatalf("Wrong uncolored text: want %q got %q", "+ //foo:bar", got)
+	}
+	if want, got := "\x1b[32m+ //foo:bar\x1b[0m", Colorize("+ //foo:bar", ColorGreen); got != want {
+		t.Fatalf("Wrong colored text: want %q got %q", want, got)
+	}
+}
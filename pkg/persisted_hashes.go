@@ -0,0 +1,1161 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	ss "github.com/bazel-contrib/target-determinator/common/sorted_set"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"google.golang.org/protobuf/proto"
+)
+
+// PersistedHashesSchemaVersion is the version of the format of the files written by PersistHashes.
+// It should be incremented whenever a change means that older versions can't read new files
+// correctly.
+// Version 4 replaced IncompatibleTargets with IncompatibleConfigurations.
+const PersistedHashesSchemaVersion = 4
+
+// PersistedHashesDeltaSchemaVersion is the version of delta files written with DeltaFrom, which
+// older versions would misread as full snapshots. Version 5 is version 2 with the changes of
+// version 4.
+const PersistedHashesDeltaSchemaVersion = 5
+
+// SupportedPersistedHashesSchemaVersions are the versions of files which LoadPersistedHashes can
+// read.
+var SupportedPersistedHashesSchemaVersions = []int{1, 2, 3, 4, 5, 6}
+
+// SnapshotSchemaVersion is the schema version of the hash snapshots written by this version of the
+// tool, for consumers which read or write them without going through this package.
+const SnapshotSchemaVersion = PersistedHashesSchemaVersion
+
+// PersistedHashFunction identifies how target hashes are computed. It should be changed whenever a
+// change to hashing means that hashes computed by older versions can't be compared with new ones, so
+// that persisted hashes computed the old way are recomputed rather than reporting every target as
+// affected. Files written before it was recorded have none, and used "sha256-v1".
+const PersistedHashFunction = "sha256-v1"
+
+// PersistedHashData is a snapshot of the hashes of the matching targets at a single revision, which
+// can be written to a file and later used in place of processing that revision again.
+type PersistedHashData struct {
+	// SchemaVersion is the PersistedHashesSchemaVersion the file was written with. Files written
+	// before versioning was introduced have none, and are version 1.
+	SchemaVersion int `json:"schema_version,omitempty"`
+	// HashFunction is the PersistedHashFunction the hashes were computed with.
+	HashFunction string `json:"hash_function,omitempty"`
+	// Revision is the git sha the hashes were computed at.
+	Revision string `json:"revision"`
+	// Dirty is whether the hashes were computed from a working directory with local changes on top
+	// of Revision.
+	Dirty bool `json:"dirty,omitempty"`
+	// BazelRelease is the Bazel release which was used to query the targets.
+	BazelRelease string `json:"bazel_release"`
+	// ConfigurationEnumeration is the Context.ConfigurationEnumeration the hashes were computed with.
+	ConfigurationEnumeration string `json:"configuration_enumeration,omitempty"`
+	// TargetsExpression is the targets expression (see TargetsList) whose matching targets were
+	// hashed. Files written before it was recorded have none.
+	TargetsExpression string `json:"targets_expression,omitempty"`
+	// IncompatibleTargets are the labels which were filtered out because they were incompatible with
+	// the target platform, in files written before IncompatibleConfigurations was recorded.
+	IncompatibleTargets []string `json:"incompatible_targets,omitempty"`
+	// IncompatibleConfigurations maps each label which was filtered out because it was incompatible
+	// with the target platform to the sorted configuration checksums it was filtered out in, which
+	// are summarized in Configurations, so that it's known which platforms it was incompatible
+	// with.
+	IncompatibleConfigurations map[string][]string `json:"incompatible_configurations,omitempty"`
+	// Hashes maps each matching label to a map of configuration checksum to hex-encoded target hash.
+	Hashes map[string]map[string]string `json:"hashes"`
+	// Targets maps each matching label which is a rule to information about that rule, so that
+	// consumers can filter targets without querying the revision. Files written before this was
+	// recorded have none.
+	Targets map[string]PersistedTargetInfo `json:"targets,omitempty"`
+	// Base, if set, is the location of another hash file which this one is a delta against: Hashes
+	// and Targets only contain the labels whose entries differ from Base, and Removed lists the
+	// labels in Base which aren't matching targets here. See DeltaFrom.
+	Base    string   `json:"base,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	// Shards, if set, are the locations of the files Hashes and Targets were split across by
+	// PersistShardedHashesAs, either absolute or relative to the directory containing this index.
+	Shards []string `json:"shards,omitempty"`
+	// Configurations summarize each configuration checksum in Hashes, so that the same
+	// configuration can be recognized by its content in snapshots where its checksum differs.
+	// Files written before they were recorded have none.
+	Configurations map[string]PersistedConfiguration `json:"configurations,omitempty"`
+	// ExternalDependencies are the versions of the external dependencies of the workspace at
+	// Revision, by repository name, so that changes to them can be reported alongside the targets
+	// they affect. See collectExternalDependencies. Files written before they were recorded have
+	// none.
+	ExternalDependencies map[string]PersistedExternalDependency `json:"external_dependencies,omitempty"`
+	// SourceFileHashes are the hex-encoded hashes of the source files in the SourceFiles of
+	// Targets, by label, if they were recorded (see Context.SourceFilesLimit).
+	SourceFileHashes map[string]string `json:"source_file_hashes,omitempty"`
+	// AnonymizationSaltDigest, if set, is the hex-encoded SHA-256 digest of the salt the labels
+	// were anonymized with by Anonymized, so that they are only compared with labels anonymized in
+	// the same way.
+	AnonymizationSaltDigest string `json:"anonymization_salt_digest,omitempty"`
+}
+
+// maxPersistedHashesChainLength is the most delta hash files LoadPersistedHashes will follow
+// before giving up, in case of cycles.
+const maxPersistedHashesChainLength = 100
+
+// PersistedTargetInfo is the information about a rule target recorded alongside its hashes.
+type PersistedTargetInfo struct {
+	// Kind is the rule class, e.g. go_test.
+	Kind string `json:"kind"`
+	// Tags are the values of the rule's tags attribute.
+	Tags []string `json:"tags,omitempty"`
+	// TestOnly is the value of the rule's testonly attribute.
+	TestOnly bool `json:"testonly,omitempty"`
+	// Dependents is the number of targets analyzed for the revision which directly depend on the
+	// rule, as a measure of how much a change to it affects.
+	Dependents int `json:"dependents,omitempty"`
+	// Breakdowns are the components of the rule's hash in each of its configurations, keyed like
+	// PersistedHashData.Hashes, if they were recorded (see Context.IncludeHashBreakdown).
+	Breakdowns map[string]PersistedHashBreakdown `json:"breakdowns,omitempty"`
+	// SourceFiles are the labels of the source files in the main repository which the rule's hash
+	// depends on in any of its configurations, directly or through other targets, sorted, if they
+	// were recorded (see Context.SourceFilesLimit).
+	SourceFiles []string `json:"source_files,omitempty"`
+}
+
+// PersistedHashBreakdown is what the hash of a rule in a configuration was computed from, so that
+// differences between two hashes can be explained, and nondeterministic hashes debugged.
+// All hashes are hex-encoded.
+type PersistedHashBreakdown struct {
+	// RuleImplementation is a hash of the Bazel release, the rule class and the hash of the
+	// Starlark code defining it.
+	RuleImplementation string `json:"rule_implementation"`
+	// Attributes is a hash of the rule's normalized attributes.
+	Attributes string `json:"attributes"`
+	// Sources are the digests of the source files the rule directly depends on, by label.
+	Sources map[string]string `json:"sources,omitempty"`
+	// Dependencies are the hashes of the other targets the rule directly depends on, by label and
+	// then configuration.
+	Dependencies map[string]map[string]string `json:"dependencies,omitempty"`
+}
+
+// PersistedConfiguration is a summary of the options which distinguish a configuration. See
+// summarizeConfiguration.
+type PersistedConfiguration struct {
+	// Platforms is the value of --platforms.
+	Platforms string `json:"platforms,omitempty"`
+	// CompilationMode is the value of --compilation_mode, e.g. fastbuild.
+	CompilationMode string `json:"compilation_mode,omitempty"`
+	// CPU is the value of --cpu.
+	CPU string `json:"cpu,omitempty"`
+	// Flags are the values of the other options in summarizedConfigurationFlags which are set.
+	Flags map[string]string `json:"flags,omitempty"`
+}
+
+// PersistedExternalDependency is the resolved version of an external dependency.
+type PersistedExternalDependency struct {
+	// Version is the version of the dependency, e.g. 0.46.0 or v1.6.0.
+	Version string `json:"version"`
+	// Integrity is a hash of the dependency's content, as recorded by its package manager, if it was.
+	Integrity string `json:"integrity,omitempty"`
+}
+
+// newPersistedTargetInfo returns the PersistedTargetInfo for configuredTarget, and false if it
+// isn't a rule.
+func newPersistedTargetInfo(configuredTarget *analysis.ConfiguredTarget) (PersistedTargetInfo, bool) {
+	rule := configuredTarget.GetTarget().GetRule()
+	if rule == nil {
+		return PersistedTargetInfo{}, false
+	}
+	info := PersistedTargetInfo{Kind: rule.GetRuleClass()}
+	for _, attr := range rule.GetAttribute() {
+		switch attr.GetName() {
+		case "tags":
+			info.Tags = attr.GetStringListValue()
+		case "testonly":
+			info.TestOnly = attr.GetBooleanValue()
+		}
+	}
+	return info, true
+}
+
+// configuredTarget returns a ConfiguredTarget describing a rule with info, which has just enough
+// metadata for e.g. RuleKindMatches and manual tag filtering to work.
+func (info PersistedTargetInfo) configuredTarget(labelString string) *analysis.ConfiguredTarget {
+	return &analysis.ConfiguredTarget{
+		Target: &build.Target{
+			Type: build.Target_RULE.Enum(),
+			Rule: &build.Rule{
+				Name:      proto.String(labelString),
+				RuleClass: proto.String(info.Kind),
+				Attribute: []*build.Attribute{
+					{
+						Name:            proto.String("tags"),
+						Type:            build.Attribute_STRING_LIST.Enum(),
+						StringListValue: info.Tags,
+					},
+					{
+						Name:         proto.String("testonly"),
+						Type:         build.Attribute_BOOLEAN.Enum(),
+						BooleanValue: proto.Bool(info.TestOnly),
+					},
+				},
+			},
+		},
+	}
+}
+
+// NewPersistedHashData collects the hashes of all of the matching targets in queryInfo, which must
+// have had its cache filled by PrefillCache.
+func NewPersistedHashData(context *Context, rev LabelledGitRev, queryInfo *QueryResults) (*PersistedHashData, error) {
+	data := &PersistedHashData{
+		SchemaVersion:            PersistedHashesSchemaVersion,
+		HashFunction:             PersistedHashFunction,
+		Revision:                 rev.GitRevision.Sha,
+		BazelRelease:             queryInfo.BazelRelease,
+		ConfigurationEnumeration: configurationEnumerationOrDefault(context.ConfigurationEnumeration),
+		TargetsExpression:        queryInfo.targets.String(),
+		Hashes:                   make(map[string]map[string]string),
+	}
+	if rev.GitRevision == CurrentWorkingDirState {
+		data.Revision = context.OriginalRevision.GitRevision.Sha
+		uncleanStatuses, err := GitStatusFiltered(context.WorkspacePath, context.IgnoredFiles)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check whether the repository is clean: %w", err)
+		}
+		data.Dirty = len(uncleanStatuses) > 0
+	}
+	externalDependencies, err := collectExternalDependencies(context.WorkspacePath, rev)
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect external dependencies: %w", err)
+	}
+	data.ExternalDependencies = externalDependencies
+	for l, configurations := range queryInfo.IncompatibleTargets {
+		configurationStrings := make([]string, 0, len(configurations))
+		for _, configuration := range configurations {
+			configurationStrings = append(configurationStrings, configuration.String())
+			if err := addPersistedConfiguration(data, queryInfo.configurations, configuration); err != nil {
+				return nil, err
+			}
+		}
+		sort.Strings(configurationStrings)
+		if data.IncompatibleConfigurations == nil {
+			data.IncompatibleConfigurations = make(map[string][]string)
+		}
+		data.IncompatibleConfigurations[l.String()] = configurationStrings
+	}
+	dependents, err := countDependents(queryInfo)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range queryInfo.MatchingTargets.Labels() {
+		hashes := make(map[string]string)
+		for _, configuration := range queryInfo.MatchingTargets.ConfigurationsFor(l) {
+			hash, err := queryInfo.TargetHashCache.Hash(LabelAndConfiguration{Label: l, Configuration: configuration})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get hash of %s in configuration %s: %w", l, configuration.String(), err)
+			}
+			hashes[configuration.String()] = hex.EncodeToString(hash)
+			if err := addPersistedConfiguration(data, queryInfo.configurations, configuration); err != nil {
+				return nil, err
+			}
+		}
+		data.Hashes[l.String()] = hashes
+		for _, configuredTarget := range queryInfo.TransitiveConfiguredTargets[l] {
+			if info, ok := newPersistedTargetInfo(configuredTarget); ok {
+				info.Dependents = dependents[l]
+				if context.IncludeHashBreakdown {
+					if info.Breakdowns, err = hashBreakdowns(queryInfo, l); err != nil {
+						return nil, err
+					}
+				}
+				if context.SourceFilesLimit > 0 {
+					if info.SourceFiles, err = addSourceFiles(data, queryInfo, l, context.SourceFilesLimit); err != nil {
+						return nil, err
+					}
+				}
+				if data.Targets == nil {
+					data.Targets = make(map[string]PersistedTargetInfo)
+				}
+				data.Targets[l.String()] = info
+			}
+			// All configurations of a target share the same rule.
+			break
+		}
+	}
+	return data, nil
+}
+
+// hashBreakdowns returns the breakdown of the hash of the rule l in each of its matching
+// configurations in queryInfo.
+func hashBreakdowns(queryInfo *QueryResults, l label.Label) (map[string]PersistedHashBreakdown, error) {
+	breakdowns := make(map[string]PersistedHashBreakdown)
+	for _, configuration := range queryInfo.MatchingTargets.ConfigurationsFor(l) {
+		breakdown, err := queryInfo.TargetHashCache.Breakdown(LabelAndConfiguration{Label: l, Configuration: configuration})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get hash breakdown of %s in configuration %s: %w", l, configuration.String(), err)
+		}
+		if breakdown != nil {
+			breakdowns[configuration.String()] = *breakdown
+		}
+	}
+	if len(breakdowns) == 0 {
+		return nil, nil
+	}
+	return breakdowns, nil
+}
+
+// addSourceFiles returns the labels of the source files which the hash of the rule l depends on in
+// any of its matching configurations in queryInfo, sorted, recording their hashes in data. If it
+// depends on more than limit of them, none are returned.
+func addSourceFiles(data *PersistedHashData, queryInfo *QueryResults, l label.Label, limit int) ([]string, error) {
+	sourceFileHashes := make(map[string]string)
+	for _, configuration := range queryInfo.MatchingTargets.ConfigurationsFor(l) {
+		hashes, err := queryInfo.TargetHashCache.SourceFileHashes(LabelAndConfiguration{Label: l, Configuration: configuration}, limit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find source files of %s in configuration %s: %w", l, configuration.String(), err)
+		}
+		if hashes == nil {
+			return nil, nil
+		}
+		for labelString, hash := range hashes {
+			sourceFileHashes[labelString] = hash
+		}
+	}
+	if len(sourceFileHashes) == 0 || len(sourceFileHashes) > limit {
+		return nil, nil
+	}
+	if data.SourceFileHashes == nil {
+		data.SourceFileHashes = make(map[string]string)
+	}
+	for labelString, hash := range sourceFileHashes {
+		data.SourceFileHashes[labelString] = hash
+	}
+	return sortedUnion(sourceFileHashes, nil), nil
+}
+
+// countDependents returns the number of targets in queryInfo which directly depend on each target,
+// counting a target once however many configurations it depends on it in.
+func countDependents(queryInfo *QueryResults) (map[label.Label]int, error) {
+	dependents := make(map[label.Label]map[label.Label]bool)
+	for l, configuredTargets := range queryInfo.TransitiveConfiguredTargets {
+		for _, configuredTarget := range configuredTargets {
+			for _, ruleInput := range configuredTarget.GetTarget().GetRule().GetRuleInput() {
+				ruleInputLabel, err := queryInfo.TargetHashCache.ParseCanonicalLabel(ruleInput)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse rule input %s of %s: %w", ruleInput, l, err)
+				}
+				if dependents[ruleInputLabel] == nil {
+					dependents[ruleInputLabel] = make(map[label.Label]bool)
+				}
+				dependents[ruleInputLabel][l] = true
+			}
+		}
+	}
+	counts := make(map[label.Label]int, len(dependents))
+	for l, dependentLabels := range dependents {
+		counts[l] = len(dependentLabels)
+	}
+	return counts, nil
+}
+
+// PersistHashes writes data to path as JSON, compressed according to the extension of path (see
+// CompressionForPath).
+func PersistHashes(path string, data *PersistedHashData) error {
+	return PersistHashesAs(path, data, "json", "auto")
+}
+
+// PersistHashesAs writes data to path (a local path, or a URI supported by HashStoreFor) in format, which is either "json" or "proto" (the binary
+// format described by persistedhashespb/persisted_hashes.proto, which is much faster to write and read for large
+// repositories). The content is compressed with compression, which is one of "none", "gzip",
+// "zstd", or "auto" to choose based on the extension of path.
+func PersistHashesAs(path string, data *PersistedHashData, format string, compression string) error {
+	return PersistSignedHashesAs(path, data, format, compression, nil)
+}
+
+// PersistSignedHashesAs is PersistHashesAs, which also signs the file with signingKey, if it is
+// non-nil, storing the signature at SignatureLocation(path) so that readers can check with
+// LoadVerifiedPersistedHashes that it hasn't been tampered with.
+func PersistSignedHashesAs(path string, data *PersistedHashData, format string, compression string, signingKey ed25519.PrivateKey) error {
+	if compression == "auto" || compression == "" {
+		compression = CompressionForPath(path)
+	}
+	content, err := MarshalPersistedHashes(data, format, compression)
+	if err != nil {
+		return fmt.Errorf("failed to write hashes to %s: %w", path, err)
+	}
+	if err := HashStoreFor(path).Put(path, content); err != nil {
+		return fmt.Errorf("failed to write hashes to %s: %w", path, err)
+	}
+	if signingKey != nil {
+		return signHashFile(path, content, signingKey)
+	}
+	return nil
+}
+
+// MarshalPersistedHashes encodes data in format, which is either "json" or "proto", compressed with
+// compression, which is one of "none", "gzip" or "zstd". See PersistHashesAs.
+// The encoding is canonical: data is first put in canonical form (see Canonical), and labels,
+// configurations and other map keys are written in sorted order, so the same hashes are always
+// encoded as the same bytes. This allows hash files to be content-addressed and deduplicated.
+func MarshalPersistedHashes(data *PersistedHashData, format string, compression string) ([]byte, error) {
+	var content []byte
+	var err error
+	data = data.Canonical()
+	switch format {
+	case "", "json":
+		content, err = json.Marshal(data)
+	case "proto":
+		content, err = marshalPersistedHashesProto(data)
+	default:
+		return nil, fmt.Errorf("unknown format %s for hashes - allowed values: json|proto", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal hashes: %w", err)
+	}
+	if content, err = compress(content, compression); err != nil {
+		return nil, fmt.Errorf("failed to compress hashes: %w", err)
+	}
+	return content, nil
+}
+
+// Canonical returns a copy of data in which everything which has no meaningful order is sorted: the
+// incompatible and removed targets, and the tags of each target. Hashes is never nil.
+func (data *PersistedHashData) Canonical() *PersistedHashData {
+	canonical := *data
+	if canonical.Hashes == nil {
+		canonical.Hashes = make(map[string]map[string]string)
+	}
+	sortedCopy := func(values []string) []string {
+		if values == nil {
+			return nil
+		}
+		sorted := append([]string(nil), values...)
+		sort.Strings(sorted)
+		return sorted
+	}
+	canonical.IncompatibleTargets = sortedCopy(data.IncompatibleTargets)
+	if data.IncompatibleConfigurations != nil {
+		canonical.IncompatibleConfigurations = make(map[string][]string, len(data.IncompatibleConfigurations))
+		for labelString, configurations := range data.IncompatibleConfigurations {
+			canonical.IncompatibleConfigurations[labelString] = sortedCopy(configurations)
+		}
+	}
+	canonical.Removed = sortedCopy(data.Removed)
+	if data.Targets != nil {
+		canonical.Targets = make(map[string]PersistedTargetInfo, len(data.Targets))
+		for labelString, info := range data.Targets {
+			info.Tags = sortedCopy(info.Tags)
+			info.SourceFiles = sortedCopy(info.SourceFiles)
+			canonical.Targets[labelString] = info
+		}
+	}
+	return &canonical
+}
+
+// CanonicalDigest returns the hex-encoded sha256 digest of the canonical, uncompressed JSON
+// encoding of data (see MarshalPersistedHashes), which identifies its content independently of how
+// it's compressed, e.g. to deduplicate hash files in object storage.
+func CanonicalDigest(data *PersistedHashData) (string, error) {
+	content, err := MarshalPersistedHashes(data, "json", "none")
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(content)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// MarshalCanonicalJSON returns the canonical JSON encoding of data (see MarshalPersistedHashes),
+// indented with one key per line and ending in a newline, so that hash files can be compared with
+// plain diff when debugging. It can be read like any other JSON hash file.
+func MarshalCanonicalJSON(data *PersistedHashData) ([]byte, error) {
+	content, err := json.MarshalIndent(data.Canonical(), "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal hashes: %w", err)
+	}
+	return append(content, '\n'), nil
+}
+
+// UnmarshalPersistedHashes decodes content written by MarshalPersistedHashes, in either format and
+// with any compression. Duplicate hashes are handled as for LoadPersistedHashes, but unlike
+// LoadPersistedHashes, deltas aren't applied to their Base, and shard indexes aren't merged with
+// their Shards.
+func UnmarshalPersistedHashes(content []byte, conflictPolicy string) (*PersistedHashData, error) {
+	return parsePersistedHashes(content, "input", conflictPolicy)
+}
+
+// LoadPersistedHashes reads hashes previously written by PersistHashes or PersistHashesAs, in
+// either format, which may be compressed with gzip or zstd. path may be a local path, or a URI
+// supported by HashStoreFor.
+// If the file is a delta (see DeltaFrom), the chain of base files is followed and applied, so the
+// returned data is always a full snapshot with no Base. If the file, or any of its bases, is a shard
+// index (see PersistShardedHashesAs), its shards are read and merged.
+// Files which were merged or written concurrently may contain the same label and configuration
+// more than once. Entries with the same hash are merged, and entries with conflicting hashes are
+// handled according to conflictPolicy:
+// - "fail" (or "") - return an error.
+// - "first" - use the first hash in the file.
+// - "last" - use the last hash in the file.
+func LoadPersistedHashes(path string, conflictPolicy string) (*PersistedHashData, error) {
+	return LoadVerifiedPersistedHashes(path, conflictPolicy, nil)
+}
+
+// LoadVerifiedPersistedHashes is LoadPersistedHashes, which also checks, if verifyKey is non-nil,
+// that the file and each of its bases were signed by verifyKey's private key when they were
+// written by PersistSignedHashesAs, returning an error if any wasn't.
+func LoadVerifiedPersistedHashes(path string, conflictPolicy string, verifyKey ed25519.PublicKey) (*PersistedHashData, error) {
+	data, err := loadPersistedHashesLocation(path, conflictPolicy, verifyKey)
+	if err != nil {
+		return nil, err
+	}
+	deltas := []*PersistedHashData{data}
+	location := path
+	for data.Base != "" {
+		if len(deltas) > maxPersistedHashesChainLength {
+			return nil, fmt.Errorf("failed to load hashes from %s: more than %d delta files in its chain of bases", path, maxPersistedHashesChainLength)
+		}
+		location = resolveBaseLocation(location, data.Base)
+		if data, err = loadPersistedHashesLocation(location, conflictPolicy, verifyKey); err != nil {
+			return nil, fmt.Errorf("failed to load base of hashes from %s: %w", path, err)
+		}
+		deltas = append(deltas, data)
+	}
+	// Apply the deltas on top of the full snapshot at the end of the chain, oldest first.
+	snapshot := *deltas[len(deltas)-1]
+	for i := len(deltas) - 2; i >= 0; i-- {
+		if got, want := deltas[i].EffectiveHashFunction(), snapshot.EffectiveHashFunction(); got != want {
+			return nil, fmt.Errorf("failed to load hashes from %s: a delta in its chain was computed with hash function %s, but its base with %s", path, got, want)
+		}
+		if deltas[i].AnonymizationSaltDigest != snapshot.AnonymizationSaltDigest {
+			return nil, fmt.Errorf("failed to load hashes from %s: a delta in its chain wasn't anonymized in the same way as its base", path)
+		}
+		snapshot = applyDelta(&snapshot, deltas[i])
+	}
+	return &snapshot, nil
+}
+
+// resolveBaseLocation returns the location of base, as recorded in the hash file at location.
+// Relative local paths are relative to the directory containing that file.
+func resolveBaseLocation(location string, base string) string {
+	if HashStoreFor(base) != (LocalHashStore{}) || filepath.IsAbs(base) || HashStoreFor(location) != (LocalHashStore{}) {
+		return base
+	}
+	return filepath.Join(filepath.Dir(location), base)
+}
+
+// relativeBaseLocation returns the location to record in the hash file at location for base, which
+// is relative to the directory containing location if they're both local paths, so that they can be
+// moved together.
+func relativeBaseLocation(location string, base string) (string, error) {
+	if HashStoreFor(base) != (LocalHashStore{}) || HashStoreFor(location) != (LocalHashStore{}) {
+		return base, nil
+	}
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve path %s: %w", base, err)
+	}
+	absLocation, err := filepath.Abs(location)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve path %s: %w", location, err)
+	}
+	return filepath.Rel(filepath.Dir(absLocation), absBase)
+}
+
+// applyDelta returns the full snapshot described by delta, which is a delta against base.
+func applyDelta(base *PersistedHashData, delta *PersistedHashData) PersistedHashData {
+	snapshot := *delta
+	snapshot.SchemaVersion = base.SchemaVersion
+	snapshot.Base = ""
+	snapshot.Removed = nil
+	snapshot.Hashes = make(map[string]map[string]string, len(base.Hashes)+len(delta.Hashes))
+	for labelString, hashes := range base.Hashes {
+		snapshot.Hashes[labelString] = hashes
+	}
+	if base.Targets != nil || delta.Targets != nil {
+		snapshot.Targets = make(map[string]PersistedTargetInfo, len(base.Targets)+len(delta.Targets))
+		for labelString, info := range base.Targets {
+			snapshot.Targets[labelString] = info
+		}
+	}
+	for _, labelString := range delta.Removed {
+		delete(snapshot.Hashes, labelString)
+		delete(snapshot.Targets, labelString)
+	}
+	for labelString, hashes := range delta.Hashes {
+		snapshot.Hashes[labelString] = hashes
+		// A target whose hashes changed may no longer be a rule.
+		delete(snapshot.Targets, labelString)
+	}
+	for labelString, info := range delta.Targets {
+		snapshot.Targets[labelString] = info
+	}
+	return snapshot
+}
+
+// DeltaFrom returns a copy of data which only contains the labels whose hashes or target info
+// differ from base, to be written alongside base as a much smaller file. baseLocation is where base
+// is stored, either as seen by readers of the delta, or relative to the directory the delta is
+// written to. LoadPersistedHashes applies deltas to their bases when reading them.
+func (data *PersistedHashData) DeltaFrom(base *PersistedHashData, baseLocation string) *PersistedHashData {
+	delta := *data
+	delta.SchemaVersion = PersistedHashesDeltaSchemaVersion
+	delta.Base = baseLocation
+	delta.Removed = nil
+	delta.Hashes = make(map[string]map[string]string)
+	delta.Targets = nil
+	for labelString, hashes := range data.Hashes {
+		info, isRule := data.Targets[labelString]
+		baseInfo, baseIsRule := base.Targets[labelString]
+		if reflect.DeepEqual(hashes, base.Hashes[labelString]) && isRule == baseIsRule && reflect.DeepEqual(info, baseInfo) {
+			continue
+		}
+		delta.Hashes[labelString] = hashes
+		if isRule {
+			if delta.Targets == nil {
+				delta.Targets = make(map[string]PersistedTargetInfo)
+			}
+			delta.Targets[labelString] = info
+		}
+	}
+	for labelString := range base.Hashes {
+		if _, ok := data.Hashes[labelString]; !ok {
+			delta.Removed = append(delta.Removed, labelString)
+		}
+	}
+	sort.Strings(delta.Removed)
+	return &delta
+}
+
+// loadPersistedHashesFile reads a single hash file, without following its Base, verifying its
+// signature if verifyKey is non-nil.
+func loadPersistedHashesFile(path string, conflictPolicy string, verifyKey ed25519.PublicKey) (*PersistedHashData, error) {
+	content, err := HashStoreFor(path).Get(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hashes from %s: %w", path, err)
+	}
+	if verifyKey != nil {
+		if err := verifyHashFile(path, content, verifyKey); err != nil {
+			return nil, err
+		}
+	}
+	return parsePersistedHashes(content, path, conflictPolicy)
+}
+
+// parsePersistedHashes decodes content, which was read from path.
+func parsePersistedHashes(content []byte, path string, conflictPolicy string) (*PersistedHashData, error) {
+	content, err := decompress(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress hashes from %s: %w", path, err)
+	}
+	if !isJSONObject(content) {
+		data, err := unmarshalPersistedHashesProto(content, conflictPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse hashes from %s: %w", path, err)
+		}
+		if err := checkPersistedHashesSchemaVersion(path, data.SchemaVersion); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	var data PersistedHashData
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse hashes from %s: %w", path, err)
+	}
+	if err := checkPersistedHashesSchemaVersion(path, data.SchemaVersion); err != nil {
+		return nil, err
+	}
+	// json.Unmarshal silently keeps the last of any duplicate keys, so we read the hashes again
+	// ourselves to find them.
+	var labels labelValidator
+	if data.Hashes, err = readHashesWithoutDuplicates(content, conflictPolicy, &labels); err != nil {
+		return nil, fmt.Errorf("failed to parse hashes from %s: %w", path, err)
+	}
+	if data.Targets != nil {
+		// Normalize labels as readHashesWithoutDuplicates does.
+		labelStrings := make([]string, 0, len(data.Targets))
+		for labelString := range data.Targets {
+			labelStrings = append(labelStrings, labelString)
+		}
+		sort.Strings(labelStrings)
+		targets := make(map[string]PersistedTargetInfo, len(data.Targets))
+		for _, labelString := range labelStrings {
+			if l, ok := labels.parse("targets", labelString); ok {
+				targets[l.String()] = data.Targets[labelString]
+			}
+		}
+		data.Targets = targets
+	}
+	for i, labelString := range data.Removed {
+		if l, ok := labels.parse(fmt.Sprintf("removed[%d]", i), labelString); ok {
+			data.Removed[i] = l.String()
+		}
+	}
+	if err := labels.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse hashes from %s: %w", path, err)
+	}
+	return &data, nil
+}
+
+// isJSONObject returns whether content looks like a JSON object rather than a binary proto. A
+// PersistedHashData proto never starts with "{" or whitespace, as those aren't valid tags for any
+// of its fields.
+func isJSONObject(content []byte) bool {
+	trimmed := bytes.TrimLeft(content, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+func checkPersistedHashesSchemaVersion(path string, version int) error {
+	if version == 0 {
+		version = 1
+	}
+	for _, supported := range SupportedPersistedHashesSchemaVersions {
+		if version == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("hashes in %s have schema version %d, but only versions %v are supported - they were probably written by a newer version of this tool", path, version, SupportedPersistedHashesSchemaVersions)
+}
+
+// addPersistedHash adds hash for labelString in configuration to hashes, handling any existing
+// conflicting hash according to conflictPolicy (see LoadPersistedHashes).
+func addPersistedHash(hashes map[string]map[string]string, labelString string, configuration string, hash string, conflictPolicy string) error {
+	if _, ok := hashes[labelString]; !ok {
+		hashes[labelString] = make(map[string]string)
+	}
+	previousHash, seen := hashes[labelString][configuration]
+	if seen && previousHash != hash {
+		switch conflictPolicy {
+		case "", "fail":
+			return fmt.Errorf("conflicting hashes for %s in configuration %s: %s and %s", labelString, configuration, previousHash, hash)
+		case "first":
+			return nil
+		case "last":
+		default:
+			return fmt.Errorf("unknown conflict policy %q", conflictPolicy)
+		}
+	}
+	hashes[labelString][configuration] = hash
+	return nil
+}
+
+// readHashesWithoutDuplicates reads the hashes from the JSON content of a hash file, handling
+// duplicates according to conflictPolicy. Invalid labels are recorded in labels and skipped.
+func readHashesWithoutDuplicates(content []byte, conflictPolicy string, labels *labelValidator) (map[string]map[string]string, error) {
+	hashes := make(map[string]map[string]string)
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	if err := expectDelim(decoder, '{'); err != nil {
+		return nil, err
+	}
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key != "hashes" {
+			var ignored json.RawMessage
+			if err := decoder.Decode(&ignored); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := expectDelim(decoder, '{'); err != nil {
+			return nil, err
+		}
+		for decoder.More() {
+			offset := decoder.InputOffset()
+			labelToken, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			// Different spellings of the same label (e.g. "//foo" and "//foo:foo") are the same target.
+			l, ok := labels.parse(jsonLocation(content, offset), labelToken.(string))
+			if !ok {
+				var ignored json.RawMessage
+				if err := decoder.Decode(&ignored); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			labelString := l.String()
+			if _, ok := hashes[labelString]; !ok {
+				hashes[labelString] = make(map[string]string)
+			}
+			if err := expectDelim(decoder, '{'); err != nil {
+				return nil, err
+			}
+			for decoder.More() {
+				configuration, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+				var hash string
+				if err := decoder.Decode(&hash); err != nil {
+					return nil, err
+				}
+				if err := addPersistedHash(hashes, labelString, configuration.(string), hash, conflictPolicy); err != nil {
+					return nil, err
+				}
+			}
+			if err := expectDelim(decoder, '}'); err != nil {
+				return nil, err
+			}
+		}
+		if err := expectDelim(decoder, '}'); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+func expectDelim(decoder *json.Decoder, want json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token != want {
+		return fmt.Errorf("expected %v but got %v", want, token)
+	}
+	return nil
+}
+
+// Anonymized returns a copy of data in which each repository name, package path component and
+// target name component of each label is replaced with an opaque token, so that it can be shared
+// without revealing the names of targets.
+// Tokens are derived from salt and the name they replace, so the same name is always replaced with
+// the same token and the structure of labels is kept, e.g. //a/b:c and //a/d:c become
+// //t1/t2:t3 and //t1/t4:t3. File extensions are kept. Without a secret salt, tokens for guessable
+// names can be reversed by hashing candidate names. Only the compilation mode and CPU of
+// configurations are kept, and external dependencies are dropped. The digest of salt is recorded
+// in AnonymizationSaltDigest.
+func (data *PersistedHashData) Anonymized(salt string) (*PersistedHashData, error) {
+	if data.AnonymizationSaltDigest != "" {
+		return nil, fmt.Errorf("hashes are already anonymized")
+	}
+	anonymized := *data
+	anonymized.AnonymizationSaltDigest = anonymizationSaltDigest(salt)
+	anonymized.Hashes = make(map[string]map[string]string, len(data.Hashes))
+	for labelString, hashes := range data.Hashes {
+		l, err := label.Parse(labelString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label %s: %w", labelString, err)
+		}
+		anonymized.Hashes[anonymizeLabel(l, salt).String()] = hashes
+	}
+	if data.Targets != nil {
+		anonymized.Targets = make(map[string]PersistedTargetInfo, len(data.Targets))
+		for labelString, info := range data.Targets {
+			l, err := label.Parse(labelString)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse label %s: %w", labelString, err)
+			}
+			if info.Breakdowns, err = anonymizeBreakdowns(info.Breakdowns, salt); err != nil {
+				return nil, err
+			}
+			if info.SourceFiles != nil {
+				sourceFiles := make([]string, 0, len(info.SourceFiles))
+				for _, sourceFile := range info.SourceFiles {
+					sourceFileLabel, err := label.Parse(sourceFile)
+					if err != nil {
+						return nil, fmt.Errorf("failed to parse label %s: %w", sourceFile, err)
+					}
+					sourceFiles = append(sourceFiles, anonymizeLabel(sourceFileLabel, salt).String())
+				}
+				sort.Strings(sourceFiles)
+				info.SourceFiles = sourceFiles
+			}
+			anonymized.Targets[anonymizeLabel(l, salt).String()] = info
+		}
+	}
+	anonymized.IncompatibleTargets = make([]string, 0, len(data.IncompatibleTargets))
+	for _, labelString := range data.IncompatibleTargets {
+		l, err := label.Parse(labelString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label %s: %w", labelString, err)
+		}
+		anonymized.IncompatibleTargets = append(anonymized.IncompatibleTargets, anonymizeLabel(l, salt).String())
+	}
+	sort.Strings(anonymized.IncompatibleTargets)
+	if data.IncompatibleConfigurations != nil {
+		anonymized.IncompatibleConfigurations = make(map[string][]string, len(data.IncompatibleConfigurations))
+		for labelString, configurations := range data.IncompatibleConfigurations {
+			l, err := label.Parse(labelString)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse label %s: %w", labelString, err)
+			}
+			anonymized.IncompatibleConfigurations[anonymizeLabel(l, salt).String()] = configurations
+		}
+	}
+	if data.Configurations != nil {
+		// Platforms and flags may name targets or reveal build settings.
+		anonymized.Configurations = make(map[string]PersistedConfiguration, len(data.Configurations))
+		for configuration, summary := range data.Configurations {
+			anonymized.Configurations[configuration] = PersistedConfiguration{CompilationMode: summary.CompilationMode, CPU: summary.CPU}
+		}
+	}
+	// The names of private dependencies may reveal as much as the names of targets.
+	anonymized.ExternalDependencies = nil
+	if data.SourceFileHashes != nil {
+		anonymized.SourceFileHashes = make(map[string]string, len(data.SourceFileHashes))
+		for labelString, hash := range data.SourceFileHashes {
+			l, err := label.Parse(labelString)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse label %s: %w", labelString, err)
+			}
+			anonymized.SourceFileHashes[anonymizeLabel(l, salt).String()] = hash
+		}
+	}
+	if data.Removed != nil {
+		anonymized.Removed = make([]string, 0, len(data.Removed))
+		for _, labelString := range data.Removed {
+			l, err := label.Parse(labelString)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse label %s: %w", labelString, err)
+			}
+			anonymized.Removed = append(anonymized.Removed, anonymizeLabel(l, salt).String())
+		}
+		sort.Strings(anonymized.Removed)
+	}
+	return &anonymized, nil
+}
+
+// anonymizationSaltDigest returns the AnonymizationSaltDigest of labels anonymized with salt.
+func anonymizationSaltDigest(salt string) string {
+	digest := sha256.Sum256([]byte(salt))
+	return hex.EncodeToString(digest[:])
+}
+
+// anonymizeBreakdowns returns a copy of breakdowns with the labels of their sources and
+// dependencies anonymized as by anonymizeLabel.
+func anonymizeBreakdowns(breakdowns map[string]PersistedHashBreakdown, salt string) (map[string]PersistedHashBreakdown, error) {
+	if breakdowns == nil {
+		return nil, nil
+	}
+	anonymizeKeys := func(labelStrings []string) (map[string]string, error) {
+		anonymized := make(map[string]string, len(labelStrings))
+		for _, labelString := range labelStrings {
+			l, err := label.Parse(labelString)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse label %s: %w", labelString, err)
+			}
+			anonymized[labelString] = anonymizeLabel(l, salt).String()
+		}
+		return anonymized, nil
+	}
+	anonymized := make(map[string]PersistedHashBreakdown, len(breakdowns))
+	for configuration, breakdown := range breakdowns {
+		var labelStrings []string
+		for labelString := range breakdown.Sources {
+			labelStrings = append(labelStrings, labelString)
+		}
+		for labelString := range breakdown.Dependencies {
+			labelStrings = append(labelStrings, labelString)
+		}
+		tokens, err := anonymizeKeys(labelStrings)
+		if err != nil {
+			return nil, err
+		}
+		anonymizedBreakdown := PersistedHashBreakdown{RuleImplementation: breakdown.RuleImplementation, Attributes: breakdown.Attributes}
+		if breakdown.Sources != nil {
+			anonymizedBreakdown.Sources = make(map[string]string, len(breakdown.Sources))
+			for labelString, digest := range breakdown.Sources {
+				anonymizedBreakdown.Sources[tokens[labelString]] = digest
+			}
+		}
+		if breakdown.Dependencies != nil {
+			anonymizedBreakdown.Dependencies = make(map[string]map[string]string, len(breakdown.Dependencies))
+			for labelString, hashes := range breakdown.Dependencies {
+				anonymizedBreakdown.Dependencies[tokens[labelString]] = hashes
+			}
+		}
+		anonymized[configuration] = anonymizedBreakdown
+	}
+	return anonymized, nil
+}
+
+func anonymizeLabel(l label.Label, salt string) label.Label {
+	anonymizeSegments := func(path string, keepExtension bool) string {
+		if path == "" {
+			return ""
+		}
+		segments := strings.Split(path, "/")
+		for i, segment := range segments {
+			extension := ""
+			if keepExtension && i == len(segments)-1 {
+				extension = filepath.Ext(segment)
+			}
+			token := sha256.Sum256([]byte(salt + "\x00" + strings.TrimSuffix(segment, extension)))
+			segments[i] = "t" + hex.EncodeToString(token[:])[:12] + extension
+		}
+		return strings.Join(segments, "/")
+	}
+	anonymized := l
+	anonymized.Repo = anonymizeSegments(l.Repo, false)
+	anonymized.Pkg = anonymizeSegments(l.Pkg, false)
+	anonymized.Name = anonymizeSegments(l.Name, true)
+	return anonymized
+}
+
+// QueryResults returns QueryResults whose matching targets and hashes are those in data, which can
+// be diffed against like any other QueryResults.
+// The returned QueryResults only have the target metadata recorded in data.Targets, so no detailed
+// differences can be computed against it, and it doesn't track toolchain resolution changes.
+func (data *PersistedHashData) QueryResults() (*QueryResults, error) {
+	targetHashCache := NewTargetHashCache(nil, &Normalizer{}, data.BazelRelease)
+	labels := make([]label.Label, 0, len(data.Hashes))
+	labelsToConfigurations := make(map[label.Label]*ss.SortedSet[Configuration], len(data.Hashes))
+	transitiveConfiguredTargets := make(map[label.Label]map[Configuration]*analysis.ConfiguredTarget, len(data.Hashes))
+	for labelString, hashes := range data.Hashes {
+		l, err := label.Parse(labelString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label %s: %w", labelString, err)
+		}
+		labels = append(labels, l)
+		configurations := ss.NewSortedSetFn([]Configuration{}, ConfigurationLess)
+		transitiveConfiguredTargets[l] = make(map[Configuration]*analysis.ConfiguredTarget, len(hashes))
+		targetHashCache.cache[l] = make(map[Configuration]*cacheEntry, len(hashes))
+		for configurationString, hashString := range hashes {
+			hash, err := hex.DecodeString(hashString)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode hash of %s in configuration %s: %w", labelString, configurationString, err)
+			}
+			configuration := NormalizeConfiguration(configurationString)
+			configurations.Add(configuration)
+			// We don't know anything about the target other than its hash and any recorded info.
+			if info, ok := data.Targets[labelString]; ok {
+				transitiveConfiguredTargets[l][configuration] = info.configuredTarget(labelString)
+			} else {
+				transitiveConfiguredTargets[l][configuration] = &analysis.ConfiguredTarget{}
+			}
+			targetHashCache.cache[l][configuration] = &cacheEntry{hash: hash}
+		}
+		labelsToConfigurations[l] = configurations
+	}
+	targetHashCache.Freeze()
+
+	incompatibleTargets := make(map[label.Label][]Configuration, len(data.IncompatibleTargets)+len(data.IncompatibleConfigurations))
+	for _, labelString := range data.IncompatibleTargets {
+		l, err := label.Parse(labelString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label %s: %w", labelString, err)
+		}
+		incompatibleTargets[l] = nil
+	}
+	for labelString, configurationStrings := range data.IncompatibleConfigurations {
+		l, err := label.Parse(labelString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label %s: %w", labelString, err)
+		}
+		configurations := make([]Configuration, 0, len(configurationStrings))
+		for _, configuration := range configurationStrings {
+			configurations = append(configurations, NormalizeConfiguration(configuration))
+		}
+		incompatibleTargets[l] = configurations
+	}
+
+	return &QueryResults{
+		MatchingTargets: &MatchingTargets{
+			labels:                 ss.NewSortedSetFn(labels, CompareLabels),
+			labelsToConfigurations: labelsToConfigurations,
+		},
+		TransitiveConfiguredTargets: transitiveConfiguredTargets,
+		TargetHashCache:             targetHashCache,
+		BazelRelease:                data.BazelRelease,
+		IncompatibleTargets:         incompatibleTargets,
+		fromPersistedHashes:         true,
+	}, nil
+}
+
+// loadBeforeHashes loads the hashes from context.BeforeHashesFile as QueryResults, if they were
+// computed at revBefore.
+// It returns nil QueryResults if the hashes can't be used for revBefore, in which case revBefore
+// should be processed as normal.
+func loadBeforeHashes(context *Context, revBefore LabelledGitRev) (*QueryResults, error) {
+	data, err := LoadVerifiedPersistedHashes(context.BeforeHashesFile, context.PersistedHashConflictPolicy, context.HashesVerifyKey)
+	if err != nil {
+		return nil, err
+	}
+	if data.AnonymizationSaltDigest != "" {
+		log.Printf("WARN: Not using hashes from %s because their labels are anonymized", context.BeforeHashesFile)
+		return nil, nil
+	}
+	if revBefore.GitRevision == CurrentWorkingDirState || data.Revision != revBefore.GitRevision.Sha || data.Dirty {
+		log.Printf("WARN: Not using hashes from %s because they weren't computed at %s (they were computed at %s, dirty: %v)", context.BeforeHashesFile, revBefore, data.Revision, data.Dirty)
+		return nil, nil
+	}
+	if want, got := configurationEnumerationOrDefault(context.ConfigurationEnumeration), configurationEnumerationOrDefault(data.ConfigurationEnumeration); want != got {
+		log.Printf("WARN: Not using hashes from %s because they were computed with configuration enumeration %s rather than %s", context.BeforeHashesFile, got, want)
+		return nil, nil
+	}
+	if got := data.EffectiveHashFunction(); got != PersistedHashFunction {
+		log.Printf("WARN: Not using hashes from %s because they were computed with hash function %s rather than %s", context.BeforeHashesFile, got, PersistedHashFunction)
+		return nil, nil
+	}
+	return data.QueryResults()
+}
+
+// EffectiveHashFunction returns the PersistedHashFunction data was computed with, accounting for
+// files written before it was recorded.
+func (data *PersistedHashData) EffectiveHashFunction() string {
+	if data.HashFunction == "" {
+		return "sha256-v1"
+	}
+	return data.HashFunction
+}
+
+func configurationEnumerationOrDefault(configurationEnumeration string) string {
+	if configurationEnumeration == "" {
+		return "top-level"
+	}
+	return configurationEnumeration
+}
+
+// writeHashOutputs persists the hashes computed for revBefore and revAfter to the files requested
+// in context, if any.
+func writeHashOutputs(context *Context, revBefore LabelledGitRev, beforeMetadata *QueryResults, revAfter LabelledGitRev, afterMetadata *QueryResults) error {
+	if context.BeforeHashesOutputFile != "" {
+		if beforeMetadata.QueryError != nil {
+			log.Printf("WARN: Not writing hashes for %s to %s because it couldn't be processed: %v", revBefore, context.BeforeHashesOutputFile, beforeMetadata.QueryError)
+		} else if err := persistHashes(context, revBefore, beforeMetadata, context.BeforeHashesOutputFile); err != nil {
+			return err
+		}
+	}
+	if context.AfterHashesOutputFile != "" {
+		if err := persistHashes(context, revAfter, afterMetadata, context.AfterHashesOutputFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func persistHashes(context *Context, rev LabelledGitRev, queryInfo *QueryResults, path string) error {
+	data, err := NewPersistedHashData(context, rev, queryInfo)
+	if err != nil {
+		return fmt.Errorf("failed to collect hashes for %s: %w", rev, err)
+	}
+	if context.AnonymizeHashOutputs {
+		if data, err = data.Anonymized(context.AnonymizationSalt); err != nil {
+			return fmt.Errorf("failed to anonymize hashes for %s: %w", rev, err)
+		}
+	}
+	if context.HashesOutputBase != "" {
+		base, err := LoadVerifiedPersistedHashes(context.HashesOutputBase, context.PersistedHashConflictPolicy, context.HashesVerifyKey)
+		if err != nil {
+			return fmt.Errorf("failed to load base to write hashes for %s as a delta against: %w", rev, err)
+		}
+		if base.AnonymizationSaltDigest != data.AnonymizationSaltDigest {
+			return fmt.Errorf("can't write hashes for %s as a delta against %s, which wasn't anonymized in the same way", rev, context.HashesOutputBase)
+		}
+		baseLocation, err := relativeBaseLocation(path, context.HashesOutputBase)
+		if err != nil {
+			return err
+		}
+		data = data.DeltaFrom(base, baseLocation)
+	}
+	return PersistShardedHashesAs(path, data, context.HashesOutputShards, context.HashesOutputFormat, context.HashesOutputCompression, context.HashesSigningKey)
+}
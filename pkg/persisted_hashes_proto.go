@@ -0,0 +1,313 @@
+package pkg
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/bazel-contrib/target-determinator/pkg/persistedhashespb"
+	"google.golang.org/protobuf/proto"
+)
+
+// marshalPersistedHashesProto encodes data as a PersistedHashData message from
+// persistedhashespb/persisted_hashes.proto. Labels and configurations are written in sorted order
+// so that the output is deterministic.
+func marshalPersistedHashesProto(data *PersistedHashData) ([]byte, error) {
+	message, err := persistedHashesToProto(data)
+	if err != nil {
+		return nil, err
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(message)
+}
+
+// persistedHashesToProto converts data to a PersistedHashData message, with its repeated fields
+// in sorted order.
+func persistedHashesToProto(data *PersistedHashData) (*persistedhashespb.PersistedHashData, error) {
+	message := &persistedhashespb.PersistedHashData{
+		SchemaVersion:            int32(data.SchemaVersion),
+		Revision:                 data.Revision,
+		Dirty:                    data.Dirty,
+		BazelRelease:             data.BazelRelease,
+		ConfigurationEnumeration: data.ConfigurationEnumeration,
+		IncompatibleTargets:      data.IncompatibleTargets,
+		Base:                     data.Base,
+		Removed:                  data.Removed,
+		HashFunction:             data.HashFunction,
+		Shards:                   data.Shards,
+		TargetsExpression:        data.TargetsExpression,
+		AnonymizationSaltDigest:  data.AnonymizationSaltDigest,
+	}
+
+	for _, labelString := range sortedKeys(data.Hashes) {
+		targetHashes := &persistedhashespb.TargetHashes{Label: labelString}
+		for _, configuration := range sortedUnion(data.Hashes[labelString], nil) {
+			hash, err := hex.DecodeString(data.Hashes[labelString][configuration])
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode hash of %s in configuration %s: %w", labelString, configuration, err)
+			}
+			targetHashes.Configurations = append(targetHashes.Configurations, &persistedhashespb.ConfigurationHash{
+				Configuration: configuration,
+				Hash:          hash,
+			})
+		}
+		if info, ok := data.Targets[labelString]; ok {
+			targetHashes.Kind = info.Kind
+			targetHashes.Tags = info.Tags
+			targetHashes.Testonly = info.TestOnly
+			targetHashes.Dependents = int64(info.Dependents)
+			targetHashes.SourceFiles = info.SourceFiles
+			for _, configuration := range sortedKeys(info.Breakdowns) {
+				breakdown, err := hashBreakdownToProto(configuration, info.Breakdowns[configuration])
+				if err != nil {
+					return nil, fmt.Errorf("failed to encode hash breakdown of %s in configuration %s: %w", labelString, configuration, err)
+				}
+				targetHashes.Breakdowns = append(targetHashes.Breakdowns, breakdown)
+			}
+		}
+		message.Hashes = append(message.Hashes, targetHashes)
+	}
+	for _, configuration := range sortedKeys(data.Configurations) {
+		message.Configurations = append(message.Configurations, configurationSummaryToProto(configuration, data.Configurations[configuration]))
+	}
+	for _, name := range sortedKeys(data.ExternalDependencies) {
+		dependency := data.ExternalDependencies[name]
+		message.ExternalDependencies = append(message.ExternalDependencies, &persistedhashespb.ExternalDependency{
+			Name:      name,
+			Version:   dependency.Version,
+			Integrity: dependency.Integrity,
+		})
+	}
+	for _, labelString := range sortedUnion(data.SourceFileHashes, nil) {
+		hash, err := hex.DecodeString(data.SourceFileHashes[labelString])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode hash of source file %s: %w", labelString, err)
+		}
+		message.SourceFileHashes = append(message.SourceFileHashes, &persistedhashespb.InputHash{Label: labelString, Hash: hash})
+	}
+	for _, labelString := range sortedKeys(data.IncompatibleConfigurations) {
+		message.IncompatibleConfigurations = append(message.IncompatibleConfigurations, &persistedhashespb.IncompatibleTarget{
+			Label:          labelString,
+			Configurations: data.IncompatibleConfigurations[labelString],
+		})
+	}
+	return message, nil
+}
+
+// unmarshalPersistedHashesProto decodes a PersistedHashData message from
+// persistedhashespb/persisted_hashes.proto. Duplicate hashes are handled as for
+// LoadPersistedHashes.
+func unmarshalPersistedHashesProto(b []byte, conflictPolicy string) (*PersistedHashData, error) {
+	var message persistedhashespb.PersistedHashData
+	if err := proto.Unmarshal(b, &message); err != nil {
+		return nil, err
+	}
+	return persistedHashesFromProto(&message, conflictPolicy)
+}
+
+// persistedHashesFromProto converts message to PersistedHashData, normalizing its labels.
+func persistedHashesFromProto(message *persistedhashespb.PersistedHashData, conflictPolicy string) (*PersistedHashData, error) {
+	data := &PersistedHashData{
+		SchemaVersion:            int(message.GetSchemaVersion()),
+		HashFunction:             message.GetHashFunction(),
+		Revision:                 message.GetRevision(),
+		Dirty:                    message.GetDirty(),
+		BazelRelease:             message.GetBazelRelease(),
+		ConfigurationEnumeration: message.GetConfigurationEnumeration(),
+		TargetsExpression:        message.GetTargetsExpression(),
+		IncompatibleTargets:      message.GetIncompatibleTargets(),
+		Hashes:                   make(map[string]map[string]string),
+		Base:                     message.GetBase(),
+		Shards:                   message.GetShards(),
+		AnonymizationSaltDigest:  message.GetAnonymizationSaltDigest(),
+	}
+	var labels labelValidator
+	for i, targetHashes := range message.GetHashes() {
+		if err := addTargetHashesFromProto(data, targetHashes, conflictPolicy, &labels, fmt.Sprintf("target %d", i+1)); err != nil {
+			return nil, err
+		}
+	}
+	for i, labelString := range message.GetRemoved() {
+		if l, ok := labels.parse(fmt.Sprintf("removed target %d", i+1), labelString); ok {
+			data.Removed = append(data.Removed, l.String())
+		}
+	}
+	for _, summary := range message.GetConfigurations() {
+		if data.Configurations == nil {
+			data.Configurations = make(map[string]PersistedConfiguration)
+		}
+		data.Configurations[summary.GetConfiguration()] = configurationSummaryFromProto(summary)
+	}
+	for _, dependency := range message.GetExternalDependencies() {
+		if data.ExternalDependencies == nil {
+			data.ExternalDependencies = make(map[string]PersistedExternalDependency)
+		}
+		data.ExternalDependencies[dependency.GetName()] = PersistedExternalDependency{
+			Version:   dependency.GetVersion(),
+			Integrity: dependency.GetIntegrity(),
+		}
+	}
+	for _, inputHash := range message.GetSourceFileHashes() {
+		if data.SourceFileHashes == nil {
+			data.SourceFileHashes = make(map[string]string)
+		}
+		data.SourceFileHashes[inputHash.GetLabel()] = hex.EncodeToString(inputHash.GetHash())
+	}
+	for _, incompatibleTarget := range message.GetIncompatibleConfigurations() {
+		if data.IncompatibleConfigurations == nil {
+			data.IncompatibleConfigurations = make(map[string][]string)
+		}
+		data.IncompatibleConfigurations[incompatibleTarget.GetLabel()] = append([]string{}, incompatibleTarget.GetConfigurations()...)
+	}
+	if err := labels.Err(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// addTargetHashesFromProto adds the hashes and target info in targetHashes, at location in its
+// file, to data. If its label is invalid, it is recorded in labels and the message is skipped.
+func addTargetHashesFromProto(data *PersistedHashData, targetHashes *persistedhashespb.TargetHashes, conflictPolicy string, labels *labelValidator, location string) error {
+	// Different spellings of the same label (e.g. "//foo" and "//foo:foo") are the same target.
+	l, ok := labels.parse(location, targetHashes.GetLabel())
+	if !ok {
+		return nil
+	}
+	labelString := l.String()
+	// Only rules have a kind.
+	if targetHashes.GetKind() != "" {
+		info := PersistedTargetInfo{
+			Kind:        targetHashes.GetKind(),
+			Tags:        targetHashes.GetTags(),
+			TestOnly:    targetHashes.GetTestonly(),
+			Dependents:  int(targetHashes.GetDependents()),
+			SourceFiles: targetHashes.GetSourceFiles(),
+		}
+		for _, breakdown := range targetHashes.GetBreakdowns() {
+			if info.Breakdowns == nil {
+				info.Breakdowns = make(map[string]PersistedHashBreakdown)
+			}
+			info.Breakdowns[breakdown.GetConfiguration()] = hashBreakdownFromProto(breakdown)
+		}
+		if data.Targets == nil {
+			data.Targets = make(map[string]PersistedTargetInfo)
+		}
+		data.Targets[labelString] = info
+	}
+	hashes := data.Hashes
+	if _, ok := hashes[labelString]; !ok {
+		hashes[labelString] = make(map[string]string)
+	}
+	for _, configurationHash := range targetHashes.GetConfigurations() {
+		if err := addPersistedHash(hashes, labelString, configurationHash.GetConfiguration(), hex.EncodeToString(configurationHash.GetHash()), conflictPolicy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// hashBreakdownToProto converts breakdown to a HashBreakdown message, with its sources and
+// dependencies in sorted order.
+func hashBreakdownToProto(configuration string, breakdown PersistedHashBreakdown) (*persistedhashespb.HashBreakdown, error) {
+	ruleImplementation, err := hex.DecodeString(breakdown.RuleImplementation)
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := hex.DecodeString(breakdown.Attributes)
+	if err != nil {
+		return nil, err
+	}
+	message := &persistedhashespb.HashBreakdown{
+		Configuration:      configuration,
+		RuleImplementation: ruleImplementation,
+		Attributes:         attributes,
+	}
+	inputHash := func(labelString string, configuration string, hexHash string) (*persistedhashespb.InputHash, error) {
+		hash, err := hex.DecodeString(hexHash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode hash of %s: %w", labelString, err)
+		}
+		return &persistedhashespb.InputHash{Label: labelString, Configuration: configuration, Hash: hash}, nil
+	}
+	for _, labelString := range sortedUnion(breakdown.Sources, nil) {
+		source, err := inputHash(labelString, "", breakdown.Sources[labelString])
+		if err != nil {
+			return nil, err
+		}
+		message.Sources = append(message.Sources, source)
+	}
+	for _, labelString := range sortedKeys(breakdown.Dependencies) {
+		for _, dependencyConfiguration := range sortedUnion(breakdown.Dependencies[labelString], nil) {
+			dependency, err := inputHash(labelString, dependencyConfiguration, breakdown.Dependencies[labelString][dependencyConfiguration])
+			if err != nil {
+				return nil, err
+			}
+			message.Dependencies = append(message.Dependencies, dependency)
+		}
+	}
+	return message, nil
+}
+
+// hashBreakdownFromProto converts a HashBreakdown message to PersistedHashBreakdown.
+func hashBreakdownFromProto(message *persistedhashespb.HashBreakdown) PersistedHashBreakdown {
+	breakdown := PersistedHashBreakdown{
+		RuleImplementation: hex.EncodeToString(message.GetRuleImplementation()),
+		Attributes:         hex.EncodeToString(message.GetAttributes()),
+	}
+	for _, source := range message.GetSources() {
+		if breakdown.Sources == nil {
+			breakdown.Sources = make(map[string]string)
+		}
+		breakdown.Sources[source.GetLabel()] = hex.EncodeToString(source.GetHash())
+	}
+	for _, dependency := range message.GetDependencies() {
+		if breakdown.Dependencies == nil {
+			breakdown.Dependencies = make(map[string]map[string]string)
+		}
+		if breakdown.Dependencies[dependency.GetLabel()] == nil {
+			breakdown.Dependencies[dependency.GetLabel()] = make(map[string]string)
+		}
+		breakdown.Dependencies[dependency.GetLabel()][dependency.GetConfiguration()] = hex.EncodeToString(dependency.GetHash())
+	}
+	return breakdown
+}
+
+// configurationSummaryToProto converts summary to a ConfigurationSummary message, with its flags
+// in sorted order.
+func configurationSummaryToProto(configuration string, summary PersistedConfiguration) *persistedhashespb.ConfigurationSummary {
+	message := &persistedhashespb.ConfigurationSummary{
+		Configuration:   configuration,
+		Platforms:       summary.Platforms,
+		CompilationMode: summary.CompilationMode,
+		Cpu:             summary.CPU,
+	}
+	for _, name := range sortedUnion(summary.Flags, nil) {
+		message.Flags = append(message.Flags, &persistedhashespb.ConfigurationFlag{Name: name, Value: summary.Flags[name]})
+	}
+	return message
+}
+
+// configurationSummaryFromProto converts a ConfigurationSummary message to PersistedConfiguration.
+func configurationSummaryFromProto(message *persistedhashespb.ConfigurationSummary) PersistedConfiguration {
+	summary := PersistedConfiguration{
+		Platforms:       message.GetPlatforms(),
+		CompilationMode: message.GetCompilationMode(),
+		CPU:             message.GetCpu(),
+	}
+	for _, flag := range message.GetFlags() {
+		if summary.Flags == nil {
+			summary.Flags = make(map[string]string)
+		}
+		summary.Flags[flag.GetName()] = flag.GetValue()
+	}
+	return summary
+}
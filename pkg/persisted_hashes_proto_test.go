@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/pkg/persistedhashespb"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMarshalPersistedHashesProtoMatchesGeneratedTypes(t *testing.T) {
+	data := &PersistedHashData{
+		SchemaVersion: PersistedHashesSchemaVersion,
+		Revision:      "0123456789abcdef0123456789abcdef01234567",
+		BazelRelease:  "release 7.1.0",
+		IncompatibleConfigurations: map[string][]string{
+			"//java/example:WindowsOnly": {configurationChecksum},
+		},
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib":   {configurationChecksum: "aabbcc"},
+			"//java/example:Greeting.java": {"": "ddeeff"},
+		},
+		Targets: map[string]PersistedTargetInfo{
+			"//java/example:GreetingLib": {Kind: "java_library", Tags: []string{"manual"}, Dependents: 2},
+		},
+		Configurations: map[string]PersistedConfiguration{
+			configurationChecksum: {Platforms: "[@local_config_platform//:host]", Flags: map[string]string{"stamp": "true"}},
+		},
+	}
+
+	content, err := marshalPersistedHashesProto(data)
+	if err != nil {
+		t.Fatalf("Failed to marshal hashes: %v", err)
+	}
+	var message persistedhashespb.PersistedHashData
+	if err := proto.Unmarshal(content, &message); err != nil {
+		t.Fatalf("Failed to unmarshal hashes into generated types: %v", err)
+	}
+	if got := message.GetSchemaVersion(); got != int32(PersistedHashesSchemaVersion) {
+		t.Fatalf("Wrong schema version: want %d got %d", PersistedHashesSchemaVersion, got)
+	}
+	var gotLabels []string
+	for _, targetHashes := range message.GetHashes() {
+		gotLabels = append(gotLabels, targetHashes.GetLabel())
+	}
+	if want := []string{"//java/example:Greeting.java", "//java/example:GreetingLib"}; !reflect.DeepEqual(want, gotLabels) {
+		t.Fatalf("Wrong labels: want %v got %v", want, gotLabels)
+	}
+	greetingLib := message.GetHashes()[1]
+	if got := greetingLib.GetConfigurations()[0].GetHash(); !bytes.Equal([]byte{0xaa, 0xbb, 0xcc}, got) {
+		t.Fatalf("Wrong hash: want aabbcc got %x", got)
+	}
+	if greetingLib.GetKind() != "java_library" || greetingLib.GetDependents() != 2 {
+		t.Fatalf("Wrong target info: want java_library with 2 dependents got %v", greetingLib)
+	}
+	if got := message.GetConfigurations()[0].GetFlags()[0].GetName(); got != "stamp" {
+		t.Fatalf("Wrong configuration flag: want stamp got %s", got)
+	}
+	if got := message.GetIncompatibleConfigurations()[0].GetConfigurations(); !reflect.DeepEqual([]string{configurationChecksum}, got) {
+		t.Fatalf("Wrong incompatible configurations: want %v got %v", []string{configurationChecksum}, got)
+	}
+
+	// Messages written by other tools with the generated types can be read back.
+	regenerated, err := proto.Marshal(&message)
+	if err != nil {
+		t.Fatalf("Failed to marshal generated types: %v", err)
+	}
+	got, err := unmarshalPersistedHashesProto(regenerated, "fail")
+	if err != nil {
+		t.Fatalf("Failed to unmarshal hashes: %v", err)
+	}
+	if !reflect.DeepEqual(data, got) {
+		t.Fatalf("Wrong persisted hashes: want %+v got %+v", data, got)
+	}
+}
@@ -0,0 +1,188 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// streamedMetadataSkippedFields are the fields of a JSON hash file which PersistedHashesStream
+// doesn't hold in memory, as they grow with the number of targets.
+var streamedMetadataSkippedFields = map[string]bool{
+	"hashes":                      true,
+	"targets":                     true,
+	"source_file_hashes":          true,
+	"incompatible_targets":        true,
+	"incompatible_configurations": true,
+}
+
+// PersistedHashesStream reads the hashes of a hash file one target at a time, in label order, so
+// that hash files can be compared without holding them in memory.
+// Only complete JSON hash files in local files, whose labels are sorted as PersistHashes writes
+// them, can be streamed: deltas, shard indexes, proto files and files in remote hash stores must be
+// read with LoadPersistedHashes. Signatures aren't checked, as that needs the whole file.
+type PersistedHashesStream struct {
+	// Metadata is the hash file without its Hashes, Targets, SourceFileHashes or incompatible
+	// targets, which are read from the file before any hashes, wherever they are in it.
+	Metadata *PersistedHashData
+
+	path     string
+	reader   io.ReadCloser
+	decoder  *json.Decoder
+	previous string
+	done     bool
+}
+
+// OpenPersistedHashesStream opens the hash file at path for streaming. The file is read twice: once
+// for its Metadata, and again as its hashes are read with Next.
+func OpenPersistedHashesStream(path string) (*PersistedHashesStream, error) {
+	if HashStoreFor(path) != (LocalHashStore{}) {
+		return nil, fmt.Errorf("can't stream hashes from %s, as only local files can be streamed", path)
+	}
+	metadata, err := readStreamedMetadata(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hashes from %s: %w", path, err)
+	}
+	if err := checkPersistedHashesSchemaVersion(path, metadata.SchemaVersion); err != nil {
+		return nil, err
+	}
+	if metadata.Base != "" {
+		return nil, fmt.Errorf("can't stream hashes from %s, as it is a delta against %s", path, metadata.Base)
+	}
+	if len(metadata.Shards) > 0 {
+		return nil, fmt.Errorf("can't stream hashes from %s, as it is an index of %d shards", path, len(metadata.Shards))
+	}
+
+	reader, err := openDecompressed(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hashes from %s: %w", path, err)
+	}
+	s := &PersistedHashesStream{Metadata: metadata, path: path, reader: reader, decoder: json.NewDecoder(reader)}
+	if err := s.seekHashes(); err != nil {
+		reader.Close()
+		return nil, fmt.Errorf("failed to read hashes from %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// readStreamedMetadata reads the fields of the JSON hash file at path other than
+// streamedMetadataSkippedFields.
+func readStreamedMetadata(path string) (*PersistedHashData, error) {
+	reader, err := openDecompressed(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	decoder := json.NewDecoder(reader)
+	token, err := decoder.Token()
+	if err != nil || token != json.Delim('{') {
+		return nil, fmt.Errorf("only JSON hash files can be streamed")
+	}
+	fields := make(map[string]json.RawMessage)
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if streamedMetadataSkippedFields[key.(string)] {
+			if err := skipJSONValue(decoder); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		fields[key.(string)] = value
+	}
+	content, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	var metadata PersistedHashData
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// seekHashes advances the decoder to the first label in the hashes field, or the end of the file
+// if it has none.
+func (s *PersistedHashesStream) seekHashes() error {
+	if err := expectDelim(s.decoder, '{'); err != nil {
+		return err
+	}
+	for s.decoder.More() {
+		key, err := s.decoder.Token()
+		if err != nil {
+			return err
+		}
+		if key == "hashes" {
+			return expectDelim(s.decoder, '{')
+		}
+		if err := skipJSONValue(s.decoder); err != nil {
+			return err
+		}
+	}
+	s.done = true
+	return nil
+}
+
+// Next returns the next target's label and hashes by configuration, or false once there are no
+// more. Labels are normalized as LoadPersistedHashes does, and must be in strictly increasing
+// order.
+func (s *PersistedHashesStream) Next() (string, map[string]string, bool, error) {
+	if s.done {
+		return "", nil, false, nil
+	}
+	if !s.decoder.More() {
+		s.done = true
+		return "", nil, false, nil
+	}
+	token, err := s.decoder.Token()
+	if err != nil {
+		return "", nil, false, fmt.Errorf("failed to read hashes from %s: %w", s.path, err)
+	}
+	l, err := label.Parse(token.(string))
+	if err != nil {
+		return "", nil, false, fmt.Errorf("failed to read hashes from %s: invalid label %q: %w", s.path, token, err)
+	}
+	labelString := l.String()
+	if labelString <= s.previous {
+		return "", nil, false, fmt.Errorf("can't stream hashes from %s, as its labels aren't sorted: %s is after %s", s.path, labelString, s.previous)
+	}
+	s.previous = labelString
+	var hashes map[string]string
+	if err := s.decoder.Decode(&hashes); err != nil {
+		return "", nil, false, fmt.Errorf("failed to read hashes of %s from %s: %w", labelString, s.path, err)
+	}
+	return labelString, hashes, true, nil
+}
+
+// Close closes the hash file.
+func (s *PersistedHashesStream) Close() error {
+	return s.reader.Close()
+}
+
+// skipJSONValue reads the next value from decoder without holding it in memory.
+func skipJSONValue(decoder *json.Decoder) error {
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,688 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+func TestPersistHashesRoundTrips(t *testing.T) {
+	want := &PersistedHashData{
+		SchemaVersion: PersistedHashesSchemaVersion,
+		Revision:      "0123456789abcdef0123456789abcdef01234567",
+		BazelRelease:  "release 7.1.0",
+		IncompatibleConfigurations: map[string][]string{
+			"//java/example:WindowsOnly": {configurationChecksum},
+		},
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib": {
+				configurationChecksum: "aabbcc",
+			},
+			"//java/example:Greeting.java": {
+				"": "ddeeff",
+			},
+		},
+		Targets: map[string]PersistedTargetInfo{
+			"//java/example:GreetingLib": {
+				Kind:        "java_library",
+				Tags:        []string{"manual", "no-remote"},
+				TestOnly:    true,
+				Dependents:  3,
+				SourceFiles: []string{"//java/example:Greeting.java"},
+				Breakdowns: map[string]PersistedHashBreakdown{
+					configurationChecksum: {
+						RuleImplementation: "0a0b0c",
+						Attributes:         "0d0e0f",
+						Sources:            map[string]string{"//java/example:Greeting.java": "ddeeff"},
+						Dependencies: map[string]map[string]string{
+							"//java/example:Util": {configurationChecksum: "a1b2c3", "": "d4e5f6"},
+						},
+					},
+				},
+			},
+		},
+		Configurations: map[string]PersistedConfiguration{
+			configurationChecksum: {
+				Platforms:       "[@local_config_platform//:host]",
+				CompilationMode: "fastbuild",
+				CPU:             "k8",
+				Flags:           map[string]string{"define": "[FOO=1]", "stamp": "true"},
+			},
+		},
+		ExternalDependencies: map[string]PersistedExternalDependency{
+			"rules_go":               {Version: "0.46.0", Integrity: "sha256:aabbcc"},
+			"com_github_google_uuid": {Version: "v1.3.0"},
+		},
+		SourceFileHashes: map[string]string{"//java/example:Greeting.java": "ddeeff"},
+	}
+
+	path := filepath.Join(t.TempDir(), "hashes.json")
+	if err := PersistHashes(path, want); err != nil {
+		t.Fatalf("Failed to persist hashes: %v", err)
+	}
+	got, err := LoadPersistedHashes(path, "fail")
+	if err != nil {
+		t.Fatalf("Failed to load persisted hashes: %v", err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong persisted hashes: want %+v got %+v", want, got)
+	}
+}
+
+func TestPersistedHashDataQueryResults(t *testing.T) {
+	data := &PersistedHashData{
+		Revision:            "0123456789abcdef0123456789abcdef01234567",
+		BazelRelease:        "release 7.1.0",
+		IncompatibleTargets: []string{"//java/example:WindowsOnly"},
+		IncompatibleConfigurations: map[string][]string{
+			"//java/example:LinuxOnly": {configurationChecksum},
+		},
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib": {
+				configurationChecksum: "aabbcc",
+			},
+			"//java/example:Greeting.java": {
+				"": "ddeeff",
+			},
+		},
+		Targets: map[string]PersistedTargetInfo{
+			"//java/example:GreetingLib": {Kind: "java_library", Tags: []string{"manual"}},
+		},
+	}
+
+	queryResults, err := data.QueryResults()
+	if err != nil {
+		t.Fatalf("Failed to create QueryResults: %v", err)
+	}
+
+	wantLabels := []label.Label{mustParseLabel("//java/example:Greeting.java"), mustParseLabel("//java/example:GreetingLib")}
+	if gotLabels := queryResults.MatchingTargets.Labels(); !reflect.DeepEqual(wantLabels, gotLabels) {
+		t.Fatalf("Wrong labels: want %v got %v", wantLabels, gotLabels)
+	}
+
+	wantIncompatibleTargets := map[label.Label][]Configuration{
+		mustParseLabel("//java/example:WindowsOnly"): nil,
+		mustParseLabel("//java/example:LinuxOnly"):   {NormalizeConfiguration(configurationChecksum)},
+	}
+	if !reflect.DeepEqual(wantIncompatibleTargets, queryResults.IncompatibleTargets) {
+		t.Fatalf("Wrong incompatible targets: want %v got %v", wantIncompatibleTargets, queryResults.IncompatibleTargets)
+	}
+
+	labelAndConfiguration := LabelAndConfiguration{
+		Label:         mustParseLabel("//java/example:GreetingLib"),
+		Configuration: NormalizeConfiguration(configurationChecksum),
+	}
+	if !queryResults.MatchingTargets.ContainsLabelAndConfiguration(labelAndConfiguration.Label, labelAndConfiguration.Configuration) {
+		t.Fatalf("Expected %v to be a matching target", labelAndConfiguration)
+	}
+	hash, err := queryResults.TargetHashCache.Hash(labelAndConfiguration)
+	if err != nil {
+		t.Fatalf("Failed to get hash: %v", err)
+	}
+	if want := []byte{0xaa, 0xbb, 0xcc}; !bytes.Equal(want, hash) {
+		t.Fatalf("Wrong hash: want %x got %x", want, hash)
+	}
+
+	configuredTarget := queryResults.TransitiveConfiguredTargets[labelAndConfiguration.Label][labelAndConfiguration.Configuration]
+	if !RuleKindMatches(configuredTarget, []string{"java_library"}) {
+		t.Fatalf("Wrong rule kind: want java_library got %v", configuredTarget.GetTarget().GetRule().GetRuleClass())
+	}
+	if !isManual(configuredTarget.GetTarget()) {
+		t.Fatalf("Expected %v to be manual", labelAndConfiguration.Label)
+	}
+}
+
+func TestPersistHashesCompressed(t *testing.T) {
+	want := &PersistedHashData{
+		SchemaVersion: PersistedHashesSchemaVersion,
+		Revision:      "0123456789abcdef0123456789abcdef01234567",
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib": {
+				configurationChecksum: "aabbcc",
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		fileName    string
+		compression string
+		wantMagic   []byte
+	}{
+		{"hashes.json.gz", "auto", gzipMagic},
+		{"hashes.json.zst", "auto", zstdMagic},
+		{"hashes.json", "gzip", gzipMagic},
+		{"hashes.json", "none", []byte("{")},
+	} {
+		path := filepath.Join(t.TempDir(), tc.fileName)
+		if err := PersistHashesAs(path, want, "json", tc.compression); err != nil {
+			t.Fatalf("Failed to persist hashes to %s: %v", tc.fileName, err)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(content, tc.wantMagic) {
+			t.Fatalf("Wrong compression of %s with %s: want prefix %v got %v", tc.fileName, tc.compression, tc.wantMagic, content[:len(tc.wantMagic)])
+		}
+		got, err := LoadPersistedHashes(path, "fail")
+		if err != nil {
+			t.Fatalf("Failed to load persisted hashes from %s: %v", tc.fileName, err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong persisted hashes from %s: want %+v got %+v", tc.fileName, want, got)
+		}
+	}
+}
+
+func TestPersistHashesProtoRoundTrips(t *testing.T) {
+	want := &PersistedHashData{
+		SchemaVersion:            PersistedHashesSchemaVersion,
+		HashFunction:             PersistedHashFunction,
+		Revision:                 "0123456789abcdef0123456789abcdef01234567",
+		Dirty:                    true,
+		BazelRelease:             "release 7.1.0",
+		ConfigurationEnumeration: "all",
+		TargetsExpression:        "//java/... - //java/example:WindowsOnly",
+		AnonymizationSaltDigest:  "0a1b2c",
+		IncompatibleTargets:      []string{"//java/example:WindowsOnly"},
+		IncompatibleConfigurations: map[string][]string{
+			"//java/example:LinuxOnly": {configurationChecksum},
+			"//java/example:MacOSOnly": {},
+		},
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib": {
+				configurationChecksum: "aabbcc",
+				"":                    "001122",
+			},
+			"//java/example:Greeting.java": {
+				"": "ddeeff",
+			},
+		},
+		Targets: map[string]PersistedTargetInfo{
+			"//java/example:GreetingLib": {
+				Kind:        "java_library",
+				Tags:        []string{"manual", "no-remote"},
+				TestOnly:    true,
+				Dependents:  3,
+				SourceFiles: []string{"//java/example:Greeting.java"},
+				Breakdowns: map[string]PersistedHashBreakdown{
+					configurationChecksum: {
+						RuleImplementation: "0a0b0c",
+						Attributes:         "0d0e0f",
+						Sources:            map[string]string{"//java/example:Greeting.java": "ddeeff"},
+						Dependencies: map[string]map[string]string{
+							"//java/example:Util": {configurationChecksum: "a1b2c3", "": "d4e5f6"},
+						},
+					},
+				},
+			},
+		},
+		Configurations: map[string]PersistedConfiguration{
+			configurationChecksum: {
+				Platforms:       "[@local_config_platform//:host]",
+				CompilationMode: "fastbuild",
+				CPU:             "k8",
+				Flags:           map[string]string{"define": "[FOO=1]", "stamp": "true"},
+			},
+		},
+		ExternalDependencies: map[string]PersistedExternalDependency{
+			"rules_go":               {Version: "0.46.0", Integrity: "sha256:aabbcc"},
+			"com_github_google_uuid": {Version: "v1.3.0"},
+		},
+		SourceFileHashes: map[string]string{"//java/example:Greeting.java": "ddeeff"},
+	}
+
+	for _, compression := range []string{"none", "gzip"} {
+		path := filepath.Join(t.TempDir(), "hashes.pb")
+		if err := PersistHashesAs(path, want, "proto", compression); err != nil {
+			t.Fatalf("Failed to persist hashes: %v", err)
+		}
+		got, err := LoadPersistedHashes(path, "fail")
+		if err != nil {
+			t.Fatalf("Failed to load persisted hashes: %v", err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong persisted hashes with compression %s: want %+v got %+v", compression, want, got)
+		}
+	}
+}
+
+func TestPersistHashesDeltaRoundTrips(t *testing.T) {
+	base := &PersistedHashData{
+		SchemaVersion: PersistedHashesSchemaVersion,
+		Revision:      "0123456789abcdef0123456789abcdef01234567",
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib":   {configurationChecksum: "aabbcc"},
+			"//java/example:Greeting.java": {"": "ddeeff"},
+			"//java/example:Removed":       {configurationChecksum: "001122"},
+		},
+		Targets: map[string]PersistedTargetInfo{
+			"//java/example:GreetingLib": {Kind: "java_library"},
+			"//java/example:Removed":     {Kind: "java_binary"},
+		},
+	}
+	want := &PersistedHashData{
+		SchemaVersion: PersistedHashesSchemaVersion,
+		Revision:      "89abcdef0123456789abcdef0123456789abcdef",
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib":   {configurationChecksum: "aabbcc"},
+			"//java/example:Greeting.java": {"": "334455"},
+			"//java/example:Added":         {configurationChecksum: "667788"},
+		},
+		Targets: map[string]PersistedTargetInfo{
+			"//java/example:GreetingLib": {Kind: "java_library"},
+			"//java/example:Added":       {Kind: "java_test", TestOnly: true},
+		},
+	}
+
+	delta := want.DeltaFrom(base, "base.json")
+	wantDeltaHashes := map[string]map[string]string{
+		"//java/example:Greeting.java": {"": "334455"},
+		"//java/example:Added":         {configurationChecksum: "667788"},
+	}
+	if !reflect.DeepEqual(wantDeltaHashes, delta.Hashes) {
+		t.Fatalf("Wrong delta hashes: want %v got %v", wantDeltaHashes, delta.Hashes)
+	}
+	if wantRemoved := []string{"//java/example:Removed"}; !reflect.DeepEqual(wantRemoved, delta.Removed) {
+		t.Fatalf("Wrong removed labels: want %v got %v", wantRemoved, delta.Removed)
+	}
+
+	dir := t.TempDir()
+	if err := PersistHashes(filepath.Join(dir, "base.json"), base); err != nil {
+		t.Fatalf("Failed to persist base hashes: %v", err)
+	}
+	for _, format := range []string{"json", "proto"} {
+		path := filepath.Join(dir, "delta."+format)
+		if err := PersistHashesAs(path, delta, format, "none"); err != nil {
+			t.Fatalf("Failed to persist delta hashes: %v", err)
+		}
+		got, err := LoadPersistedHashes(path, "fail")
+		if err != nil {
+			t.Fatalf("Failed to load delta hashes: %v", err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong hashes from %s delta: want %+v got %+v", format, want, got)
+		}
+	}
+}
+
+func TestLoadPersistedHashesRejectsDeltaCycles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.json")
+	content := `{"revision": "0123456789abcdef0123456789abcdef01234567", "hashes": {}, "base": "hashes.json"}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPersistedHashes(path, "fail"); err == nil {
+		t.Fatalf("Expected error loading hashes which are a delta against themselves")
+	}
+}
+
+func TestLoadPersistedHashesRejectsNewerSchemaVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hashes.json")
+	content := `{"schema_version": 1000, "revision": "0123456789abcdef0123456789abcdef01234567", "hashes": {}}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPersistedHashes(path, "fail"); err == nil {
+		t.Fatalf("Expected error loading hashes with an unsupported schema version")
+	}
+}
+
+func TestLoadPersistedHashesRejectsDeltasWithDifferentHashFunctions(t *testing.T) {
+	dir := t.TempDir()
+	base := `{"revision": "0123456789abcdef0123456789abcdef01234567", "hashes": {"//java/example:GreetingLib": {"cfg": "aa"}}}`
+	if err := os.WriteFile(filepath.Join(dir, "base.json"), []byte(base), 0644); err != nil {
+		t.Fatal(err)
+	}
+	delta := `{"schema_version": 2, "hash_function": "sha256-v2", "revision": "89abcdef0123456789abcdef0123456789abcdef", "hashes": {}, "base": "base.json"}`
+	if err := os.WriteFile(filepath.Join(dir, "delta.json"), []byte(delta), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPersistedHashes(filepath.Join(dir, "delta.json"), "fail"); err == nil {
+		t.Fatalf("Expected error loading a delta computed with a different hash function from its base")
+	}
+}
+
+func TestEffectiveHashFunction(t *testing.T) {
+	if got := (&PersistedHashData{}).EffectiveHashFunction(); got != "sha256-v1" {
+		t.Fatalf("Wrong hash function for hashes without one: want sha256-v1 got %v", got)
+	}
+	if got := (&PersistedHashData{HashFunction: "sha256-v2"}).EffectiveHashFunction(); got != "sha256-v2" {
+		t.Fatalf("Wrong hash function: want sha256-v2 got %v", got)
+	}
+}
+
+func TestLoadPersistedHashesWithDuplicates(t *testing.T) {
+	const content = `{"revision":"abc","hashes":{` +
+		`"//java/example:GreetingLib":{"cfg":"aa"},` +
+		`"//java/example:Greeting.java":{"":"bb"},` +
+		`"//java/example:GreetingLib":{"cfg":"cc","other":"dd"},` +
+		`"//java/example:Greeting.java":{"":"bb"}` +
+		`}}`
+	path := filepath.Join(t.TempDir(), "hashes.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write hashes: %v", err)
+	}
+
+	for policy, want := range map[string]map[string]map[string]string{
+		"first": {
+			"//java/example:GreetingLib":   {"cfg": "aa", "other": "dd"},
+			"//java/example:Greeting.java": {"": "bb"},
+		},
+		"last": {
+			"//java/example:GreetingLib":   {"cfg": "cc", "other": "dd"},
+			"//java/example:Greeting.java": {"": "bb"},
+		},
+	} {
+		t.Run(policy, func(t *testing.T) {
+			got, err := LoadPersistedHashes(path, policy)
+			if err != nil {
+				t.Fatalf("Failed to load persisted hashes: %v", err)
+			}
+			if !reflect.DeepEqual(want, got.Hashes) {
+				t.Fatalf("Wrong hashes: want %v got %v", want, got.Hashes)
+			}
+		})
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		if _, err := LoadPersistedHashes(path, "fail"); err == nil {
+			t.Fatalf("Expected conflicting hashes to fail to load")
+		}
+	})
+}
+
+func TestPersistedHashDataAnonymized(t *testing.T) {
+	data := &PersistedHashData{
+		Revision:            "0123456789abcdef0123456789abcdef01234567",
+		IncompatibleTargets: []string{"//java/example:WindowsOnly"},
+		IncompatibleConfigurations: map[string][]string{
+			"//java/example:LinuxOnly": {configurationChecksum},
+		},
+		Hashes: map[string]map[string]string{
+			"//java/example:example":       {configurationChecksum: "aabbcc"},
+			"//java/example:Greeting.java": {"": "ddeeff"},
+			"//java/other:example":         {configurationChecksum: "112233"},
+		},
+	}
+
+	anonymized, err := data.Anonymized("secret")
+	if err != nil {
+		t.Fatalf("Failed to anonymize: %v", err)
+	}
+	if anonymized.AnonymizationSaltDigest == "" {
+		t.Fatalf("Expected the anonymization salt digest to be recorded")
+	}
+	if _, err := anonymized.Anonymized("secret"); err == nil {
+		t.Fatalf("Expected error anonymizing hashes twice")
+	}
+	if len(anonymized.Hashes) != len(data.Hashes) || len(anonymized.IncompatibleTargets) != 1 || len(anonymized.IncompatibleConfigurations) != 1 {
+		t.Fatalf("Wrong number of labels: want %d hashes and 2 incompatible targets got %v", len(data.Hashes), anonymized)
+	}
+	for labelString, configurations := range anonymized.IncompatibleConfigurations {
+		if strings.Contains(labelString, "LinuxOnly") {
+			t.Fatalf("Expected incompatible target %s to be anonymized", labelString)
+		}
+		if want := []string{configurationChecksum}; !reflect.DeepEqual(want, configurations) {
+			t.Fatalf("Wrong incompatible configurations: want %v got %v", want, configurations)
+		}
+	}
+	labels := make(map[string]label.Label)
+	for labelString, hashes := range anonymized.Hashes {
+		for _, name := range []string{"java/", "example", "Greeting", "other"} {
+			if strings.Contains(labelString, name) {
+				t.Fatalf("Expected %s to be anonymized", labelString)
+			}
+		}
+		l, err := label.Parse(labelString)
+		if err != nil {
+			t.Fatalf("Failed to parse anonymized label %s: %v", labelString, err)
+		}
+		labels[hashes[configurationChecksum]+hashes[""]] = l
+	}
+
+	if example, other := labels["aabbcc"], labels["112233"]; example.Name != other.Name || example.Pkg == other.Pkg || path.Dir(example.Pkg) != path.Dir(other.Pkg) {
+		t.Fatalf("Expected anonymized labels %s and %s to keep the structure of the originals", example, other)
+	}
+	if greeting := labels["ddeeff"]; !strings.HasSuffix(greeting.Name, ".java") || greeting.Pkg != labels["aabbcc"].Pkg {
+		t.Fatalf("Expected anonymized label %s to keep its extension and package", greeting)
+	}
+
+	again, err := data.Anonymized("secret")
+	if err != nil {
+		t.Fatalf("Failed to anonymize: %v", err)
+	}
+	if !reflect.DeepEqual(anonymized, again) {
+		t.Fatalf("Expected anonymization to be stable: got %v and %v", anonymized, again)
+	}
+}
+
+func TestPersistedHashDataAnonymizedBreakdowns(t *testing.T) {
+	data := &PersistedHashData{
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib": {configurationChecksum: "aabbcc"},
+		},
+		Targets: map[string]PersistedTargetInfo{
+			"//java/example:GreetingLib": {
+				Kind: "java_library",
+				Breakdowns: map[string]PersistedHashBreakdown{
+					configurationChecksum: {
+						RuleImplementation: "0a0b0c",
+						Attributes:         "0d0e0f",
+						Sources:            map[string]string{"//java/example:Greeting.java": "ddeeff"},
+						Dependencies:       map[string]map[string]string{"//java/example:Util": {configurationChecksum: "a1b2c3"}},
+					},
+				},
+			},
+		},
+	}
+	anonymized, err := data.Anonymized("secret")
+	if err != nil {
+		t.Fatalf("Failed to anonymize: %v", err)
+	}
+	for _, info := range anonymized.Targets {
+		breakdown := info.Breakdowns[configurationChecksum]
+		if breakdown.RuleImplementation != "0a0b0c" || breakdown.Attributes != "0d0e0f" || len(breakdown.Sources) != 1 || len(breakdown.Dependencies) != 1 {
+			t.Fatalf("Wrong anonymized breakdown: %+v", breakdown)
+		}
+		for labelString := range breakdown.Sources {
+			if strings.Contains(labelString, "Greeting") || !strings.HasSuffix(labelString, ".java") {
+				t.Fatalf("Expected source %s to be anonymized", labelString)
+			}
+		}
+		for labelString := range breakdown.Dependencies {
+			if strings.Contains(labelString, "Util") {
+				t.Fatalf("Expected dependency %s to be anonymized", labelString)
+			}
+		}
+	}
+}
+
+func TestMarshalPersistedHashesIsCanonical(t *testing.T) {
+	newData := func(incompatibleTargets []string, tags []string) *PersistedHashData {
+		data := &PersistedHashData{
+			SchemaVersion:       PersistedHashesSchemaVersion,
+			Revision:            "0123456789abcdef0123456789abcdef01234567",
+			IncompatibleTargets: incompatibleTargets,
+			Hashes:              make(map[string]map[string]string),
+			Targets:             make(map[string]PersistedTargetInfo),
+		}
+		for i := 0; i < 50; i++ {
+			labelString := fmt.Sprintf("//java/example:Lib%d", i)
+			data.Hashes[labelString] = map[string]string{configurationChecksum: fmt.Sprintf("%06x", i), "": fmt.Sprintf("%06x", i+100)}
+			data.Targets[labelString] = PersistedTargetInfo{Kind: "java_library", Tags: tags}
+		}
+		return data
+	}
+	want := newData([]string{"//java/example:A", "//java/example:B"}, []string{"manual", "no-remote"})
+	reordered := newData([]string{"//java/example:B", "//java/example:A"}, []string{"no-remote", "manual"})
+
+	for _, format := range []string{"json", "proto"} {
+		for _, compression := range []string{"none", "gzip"} {
+			wantContent, err := MarshalPersistedHashes(want, format, compression)
+			if err != nil {
+				t.Fatalf("Failed to marshal hashes: %v", err)
+			}
+			for i := 0; i < 5; i++ {
+				got, err := MarshalPersistedHashes(reordered, format, compression)
+				if err != nil {
+					t.Fatalf("Failed to marshal hashes: %v", err)
+				}
+				if !bytes.Equal(wantContent, got) {
+					t.Fatalf("Wrong %s %s encoding: want the same bytes for the same hashes", format, compression)
+				}
+			}
+		}
+	}
+
+	wantDigest, err := CanonicalDigest(want)
+	if err != nil {
+		t.Fatalf("Failed to get digest: %v", err)
+	}
+	if got, err := CanonicalDigest(reordered); err != nil || got != wantDigest {
+		t.Fatalf("Wrong digest: want %v got %v (err %v)", wantDigest, got, err)
+	}
+	reordered.Hashes["//java/example:Lib0"][configurationChecksum] = "ffffff"
+	if got, err := CanonicalDigest(reordered); err != nil || got == wantDigest {
+		t.Fatalf("Wrong digest of different hashes: want other than %v got %v (err %v)", wantDigest, got, err)
+	}
+}
+
+func TestMarshalCanonicalJSON(t *testing.T) {
+	data := &PersistedHashData{
+		SchemaVersion: PersistedHashesSchemaVersion,
+		Revision:      "0123456789abcdef0123456789abcdef01234567",
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib": {configurationChecksum: "aabbcc"},
+		},
+		Targets: map[string]PersistedTargetInfo{
+			"//java/example:GreetingLib": {Kind: "java_library", Tags: []string{"no-remote", "manual"}},
+		},
+	}
+	got, err := MarshalCanonicalJSON(data)
+	if err != nil {
+		t.Fatalf("Failed to marshal hashes: %v", err)
+	}
+	want := fmt.Sprintf(`{
+  "schema_version": %d,
+  "revision": "0123456789abcdef0123456789abcdef01234567",
+  "bazel_release": "",
+  "hashes": {
+    "//java/example:GreetingLib": {
+      "%s": "aabbcc"
+    }
+  },
+  "targets": {
+    "//java/example:GreetingLib": {
+      "kind": "java_library",
+      "tags": [
+        "manual",
+        "no-remote"
+      ]
+    }
+  }
+}
+`, PersistedHashesSchemaVersion, configurationChecksum)
+	if string(got) != want {
+		t.Fatalf("Wrong canonical JSON: want %s got %s", want, got)
+	}
+	roundTripped, err := UnmarshalPersistedHashes(got, "fail")
+	if err != nil {
+		t.Fatalf("Failed to unmarshal canonical JSON: %v", err)
+	}
+	if !reflect.DeepEqual(data.Canonical(), roundTripped) {
+		t.Fatalf("Wrong hashes from canonical JSON: want %+v got %+v", data.Canonical(), roundTripped)
+	}
+}
+
+func TestSummarizeConfiguration(t *testing.T) {
+	configuration := singleConfigurationOutput{
+		ConfigHash: configurationChecksum,
+		FragmentOptions: json.RawMessage(`[
+  {"name": "com.google.devtools.build.lib.analysis.config.CoreOptions", "options": {"compilation_mode": "opt", "cpu": "k8", "define": "[FOO=1]", "features": "[]", "stamp": "false", "jobs": "8"}},
+  {"name": "com.google.devtools.build.lib.analysis.PlatformOptions", "options": {"platforms": "[@local_config_platform//:host]", "host_platform": "@local_config_platform//:host"}},
+  {"name": "com.google.devtools.build.lib.rules.cpp.CppOptions", "options": {"copt": "[-O2]", "cxxopt": null}}
+]`),
+	}
+	want := PersistedConfiguration{
+		Platforms:       "[@local_config_platform//:host]",
+		CompilationMode: "opt",
+		CPU:             "k8",
+		Flags:           map[string]string{"copt": "[-O2]", "define": "[FOO=1]", "stamp": "false"},
+	}
+	got, err := summarizeConfiguration(configuration)
+	if err != nil {
+		t.Fatalf("Error summarizing configuration: %v", err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong configuration summary: want %+v got %+v", want, got)
+	}
+}
+
+func TestLoadBeforeHashesChecksConfigurationEnumeration(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	path := filepath.Join(t.TempDir(), "hashes.json")
+	if err := PersistHashes(path, &PersistedHashData{
+		SchemaVersion:            PersistedHashesSchemaVersion,
+		Revision:                 sha,
+		BazelRelease:             "release 7.1.0",
+		ConfigurationEnumeration: "include-exec",
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib": {configurationChecksum: "aabbcc"},
+		},
+	}); err != nil {
+		t.Fatalf("Failed to persist hashes: %v", err)
+	}
+	revBefore := LabelledGitRev{Label: "before", GitRevision: GitRev{Revision: sha, Sha: sha}}
+	for configurationEnumeration, wantUsed := range map[string]bool{
+		"include-exec": true,
+		"top-level":    false,
+		"":             false,
+		"all":          false,
+	} {
+		context := &Context{BeforeHashesFile: path, PersistedHashConflictPolicy: "fail", ConfigurationEnumeration: configurationEnumeration}
+		queryInfo, err := loadBeforeHashes(context, revBefore)
+		if err != nil {
+			t.Fatalf("Failed to load hashes with configuration enumeration %q: %v", configurationEnumeration, err)
+		}
+		if gotUsed := queryInfo != nil; gotUsed != wantUsed {
+			t.Errorf("Wrong result for whether hashes computed with include-exec were used with configuration enumeration %q: want %v got %v", configurationEnumeration, wantUsed, gotUsed)
+		}
+	}
+}
+
+func TestLoadBeforeHashesRejectsAnonymizedHashes(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	data, err := (&PersistedHashData{
+		SchemaVersion: PersistedHashesSchemaVersion,
+		Revision:      sha,
+		BazelRelease:  "release 7.1.0",
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib": {configurationChecksum: "aabbcc"},
+		},
+	}).Anonymized("secret")
+	if err != nil {
+		t.Fatalf("Failed to anonymize hashes: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "hashes.json")
+	if err := PersistHashes(path, data); err != nil {
+		t.Fatalf("Failed to persist hashes: %v", err)
+	}
+	revBefore := LabelledGitRev{Label: "before", GitRevision: GitRev{Revision: sha, Sha: sha}}
+	context := &Context{BeforeHashesFile: path, PersistedHashConflictPolicy: "fail", AnonymizationSalt: "secret"}
+	queryInfo, err := loadBeforeHashes(context, revBefore)
+	if err != nil {
+		t.Fatalf("Failed to load hashes: %v", err)
+	}
+	if queryInfo != nil {
+		t.Fatalf("Expected anonymized hashes not to be used")
+	}
+}
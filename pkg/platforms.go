@@ -0,0 +1,40 @@
+package pkg
+
+import (
+	"fmt"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// PlatformWalkCallback is like WalkCallback, but is also told which platform the target was
+// affected for.
+type PlatformWalkCallback func(string, label.Label, []Difference, *analysis.ConfiguredTarget)
+
+// WalkAffectedTargetsForPlatforms computes which targets have changed between two commits for each
+// of the passed platforms, and calls callback once for each target which has changed on each
+// platform.
+// Each revision is only checked out once, then queried and hashed for each platform in turn as if
+// `--platforms=<platform>` had been passed to Bazel.
+func WalkAffectedTargetsForPlatforms(context *Context, revBefore LabelledGitRev, targets TargetsList, platforms []string, includeDifferences bool, callback PlatformWalkCallback) error {
+	revAfter, err := NewLabelledGitRev(context.WorkspacePath, "", "after")
+	if err != nil {
+		return fmt.Errorf("could not create \"after\" revision: %w", err)
+	}
+
+	beforeMetadata, afterMetadata, err := fullyProcessForPlatforms(context, revBefore, revAfter, targets, platforms)
+	if err != nil {
+		return fmt.Errorf("failed to process change: %w", err)
+	}
+
+	for i, platform := range platforms {
+		Progressf("Computing affected targets for platform %s", platform)
+		platformCallback := func(label label.Label, differences []Difference, configuredTarget *analysis.ConfiguredTarget) {
+			callback(platform, label, differences, configuredTarget)
+		}
+		if err := walkAffectedTargetsBetween(context, revBefore, beforeMetadata[i], afterMetadata[i], includeDifferences, platformCallback); err != nil {
+			return fmt.Errorf("failed to compute affected targets for platform %s: %w", platform, err)
+		}
+	}
+	return nil
+}
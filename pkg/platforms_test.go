@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"google.golang.org/protobuf/proto"
+)
+
+// platformSourceFileBazelCmd is a BazelCmd whose cquery results are a single source file for each
+// platform, and which records the platform and the content of that file for each cquery, and the
+// content of that file and the startup options of each cquery.
+type platformSourceFileBazelCmd struct {
+	sourceFiles    map[string]string
+	cqueries       []string
+	startupOptions []string
+}
+
+func (c *platformSourceFileBazelCmd) Execute(config BazelCmdConfig, startupArgs []string, command string, args ...string) (int, error) {
+	switch command {
+	case "info":
+		if args[0] == "release" {
+			fmt.Fprintln(config.Stdout, "release 6.5.0")
+		}
+		return 0, nil
+	case "config":
+		fmt.Fprintln(config.Stdout, "[]")
+		return 0, nil
+	}
+	return 1, fmt.Errorf("unexpected bazel %s %v", command, args)
+}
+
+func (c *platformSourceFileBazelCmd) Cquery(bazelRelease string, config BazelCmdConfig, startupArgs []string, args ...string) (int, error) {
+	var platform string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--platforms=") {
+			platform = strings.TrimPrefix(arg, "--platforms=")
+		}
+	}
+	sourceFile := c.sourceFiles[platform]
+	content, err := os.ReadFile(filepath.Join(config.Dir, sourceFile))
+	if err != nil {
+		return 1, err
+	}
+	c.cqueries = append(c.cqueries, platform+" "+strings.TrimSpace(string(content)))
+	c.startupOptions = append(c.startupOptions, strings.TrimSpace(string(content))+" "+strings.Join(startupArgs, " "))
+	result, err := proto.Marshal(&analysis.CqueryResult{
+		Results: []*analysis.ConfiguredTarget{
+			{
+				Target: &build.Target{
+					Type: build.Target_SOURCE_FILE.Enum(),
+					SourceFile: &build.SourceFile{
+						Name:     proto.String("//:" + sourceFile),
+						Location: proto.String(fmt.Sprintf("%s/BUILD.bazel:1:1", config.Dir)),
+					},
+				},
+				Configuration: &analysis.Configuration{},
+			},
+		},
+	})
+	if err != nil {
+		return 1, err
+	}
+	_, err = bytes.NewReader(result).WriteTo(config.Stdout)
+	return 0, err
+}
+
+func TestWalkAffectedTargetsForPlatforms(t *testing.T) {
+	dir, original := newGitRepository(t, map[string]string{"a.txt": "1", "b.txt": "1"}, map[string]string{"a.txt": "2"})
+	revBefore, err := NewLabelledGitRev(dir, "HEAD^", "before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err := ParseTargetsList("//...")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// walk returns the affected targets for platforms, the cqueries run, and how many times a
+	// revision was checked out.
+	walk := func(platforms []string) ([]string, []string, int) {
+		bazelCmd := &platformSourceFileBazelCmd{sourceFiles: map[string]string{"//:linux": "a.txt", "//:macos": "b.txt"}}
+		context := &Context{
+			WorkspacePath:              dir,
+			OriginalRevision:           original,
+			BazelCmd:                   bazelCmd,
+			BazelOutputBase:            filepath.Join(t.TempDir(), "output_base"),
+			BeforeQueryErrorBehavior:   "fatal",
+			AnalysisCacheClearStrategy: "skip",
+			WorktreeCacheDir:           t.TempDir(),
+			HashingWorkers:             1,
+		}
+		checkoutsBefore := strings.Count(runGit(t, dir, "reflog"), "checkout:")
+		var affected []string
+		if err := WalkAffectedTargetsForPlatforms(context, revBefore, targets, platforms, false, func(platform string, l label.Label, _ []Difference, _ *analysis.ConfiguredTarget) {
+			affected = append(affected, platform+" "+l.String())
+		}); err != nil {
+			t.Fatalf("Error walking affected targets: %v", err)
+		}
+		sort.Strings(bazelCmd.cqueries)
+		return affected, bazelCmd.cqueries, strings.Count(runGit(t, dir, "reflog"), "checkout:") - checkoutsBefore
+	}
+
+	_, _, onePlatformCheckouts := walk([]string{"//:linux"})
+	affected, cqueries, checkouts := walk([]string{"//:linux", "//:macos"})
+	if want := []string{"//:linux //:a.txt"}; !reflect.DeepEqual(want, affected) {
+		t.Fatalf("Wrong affected targets: want %v got %v", want, affected)
+	}
+	// The transitive and top-level cqueries are each run at both revisions for both platforms.
+	if want := []string{"//:linux 1", "//:linux 1", "//:linux 2", "//:linux 2", "//:macos 1", "//:macos 1", "//:macos 1", "//:macos 1"}; !reflect.DeepEqual(want, cqueries) {
+		t.Fatalf("Wrong cqueries: want %v got %v", want, cqueries)
+	}
+	if checkouts != onePlatformCheckouts {
+		t.Fatalf("Wrong number of checkouts for two platforms: want %d, as for one platform, got %d", onePlatformCheckouts, checkouts)
+	}
+}
@@ -0,0 +1,85 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// PolicyMarkerFileName is the name of files which declare policies for the directory containing
+// them and its subdirectories.
+const PolicyMarkerFileName = ".td-policy"
+
+// policyMarker is the JSON content of a policy marker file.
+type policyMarker struct {
+	// Action is one of:
+	// - "affected-when-touched" - when any file in the directory changes, consider all targets in it
+	//   affected.
+	// - "ignore" - ignore changes to files in the directory, and never consider targets in it
+	//   affected.
+	// - "targets" - when any file in the directory changes, consider Targets affected.
+	Action  string   `json:"action"`
+	Targets []string `json:"targets,omitempty"`
+}
+
+// LoadPolicyMarkers reads the policy marker files in the repository at workspacePath, and returns
+// the equivalent InfraFilePolicy for each, ordered so that markers in subdirectories override those
+// in their parents.
+func LoadPolicyMarkers(workspacePath string) ([]InfraFilePolicy, error) {
+	markerPaths, err := runToLines(workspacePath, "git", "ls-files", "--cached", "--others", "--exclude-standard", "--", ":(glob)"+PolicyMarkerFileName, ":(glob)**/"+PolicyMarkerFileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find policy marker files: %w", err)
+	}
+	sort.SliceStable(markerPaths, func(i, j int) bool {
+		return strings.Count(markerPaths[i], "/") < strings.Count(markerPaths[j], "/")
+	})
+
+	policies := make([]InfraFilePolicy, 0, len(markerPaths))
+	var labels labelValidator
+	for _, markerPath := range markerPaths {
+		content, err := os.ReadFile(filepath.Join(workspacePath, filepath.FromSlash(markerPath)))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Deleted but not yet committed.
+				continue
+			}
+			return nil, fmt.Errorf("failed to read policy marker %s: %w", markerPath, err)
+		}
+		var marker policyMarker
+		if err := json.Unmarshal(content, &marker); err != nil {
+			return nil, fmt.Errorf("failed to parse policy marker %s: %w", markerPath, err)
+		}
+
+		dir := path.Dir(markerPath)
+		policy := InfraFilePolicy{Pattern: dir + "/**"}
+		if dir == "." {
+			dir = ""
+			policy.Pattern = "**"
+		}
+		switch marker.Action {
+		case "affected-when-touched":
+			policy.Action = "subtree"
+			policy.Subtree = dir
+		case "ignore":
+			policy.Action = "exclude-subtree"
+			policy.Subtree = dir
+		case "targets":
+			for i, target := range marker.Targets {
+				labels.parse(fmt.Sprintf("%s targets[%d]", markerPath, i), target)
+			}
+			policy.Action = "targets"
+			policy.Targets = marker.Targets
+		default:
+			return nil, fmt.Errorf("unexpected action in policy marker %s - allowed values: affected-when-touched|ignore|targets, saw: %s", markerPath, marker.Action)
+		}
+		policies = append(policies, policy)
+	}
+	if err := labels.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse policy markers: %w", err)
+	}
+	return policies, nil
+}
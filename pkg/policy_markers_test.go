@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadPolicyMarkers(t *testing.T) {
+	dir := t.TempDir()
+	if output, err := exec.Command("git", "init", "-q", dir).CombinedOutput(); err != nil {
+		t.Fatalf("Failed to init git repository: %v. Output: %s", err, output)
+	}
+	for path, content := range map[string]string{
+		"docs/.td-policy":             `{"action": "ignore"}`,
+		"java/example/.td-policy":     `{"action": "affected-when-touched"}`,
+		"java/.td-policy":             `{"action": "targets", "targets": ["//java:all_tests"]}`,
+		"java/example/Greeting.java":  "",
+		"java/example/sub/.td-policy": `{"action": "ignore"}`,
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(path)), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	got, err := LoadPolicyMarkers(dir)
+	if err != nil {
+		t.Fatalf("Failed to load policy markers: %v", err)
+	}
+	want := []InfraFilePolicy{
+		{Pattern: "docs/**", Action: "exclude-subtree", Subtree: "docs"},
+		{Pattern: "java/**", Action: "targets", Targets: []string{"//java:all_tests"}},
+		{Pattern: "java/example/**", Action: "subtree", Subtree: "java/example"},
+		{Pattern: "java/example/sub/**", Action: "exclude-subtree", Subtree: "java/example/sub"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong policies: want %+v got %+v", want, got)
+	}
+
+	effect, err := ApplyInfraFilePolicies(got, []string{"java/example/Greeting.java", "java/Other.java", "java/example/sub/Ignored.java"})
+	if err != nil {
+		t.Fatalf("Failed to apply policies: %v", err)
+	}
+	if want := []string{"java/example"}; !reflect.DeepEqual(want, effect.Subtrees) {
+		t.Fatalf("Wrong affected subtrees: want %v got %v", want, effect.Subtrees)
+	}
+	if want := []string{"docs", "java/example/sub"}; !reflect.DeepEqual(want, ExcludedSubtrees(got)) {
+		t.Fatalf("Wrong excluded subtrees: want %v got %v", want, ExcludedSubtrees(got))
+	}
+}
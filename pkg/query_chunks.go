@@ -0,0 +1,126 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// queryChunks returns the target expressions to cquery in turn instead of targets, each matching
+// at most context.QueryChunkSize targets, so that Bazel never has to analyze the whole universe at
+// once. Chunks keep the targets of each package together, and neighbouring packages in the same
+// chunk. If chunking is disabled, or targets matches few enough targets, it returns just targets.
+// Chunks are queried sequentially, as a Bazel server only runs one command at a time.
+func queryChunks(context *Context, targets TargetsList) ([]string, error) {
+	if context.QueryChunkSize <= 0 {
+		return []string{targets.String()}, nil
+	}
+	var stdout, stderr bytes.Buffer
+	args := []string{"--output=label"}
+	if context.KeepGoing {
+		args = append(args, "--keep_going")
+	}
+	args = append(args, targets.String())
+	returnVal, err := context.BazelCmd.Execute(
+		BazelCmdConfig{Dir: context.WorkspacePath, Stdout: &stdout, Stderr: &stderr},
+		[]string{"--output_base", context.BazelOutputBase},
+		"query", args...)
+	// With --keep_going, Bazel exits with 3 if it only partially succeeded, in which case the
+	// failures are reported by the cqueries of the chunks.
+	partiallySucceeded := context.KeepGoing && returnVal == 3
+	if !partiallySucceeded && (returnVal != 0 || err != nil) {
+		return nil, fmt.Errorf("failed to query %s to split it into chunks: %w. Stderr:\n%v", targets.String(), err, stderr.String())
+	}
+	labels := strings.Fields(stdout.String())
+	if len(labels) <= context.QueryChunkSize {
+		return []string{targets.String()}, nil
+	}
+	chunks, err := chunkLabelsByPackage(labels, context.QueryChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	Progressf("Splitting the %d targets matching %s into %d chunks of at most %d targets", len(labels), targets.String(), len(chunks), context.QueryChunkSize)
+	expressions := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		expressions = append(expressions, "set("+strings.Join(chunk, " ")+")")
+	}
+	return expressions, nil
+}
+
+// chunkLabelsByPackage splits labels into chunks of at most chunkSize labels, in package order,
+// without splitting packages across chunks unless a single package has more than chunkSize labels.
+func chunkLabelsByPackage(labels []string, chunkSize int) ([][]string, error) {
+	byPackage := make(map[string][]string)
+	for _, labelString := range labels {
+		l, err := label.Parse(labelString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label %s from query: %w", labelString, err)
+		}
+		pkg := l.Repo + "//" + l.Pkg
+		byPackage[pkg] = append(byPackage[pkg], labelString)
+	}
+	packages := make([]string, 0, len(byPackage))
+	for pkg := range byPackage {
+		packages = append(packages, pkg)
+	}
+	sort.Strings(packages)
+
+	var chunks [][]string
+	var current []string
+	for _, pkg := range packages {
+		pkgLabels := byPackage[pkg]
+		sort.Strings(pkgLabels)
+		if len(current) > 0 && len(current)+len(pkgLabels) > chunkSize {
+			chunks = append(chunks, current)
+			current = nil
+		}
+		for len(pkgLabels) > chunkSize {
+			chunks = append(chunks, pkgLabels[:chunkSize])
+			pkgLabels = pkgLabels[chunkSize:]
+		}
+		current = append(current, pkgLabels...)
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks, nil
+}
+
+// runToCqueryResultInChunks runs runToCqueryResult on patternFor each of chunks in turn, and merges
+// the results. Targets which are in the results for more than one chunk (e.g. shared
+// dependencies) are de-duplicated by ParseCqueryResult.
+func runToCqueryResultInChunks(context *Context, chunks []string, patternFor func(chunk string) string, includeTransitions bool, bazelRelease string) ([]*analysis.ConfiguredTarget, []string, error) {
+	var results []*analysis.ConfiguredTarget
+	var degradedPackages []string
+	for i, chunk := range chunks {
+		if len(chunks) > 1 {
+			Progressf("Querying chunk %d of %d", i+1, len(chunks))
+		}
+		chunkResults, chunkDegradedPackages, err := runToCqueryResult(context, patternFor(chunk), includeTransitions, bazelRelease)
+		if err != nil {
+			return nil, nil, err
+		}
+		results = append(results, chunkResults...)
+		degradedPackages = append(degradedPackages, chunkDegradedPackages...)
+	}
+	return results, degradedPackages, nil
+}
+
+// findCompatibleTargetsInChunks is findCompatibleTargets for each of chunks, merging the results.
+func findCompatibleTargetsInChunks(context *Context, chunks []string, compatibility bool, n *Normalizer, bazelRelease string) (map[label.Label]bool, error) {
+	merged := make(map[label.Label]bool)
+	for _, chunk := range chunks {
+		compatibleTargets, err := findCompatibleTargets(context, chunk, compatibility, n, bazelRelease)
+		if err != nil {
+			return nil, err
+		}
+		for l, v := range compatibleTargets {
+			merged[l] = v
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,35 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChunkLabelsByPackage(t *testing.T) {
+	labels := []string{
+		"//b:one", "//a:two", "//a:one", "//c:one", "//c:two", "//c:three", "//c:four", "//c:five", "//d:one",
+	}
+	got, err := chunkLabelsByPackage(labels, 3)
+	if err != nil {
+		t.Fatalf("Error chunking labels: %v", err)
+	}
+	want := [][]string{
+		{"//a:one", "//a:two", "//b:one"},
+		{"//c:five", "//c:four", "//c:one"},
+		{"//c:three", "//c:two", "//d:one"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Wrong chunks: want %v got %v", want, got)
+	}
+}
+
+func TestChunkLabelsByPackageKeepsPackagesTogether(t *testing.T) {
+	got, err := chunkLabelsByPackage([]string{"//a:one", "//b:one", "//b:two", "@other//a:one"}, 2)
+	if err != nil {
+		t.Fatalf("Error chunking labels: %v", err)
+	}
+	want := [][]string{{"//a:one"}, {"//b:one", "//b:two"}, {"@other//a:one"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Wrong chunks: want %v got %v", want, got)
+	}
+}
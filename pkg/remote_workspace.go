@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const cloneDirPrefix = "td-clone-"
+
+// PrepareRemoteWorkspace ensures there is a clone of the repository at url in cacheDir containing
+// revisions, with afterRevision checked out, and returns its path.
+// The clone is treeless, so only the commits are fetched up front, and trees and files are fetched
+// on demand. Clones are reused by later calls for the same url.
+func PrepareRemoteWorkspace(cacheDir string, url string, afterRevision string, revisions []string) (string, error) {
+	urlHash := sha256.Sum256([]byte(url))
+	clonePath := filepath.Join(cacheDir, cloneDirPrefix+hex.EncodeToString(urlHash[:])[:16])
+
+	if _, err := os.Stat(filepath.Join(clonePath, ".git")); err != nil {
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to check for existing clone at %s: %w", clonePath, err)
+		}
+		if err := os.RemoveAll(clonePath); err != nil {
+			return "", fmt.Errorf("failed to remove incomplete clone at %s: %w", clonePath, err)
+		}
+		if err := os.MkdirAll(cacheDir, 0755); err != nil {
+			return "", fmt.Errorf("failed to create clone cache directory %s: %w", cacheDir, err)
+		}
+		Progressf("Cloning %s into %s", url, clonePath)
+		if _, err := runToLines(cacheDir, "git", "clone", "--quiet", "--filter=tree:0", "--no-checkout", url, clonePath); err != nil {
+			return "", fmt.Errorf("failed to clone %s: %w", url, err)
+		}
+	} else {
+		Progressf("Reusing clone of %s at %s", url, clonePath)
+	}
+
+	for _, revision := range append([]string{afterRevision}, revisions...) {
+		if _, err := GitRevParse(clonePath, revision+"^{commit}", false); err == nil {
+			continue
+		}
+		Progressf("Fetching %s from %s", revision, url)
+		if _, err := runToLines(clonePath, "git", "fetch", "--quiet", "--filter=tree:0", "origin", revision); err != nil {
+			return "", fmt.Errorf("failed to fetch %s from %s: %w", revision, url, err)
+		}
+	}
+
+	if err := gitCleanCheckout(clonePath, afterRevision); err != nil {
+		return "", fmt.Errorf("failed to check out %s in %s: %w", afterRevision, clonePath, err)
+	}
+	return clonePath, nil
+}
@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrepareRemoteWorkspace(t *testing.T) {
+	origin := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = origin
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=td", "GIT_AUTHOR_EMAIL=td@example.com", "GIT_COMMITTER_NAME=td", "GIT_COMMITTER_EMAIL=td@example.com")
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("Failed to run git %v: %v. Output: %s", args, err, output)
+		}
+		return strings.TrimSpace(string(output))
+	}
+	commit := func(content string) string {
+		if err := os.WriteFile(filepath.Join(origin, "file.txt"), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		git("add", ".")
+		git("commit", "-q", "-m", content)
+		return git("rev-parse", "HEAD")
+	}
+	git("init", "-q")
+	before := commit("before")
+	after := commit("after")
+
+	cacheDir := t.TempDir()
+	url := "file://" + origin
+	for i := 0; i < 2; i++ {
+		clonePath, err := PrepareRemoteWorkspace(cacheDir, url, after, []string{before})
+		if err != nil {
+			t.Fatalf("Failed to prepare remote workspace: %v", err)
+		}
+		content, err := os.ReadFile(filepath.Join(clonePath, "file.txt"))
+		if err != nil {
+			t.Fatalf("Failed to read file from clone: %v", err)
+		}
+		if want := "after"; string(content) != want {
+			t.Fatalf("Wrong file content: want %v got %v", want, string(content))
+		}
+		if _, err := GitRevParse(clonePath, before+"^{commit}", false); err != nil {
+			t.Fatalf("Expected %s to be present in clone: %v", before, err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResourceUsage is the resources used by this process and the processes it has run, e.g. the Bazel
+// client and git. The Bazel server isn't a child process, so is accounted for separately.
+type ResourceUsage struct {
+	UserCPUSeconds   float64 `json:"user_cpu_seconds"`
+	SystemCPUSeconds float64 `json:"system_cpu_seconds"`
+	// MaxRSSBytes is the peak resident set size so far of this process, or of the largest of its
+	// child processes.
+	MaxRSSBytes int64 `json:"max_rss_bytes"`
+	// BlockReads and BlockWrites are the number of filesystem reads and writes which had to go to
+	// disk.
+	BlockReads  int64 `json:"block_reads"`
+	BlockWrites int64 `json:"block_writes"`
+}
+
+// since returns the resources used between earlier and u. MaxRSSBytes is kept, as peaks can't be
+// subtracted.
+func (u ResourceUsage) since(earlier ResourceUsage) ResourceUsage {
+	return ResourceUsage{
+		UserCPUSeconds:   u.UserCPUSeconds - earlier.UserCPUSeconds,
+		SystemCPUSeconds: u.SystemCPUSeconds - earlier.SystemCPUSeconds,
+		MaxRSSBytes:      u.MaxRSSBytes,
+		BlockReads:       u.BlockReads - earlier.BlockReads,
+		BlockWrites:      u.BlockWrites - earlier.BlockWrites,
+	}
+}
+
+// PhaseUsage is the resources used during a phase of a run.
+type PhaseUsage struct {
+	Phase           string  `json:"phase"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	ResourceUsage
+	// BazelServerHeapBytes is the heap used by the Bazel servers used in the phase at its end, if
+	// the phase ran Bazel.
+	BazelServerHeapBytes int64 `json:"bazel_server_heap_bytes,omitempty"`
+}
+
+// ResourceAccounting records the resources used by each phase of a run. A nil ResourceAccounting
+// records nothing.
+type ResourceAccounting struct {
+	mu        sync.Mutex
+	lastUsage ResourceUsage
+	lastTime  time.Time
+	phases    []PhaseUsage
+}
+
+// NewResourceAccounting returns a ResourceAccounting whose first phase starts now.
+func NewResourceAccounting() *ResourceAccounting {
+	usage, _ := currentResourceUsage()
+	return &ResourceAccounting{lastUsage: usage, lastTime: time.Now()}
+}
+
+// TotalResourceUsage returns the resources used so far by this process and its child processes,
+// and false if resource usage can't be measured on this platform.
+func TotalResourceUsage() (ResourceUsage, bool) {
+	return currentResourceUsage()
+}
+
+// EndPhase records the resources used since the end of the previous phase as phase.
+func (a *ResourceAccounting) EndPhase(phase string, bazelServerHeapBytes int64) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	usage, _ := currentResourceUsage()
+	now := time.Now()
+	phaseUsage := PhaseUsage{
+		Phase:                phase,
+		DurationSeconds:      now.Sub(a.lastTime).Seconds(),
+		ResourceUsage:        usage.since(a.lastUsage),
+		BazelServerHeapBytes: bazelServerHeapBytes,
+	}
+	Progressf("Phase %s took %.1fs using %.1fs of CPU, peak RSS so far %d MB", phase, phaseUsage.DurationSeconds,
+		phaseUsage.UserCPUSeconds+phaseUsage.SystemCPUSeconds, phaseUsage.MaxRSSBytes>>20)
+	a.phases = append(a.phases, phaseUsage)
+	a.lastUsage, a.lastTime = usage, now
+}
+
+// Phases returns the phases recorded so far.
+func (a *ResourceAccounting) Phases() []PhaseUsage {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]PhaseUsage(nil), a.phases...)
+}
+
+// endProcessingPhase ends phase in context.ResourceAccounting, recording the combined heap of the
+// Bazel servers of contexts.
+func endProcessingPhase(context *Context, phase string, contexts ...*Context) {
+	if context.ResourceAccounting == nil {
+		return
+	}
+	var heapBytes int64
+	for _, c := range contexts {
+		heap, err := bazelServerHeapBytes(c)
+		if err != nil {
+			log.Printf("WARN: Failed to get Bazel server memory usage: %v", err)
+			continue
+		}
+		heapBytes += heap
+	}
+	context.ResourceAccounting.EndPhase(phase, heapBytes)
+}
+
+// bazelServerHeapBytes returns the heap used by the Bazel server for context.BazelOutputBase.
+func bazelServerHeapBytes(context *Context) (int64, error) {
+	var stdout, stderr bytes.Buffer
+	result, err := context.BazelCmd.Execute(
+		BazelCmdConfig{Dir: context.WorkspacePath, Stdout: &stdout, Stderr: &stderr},
+		[]string{"--output_base", context.BazelOutputBase}, "info", "used-heap-size")
+	if result != 0 || err != nil {
+		return 0, fmt.Errorf("failed to get the Bazel used-heap-size: %w. Stderr:\n%v", err, stderr.String())
+	}
+	return parseBazelMemorySize(strings.TrimSpace(stdout.String()))
+}
+
+// parseBazelMemorySize parses a size as output by bazel info, e.g. "512MB".
+func parseBazelMemorySize(size string) (int64, error) {
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if number, ok := strings.CutSuffix(size, unit.suffix); ok {
+			n, err := strconv.ParseInt(number, 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("failed to parse memory size %q: %w", size, err)
+			}
+			return n * unit.multiplier, nil
+		}
+	}
+	return 0, fmt.Errorf("failed to parse memory size %q: unknown unit", size)
+}
@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestParseBazelMemorySize(t *testing.T) {
+	for size, want := range map[string]int64{
+		"512MB": 512 << 20,
+		"2GB":   2 << 30,
+		"100KB": 100 << 10,
+		"7B":    7,
+	} {
+		got, err := parseBazelMemorySize(size)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", size, err)
+		}
+		if got != want {
+			t.Fatalf("Wrong size for %s: want %d got %d", size, want, got)
+		}
+	}
+	if _, err := parseBazelMemorySize("lots"); err == nil {
+		t.Fatalf("Expected an error parsing an unknown size")
+	}
+}
+
+func TestResourceAccountingPhases(t *testing.T) {
+	var nilAccounting *ResourceAccounting
+	nilAccounting.EndPhase("ignored", 0)
+	if phases := nilAccounting.Phases(); phases != nil {
+		t.Fatalf("Wrong phases of nil ResourceAccounting: want nil got %v", phases)
+	}
+
+	accounting := NewResourceAccounting()
+	accounting.EndPhase("first", 123)
+	accounting.EndPhase("second", 0)
+	phases := accounting.Phases()
+	if len(phases) != 2 || phases[0].Phase != "first" || phases[1].Phase != "second" {
+		t.Fatalf("Wrong phases: want first and second got %+v", phases)
+	}
+	if phases[0].BazelServerHeapBytes != 123 {
+		t.Fatalf("Wrong Bazel server heap: want 123 got %d", phases[0].BazelServerHeapBytes)
+	}
+	if phases[1].DurationSeconds < 0 || phases[1].UserCPUSeconds < 0 {
+		t.Fatalf("Wrong phase usage: want non-negative got %+v", phases[1])
+	}
+}
@@ -0,0 +1,36 @@
+//go:build !windows
+
+package pkg
+
+import (
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// currentResourceUsage returns the resources used so far by this process and its child processes
+// which have been waited for, and whether they could be measured.
+func currentResourceUsage() (ResourceUsage, bool) {
+	var self, children syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &self); err != nil {
+		return ResourceUsage{}, false
+	}
+	if err := syscall.Getrusage(syscall.RUSAGE_CHILDREN, &children); err != nil {
+		return ResourceUsage{}, false
+	}
+	seconds := func(tv syscall.Timeval) float64 {
+		return time.Duration(tv.Nano()).Seconds()
+	}
+	// Linux reports maxrss in kilobytes, and macOS in bytes.
+	maxRSSUnit := int64(1024)
+	if runtime.GOOS == "darwin" {
+		maxRSSUnit = 1
+	}
+	return ResourceUsage{
+		UserCPUSeconds:   seconds(self.Utime) + seconds(children.Utime),
+		SystemCPUSeconds: seconds(self.Stime) + seconds(children.Stime),
+		MaxRSSBytes:      max(int64(self.Maxrss), int64(children.Maxrss)) * maxRSSUnit,
+		BlockReads:       int64(self.Inblock) + int64(children.Inblock),
+		BlockWrites:      int64(self.Oublock) + int64(children.Oublock),
+	}, true
+}
@@ -0,0 +1,6 @@
+package pkg
+
+// currentResourceUsage isn't implemented on Windows, so resource usage isn't reported.
+func currentResourceUsage() (ResourceUsage, bool) {
+	return ResourceUsage{}, false
+}
@@ -0,0 +1,249 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// CachedResult is the output of a previous run, stored in a result cache.
+type CachedResult struct {
+	// Created is when the result was computed.
+	Created time.Time `json:"created"`
+	// Lines are the lines which were output.
+	Lines []string `json:"lines"`
+}
+
+// DefaultResultCache is the result cache used if none is specified.
+func DefaultResultCache() (string, error) {
+	cacheDir, err := DefaultWorktreeCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "results"), nil
+}
+
+// ResultCacheKey computes the key under which to cache the result of comparing revBefore against
+// the current working directory state in context, for the given targets and flags, with the Bazel
+// release context uses, so that upgrading Bazel doesn't reuse results computed with an older one.
+// flags should describe all of the flags affecting the result, in a stable order.
+// It returns an empty key if the result can't be cached, because the working directory has local
+// changes which git doesn't identify.
+func ResultCacheKey(context *Context, revBefore LabelledGitRev, targets TargetsList, flags []string, bazelStartupOpts []string, toolVersion string) (string, error) {
+	uncleanStatuses, err := GitStatusFiltered(context.WorkspacePath, context.IgnoredFiles)
+	if err != nil {
+		return "", fmt.Errorf("failed to check whether the repository is clean: %w", err)
+	}
+	if len(uncleanStatuses) > 0 {
+		return "", nil
+	}
+	bazelrcDigests, err := bazelrcDigests(context.WorkspacePath, bazelStartupOpts)
+	if err != nil {
+		return "", err
+	}
+	bazelRelease, err := BazelRelease(context.WorkspacePath, context.BazelCmd)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	write := func(s string) {
+		fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+	write(toolVersion)
+	write(bazelRelease)
+	write(revBefore.GitRevision.Sha)
+	write(context.OriginalRevision.GitRevision.Sha)
+	write(targets.String())
+	for _, flag := range flags {
+		write(flag)
+	}
+	for _, path := range sortedUnion(bazelrcDigests, nil) {
+		write(path)
+		write(bazelrcDigests[path])
+	}
+	for _, name := range consultedEnvironmentVariables {
+		value, ok := os.LookupEnv(name)
+		write(fmt.Sprintf("%s=%v:%s", name, ok, value))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// LookupCachedResult returns the result stored under key in cache, which is either a local
+// directory or an HTTP(S) URL, if there is one and it is no older than ttl.
+// It returns nil if there is no such result.
+// Anyone who can write to a remote cache could store a result, so results in remote caches must
+// have a valid signature by the private key corresponding to verifyKey (see StoreCachedResult),
+// and remote caches can't be used without one.
+func LookupCachedResult(cache string, key string, ttl time.Duration, verifyKey ed25519.PublicKey) (*CachedResult, error) {
+	var content []byte
+	if IsRemoteResultCache(cache) {
+		if verifyKey == nil {
+			return nil, fmt.Errorf("can't look up results in remote result cache %s without a key to verify them with", cache)
+		}
+		var found bool
+		var err error
+		if content, found, err = getCachedResultURL(resultCacheURL(cache, key)); err != nil || !found {
+			return nil, err
+		}
+		encoded, found, err := getCachedResultURL(resultCacheURL(cache, key) + ".sig")
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("cached result %s in %s isn't signed", key, cache)
+		}
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode signature of cached result %s in %s: %w", key, cache, err)
+		}
+		if !ed25519.Verify(verifyKey, content, signature) {
+			return nil, fmt.Errorf("signature of cached result %s in %s is invalid: it may have been tampered with, or signed with a different key", key, cache)
+		}
+	} else {
+		var err error
+		content, err = os.ReadFile(filepath.Join(cache, key+".json"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("failed to read cached result from %s: %w", cache, err)
+		}
+	}
+
+	var result CachedResult
+	if err := json.Unmarshal(content, &result); err != nil {
+		return nil, fmt.Errorf("failed to parse cached result from %s: %w", cache, err)
+	}
+	if ttl > 0 && time.Since(result.Created) > ttl {
+		return nil, nil
+	}
+	return &result, nil
+}
+
+// StoreCachedResult stores result under key in cache, which is either a local directory or an
+// HTTP(S) URL which accepts PUT requests. Results stored in remote caches are signed with
+// signingKey, which they can't be stored without, with the signature stored under key + ".sig".
+func StoreCachedResult(cache string, key string, result *CachedResult, signingKey ed25519.PrivateKey) error {
+	content, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to marshal result: %w", err)
+	}
+	if IsRemoteResultCache(cache) {
+		if signingKey == nil {
+			return fmt.Errorf("can't store results in remote result cache %s without a key to sign them with", cache)
+		}
+		// The signature is stored first, so that the result is never found without it.
+		signature := base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, content)) + "\n"
+		if err := putCachedResultURL(resultCacheURL(cache, key)+".sig", "text/plain", []byte(signature)); err != nil {
+			return err
+		}
+		return putCachedResultURL(resultCacheURL(cache, key), "application/json", content)
+	}
+
+	if err := os.MkdirAll(cache, 0755); err != nil {
+		return fmt.Errorf("failed to create result cache directory %s: %w", cache, err)
+	}
+	// Write to a temporary file first so that concurrent lookups never see a partial result.
+	tmp, err := os.CreateTemp(cache, key+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to store result in %s: %w", cache, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to store result in %s: %w", cache, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to store result in %s: %w", cache, err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(cache, key+".json")); err != nil {
+		return fmt.Errorf("failed to store result in %s: %w", cache, err)
+	}
+	return nil
+}
+
+// IsRemoteResultCache returns whether cache is an HTTP(S) URL rather than a local directory.
+func IsRemoteResultCache(cache string) bool {
+	return strings.HasPrefix(cache, "http://") || strings.HasPrefix(cache, "https://")
+}
+
+// getCachedResultURL returns the content at url, and whether there was any.
+func getCachedResultURL(url string) ([]byte, bool, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get cached result from %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, false, fmt.Errorf("failed to get cached result from %s: got status %s", url, resp.Status)
+	}
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read cached result from %s: %w", url, err)
+	}
+	return content, true, nil
+}
+
+// putCachedResultURL stores content at url.
+func putCachedResultURL(url string, contentType string, content []byte) error {
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("failed to create request to store result at %s: %w", url, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to store result at %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to store result at %s: got status %s", url, resp.Status)
+	}
+	return nil
+}
+
+func resultCacheURL(cache string, key string) string {
+	return strings.TrimSuffix(cache, "/") + "/" + key
+}
+
+// AffectedLabels returns which of labels are affected according to lines output by a run, which
+// each start with an affected label.
+// Labels are compared after normalization, so e.g. "//foo" and "//foo:foo" are the same label.
+func AffectedLabels(lines []string, labels []string) (map[string]bool, error) {
+	affected := make(map[string]bool, len(lines))
+	for _, line := range lines {
+		labelString, _, _ := strings.Cut(line, " ")
+		l, err := label.Parse(labelString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse affected label %s: %w", labelString, err)
+		}
+		affected[l.String()] = true
+	}
+	result := make(map[string]bool, len(labels))
+	for _, labelString := range labels {
+		l, err := label.Parse(labelString)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse label %s: %w", labelString, err)
+		}
+		result[labelString] = affected[l.String()]
+	}
+	return result, nil
+}
@@ -0,0 +1,155 @@
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResultCacheRoundTrips(t *testing.T) {
+	verifyKey, signingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	stored := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			stored[r.URL.Path] = body
+		case http.MethodGet:
+			body, ok := stored[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(body)
+		}
+	}))
+	defer server.Close()
+
+	for name, cache := range map[string]string{"local": t.TempDir(), "remote": server.URL + "/cache/"} {
+		t.Run(name, func(t *testing.T) {
+			got, err := LookupCachedResult(cache, "abc", time.Hour, verifyKey)
+			if err != nil {
+				t.Fatalf("Failed to look up result: %v", err)
+			}
+			if got != nil {
+				t.Fatalf("Wrong result before storing: want nil got %v", got)
+			}
+
+			want := &CachedResult{Created: time.Now().Add(-time.Minute).UTC().Truncate(time.Second), Lines: []string{"//java/example:GreetingLib"}}
+			if err := StoreCachedResult(cache, "abc", want, signingKey); err != nil {
+				t.Fatalf("Failed to store result: %v", err)
+			}
+			got, err = LookupCachedResult(cache, "abc", time.Hour, verifyKey)
+			if err != nil {
+				t.Fatalf("Failed to look up result: %v", err)
+			}
+			if !reflect.DeepEqual(want, got) {
+				t.Fatalf("Wrong result: want %v got %v", want, got)
+			}
+
+			got, err = LookupCachedResult(cache, "abc", time.Second, verifyKey)
+			if err != nil {
+				t.Fatalf("Failed to look up result: %v", err)
+			}
+			if got != nil {
+				t.Fatalf("Wrong result after TTL: want nil got %v", got)
+			}
+		})
+	}
+
+	if _, ok := stored["/cache/abc"]; !ok {
+		t.Fatalf("Expected remote result to be stored at /cache/abc")
+	}
+	if _, ok := stored["/cache/abc.sig"]; !ok {
+		t.Fatalf("Expected remote result's signature to be stored at /cache/abc.sig")
+	}
+
+	remote := server.URL + "/cache/"
+	if _, err := LookupCachedResult(remote, "abc", time.Hour, nil); err == nil {
+		t.Fatalf("Expected an error looking up a remote result without a verify key")
+	}
+	if err := StoreCachedResult(remote, "abc", &CachedResult{}, nil); err == nil {
+		t.Fatalf("Expected an error storing a remote result without a signing key")
+	}
+
+	// A result injected by anyone who can write to the cache, but not sign for it, isn't used.
+	mu.Lock()
+	stored["/cache/abc"] = []byte(`{"created":"2024-01-01T00:00:00Z","lines":[]}`)
+	mu.Unlock()
+	if got, err := LookupCachedResult(remote, "abc", 0, verifyKey); err == nil {
+		t.Fatalf("Expected an error looking up a tampered result, got %v", got)
+	}
+	mu.Lock()
+	delete(stored, "/cache/abc.sig")
+	mu.Unlock()
+	if got, err := LookupCachedResult(remote, "abc", 0, verifyKey); err == nil {
+		t.Fatalf("Expected an error looking up an unsigned result, got %v", got)
+	}
+}
+
+// releaseBazelCmd is a BazelCmd which only reports its release.
+type releaseBazelCmd struct {
+	release string
+}
+
+func (c *releaseBazelCmd) Execute(config BazelCmdConfig, startupArgs []string, command string, args ...string) (int, error) {
+	if command == "info" && len(args) == 1 && args[0] == "release" {
+		fmt.Fprintf(config.Stdout, "release %s\n", c.release)
+		return 0, nil
+	}
+	return 1, fmt.Errorf("unexpected bazel %s %v", command, args)
+}
+
+func (c *releaseBazelCmd) Cquery(bazelRelease string, config BazelCmdConfig, startupArgs []string, args ...string) (int, error) {
+	return 1, fmt.Errorf("unexpected cquery %v", args)
+}
+
+func TestResultCacheKeyIncludesBazelRelease(t *testing.T) {
+	dir, original := newGitRepository(t, map[string]string{"a.txt": "1"})
+	targets, err := ParseTargetsList("//...")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := func(release string) string {
+		context := &Context{WorkspacePath: dir, OriginalRevision: original, BazelCmd: &releaseBazelCmd{release: release}}
+		key, err := ResultCacheKey(context, original, targets, nil, nil, "v1")
+		if err != nil {
+			t.Fatalf("Error computing result cache key: %v", err)
+		}
+		return key
+	}
+	if key("7.1.0") != key("7.1.0") {
+		t.Fatalf("Wrong result cache keys: want the same key for the same Bazel release")
+	}
+	if key("7.1.0") == key("7.2.0") {
+		t.Fatalf("Wrong result cache keys: want different keys for different Bazel releases")
+	}
+}
+
+func TestAffectedLabels(t *testing.T) {
+	lines := []string{
+		"//java/example:GreetingLib Changes: NewLabel",
+		"//java/example:example //platforms:linux",
+	}
+	got, err := AffectedLabels(lines, []string{"//java/example", "//java/example:GreetingLib", "//java/other:Other"})
+	if err != nil {
+		t.Fatalf("Failed to find affected labels: %v", err)
+	}
+	want := map[string]bool{"//java/example": true, "//java/example:GreetingLib": true, "//java/other:Other": false}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong affected labels: want %v got %v", want, got)
+	}
+}
@@ -0,0 +1,58 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LoadResults reads the affected targets recorded in path, which is either the output of a run
+// (one affected target per line, optionally followed by more information) or a RunManifest.
+// Labels are normalized, so e.g. "//foo" and "//foo:foo" are the same label, and duplicates are
+// removed.
+func LoadResults(path string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read results from %s: %w", path, err)
+	}
+	type entry struct {
+		location string
+		target   string
+	}
+	var entries []entry
+	if isJSONObject(content) {
+		var manifest RunManifest
+		if err := json.Unmarshal(content, &manifest); err != nil {
+			return nil, fmt.Errorf("failed to parse run manifest from %s: %w", path, err)
+		}
+		for i, target := range manifest.AffectedTargets {
+			entries = append(entries, entry{fmt.Sprintf("affected_targets[%d]", i), target})
+		}
+	} else {
+		for i, line := range strings.Split(string(bytes.TrimSpace(content)), "\n") {
+			if target, _, _ := strings.Cut(strings.TrimSpace(line), " "); target != "" {
+				entries = append(entries, entry{fmt.Sprintf("line %d", i+1), target})
+			}
+		}
+	}
+
+	var labels labelValidator
+	seen := make(map[string]bool, len(entries))
+	normalized := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		l, ok := labels.parse(entry.location, entry.target)
+		if !ok {
+			continue
+		}
+		if labelString := l.String(); !seen[labelString] {
+			seen[labelString] = true
+			normalized = append(normalized, labelString)
+		}
+	}
+	if err := labels.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse affected targets in %s: %w", path, err)
+	}
+	return normalized, nil
+}
@@ -0,0 +1,43 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadResults(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "output.txt")
+	if err := os.WriteFile(output, []byte("//java/example:example\n//java/example:Lib //platforms:linux\n\n//java/example:Lib //platforms:macos\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.Join(dir, "manifest.json")
+	if err := WriteRunManifest(manifest, &RunManifest{AffectedTargets: []string{"//java/example", "//java/example:Other"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string][]string{
+		output:   {"//java/example", "//java/example:Lib"},
+		manifest: {"//java/example", "//java/example:Other"},
+	} {
+		got, err := LoadResults(path)
+		if err != nil {
+			t.Fatalf("Failed to load results from %s: %v", path, err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong results from %s: want %v got %v", path, want, got)
+		}
+	}
+}
+
+func TestDiffTargetLists(t *testing.T) {
+	added, removed := DiffTargetLists([]string{"//c", "//a", "//b"}, []string{"//d", "//b", "//a"})
+	if want := []string{"//d"}; !reflect.DeepEqual(want, added) {
+		t.Fatalf("Wrong added targets: want %v got %v", want, added)
+	}
+	if want := []string{"//c"}; !reflect.DeepEqual(want, removed) {
+		t.Fatalf("Wrong removed targets: want %v got %v", want, removed)
+	}
+}
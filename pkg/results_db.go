@@ -0,0 +1,80 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// ResultsDBRun is a run to store in a results database with StoreResultsInDB.
+type ResultsDBRun struct {
+	Timestamp      time.Time
+	BeforeRevision string
+	AfterRevision  string
+	Targets        []ResultsDBTarget
+}
+
+// ResultsDBTarget is an affected target to store in a results database.
+type ResultsDBTarget struct {
+	Label label.Label
+	// Platform is the platform the target was affected for, if affected targets were computed per
+	// platform.
+	Platform string
+	// Kind is the rule class of the target, if it is a rule, and Language is as classified by
+	// LanguageOf.
+	Kind     string
+	Language string
+}
+
+// resultsDBSchema creates the tables of a results database, if they don't already exist.
+const resultsDBSchema = `CREATE TABLE IF NOT EXISTS runs (
+  id INTEGER PRIMARY KEY,
+  timestamp TEXT NOT NULL,
+  before_revision TEXT NOT NULL,
+  after_revision TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS affected_targets (
+  run_id INTEGER NOT NULL REFERENCES runs(id),
+  label TEXT NOT NULL,
+  repository TEXT NOT NULL,
+  package TEXT NOT NULL,
+  name TEXT NOT NULL,
+  platform TEXT NOT NULL,
+  kind TEXT NOT NULL,
+  language TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS affected_targets_run_id ON affected_targets(run_id);
+`
+
+// StoreResultsInDB appends run to the SQLite database at dbPath, creating it if needed, so that
+// results can be sliced with SQL using QueryResultsDB. The sqlite3 command must be on the PATH.
+func StoreResultsInDB(dbPath string, run ResultsDBRun) error {
+	var script strings.Builder
+	script.WriteString(resultsDBSchema)
+	script.WriteString("BEGIN;\n")
+	fmt.Fprintf(&script, "INSERT INTO runs (timestamp, before_revision, after_revision) VALUES (%s, %s, %s);\n",
+		sqlString(run.Timestamp.UTC().Format(time.RFC3339)), sqlString(run.BeforeRevision), sqlString(run.AfterRevision))
+	for _, target := range run.Targets {
+		// last_insert_rowid() changes after each insert, so refer to the run by the maximum id instead.
+		fmt.Fprintf(&script, "INSERT INTO affected_targets VALUES ((SELECT MAX(id) FROM runs), %s, %s, %s, %s, %s, %s, %s);\n",
+			sqlString(target.Label.String()), sqlString(target.Label.Repo), sqlString(target.Label.Pkg), sqlString(target.Label.Name),
+			sqlString(target.Platform), sqlString(target.Kind), sqlString(target.Language))
+	}
+	script.WriteString("COMMIT;\n")
+	if _, err := runWithStdin([]byte(script.String()), "sqlite3", "-bail", dbPath); err != nil {
+		return fmt.Errorf("failed to store results in %s: %w", dbPath, err)
+	}
+	return nil
+}
+
+// QueryResultsDB runs query against the results database at dbPath, and returns the result as
+// CSV with a header row.
+func QueryResultsDB(dbPath string, query string) ([]byte, error) {
+	output, err := runWithStdin(nil, "sqlite3", "-bail", "-readonly", "-header", "-csv", dbPath, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s: %w", dbPath, err)
+	}
+	return output, nil
+}
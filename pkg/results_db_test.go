@@ -0,0 +1,58 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/csv"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResultsDB(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 isn't on the PATH")
+	}
+	dbPath := filepath.Join(t.TempDir(), "results.sqlite")
+	for _, run := range []ResultsDBRun{
+		{
+			Timestamp:      time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			BeforeRevision: "aaa",
+			AfterRevision:  "bbb",
+			Targets: []ResultsDBTarget{
+				{Label: mustParseLabel("//java/example:GreetingLib"), Kind: "java_library", Language: "java"},
+				{Label: mustParseLabel("//go/example:lib"), Kind: "go_library", Language: "go"},
+			},
+		},
+		{
+			Timestamp:      time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+			BeforeRevision: "bbb",
+			AfterRevision:  "it's",
+			Targets: []ResultsDBTarget{
+				{Label: mustParseLabel("//java/example:GreetingTest"), Kind: "java_test", Language: "java"},
+			},
+		},
+	} {
+		if err := StoreResultsInDB(dbPath, run); err != nil {
+			t.Fatalf("Failed to store results: %v", err)
+		}
+	}
+
+	got, err := QueryResultsDB(dbPath, "SELECT r.after_revision, t.label, t.kind FROM affected_targets t JOIN runs r ON t.run_id = r.id WHERE t.package = 'java/example' ORDER BY t.label")
+	if err != nil {
+		t.Fatalf("Failed to query results: %v", err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(got)).ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to parse query result %q: %v", string(got), err)
+	}
+	want := [][]string{
+		{"after_revision", "label", "kind"},
+		{"bbb", "//java/example:GreetingLib", "java_library"},
+		{"it's", "//java/example:GreetingTest", "java_test"},
+	}
+	if !reflect.DeepEqual(want, records) {
+		t.Fatalf("Wrong query result: want %v got %v", want, records)
+	}
+}
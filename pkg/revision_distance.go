@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrStaleBeforeRevision indicates that the "before" revision was considered too old to compare
+// against meaningfully.
+var ErrStaleBeforeRevision = errors.New("before revision is stale")
+
+// RevisionDistance describes how far apart two commits are.
+type RevisionDistance struct {
+	// Commits is the number of commits reachable from the later commit but not the earlier one.
+	Commits int
+	// Age is the difference between the committer dates of the two commits.
+	Age time.Duration
+}
+
+// ComputeRevisionDistance computes how far apart the before and after shas are.
+// Both shas must be resolved commits (i.e. not CurrentWorkingDirState).
+func ComputeRevisionDistance(workspacePath string, beforeSha string, afterSha string) (RevisionDistance, error) {
+	lines, err := runToLines(workspacePath, "git", "rev-list", "--count", beforeSha+".."+afterSha)
+	if err != nil {
+		return RevisionDistance{}, fmt.Errorf("failed to count commits between %s and %s: %w", beforeSha, afterSha, err)
+	}
+	if len(lines) != 1 {
+		return RevisionDistance{}, fmt.Errorf("unexpected output counting commits between %s and %s: %v", beforeSha, afterSha, lines)
+	}
+	commits, err := strconv.Atoi(strings.TrimSpace(lines[0]))
+	if err != nil {
+		return RevisionDistance{}, fmt.Errorf("failed to parse commit count between %s and %s: %w", beforeSha, afterSha, err)
+	}
+
+	beforeTime, err := gitCommitTime(workspacePath, beforeSha)
+	if err != nil {
+		return RevisionDistance{}, err
+	}
+	afterTime, err := gitCommitTime(workspacePath, afterSha)
+	if err != nil {
+		return RevisionDistance{}, err
+	}
+
+	return RevisionDistance{
+		Commits: commits,
+		Age:     afterTime.Sub(beforeTime),
+	}, nil
+}
+
+func gitCommitTime(workspacePath string, sha string) (time.Time, error) {
+	lines, err := runToLines(workspacePath, "git", "show", "-s", "--format=%ct", sha)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get commit time of %s: %w", sha, err)
+	}
+	if len(lines) != 1 {
+		return time.Time{}, fmt.Errorf("unexpected output getting commit time of %s: %v", sha, lines)
+	}
+	seconds, err := strconv.ParseInt(strings.TrimSpace(lines[0]), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse commit time of %s: %w", sha, err)
+	}
+	return time.Unix(seconds, 0), nil
+}
+
+// String returns a human-readable description of the distance.
+func (d RevisionDistance) String() string {
+	return fmt.Sprintf("%d commits and %.1f days", d.Commits, d.Age.Hours()/24)
+}
+
+// checkBeforeRevisionDistance logs how far revBefore is from the original revision, warning if it
+// exceeds the context's warning thresholds.
+// It returns an error wrapping ErrStaleBeforeRevision if revBefore is further from the original
+// revision than the context allows.
+func checkBeforeRevisionDistance(context *Context, revBefore LabelledGitRev) error {
+	if revBefore.GitRevision == CurrentWorkingDirState || context.OriginalRevision.GitRevision == CurrentWorkingDirState {
+		return nil
+	}
+	hasLimits := context.MaxBeforeRevisionAge > 0 || context.MaxBeforeRevisionCommits > 0
+	distance, err := ComputeRevisionDistance(context.WorkspacePath, revBefore.GitRevision.Sha, context.OriginalRevision.GitRevision.Sha)
+	if err != nil {
+		if hasLimits {
+			return err
+		}
+		log.Printf("WARN: Couldn't compute the distance between %s and %s: %v", revBefore, context.OriginalRevision, err)
+		return nil
+	}
+	Progressf("Comparing against %s, which is %v behind %s", revBefore, distance, context.OriginalRevision)
+
+	if context.MaxBeforeRevisionAge > 0 && distance.Age > context.MaxBeforeRevisionAge {
+		return fmt.Errorf("%w: %s is %v older than %s, which is more than the maximum of %v", ErrStaleBeforeRevision, revBefore, distance.Age, context.OriginalRevision, context.MaxBeforeRevisionAge)
+	}
+	if context.MaxBeforeRevisionCommits > 0 && distance.Commits > context.MaxBeforeRevisionCommits {
+		return fmt.Errorf("%w: %s is %d commits behind %s, which is more than the maximum of %d", ErrStaleBeforeRevision, revBefore, distance.Commits, context.OriginalRevision, context.MaxBeforeRevisionCommits)
+	}
+	if context.WarnBeforeRevisionAge > 0 && distance.Age > context.WarnBeforeRevisionAge {
+		log.Printf("WARN: %s is %v older than %s - differences spanning this long are likely to over-report affected targets", revBefore, distance.Age, context.OriginalRevision)
+	}
+	if context.WarnBeforeRevisionCommits > 0 && distance.Commits > context.WarnBeforeRevisionCommits {
+		log.Printf("WARN: %s is %d commits behind %s - differences spanning this many commits are likely to over-report affected targets", revBefore, distance.Commits, context.OriginalRevision)
+	}
+	return nil
+}
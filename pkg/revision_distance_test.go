@@ -0,0 +1,41 @@
+package pkg
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComputeRevisionDistance(t *testing.T) {
+	dir := t.TempDir()
+	git := func(date string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=td", "GIT_AUTHOR_EMAIL=td@example.com", "GIT_AUTHOR_DATE="+date,
+			"GIT_COMMITTER_NAME=td", "GIT_COMMITTER_EMAIL=td@example.com", "GIT_COMMITTER_DATE="+date)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("Failed to run git %v: %v. Output: %s", args, err, output)
+		}
+		return strings.TrimSpace(string(output))
+	}
+
+	git("", "init", "-q")
+	git("2024-01-01T00:00:00Z", "commit", "-q", "--allow-empty", "-m", "first")
+	before := git("", "rev-parse", "HEAD")
+	git("2024-01-02T00:00:00Z", "commit", "-q", "--allow-empty", "-m", "second")
+	git("2024-01-04T00:00:00Z", "commit", "-q", "--allow-empty", "-m", "third")
+	after := git("", "rev-parse", "HEAD")
+
+	got, err := ComputeRevisionDistance(dir, before, after)
+	if err != nil {
+		t.Fatalf("Failed to compute revision distance: %v", err)
+	}
+	want := RevisionDistance{Commits: 2, Age: 72 * time.Hour}
+	if got != want {
+		t.Fatalf("Wrong revision distance: want %+v got %+v", want, got)
+	}
+}
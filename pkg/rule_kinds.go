@@ -0,0 +1,29 @@
+package pkg
+
+import (
+	"path"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+)
+
+// DefaultDeployableKinds are the rule kinds of targets which are typically deployed.
+var DefaultDeployableKinds = []string{"*_image", "*_push", "k8s_deploy"}
+
+// DefaultAPIKinds are the rule kinds of targets which define API schemas, whose changes may need
+// compatibility checks.
+var DefaultAPIKinds = []string{"proto_library", "openapi_*", "thrift_library", "graphql_schema"}
+
+// RuleKindMatches returns whether configuredTarget is a rule whose kind matches any of patterns,
+// which may contain wildcards as accepted by path.Match, e.g. "*_image".
+func RuleKindMatches(configuredTarget *analysis.ConfiguredTarget, patterns []string) bool {
+	ruleClass := configuredTarget.GetTarget().GetRule().GetRuleClass()
+	if ruleClass == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, ruleClass); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package pkg
+
+import (
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRuleKindMatches(t *testing.T) {
+	for ruleClass, want := range map[string]bool{
+		"oci_image":    true,
+		"oci_push":     true,
+		"k8s_deploy":   true,
+		"k8s_object":   false,
+		"go_library":   false,
+		"image_layers": false,
+	} {
+		configuredTarget := &analysis.ConfiguredTarget{Target: &build.Target{
+			Type: build.Target_RULE.Enum(),
+			Rule: &build.Rule{Name: proto.String("//foo:bar"), RuleClass: proto.String(ruleClass)},
+		}}
+		if got := RuleKindMatches(configuredTarget, DefaultDeployableKinds); want != got {
+			t.Fatalf("Wrong match for %s: want %v got %v", ruleClass, want, got)
+		}
+	}
+}
+
+func TestRuleKindMatchesAPIKinds(t *testing.T) {
+	for ruleClass, want := range map[string]bool{
+		"proto_library":    true,
+		"openapi_spec":     true,
+		"go_proto_library": false,
+		"java_library":     false,
+	} {
+		configuredTarget := &analysis.ConfiguredTarget{Target: &build.Target{
+			Type: build.Target_RULE.Enum(),
+			Rule: &build.Rule{Name: proto.String("//foo:bar"), RuleClass: proto.String(ruleClass)},
+		}}
+		if got := RuleKindMatches(configuredTarget, DefaultAPIKinds); want != got {
+			t.Fatalf("Wrong match for %s: want %v got %v", ruleClass, want, got)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// RunManifest records everything needed to reproduce a target determination run.
+type RunManifest struct {
+	// ToolVersion is the version of the binary which performed the run.
+	ToolVersion string `json:"tool_version"`
+	// Args are the command line arguments the binary was invoked with, excluding the binary itself.
+	Args []string `json:"args"`
+	// WorkspacePath is the Bazel workspace the run was performed in.
+	WorkspacePath string `json:"workspace_path"`
+	// BeforeRevision is the revision targets were compared against.
+	BeforeRevision ManifestRevision `json:"before_revision"`
+	// AfterRevision is the revision which was checked out in WorkspacePath.
+	AfterRevision ManifestRevision `json:"after_revision"`
+	// BazelRelease is the Bazel release used in WorkspacePath.
+	BazelRelease string `json:"bazel_release"`
+	// BazelrcDigests maps the paths of bazelrc files which may have been read by Bazel to the
+	// hex-encoded sha256 of their contents.
+	BazelrcDigests map[string]string `json:"bazelrc_digests"`
+	// Environment contains the values of the set environment variables which may affect the run.
+	Environment map[string]string `json:"environment"`
+	// AffectedTargets are the affected targets which were output, sorted.
+	AffectedTargets []string `json:"affected_targets"`
+}
+
+// ManifestRevision is a git revision as recorded in a RunManifest.
+type ManifestRevision struct {
+	// Revision is the revision as requested, e.g. a branch name.
+	Revision string `json:"revision"`
+	// Sha is the commit Revision resolved to.
+	Sha string `json:"sha"`
+	// Dirty is whether there were local changes on top of Sha.
+	Dirty bool `json:"dirty,omitempty"`
+}
+
+// consultedEnvironmentVariables are the environment variables which target-determinator or the
+// tools it runs are known to consult in ways which can affect the result.
+var consultedEnvironmentVariables = []string{
+	"TD_WORKER_COUNT",
+	"USE_BAZEL_VERSION",
+	"BAZELISK_BASE_URL",
+	"HOME",
+}
+
+// NewRunManifest describes the inputs to a run in context comparing against revBefore, where Bazel
+// was invoked with bazelStartupOpts.
+// ToolVersion, Args and AffectedTargets are left for the caller to fill in.
+func NewRunManifest(context *Context, revBefore LabelledGitRev, bazelStartupOpts []string) (*RunManifest, error) {
+	bazelRelease, err := BazelRelease(context.WorkspacePath, context.BazelCmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine bazel release: %w", err)
+	}
+	uncleanStatuses, err := GitStatusFiltered(context.WorkspacePath, context.IgnoredFiles)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check whether the repository is clean: %w", err)
+	}
+	bazelrcDigests, err := bazelrcDigests(context.WorkspacePath, bazelStartupOpts)
+	if err != nil {
+		return nil, err
+	}
+	environment := make(map[string]string)
+	for _, name := range consultedEnvironmentVariables {
+		if value, ok := os.LookupEnv(name); ok {
+			environment[name] = value
+		}
+	}
+	return &RunManifest{
+		WorkspacePath: context.WorkspacePath,
+		BeforeRevision: ManifestRevision{
+			Revision: revBefore.GitRevision.Revision,
+			Sha:      revBefore.GitRevision.Sha,
+		},
+		AfterRevision: ManifestRevision{
+			Revision: context.OriginalRevision.GitRevision.Revision,
+			Sha:      context.OriginalRevision.GitRevision.Sha,
+			Dirty:    len(uncleanStatuses) > 0,
+		},
+		BazelRelease:   bazelRelease,
+		BazelrcDigests: bazelrcDigests,
+		Environment:    environment,
+	}, nil
+}
+
+// bazelrcDigests hashes the bazelrc files Bazel may read when run in workspacePath with
+// bazelStartupOpts, skipping any which don't exist.
+func bazelrcDigests(workspacePath string, bazelStartupOpts []string) (map[string]string, error) {
+	paths := []string{"/etc/bazel.bazelrc", filepath.Join(workspacePath, ".bazelrc")}
+	if currentUser, err := user.Current(); err == nil {
+		paths = append(paths, filepath.Join(currentUser.HomeDir, ".bazelrc"))
+	}
+	for i, opt := range bazelStartupOpts {
+		var path string
+		if strings.HasPrefix(opt, "--bazelrc=") {
+			path = strings.TrimPrefix(opt, "--bazelrc=")
+		} else if opt == "--bazelrc" && i+1 < len(bazelStartupOpts) {
+			path = bazelStartupOpts[i+1]
+		} else {
+			continue
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(workspacePath, path)
+		}
+		paths = append(paths, path)
+	}
+
+	digests := make(map[string]string)
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read bazelrc %s: %w", path, err)
+		}
+		digest := sha256.Sum256(content)
+		digests[path] = hex.EncodeToString(digest[:])
+	}
+	return digests, nil
+}
+
+// WriteRunManifest writes manifest to path as JSON.
+func WriteRunManifest(path string, manifest *RunManifest) error {
+	sort.Strings(manifest.AffectedTargets)
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal run manifest: %w", err)
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("failed to write run manifest to %s: %w", path, err)
+	}
+	return nil
+}
+
+// LoadRunManifest reads a manifest previously written by WriteRunManifest.
+func LoadRunManifest(path string) (*RunManifest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read run manifest from %s: %w", path, err)
+	}
+	var manifest RunManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse run manifest from %s: %w", path, err)
+	}
+	return &manifest, nil
+}
+
+// PrepareReplay checks out the "after" revision of manifest in the git repository at
+// workspacePath, fetching the revisions of manifest from remote if they aren't present.
+// It returns a function to check out the previously checked out revision again.
+func PrepareReplay(workspacePath string, manifest *RunManifest, remote string) (func() error, error) {
+	if manifest.AfterRevision.Dirty {
+		return nil, fmt.Errorf("can't replay run manifest because there were local changes on top of %s which weren't recorded", manifest.AfterRevision.Sha)
+	}
+	isClean, err := EnsureGitRepositoryClean(workspacePath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check whether the repository is clean: %w", err)
+	}
+	if !isClean {
+		return nil, fmt.Errorf("can't replay run manifest because the repository at %s isn't clean", workspacePath)
+	}
+	for _, sha := range []string{manifest.BeforeRevision.Sha, manifest.AfterRevision.Sha} {
+		if _, err := GitRevParse(workspacePath, sha+"^{commit}", false); err == nil {
+			continue
+		}
+		Progressf("Fetching %s from %s", sha, remote)
+		if _, err := runToLines(workspacePath, "git", "fetch", remote, sha); err != nil {
+			return nil, fmt.Errorf("failed to fetch %s from %s: %w", sha, remote, err)
+		}
+	}
+
+	original, err := GitRevParse(workspacePath, "HEAD", true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current git revision: %w", err)
+	}
+	if original == "HEAD" {
+		if original, err = GitRevParse(workspacePath, "HEAD", false); err != nil {
+			return nil, fmt.Errorf("failed to get current git revision: %w", err)
+		}
+	}
+	if _, err := runToLines(workspacePath, "git", "checkout", "--quiet", manifest.AfterRevision.Sha); err != nil {
+		return nil, fmt.Errorf("failed to check out %s: %w", manifest.AfterRevision.Sha, err)
+	}
+	return func() error {
+		if _, err := runToLines(workspacePath, "git", "checkout", "--quiet", original); err != nil {
+			return fmt.Errorf("failed to check out %s again: %w", original, err)
+		}
+		return nil
+	}, nil
+}
+
+// InputDifferences describes the ways in which the inputs recorded in other differ from those in
+// m, other than the affected targets.
+func (m *RunManifest) InputDifferences(other *RunManifest) []string {
+	var differences []string
+	compare := func(name, before, after string) {
+		if before != after {
+			differences = append(differences, fmt.Sprintf("%s: %q != %q", name, before, after))
+		}
+	}
+	compare("tool version", m.ToolVersion, other.ToolVersion)
+	compare("arguments", strings.Join(m.Args, " "), strings.Join(other.Args, " "))
+	compare("before revision", m.BeforeRevision.Sha, other.BeforeRevision.Sha)
+	compare("after revision", m.AfterRevision.Sha, other.AfterRevision.Sha)
+	compare("bazel release", m.BazelRelease, other.BazelRelease)
+	for _, path := range sortedUnion(m.BazelrcDigests, other.BazelrcDigests) {
+		compare("digest of "+path, m.BazelrcDigests[path], other.BazelrcDigests[path])
+	}
+	for _, name := range sortedUnion(m.Environment, other.Environment) {
+		compare("environment variable "+name, m.Environment[name], other.Environment[name])
+	}
+	return differences
+}
+
+// AffectedTargetDifferences returns the affected targets which are only in other, and only in m.
+func (m *RunManifest) AffectedTargetDifferences(other *RunManifest) (added []string, removed []string) {
+	return DiffTargetLists(m.AffectedTargets, other.AffectedTargets)
+}
+
+// DiffTargetLists returns the targets which are only in after, and only in before, sorted.
+func DiffTargetLists(before []string, after []string) (added []string, removed []string) {
+	beforeSet := make(map[string]bool, len(before))
+	for _, target := range before {
+		beforeSet[target] = true
+	}
+	afterSet := make(map[string]bool, len(after))
+	for _, target := range after {
+		afterSet[target] = true
+		if !beforeSet[target] {
+			added = append(added, target)
+		}
+	}
+	for _, target := range before {
+		if !afterSet[target] {
+			removed = append(removed, target)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func sortedUnion(l, r map[string]string) []string {
+	keys := make([]string, 0, len(l)+len(r))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	for k := range r {
+		if _, ok := l[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
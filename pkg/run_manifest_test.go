@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBazelrcDigests(t *testing.T) {
+	workspace := t.TempDir()
+	for path, content := range map[string]string{
+		".bazelrc":         "build --jobs=4\n",
+		"tools/ci.bazelrc": "build --config=ci\n",
+	} {
+		absPath := filepath.Join(workspace, path)
+		if err := os.MkdirAll(filepath.Dir(absPath), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(absPath, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+
+	digests, err := bazelrcDigests(workspace, []string{"--bazelrc=tools/ci.bazelrc", "--bazelrc", "missing.bazelrc"})
+	if err != nil {
+		t.Fatalf("Failed to compute bazelrc digests: %v", err)
+	}
+
+	for path, want := range map[string]string{
+		filepath.Join(workspace, ".bazelrc"):         "3bfb3b0d371f35c6f7198d4b4432ef38dde2dd4ecad2299a66f163c8367273c1",
+		filepath.Join(workspace, "tools/ci.bazelrc"): "13218ffd6acf5eef40f13c3de86fae3e9d5324e9c6af1de71509a2b3dbc9c95d",
+	} {
+		got, ok := digests[path]
+		if !ok {
+			t.Fatalf("Missing digest for %s in %v", path, digests)
+		}
+		if got != want {
+			t.Fatalf("Wrong digest for %s: want %v got %v", path, want, got)
+		}
+	}
+	if _, ok := digests[filepath.Join(workspace, "missing.bazelrc")]; ok {
+		t.Fatalf("Unexpected digest for missing bazelrc in %v", digests)
+	}
+}
+
+func TestRunManifestDifferences(t *testing.T) {
+	recorded := &RunManifest{
+		ToolVersion:     "1.0.0",
+		BazelRelease:    "release 7.1.0",
+		BazelrcDigests:  map[string]string{"/ws/.bazelrc": "aa"},
+		Environment:     map[string]string{"TD_WORKER_COUNT": "4"},
+		AffectedTargets: []string{"//a:a", "//b:b"},
+	}
+	replayed := &RunManifest{
+		ToolVersion:     "1.0.0",
+		BazelRelease:    "release 7.2.0",
+		BazelrcDigests:  map[string]string{"/ws/.bazelrc": "aa"},
+		Environment:     map[string]string{},
+		AffectedTargets: []string{"//b:b", "//c:c"},
+	}
+
+	wantInputDifferences := []string{
+		`bazel release: "release 7.1.0" != "release 7.2.0"`,
+		`environment variable TD_WORKER_COUNT: "4" != ""`,
+	}
+	if got := recorded.InputDifferences(replayed); !reflect.DeepEqual(wantInputDifferences, got) {
+		t.Fatalf("Wrong input differences: want %v got %v", wantInputDifferences, got)
+	}
+
+	added, removed := recorded.AffectedTargetDifferences(replayed)
+	if want := []string{"//c:c"}; !reflect.DeepEqual(want, added) {
+		t.Fatalf("Wrong added targets: want %v got %v", want, added)
+	}
+	if want := []string{"//a:a"}; !reflect.DeepEqual(want, removed) {
+		t.Fatalf("Wrong removed targets: want %v got %v", want, removed)
+	}
+}
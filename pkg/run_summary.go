@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// RunSummary is a compact record of a single target determination run, suitable for tracking
+// blast-radius and performance over time.
+type RunSummary struct {
+	// Timestamp is when the run started.
+	Timestamp time.Time `json:"timestamp"`
+	// BeforeCommit is the sha of the "before" revision.
+	BeforeCommit string `json:"before_commit"`
+	// AfterCommit is the sha of the "after" revision.
+	AfterCommit string `json:"after_commit"`
+	// CommitsBetween is the number of commits between BeforeCommit and AfterCommit.
+	CommitsBetween int `json:"commits_between"`
+	// DaysBetween is the difference between the commit times of BeforeCommit and AfterCommit, in days.
+	DaysBetween float64 `json:"days_between"`
+	// AffectedTargets is the number of distinct affected labels.
+	AffectedTargets int `json:"affected_targets"`
+	// DurationSeconds is how long the run took, in seconds.
+	DurationSeconds float64 `json:"duration_seconds"`
+	// ResourceUsage is the resources used by the whole run, and Phases breaks them down by phase.
+	// They're only recorded in JSON summaries.
+	ResourceUsage *ResourceUsage `json:"resource_usage,omitempty"`
+	Phases        []PhaseUsage   `json:"phases,omitempty"`
+}
+
+// runSummaryCsvHeader is the header of new CSV history files. Columns added since the first
+// version are at the end, so that tools reading columns by position keep working.
+var runSummaryCsvHeader = []string{"timestamp", "before_commit", "after_commit", "affected_targets", "duration_seconds", "commits_between", "days_between"}
+
+// csvRecord returns the values of the columns in header, which must all be in runSummaryCsvHeader.
+func (s RunSummary) csvRecord(header []string) ([]string, error) {
+	values := map[string]string{
+		"timestamp":        s.Timestamp.UTC().Format(time.RFC3339),
+		"before_commit":    s.BeforeCommit,
+		"after_commit":     s.AfterCommit,
+		"affected_targets": strconv.Itoa(s.AffectedTargets),
+		"duration_seconds": strconv.FormatFloat(s.DurationSeconds, 'f', 3, 64),
+		"commits_between":  strconv.Itoa(s.CommitsBetween),
+		"days_between":     strconv.FormatFloat(s.DaysBetween, 'f', 2, 64),
+	}
+	record := make([]string, 0, len(header))
+	for _, column := range header {
+		value, ok := values[column]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q", column)
+		}
+		record = append(record, value)
+	}
+	return record, nil
+}
+
+// AppendRunSummary appends summary to the history file at path, creating it if needed.
+// Files with a .csv extension get a CSV record (and a header row if the file was empty), all other
+// files get a newline-delimited JSON record. CSV records have the columns of the file's existing
+// header, so files written by older versions, which had fewer columns, stay consistent.
+func AppendRunSummary(path string, summary RunSummary) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open run summary history file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if filepath.Ext(path) == ".csv" {
+		info, err := f.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to stat run summary history file %s: %w", path, err)
+		}
+		w := csv.NewWriter(f)
+		header := runSummaryCsvHeader
+		if info.Size() == 0 {
+			if err := w.Write(header); err != nil {
+				return fmt.Errorf("failed to write run summary header to %s: %w", path, err)
+			}
+		} else if header, err = csv.NewReader(f).Read(); err != nil {
+			return fmt.Errorf("failed to read run summary header from %s: %w", path, err)
+		}
+		record, err := summary.csvRecord(header)
+		if err != nil {
+			return fmt.Errorf("can't append run summary to %s: %w", path, err)
+		}
+		if err := w.Write(record); err != nil {
+			return fmt.Errorf("failed to write run summary to %s: %w", path, err)
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return fmt.Errorf("failed to write run summary to %s: %w", path, err)
+		}
+	} else {
+		line, err := json.Marshal(summary)
+		if err != nil {
+			return fmt.Errorf("failed to marshal run summary: %w", err)
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("failed to write run summary to %s: %w", path, err)
+		}
+	}
+	return f.Close()
+}
+
+// PostRunSummary POSTs summary as JSON to url, failing if the response isn't a 2xx.
+func PostRunSummary(url string, summary RunSummary) error {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		return fmt.Errorf("failed to marshal run summary: %w", err)
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post run summary to %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to post run summary to %s: got status %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAppendRunSummary(t *testing.T) {
+	summary := RunSummary{
+		Timestamp:       time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		BeforeCommit:    "aaaa",
+		AfterCommit:     "bbbb",
+		CommitsBetween:  4,
+		DaysBetween:     1.25,
+		AffectedTargets: 3,
+		DurationSeconds: 1.5,
+	}
+
+	for name, tc := range map[string]struct {
+		fileName string
+		want     string
+	}{
+		"csv": {
+			fileName: "history.csv",
+			want: "timestamp,before_commit,after_commit,affected_targets,duration_seconds,commits_between,days_between\n" +
+				"2024-01-02T03:04:05Z,aaaa,bbbb,3,1.500,4,1.25\n" +
+				"2024-01-02T03:04:05Z,aaaa,bbbb,3,1.500,4,1.25\n",
+		},
+		"ndjson": {
+			fileName: "history.ndjson",
+			want: `{"timestamp":"2024-01-02T03:04:05Z","before_commit":"aaaa","after_commit":"bbbb","commits_between":4,"days_between":1.25,"affected_targets":3,"duration_seconds":1.5}` + "\n" +
+				`{"timestamp":"2024-01-02T03:04:05Z","before_commit":"aaaa","after_commit":"bbbb","commits_between":4,"days_between":1.25,"affected_targets":3,"duration_seconds":1.5}` + "\n",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.fileName)
+			for i := 0; i < 2; i++ {
+				if err := AppendRunSummary(path, summary); err != nil {
+					t.Fatalf("Failed to append run summary: %v", err)
+				}
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read run summary history: %v", err)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("Wrong run summary history: want %q got %q", tc.want, string(got))
+			}
+		})
+	}
+}
+
+func TestAppendRunSummaryKeepsExistingCsvColumns(t *testing.T) {
+	summary := RunSummary{
+		Timestamp:       time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		BeforeCommit:    "aaaa",
+		AfterCommit:     "bbbb",
+		CommitsBetween:  4,
+		AffectedTargets: 3,
+		DurationSeconds: 1.5,
+	}
+	path := filepath.Join(t.TempDir(), "history.csv")
+	// Written before commits_between and days_between were recorded.
+	existing := "timestamp,before_commit,after_commit,affected_targets,duration_seconds\n" +
+		"2024-01-01T00:00:00Z,cccc,dddd,1,0.500\n"
+	if err := os.WriteFile(path, []byte(existing), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendRunSummary(path, summary); err != nil {
+		t.Fatalf("Failed to append run summary: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read run summary history: %v", err)
+	}
+	if want := existing + "2024-01-02T03:04:05Z,aaaa,bbbb,3,1.500\n"; string(got) != want {
+		t.Fatalf("Wrong run summary history: want %q got %q", want, string(got))
+	}
+
+	if err := os.WriteFile(path, []byte("timestamp,unknown\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendRunSummary(path, summary); err == nil {
+		t.Fatalf("Wrong result appending to history with unknown columns: want error got nil")
+	}
+}
@@ -0,0 +1,42 @@
+package pkg
+
+// ShadowComparison compares the targets selected by another mechanism (e.g. a legacy CI selection
+// being replaced) with the affected targets determined for the same change.
+type ShadowComparison struct {
+	// LegacyTargets and DeterminedTargets are the number of targets in each set, and BothTargets the
+	// number in both.
+	LegacyTargets     int `json:"legacy_targets"`
+	DeterminedTargets int `json:"determined_targets"`
+	BothTargets       int `json:"both_targets"`
+	// Precision is the fraction of the determined targets which were also selected by the legacy
+	// mechanism, and Recall is the fraction of the targets selected by the legacy mechanism which
+	// were also determined to be affected. Each is 1 if there are no targets to take a fraction of.
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+	// OnlyLegacy and OnlyDetermined are the targets only in each set, sorted.
+	OnlyLegacy     []string `json:"only_legacy"`
+	OnlyDetermined []string `json:"only_determined"`
+}
+
+// CompareShadow compares the targets selected by the legacy mechanism with the determined targets.
+// Both should be normalized labels without duplicates, e.g. as returned by LoadResults.
+func CompareShadow(legacy []string, determined []string) ShadowComparison {
+	onlyDetermined, onlyLegacy := DiffTargetLists(legacy, determined)
+	both := len(determined) - len(onlyDetermined)
+	comparison := ShadowComparison{
+		LegacyTargets:     len(legacy),
+		DeterminedTargets: len(determined),
+		BothTargets:       both,
+		Precision:         1,
+		Recall:            1,
+		OnlyLegacy:        onlyLegacy,
+		OnlyDetermined:    onlyDetermined,
+	}
+	if len(determined) > 0 {
+		comparison.Precision = float64(both) / float64(len(determined))
+	}
+	if len(legacy) > 0 {
+		comparison.Recall = float64(both) / float64(len(legacy))
+	}
+	return comparison
+}
@@ -0,0 +1,31 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareShadow(t *testing.T) {
+	legacy := []string{"//a", "//b", "//c", "//d"}
+	determined := []string{"//b", "//a", "//e"}
+
+	want := ShadowComparison{
+		LegacyTargets:     4,
+		DeterminedTargets: 3,
+		BothTargets:       2,
+		Precision:         2.0 / 3.0,
+		Recall:            0.5,
+		OnlyLegacy:        []string{"//c", "//d"},
+		OnlyDetermined:    []string{"//e"},
+	}
+	if got := CompareShadow(legacy, determined); !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong shadow comparison: want %+v got %+v", want, got)
+	}
+}
+
+func TestCompareShadowEmpty(t *testing.T) {
+	got := CompareShadow(nil, nil)
+	if got.Precision != 1 || got.Recall != 1 {
+		t.Fatalf("Wrong precision and recall of empty comparison: want 1 and 1 got %v and %v", got.Precision, got.Recall)
+	}
+}
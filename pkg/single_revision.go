@@ -0,0 +1,210 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// ChangedFilesSince lists the files, relative to the workspace root, which differ between rev and
+// the current state of the working directory in workspacePath, including untracked files.
+func ChangedFilesSince(workspacePath string, rev LabelledGitRev) ([]string, error) {
+	changed, err := runToLines(workspacePath, "git", "diff", "--name-only", "--no-renames", rev.GitRevision.Sha)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files changed since %s: %w", rev, err)
+	}
+	untracked, err := runToLines(workspacePath, "git", "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list untracked files: %w", err)
+	}
+	return append(changed, untracked...), nil
+}
+
+// ReadChangedFiles reads a list of changed files, one per line, relative to the workspace root.
+// Blank lines are ignored.
+func ReadChangedFiles(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open changed files list %s: %w", path, err)
+	}
+	defer f.Close()
+	var changedFiles []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			changedFiles = append(changedFiles, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read changed files list %s: %w", path, err)
+	}
+	return changedFiles, nil
+}
+
+// NormalizeHypotheticalPaths returns paths, which may be relative to the workspace root or absolute
+// paths inside workspacePath, as clean slash-separated paths relative to the workspace root, for
+// use as the changed files of WalkAffectedTargetsSingleRevision. The files needn't exist, so that
+// the impact of changes can be assessed before making them. It returns an error for paths outside
+// the workspace.
+func NormalizeHypotheticalPaths(workspacePath string, paths []string) ([]string, error) {
+	normalized := make([]string, 0, len(paths))
+	for _, p := range paths {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		relative := filepath.Clean(filepath.FromSlash(p))
+		if filepath.IsAbs(relative) {
+			var err error
+			if relative, err = filepath.Rel(workspacePath, relative); err != nil {
+				return nil, fmt.Errorf("failed to make %s relative to the workspace %s: %w", p, workspacePath, err)
+			}
+		}
+		if relative == "." || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("%s isn't a file in the workspace %s", p, workspacePath)
+		}
+		normalized = append(normalized, filepath.ToSlash(relative))
+	}
+	return normalized, nil
+}
+
+// WalkAffectedTargetsSingleRevision approximates which targets are affected by changedFiles (paths
+// relative to the workspace root), which changed since revBefore, using only the build graph of the
+// current working directory state, and calls callback once for each such target.
+//
+// This is much faster than WalkAffectedTargets because nothing is checked out or queried at the
+// "before" revision, but it is less precise: targets are considered affected if any of their
+// transitive dependencies is defined in or reads a changed file, regardless of configuration, and
+// changes to infrastructure files are handled according to Context.InfraFilePolicies, which by
+// default report changes which may affect any target (e.g. to .bzl files or MODULE.bazel) as
+// affecting every matching target. Changes to package manager files (e.g. go.sum) are mapped to
+// the external repositories generated from them, see ChangedExternalRepositories. Targets which
+// were deleted can't be reported at all.
+func WalkAffectedTargetsSingleRevision(context *Context, revBefore LabelledGitRev, changedFiles []string, targets TargetsList, includeDifferences bool, callback WalkCallback) error {
+	revAfter, err := NewLabelledGitRev(context.WorkspacePath, "", "after")
+	if err != nil {
+		return fmt.Errorf("could not create \"after\" revision: %w", err)
+	}
+	queryInfo, cleanup, err := LoadIncompleteMetadata(context, revAfter, targets)
+	defer cleanup()
+	if err != nil {
+		return fmt.Errorf("failed to process %s: %w", revAfter, err)
+	}
+
+	changedRepositories, err := ChangedExternalRepositories(context.WorkspacePath, revBefore, changedFiles)
+	if err != nil {
+		return err
+	}
+	if len(changedRepositories) > 0 {
+		Progressf("Considering targets in external repositories %s affected because package manager files changed", strings.Join(changedRepositories, ", "))
+	}
+	policies := infraFilePolicies(context)
+	callback = excludingSubtrees(ExcludedSubtrees(policies), callback)
+	affected, allAffectedBecause, err := affectedLabelsSingleRevision(context.WorkspacePath, queryInfo, changedFiles, changedRepositories, policies)
+	if err != nil {
+		return err
+	}
+	if allAffectedBecause != "" {
+		Progressf("Considering all targets affected because %s changed", allAffectedBecause)
+	}
+
+	for _, l := range queryInfo.MatchingTargets.Labels() {
+		if allAffectedBecause == "" && !affected[l] {
+			continue
+		}
+		for _, configuration := range queryInfo.MatchingTargets.ConfigurationsFor(l) {
+			var differences []Difference
+			if includeDifferences {
+				differences = append(differences, Difference{Category: "DependsOnChangedFile"})
+			}
+			callback(l, differences, queryInfo.TransitiveConfiguredTargets[l][configuration])
+		}
+	}
+	return nil
+}
+
+// affectedLabelsSingleRevision returns the labels in queryInfo which transitively depend on
+// changedFiles, on targets in changedRepositories, or on targets which policies consider affected
+// by changedFiles. If policies consider every target affected by a changed file, its path is
+// returned instead.
+func affectedLabelsSingleRevision(workspacePath string, queryInfo *QueryResults, changedFiles []string, changedRepositories []string, policies []InfraFilePolicy) (map[label.Label]bool, string, error) {
+	effect, err := ApplyInfraFilePolicies(policies, changedFiles)
+	if err != nil {
+		return nil, "", err
+	}
+	if effect.AllAffectedBecause != "" {
+		return nil, effect.AllAffectedBecause, nil
+	}
+	changed := make(map[string]bool, len(changedFiles))
+	for _, path := range changedFiles {
+		changed[filepath.Join(workspacePath, filepath.FromSlash(path))] = true
+	}
+
+	var queue []label.Label
+	seen := make(map[label.Label]bool)
+	for _, l := range effect.Targets {
+		if !seen[l] {
+			seen[l] = true
+			queue = append(queue, l)
+		}
+	}
+	rdeps := make(map[label.Label][]label.Label)
+	for l, configuredTargets := range queryInfo.TransitiveConfiguredTargets {
+		for _, configuredTarget := range configuredTargets {
+			target := configuredTarget.GetTarget()
+			var definedIn string
+			for _, subtree := range effect.Subtrees {
+				if isInSubtree(l, subtree) && !seen[l] {
+					seen[l] = true
+					queue = append(queue, l)
+				}
+			}
+			for _, repository := range changedRepositories {
+				if l.Repo != "" && repositoryNameMatches(l.Repo, repository) && !seen[l] {
+					seen[l] = true
+					queue = append(queue, l)
+				}
+			}
+			switch target.GetType() {
+			case build.Target_SOURCE_FILE:
+				definedIn = AbsolutePath(target)
+			case build.Target_RULE:
+				definedIn, _, _ = strings.Cut(target.GetRule().GetLocation(), ":")
+				for _, ruleInput := range target.GetRule().GetRuleInput() {
+					ruleInputLabel, err := queryInfo.TargetHashCache.ParseCanonicalLabel(ruleInput)
+					if err != nil {
+						return nil, "", fmt.Errorf("failed to parse ruleInput label %s: %w", ruleInput, err)
+					}
+					rdeps[ruleInputLabel] = append(rdeps[ruleInputLabel], l)
+				}
+			case build.Target_GENERATED_FILE:
+				generatingRule, err := queryInfo.TargetHashCache.ParseCanonicalLabel(target.GetGeneratedFile().GetGeneratingRule())
+				if err != nil {
+					return nil, "", fmt.Errorf("failed to parse generating rule label %s: %w", target.GetGeneratedFile().GetGeneratingRule(), err)
+				}
+				rdeps[generatingRule] = append(rdeps[generatingRule], l)
+			}
+			if changed[definedIn] && !seen[l] {
+				seen[l] = true
+				queue = append(queue, l)
+			}
+		}
+	}
+
+	for len(queue) > 0 {
+		l := queue[0]
+		queue = queue[1:]
+		for _, rdep := range rdeps[l] {
+			if !seen[rdep] {
+				seen[rdep] = true
+				queue = append(queue, rdep)
+			}
+		}
+	}
+	return seen, "", nil
+}
@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestAffectedLabelsSingleRevision(t *testing.T) {
+	sourceFile := func(name, location string) *analysis.ConfiguredTarget {
+		return &analysis.ConfiguredTarget{Target: &build.Target{
+			Type:       build.Target_SOURCE_FILE.Enum(),
+			SourceFile: &build.SourceFile{Name: proto.String(name), Location: proto.String(location)},
+		}}
+	}
+	rule := func(name, location string, ruleInputs ...string) *analysis.ConfiguredTarget {
+		return &analysis.ConfiguredTarget{Target: &build.Target{
+			Type: build.Target_RULE.Enum(),
+			Rule: &build.Rule{Name: proto.String(name), RuleClass: proto.String("java_library"), Location: proto.String(location), RuleInput: ruleInputs},
+		}}
+	}
+	configuration := NormalizeConfiguration(configurationChecksum)
+	unconfigured := NormalizeConfiguration("")
+	queryInfo := &QueryResults{
+		TransitiveConfiguredTargets: map[label.Label]map[Configuration]*analysis.ConfiguredTarget{
+			mustParseLabel("//java/example:Dep.java"): {
+				unconfigured: sourceFile("//java/example:Dep.java", "/ws/java/example/Dep.java:1:1"),
+			},
+			mustParseLabel("//java/example:Dep"): {
+				configuration: rule("//java/example:Dep", "/ws/java/example/BUILD.bazel:1:13", "//java/example:Dep.java"),
+			},
+			mustParseLabel("//java/example:Lib"): {
+				configuration: rule("//java/example:Lib", "/ws/java/example/BUILD.bazel:7:13", "//java/example:Dep", "@@gazelle++go_deps+com_github_google_uuid//:uuid"),
+			},
+			mustParseLabel("@@gazelle++go_deps+com_github_google_uuid//:uuid"): {
+				configuration: rule("@@gazelle++go_deps+com_github_google_uuid//:uuid", "/out/external/gazelle++go_deps+com_github_google_uuid/BUILD.bazel:1:1"),
+			},
+			mustParseLabel("//java/other:Other"): {
+				configuration: rule("//java/other:Other", "/ws/java/other/BUILD.bazel:1:13"),
+			},
+		},
+		TargetHashCache: NewTargetHashCache(nil, &Normalizer{}, "release 7.1.0"),
+	}
+
+	policies := append([]InfraFilePolicy{
+		{Pattern: "ci/**", Action: "targets", Targets: []string{"//java/example:Dep"}},
+	}, DefaultInfraFilePolicies...)
+	policies = append(policies, InfraFilePolicy{Pattern: "tools/lint/*.bzl", Action: "ignore"})
+
+	for name, tc := range map[string]struct {
+		changedFiles        []string
+		changedRepositories []string
+		want                map[label.Label]bool
+		wantAll             string
+	}{
+		"source file": {
+			changedFiles: []string{"java/example/Dep.java"},
+			want: map[label.Label]bool{
+				mustParseLabel("//java/example:Dep.java"): true,
+				mustParseLabel("//java/example:Dep"):      true,
+				mustParseLabel("//java/example:Lib"):      true,
+			},
+		},
+		"BUILD file": {
+			changedFiles: []string{"java/other/BUILD.bazel"},
+			want:         map[label.Label]bool{mustParseLabel("//java/other:Other"): true},
+		},
+		"unrelated file": {
+			changedFiles: []string{"README.md"},
+			want:         map[label.Label]bool{},
+		},
+		"infra file affecting targets": {
+			changedFiles: []string{"ci/pipeline.yaml"},
+			want: map[label.Label]bool{
+				mustParseLabel("//java/example:Dep"): true,
+				mustParseLabel("//java/example:Lib"): true,
+			},
+		},
+		"changed external repository": {
+			changedFiles:        []string{"go.sum"},
+			changedRepositories: []string{"com_github_google_uuid"},
+			want: map[label.Label]bool{
+				mustParseLabel("@@gazelle++go_deps+com_github_google_uuid//:uuid"): true,
+				mustParseLabel("//java/example:Lib"):                               true,
+			},
+		},
+		"ignored infra file": {
+			changedFiles: []string{"tools/lint/defs.bzl"},
+			want:         map[label.Label]bool{},
+		},
+		"bzl file": {
+			changedFiles: []string{"README.md", "tools/defs.bzl"},
+			wantAll:      "tools/defs.bzl",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, gotAll, err := affectedLabelsSingleRevision("/ws", queryInfo, tc.changedFiles, tc.changedRepositories, policies)
+			if err != nil {
+				t.Fatalf("Failed to compute affected labels: %v", err)
+			}
+			if tc.wantAll != gotAll {
+				t.Fatalf("Wrong file affecting all targets: want %v got %v", tc.wantAll, gotAll)
+			}
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("Wrong affected labels: want %v got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestNormalizeHypotheticalPaths(t *testing.T) {
+	workspace := filepath.Join(string(filepath.Separator), "workspace")
+	got, err := NormalizeHypotheticalPaths(workspace, []string{"java/example/Lib.java", " ./tools/defs.bzl", "", filepath.Join(workspace, "new", "BUILD.bazel")})
+	if err != nil {
+		t.Fatalf("Error normalizing paths: %v", err)
+	}
+	want := []string{"java/example/Lib.java", "tools/defs.bzl", "new/BUILD.bazel"}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong paths: want %v got %v", want, got)
+	}
+
+	for _, p := range []string{"../outside", filepath.Join(string(filepath.Separator), "elsewhere", "BUILD"), "."} {
+		if _, err := NormalizeHypotheticalPaths(workspace, []string{p}); err == nil {
+			t.Fatalf("Expected an error for %s", p)
+		}
+	}
+}
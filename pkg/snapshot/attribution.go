@@ -0,0 +1,59 @@
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ContributingSourceFiles returns the source files which the target labelString's hash depends on
+// in either snapshot, and whose hashes differ between before and after, sorted: the files whose
+// changes caused it to be reported, e.g. to route failures of it to their owners. It returns false
+// if the snapshots didn't record the source files of labelString (see pkg.Context.SourceFilesLimit).
+func ContributingSourceFiles(before *Snapshot, after *Snapshot, labelString string) ([]string, bool) {
+	if before.SourceFileHashes == nil || after.SourceFileHashes == nil {
+		return nil, false
+	}
+	sourceFiles := make(map[string]bool)
+	for _, s := range []*Snapshot{before, after} {
+		if _, ok := s.Hashes[labelString]; !ok {
+			continue
+		}
+		info := s.Targets[labelString]
+		if info.SourceFiles == nil {
+			return nil, false
+		}
+		for _, sourceFile := range info.SourceFiles {
+			sourceFiles[sourceFile] = true
+		}
+	}
+	contributing := make([]string, 0, len(sourceFiles))
+	for sourceFile := range sourceFiles {
+		if before.SourceFileHashes[sourceFile] != after.SourceFileHashes[sourceFile] {
+			contributing = append(contributing, sourceFile)
+		}
+	}
+	sort.Strings(contributing)
+	return contributing, true
+}
+
+// WriteSourceFileAttribution writes changes to w as for WriteText, or WriteColorText if color is
+// set, with the source files which contributed to each (see ContributingSourceFiles) indented on
+// the following lines.
+func WriteSourceFileAttribution(w io.Writer, changes []Change, before *Snapshot, after *Snapshot, color bool) error {
+	for _, change := range changes {
+		if err := writeText(w, []Change{change}, color); err != nil {
+			return err
+		}
+		sourceFiles, ok := ContributingSourceFiles(before, after, change.Label)
+		if !ok {
+			sourceFiles = []string{"(source files not recorded)"}
+		}
+		for _, sourceFile := range sourceFiles {
+			if _, err := fmt.Fprintf(w, "    %s\n", sourceFile); err != nil {
+				return fmt.Errorf("failed to write changes: %w", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package snapshot
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+func TestContributingSourceFiles(t *testing.T) {
+	before := &Snapshot{
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib": {"cfg": "aa"},
+			"//java/example:Unrecorded":  {"cfg": "bb"},
+		},
+		Targets: map[string]pkg.PersistedTargetInfo{
+			"//java/example:GreetingLib": {Kind: "java_library", SourceFiles: []string{"//java/example:Greeting.java", "//java/example:Old.java", "//java/example:Util.java"}},
+			"//java/example:Unrecorded":  {Kind: "java_library"},
+		},
+		SourceFileHashes: map[string]string{
+			"//java/example:Greeting.java": "01",
+			"//java/example:Old.java":      "02",
+			"//java/example:Util.java":     "03",
+		},
+	}
+	after := &Snapshot{
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib": {"cfg": "ab"},
+			"//java/example:Unrecorded":  {"cfg": "bc"},
+			"//go/example:lib_test":      {"cfg": "cc"},
+		},
+		Targets: map[string]pkg.PersistedTargetInfo{
+			"//java/example:GreetingLib": {Kind: "java_library", SourceFiles: []string{"//java/example:Greeting.java", "//java/example:New.java", "//java/example:Util.java"}},
+			"//java/example:Unrecorded":  {Kind: "java_library"},
+			"//go/example:lib_test":      {Kind: "go_test", SourceFiles: []string{"//go/example:lib_test.go", "//java/example:Util.java"}},
+		},
+		SourceFileHashes: map[string]string{
+			"//java/example:Greeting.java": "11",
+			"//java/example:New.java":      "12",
+			"//java/example:Util.java":     "03",
+			"//go/example:lib_test.go":     "14",
+		},
+	}
+	for labelString, want := range map[string][]string{
+		"//java/example:GreetingLib": {"//java/example:Greeting.java", "//java/example:New.java", "//java/example:Old.java"},
+		"//go/example:lib_test":      {"//go/example:lib_test.go"},
+	} {
+		got, ok := ContributingSourceFiles(before, after, labelString)
+		if !ok || !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong contributing source files of %s: want %v got %v (recorded: %v)", labelString, want, got, ok)
+		}
+	}
+	if _, ok := ContributingSourceFiles(before, after, "//java/example:Unrecorded"); ok {
+		t.Fatalf("Wrong result for target without recorded source files: want not recorded got recorded")
+	}
+	if _, ok := ContributingSourceFiles(&Snapshot{}, after, "//go/example:lib_test"); ok {
+		t.Fatalf("Wrong result for snapshot without recorded source files: want not recorded got recorded")
+	}
+
+	var buf bytes.Buffer
+	changes := []Change{{Label: "//go/example:lib_test", Status: StatusAdded}, {Label: "//java/example:Unrecorded", Status: StatusChanged}}
+	if err := WriteSourceFileAttribution(&buf, changes, before, after, false); err != nil {
+		t.Fatalf("Error writing source file attribution: %v", err)
+	}
+	want := "+ //go/example:lib_test\n    //go/example:lib_test.go\n~ //java/example:Unrecorded\n    (source files not recorded)\n"
+	if got := buf.String(); want != got {
+		t.Fatalf("Wrong source file attribution: want %q got %q", want, got)
+	}
+}
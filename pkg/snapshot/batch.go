@@ -0,0 +1,100 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+// BatchEntry is a pair of snapshots to compare in a batch, and where to write their differences.
+type BatchEntry struct {
+	// Before and After are the locations of the snapshots, as for ReadFile.
+	Before string `json:"before"`
+	After  string `json:"after"`
+	// Output is the local path to write the differences to.
+	Output string `json:"output"`
+}
+
+// LoadBatchManifest reads the entries of a batch from the JSON file at path, which contains an
+// array of BatchEntry objects. Relative local paths are relative to the manifest.
+func LoadBatchManifest(path string) ([]BatchEntry, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch manifest from %s: %w", path, err)
+	}
+	var entries []BatchEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse batch manifest from %s: %w", path, err)
+	}
+	dir := filepath.Dir(path)
+	for i, entry := range entries {
+		if entry.Before == "" || entry.After == "" || entry.Output == "" {
+			return nil, fmt.Errorf("entry %d in batch manifest %s must have a before, after and output", i, path)
+		}
+		entries[i] = BatchEntry{
+			Before: resolveBatchLocation(dir, entry.Before),
+			After:  resolveBatchLocation(dir, entry.After),
+			Output: resolveBatchLocation(dir, entry.Output),
+		}
+	}
+	return entries, nil
+}
+
+func resolveBatchLocation(dir string, location string) string {
+	if pkg.HashStoreFor(location) != (pkg.LocalHashStore{}) || filepath.IsAbs(location) {
+		return location
+	}
+	return filepath.Join(dir, location)
+}
+
+// DiffBatch reads the snapshots of each of entries in turn, and calls diff with them.
+// Each snapshot is read once, however many entries it's in, and is only kept in memory until the
+// last entry it's in has been diffed, so that e.g. a main branch commit's snapshot compared with
+// each of several pull requests' is loaded once, without holding every snapshot at once.
+func DiffBatch(entries []BatchEntry, opts ReadOptions, diff func(entry BatchEntry, before *Snapshot, after *Snapshot) error) error {
+	return diffBatch(entries, func(location string) (*Snapshot, error) {
+		return ReadFile(location, opts)
+	}, diff)
+}
+
+func diffBatch(entries []BatchEntry, read func(location string) (*Snapshot, error), diff func(entry BatchEntry, before *Snapshot, after *Snapshot) error) error {
+	remainingUses := make(map[string]int)
+	for _, entry := range entries {
+		remainingUses[entry.Before]++
+		remainingUses[entry.After]++
+	}
+	loaded := make(map[string]*Snapshot)
+	load := func(location string) (*Snapshot, error) {
+		s, ok := loaded[location]
+		if !ok {
+			var err error
+			if s, err = read(location); err != nil {
+				return nil, err
+			}
+			loaded[location] = s
+		}
+		remainingUses[location]--
+		if remainingUses[location] == 0 {
+			delete(loaded, location)
+		}
+		return s, nil
+	}
+
+	for _, entry := range entries {
+		before, err := load(entry.Before)
+		if err != nil {
+			return err
+		}
+		after, err := load(entry.After)
+		if err != nil {
+			return err
+		}
+		if err := diff(entry, before, after); err != nil {
+			return fmt.Errorf("failed to compare %s and %s: %w", entry.Before, entry.After, err)
+		}
+	}
+	return nil
+}
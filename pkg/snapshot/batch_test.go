@@ -0,0 +1,69 @@
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadBatchManifest(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "manifest.json")
+	content := `[
+  {"before": "main.json", "after": "pr1.json", "output": "out/pr1.txt"},
+  {"before": "gs://bucket/main.json", "after": "/abs/pr2.json", "output": "pr2.txt"}
+]`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadBatchManifest(path)
+	if err != nil {
+		t.Fatalf("Error loading batch manifest: %v", err)
+	}
+	want := []BatchEntry{
+		{Before: filepath.Join(dir, "main.json"), After: filepath.Join(dir, "pr1.json"), Output: filepath.Join(dir, "out/pr1.txt")},
+		{Before: "gs://bucket/main.json", After: "/abs/pr2.json", Output: filepath.Join(dir, "pr2.txt")},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong batch entries: want %v got %v", want, got)
+	}
+
+	if err := os.WriteFile(path, []byte(`[{"before": "main.json", "after": "pr1.json"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadBatchManifest(path); err == nil {
+		t.Fatalf("Wrong result loading batch manifest without output: want error got nil")
+	}
+}
+
+func TestDiffBatchReadsEachSnapshotOnce(t *testing.T) {
+	snapshots := map[string]*Snapshot{"main": before, "pr1": after, "pr2": after}
+	reads := make(map[string]int)
+	read := func(location string) (*Snapshot, error) {
+		reads[location]++
+		return snapshots[location], nil
+	}
+	entries := []BatchEntry{
+		{Before: "main", After: "pr1", Output: "pr1.txt"},
+		{Before: "main", After: "pr2", Output: "pr2.txt"},
+		{Before: "pr1", After: "pr2", Output: "pr1-pr2.txt"},
+	}
+	var outputs []string
+	err := diffBatch(entries, read, func(entry BatchEntry, b *Snapshot, a *Snapshot) error {
+		if b != snapshots[entry.Before] || a != snapshots[entry.After] {
+			t.Fatalf("Wrong snapshots for %v", entry)
+		}
+		outputs = append(outputs, entry.Output)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error diffing batch: %v", err)
+	}
+	if want := []string{"pr1.txt", "pr2.txt", "pr1-pr2.txt"}; !reflect.DeepEqual(want, outputs) {
+		t.Fatalf("Wrong outputs: want %v got %v", want, outputs)
+	}
+	if want := map[string]int{"main": 1, "pr1": 1, "pr2": 1}; !reflect.DeepEqual(want, reads) {
+		t.Fatalf("Wrong number of reads: want %v got %v", want, reads)
+	}
+}
@@ -0,0 +1,83 @@
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+// DependencyChange is an external dependency which differs between two snapshots.
+type DependencyChange struct {
+	// Name is the name of the dependency's repository.
+	Name string
+	// Status is StatusAdded, StatusRemoved, or StatusChanged if its version or integrity changed.
+	Status string
+	// Before and After are the dependency in the before and after snapshots. They are empty for
+	// added and removed dependencies respectively.
+	Before pkg.PersistedExternalDependency
+	After  pkg.PersistedExternalDependency
+}
+
+// DiffDependencies returns the external dependencies which were added, removed or changed between
+// before and after, sorted by name. If either snapshot didn't record its external dependencies,
+// there are none.
+func DiffDependencies(before *Snapshot, after *Snapshot) []DependencyChange {
+	if before.ExternalDependencies == nil || after.ExternalDependencies == nil {
+		return nil
+	}
+	var changes []DependencyChange
+	for name, afterDependency := range after.ExternalDependencies {
+		beforeDependency, ok := before.ExternalDependencies[name]
+		switch {
+		case !ok:
+			changes = append(changes, DependencyChange{Name: name, Status: StatusAdded, After: afterDependency})
+		case beforeDependency != afterDependency:
+			changes = append(changes, DependencyChange{Name: name, Status: StatusChanged, Before: beforeDependency, After: afterDependency})
+		}
+	}
+	for name, beforeDependency := range before.ExternalDependencies {
+		if _, ok := after.ExternalDependencies[name]; !ok {
+			changes = append(changes, DependencyChange{Name: name, Status: StatusRemoved, Before: beforeDependency})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
+
+// String describes the change, e.g. "~ rules_go 0.46.0 -> 0.50.1", prefixed as by WriteText.
+func (c DependencyChange) String() string {
+	switch c.Status {
+	case StatusAdded:
+		return "+ " + c.Name + " " + c.After.Version
+	case StatusRemoved:
+		return "- " + c.Name + " " + c.Before.Version
+	}
+	if c.Before.Version == c.After.Version {
+		return fmt.Sprintf("~ %s %s (integrity changed)", c.Name, c.After.Version)
+	}
+	return fmt.Sprintf("~ %s %s -> %s", c.Name, c.Before.Version, c.After.Version)
+}
+
+// WriteDependencyChanges writes a "Dependency changes" section listing changes to w, colored as by
+// WriteColorText if color is set. Nothing is written if there are no changes.
+func WriteDependencyChanges(w io.Writer, changes []DependencyChange, color bool) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	colors := map[string]string{StatusAdded: pkg.ColorGreen, StatusRemoved: pkg.ColorRed, StatusChanged: pkg.ColorYellow}
+	if _, err := fmt.Fprintln(w, "Dependency changes:"); err != nil {
+		return fmt.Errorf("failed to write dependency changes: %w", err)
+	}
+	for _, change := range changes {
+		line := change.String()
+		if color {
+			line = pkg.Colorize(line, colors[change.Status])
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return fmt.Errorf("failed to write dependency changes: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package snapshot
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+func TestDiffDependencies(t *testing.T) {
+	before := &Snapshot{ExternalDependencies: map[string]pkg.PersistedExternalDependency{
+		"rules_go":               {Version: "0.46.0", Integrity: "sha256:aa"},
+		"gazelle":                {Version: "0.35.0", Integrity: "sha256:bb"},
+		"com_github_google_uuid": {Version: "v1.3.0", Integrity: "h1:cc"},
+		"rules_python":           {Version: "0.31.0"},
+	}}
+	after := &Snapshot{ExternalDependencies: map[string]pkg.PersistedExternalDependency{
+		"rules_go":               {Version: "0.50.1", Integrity: "sha256:dd"},
+		"gazelle":                {Version: "0.35.0", Integrity: "sha256:bb"},
+		"com_github_google_uuid": {Version: "v1.3.0", Integrity: "h1:ee"},
+		"rules_java":             {Version: "7.4.0"},
+	}}
+	got := DiffDependencies(before, after)
+	want := []DependencyChange{
+		{Name: "com_github_google_uuid", Status: StatusChanged, Before: before.ExternalDependencies["com_github_google_uuid"], After: after.ExternalDependencies["com_github_google_uuid"]},
+		{Name: "rules_go", Status: StatusChanged, Before: before.ExternalDependencies["rules_go"], After: after.ExternalDependencies["rules_go"]},
+		{Name: "rules_java", Status: StatusAdded, After: after.ExternalDependencies["rules_java"]},
+		{Name: "rules_python", Status: StatusRemoved, Before: before.ExternalDependencies["rules_python"]},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong dependency changes: want %v got %v", want, got)
+	}
+	wantStrings := []string{
+		"~ com_github_google_uuid v1.3.0 (integrity changed)",
+		"~ rules_go 0.46.0 -> 0.50.1",
+		"+ rules_java 7.4.0",
+		"- rules_python 0.31.0",
+	}
+	for i, change := range got {
+		if change.String() != wantStrings[i] {
+			t.Fatalf("Wrong dependency change description: want %q got %q", wantStrings[i], change.String())
+		}
+	}
+
+	if got := DiffDependencies(&Snapshot{}, after); len(got) != 0 {
+		t.Fatalf("Wrong dependency changes without recorded dependencies: want none got %v", got)
+	}
+}
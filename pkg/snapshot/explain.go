@@ -0,0 +1,155 @@
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+// Explain returns human-readable reasons why the target labelString differs between before and
+// after: whether it was added or removed, which of its configurations' hashes changed, and which
+// of its recorded rule information changed. If both snapshots recorded the breakdown of a changed
+// hash, the components of it which changed are also listed.
+func Explain(before *Snapshot, after *Snapshot, labelString string) []string {
+	beforeHashes, inBefore := before.Hashes[labelString]
+	afterHashes, inAfter := after.Hashes[labelString]
+	if !inBefore {
+		return []string{"target was added"}
+	}
+	if !inAfter {
+		return []string{"target was removed"}
+	}
+
+	beforeInfo, beforeIsRule := before.Targets[labelString]
+	afterInfo, afterIsRule := after.Targets[labelString]
+
+	var reasons []string
+	configurations := make([]string, 0, len(beforeHashes)+len(afterHashes))
+	for configuration := range beforeHashes {
+		configurations = append(configurations, configuration)
+	}
+	for configuration := range afterHashes {
+		if _, ok := beforeHashes[configuration]; !ok {
+			configurations = append(configurations, configuration)
+		}
+	}
+	sort.Strings(configurations)
+	for _, configuration := range configurations {
+		name := configuration
+		if name == "" {
+			name = "<none>"
+		}
+		beforeHash, inBefore := beforeHashes[configuration]
+		afterHash, inAfter := afterHashes[configuration]
+		switch {
+		case !inBefore:
+			reasons = append(reasons, fmt.Sprintf("now in configuration %s", name))
+		case !inAfter:
+			reasons = append(reasons, fmt.Sprintf("no longer in configuration %s", name))
+		case beforeHash != afterHash:
+			reasons = append(reasons, fmt.Sprintf("hash in configuration %s changed from %s to %s", name, beforeHash, afterHash))
+			beforeBreakdown, inBefore := beforeInfo.Breakdowns[configuration]
+			afterBreakdown, inAfter := afterInfo.Breakdowns[configuration]
+			if inBefore && inAfter {
+				for _, component := range changedComponents(beforeBreakdown, afterBreakdown) {
+					reasons = append(reasons, fmt.Sprintf("in configuration %s: %s", name, component))
+				}
+			}
+		}
+	}
+
+	if beforeIsRule && afterIsRule {
+		if beforeInfo.Kind != afterInfo.Kind {
+			reasons = append(reasons, fmt.Sprintf("kind changed from %s to %s", beforeInfo.Kind, afterInfo.Kind))
+		}
+		if !reflect.DeepEqual(beforeInfo.Tags, afterInfo.Tags) {
+			reasons = append(reasons, fmt.Sprintf("tags changed from [%s] to [%s]", strings.Join(beforeInfo.Tags, ", "), strings.Join(afterInfo.Tags, ", ")))
+		}
+		if beforeInfo.TestOnly != afterInfo.TestOnly {
+			reasons = append(reasons, fmt.Sprintf("testonly changed from %v to %v", beforeInfo.TestOnly, afterInfo.TestOnly))
+		}
+	}
+	return reasons
+}
+
+// changedComponents describes each component which differs between two breakdowns of a hash.
+func changedComponents(before pkg.PersistedHashBreakdown, after pkg.PersistedHashBreakdown) []string {
+	var components []string
+	if before.RuleImplementation != after.RuleImplementation {
+		components = append(components, "rule implementation changed")
+	}
+	if before.Attributes != after.Attributes {
+		components = append(components, "attributes changed")
+	}
+	components = append(components, changedInputs("source", before.Sources, after.Sources)...)
+
+	beforeDependencies := flattenDependencies(before.Dependencies)
+	afterDependencies := flattenDependencies(after.Dependencies)
+	components = append(components, changedInputs("dependency", beforeDependencies, afterDependencies)...)
+	return components
+}
+
+// flattenDependencies returns the hashes of dependencies, keyed by label, followed by the
+// configuration in brackets if it has one.
+func flattenDependencies(dependencies map[string]map[string]string) map[string]string {
+	flattened := make(map[string]string)
+	for labelString, hashes := range dependencies {
+		for configuration, hash := range hashes {
+			key := labelString
+			if configuration != "" {
+				key += "[" + configuration + "]"
+			}
+			flattened[key] = hash
+		}
+	}
+	return flattened
+}
+
+// changedInputs describes each input, of kind, which was added, removed or whose hash changed.
+func changedInputs(kind string, before map[string]string, after map[string]string) []string {
+	keys := make([]string, 0, len(before)+len(after))
+	for key := range before {
+		keys = append(keys, key)
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var changes []string
+	for _, key := range keys {
+		beforeHash, inBefore := before[key]
+		afterHash, inAfter := after[key]
+		switch {
+		case !inBefore:
+			changes = append(changes, fmt.Sprintf("%s %s added", kind, key))
+		case !inAfter:
+			changes = append(changes, fmt.Sprintf("%s %s removed", kind, key))
+		case beforeHash != afterHash:
+			changes = append(changes, fmt.Sprintf("%s %s changed", kind, key))
+		}
+	}
+	return changes
+}
+
+// WriteExplanation writes changes to w as for WriteText, or WriteColorText if color is set, with the
+// reasons each target differs between before and after (see Explain) indented on the following
+// lines.
+func WriteExplanation(w io.Writer, changes []Change, before *Snapshot, after *Snapshot, color bool) error {
+	for _, change := range changes {
+		if err := writeText(w, []Change{change}, color); err != nil {
+			return err
+		}
+		for _, reason := range Explain(before, after, change.Label) {
+			if _, err := fmt.Fprintf(w, "    %s\n", reason); err != nil {
+				return fmt.Errorf("failed to write changes: %w", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package snapshot
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+func TestExplain(t *testing.T) {
+	before := &Snapshot{
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib": {"cfg": "aa", "exec": "bb"},
+			"//java/example:Removed":     {"cfg": "cc"},
+		},
+		Targets: map[string]pkg.PersistedTargetInfo{
+			"//java/example:GreetingLib": {Kind: "java_library", Tags: []string{"manual"}},
+		},
+	}
+	after := &Snapshot{
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib": {"cfg": "ab", "host": "dd"},
+			"//go/example:lib_test":      {"cfg": "ee"},
+		},
+		Targets: map[string]pkg.PersistedTargetInfo{
+			"//java/example:GreetingLib": {Kind: "java_binary", Tags: []string{"manual"}, TestOnly: true},
+		},
+	}
+	for labelString, want := range map[string][]string{
+		"//go/example:lib_test":  {"target was added"},
+		"//java/example:Removed": {"target was removed"},
+		"//java/example:GreetingLib": {
+			"hash in configuration cfg changed from aa to ab",
+			"no longer in configuration exec",
+			"now in configuration host",
+			"kind changed from java_library to java_binary",
+			"testonly changed from false to true",
+		},
+	} {
+		if got := Explain(before, after, labelString); !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong explanation of %s: want %v got %v", labelString, want, got)
+		}
+	}
+}
+
+func TestExplainBreakdowns(t *testing.T) {
+	breakdown := pkg.PersistedHashBreakdown{
+		RuleImplementation: "01",
+		Attributes:         "02",
+		Sources:            map[string]string{"//java/example:Greeting.java": "03", "//java/example:Old.java": "04"},
+		Dependencies:       map[string]map[string]string{"//java/example:Util": {"cfg": "05", "": "06"}},
+	}
+	changed := pkg.PersistedHashBreakdown{
+		RuleImplementation: "01",
+		Attributes:         "12",
+		Sources:            map[string]string{"//java/example:Greeting.java": "13", "//java/example:New.java": "14"},
+		Dependencies:       map[string]map[string]string{"//java/example:Util": {"cfg": "15", "": "06"}},
+	}
+	before := &Snapshot{
+		Hashes: map[string]map[string]string{"//java/example:GreetingLib": {"cfg": "aa"}},
+		Targets: map[string]pkg.PersistedTargetInfo{
+			"//java/example:GreetingLib": {Kind: "java_library", Breakdowns: map[string]pkg.PersistedHashBreakdown{"cfg": breakdown}},
+		},
+	}
+	after := &Snapshot{
+		Hashes: map[string]map[string]string{"//java/example:GreetingLib": {"cfg": "ab"}},
+		Targets: map[string]pkg.PersistedTargetInfo{
+			"//java/example:GreetingLib": {Kind: "java_library", Breakdowns: map[string]pkg.PersistedHashBreakdown{"cfg": changed}},
+		},
+	}
+	want := []string{
+		"hash in configuration cfg changed from aa to ab",
+		"in configuration cfg: attributes changed",
+		"in configuration cfg: source //java/example:Greeting.java changed",
+		"in configuration cfg: source //java/example:New.java added",
+		"in configuration cfg: source //java/example:Old.java removed",
+		"in configuration cfg: dependency //java/example:Util[cfg] changed",
+	}
+	if got := Explain(before, after, "//java/example:GreetingLib"); !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong explanation: want %v got %v", want, got)
+	}
+}
+
+func TestWriteExplanation(t *testing.T) {
+	result, err := Diff(before, after, DiffOptions{})
+	if err != nil {
+		t.Fatalf("Error diffing snapshots: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteExplanation(&buf, result.Changes(before, after), before, after, false); err != nil {
+		t.Fatalf("Error writing explanation: %v", err)
+	}
+	want := "+ //go/example:lib_test\n    target was added\n" +
+		"~ //java/example:GreetingLib\n    hash in configuration cfg changed from aa to ab\n" +
+		"~ //java/example:GreetingTest\n    hash in configuration cfg changed from bb to bc\n" +
+		"- //java/example:Removed\n    target was removed\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("Wrong explanation: want %q got %q", want, got)
+	}
+}
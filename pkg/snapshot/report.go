@@ -0,0 +1,422 @@
+package snapshot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// Change statuses.
+const (
+	StatusAdded   = "added"
+	StatusRemoved = "removed"
+	StatusChanged = "changed"
+)
+
+// Change is a single target reported by Diff, with its hashes in each snapshot.
+type Change struct {
+	Label string
+	// Status is one of StatusAdded, StatusRemoved or StatusChanged.
+	Status string
+	// BeforeHashes and AfterHashes map each configuration of the target to its hash in the before
+	// and after snapshots. They are nil for added and removed targets respectively.
+	BeforeHashes map[string]string
+	AfterHashes  map[string]string
+}
+
+// ID identifies the change by its label, status and configurations, so that the same difference
+// has the same ID when snapshots are diffed again, and can be tracked and deduplicated across runs
+// without relying on its position in a report. It doesn't depend on the hashes, so a target which
+// changes again in the same way keeps its ID.
+func (c Change) ID() string {
+	digest := sha256.New()
+	for _, part := range append([]string{c.Label, c.Status}, sortedUnion(c.BeforeHashes, c.AfterHashes)...) {
+		// Each part is length-prefixed so that different parts can't produce the same input.
+		fmt.Fprintf(digest, "%d:%s", len(part), part)
+	}
+	return hex.EncodeToString(digest.Sum(nil))[:16]
+}
+
+// sortedUnion returns the keys of a and b, sorted.
+func sortedUnion(a map[string]string, b map[string]string) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Changes returns each of the targets in r, with their hashes in before and after, sorted by label.
+func (r *Result) Changes(before *Snapshot, after *Snapshot) []Change {
+	var changes []Change
+	for _, status := range []string{StatusAdded, StatusRemoved, StatusChanged} {
+		for _, labelString := range r.TargetsWithStatus(status) {
+			changes = append(changes, Change{
+				Label:        labelString,
+				Status:       status,
+				BeforeHashes: before.Hashes[labelString],
+				AfterHashes:  after.Hashes[labelString],
+			})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Label < changes[j].Label })
+	return changes
+}
+
+// statusOrder is the order changes are sorted in by status.
+var statusOrder = map[string]int{StatusAdded: 0, StatusChanged: 1, StatusRemoved: 2}
+
+// SortChanges sorts changes, which must be sorted by label as returned by Result.Changes, by order,
+// one of "label", "package", "kind", "status" or "impact". Changes which are otherwise equal stay sorted by label.
+//   - label sorts by label.
+//   - package sorts by package, so that all of a package's targets are together.
+//   - kind sorts by rule kind, with targets which aren't rules last.
+//   - status sorts added targets first, then changed, then removed.
+//   - impact sorts by the number of targets directly depending on each, most first, so that the
+//     changes which affect the most are at the top.
+//
+// Kinds and numbers of dependents are taken from after, or from before for removed targets.
+func SortChanges(changes []Change, order string, before *Snapshot, after *Snapshot) error {
+	info := func(change Change) pkg.PersistedTargetInfo {
+		if change.Status == StatusRemoved {
+			return before.Targets[change.Label]
+		}
+		return after.Targets[change.Label]
+	}
+	var less func(a, b Change) bool
+	switch order {
+	case "label":
+		return nil
+	case "package":
+		less = func(a, b Change) bool { return packageOf(a.Label) < packageOf(b.Label) }
+	case "kind":
+		less = func(a, b Change) bool {
+			aKind, bKind := info(a).Kind, info(b).Kind
+			if aKind == "" || bKind == "" {
+				return bKind == "" && aKind != ""
+			}
+			return aKind < bKind
+		}
+	case "status":
+		less = func(a, b Change) bool { return statusOrder[a.Status] < statusOrder[b.Status] }
+	case "impact":
+		less = func(a, b Change) bool { return info(a).Dependents > info(b).Dependents }
+	default:
+		return fmt.Errorf("unknown sort order %q, expected one of label, package, kind, status or impact", order)
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return less(changes[i], changes[j]) })
+	return nil
+}
+
+// packageOf returns the package of labelString, e.g. //java/example or @repo//java/example, or
+// labelString itself if it can't be parsed.
+func packageOf(labelString string) string {
+	l, err := label.Parse(labelString)
+	if err != nil {
+		return labelString
+	}
+	if l.Repo != "" {
+		return "@" + l.Repo + "//" + l.Pkg
+	}
+	return "//" + l.Pkg
+}
+
+// formatHashes formats hashes for display: just the hash if the target has a single configuration,
+// and otherwise configuration=hash pairs sorted by configuration.
+func formatHashes(hashes map[string]string) string {
+	if len(hashes) == 0 {
+		return "none"
+	}
+	configurations := make([]string, 0, len(hashes))
+	for configuration := range hashes {
+		configurations = append(configurations, configuration)
+	}
+	sort.Strings(configurations)
+	if len(configurations) == 1 {
+		return hashes[configurations[0]]
+	}
+	parts := make([]string, 0, len(configurations))
+	for _, configuration := range configurations {
+		parts = append(parts, configuration+"="+hashes[configuration])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// WriteText writes changes to w, one per line, prefixed with + if added, - if removed and ~ if
+// changed.
+func WriteText(w io.Writer, changes []Change) error {
+	return writeText(w, changes, false)
+}
+
+// WriteColorText writes changes to w as WriteText does, colored for terminals: green if added, red
+// if removed and yellow if changed.
+func WriteColorText(w io.Writer, changes []Change) error {
+	return writeText(w, changes, true)
+}
+
+func writeText(w io.Writer, changes []Change, color bool) error {
+	prefixes := map[string]string{StatusAdded: "+", StatusRemoved: "-", StatusChanged: "~"}
+	colors := map[string]string{StatusAdded: pkg.ColorGreen, StatusRemoved: pkg.ColorRed, StatusChanged: pkg.ColorYellow}
+	for _, change := range changes {
+		line := prefixes[change.Status] + " " + change.Label
+		if color {
+			line = pkg.Colorize(line, colors[change.Status])
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return fmt.Errorf("failed to write changes: %w", err)
+		}
+	}
+	return nil
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string `xml:"name,attr"`
+	ClassName string `xml:"classname,attr"`
+	SystemOut string `xml:"system-out"`
+}
+
+// WriteJUnit writes changes to w as a JUnit XML report, with a passing test case per target whose
+// class name is its package and whose output is its status and hashes, so that CI systems can show
+// the affected targets alongside test results.
+func WriteJUnit(w io.Writer, changes []Change) error {
+	suite := junitTestSuite{Name: "affected-targets", Tests: len(changes), TestCases: []junitTestCase{}}
+	for _, change := range changes {
+		suite.TestCases = append(suite.TestCases, junitTestCase{
+			Name:      change.Label,
+			ClassName: packageOf(change.Label),
+			SystemOut: fmt.Sprintf("status: %s\nbefore: %s\nafter: %s\n", change.Status, formatHashes(change.BeforeHashes), formatHashes(change.AfterHashes)),
+		})
+	}
+	content, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JUnit report: %w", err)
+	}
+	if _, err := fmt.Fprintf(w, "%s%s\n", xml.Header, content); err != nil {
+		return fmt.Errorf("failed to write JUnit report: %w", err)
+	}
+	return nil
+}
+
+// WriteSARIF writes changes to w as a SARIF 2.1.0 log, with a note-level result per target whose
+// rule is its status, so that code-scanning UIs can show the affected targets.
+func WriteSARIF(w io.Writer, changes []Change) error {
+	type message struct {
+		Text string `json:"text"`
+	}
+	type rule struct {
+		ID               string  `json:"id"`
+		ShortDescription message `json:"shortDescription"`
+	}
+	type logicalLocation struct {
+		FullyQualifiedName string `json:"fullyQualifiedName"`
+		Kind               string `json:"kind"`
+	}
+	type location struct {
+		LogicalLocations []logicalLocation `json:"logicalLocations"`
+	}
+	type result struct {
+		RuleID              string            `json:"ruleId"`
+		Level               string            `json:"level"`
+		Message             message           `json:"message"`
+		Locations           []location        `json:"locations"`
+		PartialFingerprints map[string]string `json:"partialFingerprints"`
+		Properties          map[string]string `json:"properties"`
+	}
+	rules := []rule{
+		{StatusAdded, message{"Target was added"}},
+		{StatusRemoved, message{"Target was removed"}},
+		{StatusChanged, message{"Target's hash changed"}},
+	}
+	results := make([]result, 0, len(changes))
+	for _, change := range changes {
+		before, after := formatHashes(change.BeforeHashes), formatHashes(change.AfterHashes)
+		results = append(results, result{
+			RuleID:    change.Status,
+			Level:     "note",
+			Message:   message{fmt.Sprintf("%s was %s (before: %s, after: %s)", change.Label, change.Status, before, after)},
+			Locations: []location{{LogicalLocations: []logicalLocation{{FullyQualifiedName: change.Label, Kind: "module"}}}},
+			// Code-scanning UIs use fingerprints to recognize the same result across runs.
+			PartialFingerprints: map[string]string{"targetDifference/v1": change.ID()},
+			Properties: map[string]string{
+				"id":     change.ID(),
+				"label":  change.Label,
+				"status": change.Status,
+				"before": before,
+				"after":  after,
+			},
+		})
+	}
+	sarif := map[string]any{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs": []any{map[string]any{
+			"tool": map[string]any{"driver": map[string]any{
+				"name":           "target-determinator",
+				"informationUri": "https://github.com/bazel-contrib/target-determinator",
+				"rules":          rules,
+			}},
+			"results": results,
+		}},
+	}
+	content, err := json.MarshalIndent(sarif, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal SARIF report: %w", err)
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", content); err != nil {
+		return fmt.Errorf("failed to write SARIF report: %w", err)
+	}
+	return nil
+}
+
+// jsonChange is how WriteJSON writes a Change.
+type jsonChange struct {
+	ID      string                       `json:"id"`
+	Status  string                       `json:"status"`
+	Configs map[string]jsonConfiguration `json:"configs"`
+}
+
+// jsonConfiguration is the hashes of a target in a configuration, which is omitted from the
+// snapshot the target isn't in in that configuration.
+type jsonConfiguration struct {
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// WriteJSON writes changes to w as a JSON object keyed by label, whose values are each target's
+// ID (see Change.ID), status and its hashes in each of its configurations, e.g.
+// {"//a:b": {"id": "0123456789abcdef", "status": "changed", "configs": {"<checksum>": {"before": "aa", "after": "ab"}}}}, so
+// that tools can look up individual targets without scanning a list.
+func WriteJSON(w io.Writer, changes []Change) error {
+	byLabel := make(map[string]jsonChange, len(changes))
+	for _, change := range changes {
+		configs := make(map[string]jsonConfiguration)
+		for configuration, hash := range change.BeforeHashes {
+			configs[configuration] = jsonConfiguration{Before: hash}
+		}
+		for configuration, hash := range change.AfterHashes {
+			config := configs[configuration]
+			config.After = hash
+			configs[configuration] = config
+		}
+		byLabel[change.Label] = jsonChange{ID: change.ID(), Status: change.Status, Configs: configs}
+	}
+	// Maps are marshalled with sorted keys, so the output is deterministic.
+	content, err := json.MarshalIndent(byLabel, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON report: %w", err)
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", content); err != nil {
+		return fmt.Errorf("failed to write JSON report: %w", err)
+	}
+	return nil
+}
+
+// StatusCounts counts changes by status.
+type StatusCounts struct {
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+	Changed int `json:"changed"`
+}
+
+func (c *StatusCounts) add(status string) {
+	switch status {
+	case StatusAdded:
+		c.Added++
+	case StatusRemoved:
+		c.Removed++
+	case StatusChanged:
+		c.Changed++
+	}
+}
+
+// Summary counts changes in total, by rule kind, and by top-level directory, so that questions
+// like how many go_test targets were affected can be answered without the full list of changes.
+type Summary struct {
+	Total StatusCounts `json:"total"`
+	// ByKind is keyed by rule kind, or "unknown" for targets which aren't rules or whose snapshot
+	// didn't record kinds.
+	ByKind map[string]StatusCounts `json:"by_kind"`
+	// ByDirectory is keyed by the first directory of each target's package, e.g. //java for
+	// //java/example:lib, which is // for the root package and includes the repository for
+	// external targets, e.g. @repo//go.
+	ByDirectory map[string]StatusCounts `json:"by_directory"`
+}
+
+// Summarize counts changes. Kinds are taken from after, or from before for removed targets.
+func Summarize(changes []Change, before *Snapshot, after *Snapshot) Summary {
+	summary := Summary{
+		ByKind:      make(map[string]StatusCounts),
+		ByDirectory: make(map[string]StatusCounts),
+	}
+	for _, change := range changes {
+		info := after.Targets[change.Label]
+		if change.Status == StatusRemoved {
+			info = before.Targets[change.Label]
+		}
+		kind := info.Kind
+		if kind == "" {
+			kind = "unknown"
+		}
+		summary.Total.add(change.Status)
+		kindCounts := summary.ByKind[kind]
+		kindCounts.add(change.Status)
+		summary.ByKind[kind] = kindCounts
+		directory := topLevelDirectoryOf(change.Label)
+		directoryCounts := summary.ByDirectory[directory]
+		directoryCounts.add(change.Status)
+		summary.ByDirectory[directory] = directoryCounts
+	}
+	return summary
+}
+
+// topLevelDirectoryOf returns the first directory of the package of labelString, e.g. //java for
+// //java/example:lib, or labelString itself if it can't be parsed.
+func topLevelDirectoryOf(labelString string) string {
+	l, err := label.Parse(labelString)
+	if err != nil {
+		return labelString
+	}
+	directory, _, _ := strings.Cut(l.Pkg, "/")
+	if l.Repo != "" {
+		return "@" + l.Repo + "//" + directory
+	}
+	return "//" + directory
+}
+
+// WriteSummary writes the Summarize of changes to w as JSON.
+func WriteSummary(w io.Writer, changes []Change, before *Snapshot, after *Snapshot) error {
+	content, err := json.MarshalIndent(Summarize(changes, before, after), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal summary: %w", err)
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", content); err != nil {
+		return fmt.Errorf("failed to write summary: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+func TestWriteText(t *testing.T) {
+	result, err := Diff(before, after, DiffOptions{})
+	if err != nil {
+		t.Fatalf("Error diffing snapshots: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteText(&buf, result.Changes(before, after)); err != nil {
+		t.Fatalf("Error writing text: %v", err)
+	}
+	want := "+ //go/example:lib_test\n~ //java/example:GreetingLib\n~ //java/example:GreetingTest\n- //java/example:Removed\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("Wrong text: want %q got %q", want, got)
+	}
+}
+
+func TestWriteColorText(t *testing.T) {
+	var buf bytes.Buffer
+	changes := []Change{{Label: "//go/example:lib_test", Status: StatusAdded}, {Label: "//java/example:Removed", Status: StatusRemoved}}
+	if err := WriteColorText(&buf, changes); err != nil {
+		t.Fatalf("Error writing text: %v", err)
+	}
+	want := "\x1b[32m+ //go/example:lib_test\x1b[0m\n\x1b[31m- //java/example:Removed\x1b[0m\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("Wrong colored text: want %q got %q", want, got)
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	result, err := Diff(before, after, DiffOptions{})
+	if err != nil {
+		t.Fatalf("Error diffing snapshots: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteJUnit(&buf, result.Changes(before, after)); err != nil {
+		t.Fatalf("Error writing JUnit: %v", err)
+	}
+	var got junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Error parsing JUnit: %v\n%s", err, buf.String())
+	}
+	if len(got.Suites) != 1 || got.Suites[0].Tests != 4 || len(got.Suites[0].TestCases) != 4 {
+		t.Fatalf("Wrong JUnit suites: want one suite with 4 test cases got %+v", got.Suites)
+	}
+	testCase := got.Suites[0].TestCases[1]
+	if testCase.Name != "//java/example:GreetingLib" || testCase.ClassName != "//java/example" {
+		t.Fatalf("Wrong JUnit test case: want //java/example:GreetingLib in //java/example got %v in %v", testCase.Name, testCase.ClassName)
+	}
+	if want := "status: changed\nbefore: aa\nafter: ab\n"; testCase.SystemOut != want {
+		t.Fatalf("Wrong JUnit output: want %q got %q", want, testCase.SystemOut)
+	}
+}
+
+func TestWriteSARIF(t *testing.T) {
+	result, err := Diff(before, after, DiffOptions{})
+	if err != nil {
+		t.Fatalf("Error diffing snapshots: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := WriteSARIF(&buf, result.Changes(before, after)); err != nil {
+		t.Fatalf("Error writing SARIF: %v", err)
+	}
+	var got struct {
+		Version string `json:"version"`
+		Runs    []struct {
+			Results []struct {
+				RuleID     string            `json:"ruleId"`
+				Properties map[string]string `json:"properties"`
+			} `json:"results"`
+		} `json:"runs"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Error parsing SARIF: %v", err)
+	}
+	if got.Version != "2.1.0" || len(got.Runs) != 1 || len(got.Runs[0].Results) != 4 {
+		t.Fatalf("Wrong SARIF log: want version 2.1.0 with one run with 4 results got %s", buf.String())
+	}
+	removed := got.Runs[0].Results[3]
+	if removed.RuleID != "removed" || removed.Properties["before"] != "cc" || removed.Properties["after"] != "none" {
+		t.Fatalf("Wrong SARIF result for removed target: %+v", removed)
+	}
+	if !strings.Contains(buf.String(), `"name": "target-determinator"`) {
+		t.Fatalf("Expected the tool name in the SARIF log, got %s", buf.String())
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	result, err := Diff(before, after, DiffOptions{})
+	if err != nil {
+		t.Fatalf("Error diffing snapshots: %v", err)
+	}
+	changes := result.Changes(before, after)
+	var buf bytes.Buffer
+	if err := WriteJSON(&buf, changes); err != nil {
+		t.Fatalf("Error writing JSON: %v", err)
+	}
+	var got map[string]jsonChange
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Error parsing JSON: %v\n%s", err, buf.String())
+	}
+	for _, change := range changes {
+		gotChange := got[change.Label]
+		if gotChange.ID != change.ID() {
+			t.Fatalf("Wrong JSON ID for %s: want %s got %s", change.Label, change.ID(), gotChange.ID)
+		}
+		gotChange.ID = ""
+		got[change.Label] = gotChange
+	}
+	want := map[string]jsonChange{
+		"//go/example:lib_test":       {Status: StatusAdded, Configs: map[string]jsonConfiguration{"cfg": {After: "ee"}}},
+		"//java/example:GreetingLib":  {Status: StatusChanged, Configs: map[string]jsonConfiguration{"cfg": {Before: "aa", After: "ab"}}},
+		"//java/example:GreetingTest": {Status: StatusChanged, Configs: map[string]jsonConfiguration{"cfg": {Before: "bb", After: "bc"}}},
+		"//java/example:Removed":      {Status: StatusRemoved, Configs: map[string]jsonConfiguration{"cfg": {Before: "cc"}}},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong JSON report: want %+v got %+v", want, got)
+	}
+}
+
+func TestChangeID(t *testing.T) {
+	change := Change{
+		Label:        "//java/example:GreetingLib",
+		Status:       StatusChanged,
+		BeforeHashes: map[string]string{"cfg1": "aa", "cfg2": "bb"},
+		AfterHashes:  map[string]string{"cfg1": "ab", "cfg2": "bb"},
+	}
+	sameDifference := Change{
+		Label:        "//java/example:GreetingLib",
+		Status:       StatusChanged,
+		BeforeHashes: map[string]string{"cfg2": "cc", "cfg1": "dd"},
+		AfterHashes:  map[string]string{"cfg2": "cd", "cfg1": "dd"},
+	}
+	if change.ID() != sameDifference.ID() {
+		t.Fatalf("Wrong IDs: want the same ID for changes in the same configurations, got %s and %s", change.ID(), sameDifference.ID())
+	}
+	for name, other := range map[string]Change{
+		"label":         {Label: "//java/example:GreetingTest", Status: change.Status, BeforeHashes: change.BeforeHashes, AfterHashes: change.AfterHashes},
+		"status":        {Label: change.Label, Status: StatusAdded, AfterHashes: change.AfterHashes},
+		"configuration": {Label: change.Label, Status: change.Status, BeforeHashes: map[string]string{"cfg1": "aa"}, AfterHashes: map[string]string{"cfg1": "ab"}},
+	} {
+		if other.ID() == change.ID() {
+			t.Fatalf("Wrong IDs: want changes with a different %s to have different IDs, got %s for both", name, change.ID())
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	result, err := Diff(before, after, DiffOptions{})
+	if err != nil {
+		t.Fatalf("Error diffing snapshots: %v", err)
+	}
+	changes := append(result.Changes(before, after), Change{Label: "@rules_go//go/tools:builder", Status: StatusChanged}, Change{Label: "//:BUILD.bazel", Status: StatusChanged})
+	want := Summary{
+		Total: StatusCounts{Added: 1, Removed: 1, Changed: 4},
+		ByKind: map[string]StatusCounts{
+			"go_test":      {Added: 1},
+			"java_binary":  {Removed: 1},
+			"java_library": {Changed: 1},
+			"java_test":    {Changed: 1},
+			"unknown":      {Changed: 2},
+		},
+		ByDirectory: map[string]StatusCounts{
+			"//":            {Changed: 1},
+			"//go":          {Added: 1},
+			"//java":        {Removed: 1, Changed: 2},
+			"@rules_go//go": {Changed: 1},
+		},
+	}
+	if got := Summarize(changes, before, after); !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong summary: want %+v got %+v", want, got)
+	}
+}
+
+func TestSortChanges(t *testing.T) {
+	before := &Snapshot{
+		Targets: map[string]pkg.PersistedTargetInfo{
+			"//java/example:Removed": {Kind: "java_binary", Dependents: 5},
+		},
+	}
+	after := &Snapshot{
+		Targets: map[string]pkg.PersistedTargetInfo{
+			"//java/example/sub:Lib":     {Kind: "java_library", Dependents: 2},
+			"//java/example:GreetingLib": {Kind: "java_library", Dependents: 7},
+			"//go/example:lib_test":      {Kind: "go_test"},
+		},
+	}
+	unsorted := []Change{
+		{Label: "//go/example:lib_test", Status: StatusAdded},
+		{Label: "//java/example/sub:Lib", Status: StatusChanged},
+		{Label: "//java/example:Greeting.java", Status: StatusChanged},
+		{Label: "//java/example:GreetingLib", Status: StatusChanged},
+		{Label: "//java/example:Removed", Status: StatusRemoved},
+	}
+	for order, want := range map[string][]string{
+		"label":   {"//go/example:lib_test", "//java/example/sub:Lib", "//java/example:Greeting.java", "//java/example:GreetingLib", "//java/example:Removed"},
+		"package": {"//go/example:lib_test", "//java/example:Greeting.java", "//java/example:GreetingLib", "//java/example:Removed", "//java/example/sub:Lib"},
+		"kind":    {"//go/example:lib_test", "//java/example:Removed", "//java/example/sub:Lib", "//java/example:GreetingLib", "//java/example:Greeting.java"},
+		"status":  {"//go/example:lib_test", "//java/example/sub:Lib", "//java/example:Greeting.java", "//java/example:GreetingLib", "//java/example:Removed"},
+		"impact":  {"//java/example:GreetingLib", "//java/example:Removed", "//java/example/sub:Lib", "//go/example:lib_test", "//java/example:Greeting.java"},
+	} {
+		changes := append([]Change(nil), unsorted...)
+		if err := SortChanges(changes, order, before, after); err != nil {
+			t.Fatalf("Error sorting by %s: %v", order, err)
+		}
+		var got []string
+		for _, change := range changes {
+			got = append(got, change.Label)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong order by %s: want %v got %v", order, want, got)
+		}
+	}
+	if err := SortChanges(unsorted, "size", before, after); err == nil {
+		t.Fatalf("Expected an error sorting by an unknown order")
+	}
+}
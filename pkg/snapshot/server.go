@@ -0,0 +1,313 @@
+package snapshot
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+// commitPattern matches full git commit shas, which are the only revisions Server accepts, as it
+// has no repository to resolve others in, and they're used in the locations of snapshots.
+var commitPattern = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// Server serves the differences between the snapshots in a hash store over HTTP, so that CI
+// systems and bots can look up affected targets without running target-determinator themselves.
+// It serves:
+//   - GET /affected?before=<sha>&after=<sha>, responding with an AffectedResponse, or with an
+//     IsAffectedResponse if there are is-affected=<label> parameters.
+//   - POST /affected?before=<sha>, with a snapshot in the body, in either format and with any
+//     compression, responding with an AffectedResponse comparing it with the snapshot for before,
+//     or the pinned baseline if before is omitted, or with an IsAffectedResponse as for GET.
+//     Submitted snapshots aren't signed, so aren't
+//     verified even if ReadOptions.VerifyKey is set. If Token is set, requests must have an
+//     "Authorization: Bearer <Token>" header, as reading submissions takes a lot of memory.
+//   - POST /baseline?sha=<sha>, pinning the snapshot for sha as the baseline. See PinBaseline.
+//     Requests must have an "Authorization: Bearer <Token>" header, and are refused if Token isn't
+//     set, as the baseline is shared by every client.
+type Server struct {
+	// Store is a directory, or s3:// or gs:// URI, containing snapshots named <commit>.json, as
+	// used by target-determinator's -before-hash-store.
+	Store string
+	// ReadOptions and DiffOptions control how snapshots are read and compared.
+	ReadOptions ReadOptions
+	DiffOptions DiffOptions
+	// MaxSubmittedBytes is the largest snapshot which can be submitted to POST /affected, or
+	// defaultMaxSubmittedBytes if 0. It limits both the size of the request body and the size it
+	// decompresses to.
+	MaxSubmittedBytes int64
+	// MaxConcurrentSubmissions is how many snapshots POST /affected reads at once, or
+	// defaultMaxConcurrentSubmissions if 0. Further submissions are refused with 503 Service
+	// Unavailable until one finishes, so that they use at most about MaxConcurrentSubmissions times
+	// MaxSubmittedBytes of memory.
+	MaxConcurrentSubmissions int
+	// Token is the bearer token POST /baseline and POST /affected requests must have. If empty, the
+	// baseline can only be pinned with PinBaseline, and anyone can submit snapshots.
+	Token string
+
+	mu       sync.RWMutex
+	baseline *Snapshot
+
+	submissionsOnce sync.Once
+	submissions     chan struct{}
+}
+
+const (
+	defaultMaxSubmittedBytes        = 64 << 20
+	defaultMaxConcurrentSubmissions = 4
+)
+
+// PinBaseline reads the snapshot for sha from s.Store and keeps it in memory, in place of any
+// previously pinned baseline, so that the many requests comparing against it, e.g. from each pull
+// request against the latest main branch commit, don't each read it again.
+func (s *Server) PinBaseline(sha string) error {
+	_, err := s.pinBaseline(sha)
+	return err
+}
+
+// pinBaseline pins the snapshot for sha as the baseline, returning the HTTP status to respond with
+// if it can't.
+func (s *Server) pinBaseline(sha string) (int, error) {
+	baseline, status, err := s.readStored(sha)
+	if err != nil {
+		return status, err
+	}
+	s.mu.Lock()
+	s.baseline = baseline
+	s.mu.Unlock()
+	return http.StatusOK, nil
+}
+
+func (s *Server) pinnedBaseline() *Snapshot {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.baseline
+}
+
+// AffectedResponse is the JSON body of a successful response to /affected. Each list of labels is
+// sorted, and is empty rather than null if there are none.
+type AffectedResponse struct {
+	Before   string   `json:"before"`
+	After    string   `json:"after"`
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Changed  []string `json:"changed"`
+	Affected []string `json:"affected"`
+}
+
+// IsAffectedResponse is the JSON body of a successful response to /affected with is-affected
+// parameters, saying whether each of their labels, as given, is affected, so that clients asking
+// about a few labels, e.g. deployment tooling asking about each service, don't need the full list.
+type IsAffectedResponse struct {
+	Before   string          `json:"before"`
+	After    string          `json:"after"`
+	Affected map[string]bool `json:"affected"`
+}
+
+// Handler returns the http.Handler serving s's endpoints.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/affected", s.serveAffected)
+	mux.HandleFunc("/baseline", s.serveBaseline)
+	return mux
+}
+
+func (s *Server) serveAffected(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		s.serveSubmittedAffected(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	before, after := r.URL.Query().Get("before"), r.URL.Query().Get("after")
+	for name, sha := range map[string]string{"before": before, "after": after} {
+		if !commitPattern.MatchString(sha) {
+			http.Error(w, fmt.Sprintf("%s must be a full commit sha, saw: %q", name, sha), http.StatusBadRequest)
+			return
+		}
+	}
+	beforeSnapshot, status, err := s.load(before)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	afterSnapshot, status, err := s.load(after)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	s.writeAffected(w, r, before, beforeSnapshot, after, afterSnapshot, http.StatusInternalServerError)
+}
+
+// serveSubmittedAffected compares the snapshot in the body of r with the snapshot for its before
+// parameter, or the pinned baseline.
+func (s *Server) serveSubmittedAffected(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" && !s.authorize(w, r, "submit snapshots") {
+		return
+	}
+	s.submissionsOnce.Do(func() {
+		n := s.MaxConcurrentSubmissions
+		if n == 0 {
+			n = defaultMaxConcurrentSubmissions
+		}
+		s.submissions = make(chan struct{}, n)
+	})
+	select {
+	case s.submissions <- struct{}{}:
+		defer func() { <-s.submissions }()
+	default:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many snapshots are being compared, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	var before string
+	var beforeSnapshot *Snapshot
+	if before = r.URL.Query().Get("before"); before != "" {
+		if !commitPattern.MatchString(before) {
+			http.Error(w, fmt.Sprintf("before must be a full commit sha, saw: %q", before), http.StatusBadRequest)
+			return
+		}
+		var status int
+		var err error
+		if beforeSnapshot, status, err = s.load(before); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	} else {
+		if beforeSnapshot = s.pinnedBaseline(); beforeSnapshot == nil {
+			http.Error(w, "no baseline is pinned, so before is required", http.StatusConflict)
+			return
+		}
+		before = beforeSnapshot.Revision
+	}
+
+	maxBytes := s.MaxSubmittedBytes
+	if maxBytes == 0 {
+		maxBytes = defaultMaxSubmittedBytes
+	}
+	readOptions := s.ReadOptions
+	readOptions.MaxDecompressedBytes = maxBytes
+	afterSnapshot, err := Read(http.MaxBytesReader(w, r.Body, maxBytes), readOptions)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid snapshot: %v", err), http.StatusBadRequest)
+		return
+	}
+	// Differences between submitted snapshots and the baseline, e.g. in hash function, are the
+	// client's fault.
+	s.writeAffected(w, r, before, beforeSnapshot, afterSnapshot.Revision, afterSnapshot, http.StatusBadRequest)
+}
+
+// serveBaseline pins the snapshot for the sha parameter as the baseline.
+func (s *Server) serveBaseline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Token == "" {
+		http.Error(w, "pinning the baseline over HTTP is disabled", http.StatusForbidden)
+		return
+	}
+	if !s.authorize(w, r, "pin the baseline") {
+		return
+	}
+	sha := r.URL.Query().Get("sha")
+	if !commitPattern.MatchString(sha) {
+		http.Error(w, fmt.Sprintf("sha must be a full commit sha, saw: %q", sha), http.StatusBadRequest)
+		return
+	}
+	if status, err := s.pinBaseline(sha); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorize returns whether r has s.Token as its bearer token, responding with 401 Unauthorized,
+// saying that one is required to do action, if it doesn't.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, action string) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, fmt.Sprintf("a valid bearer token is required to %s", action), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// writeAffected responds to r with the AffectedResponse comparing beforeSnapshot and
+// afterSnapshot, or the IsAffectedResponse if r has is-affected parameters, responding with
+// diffErrorStatus if they can't be compared.
+func (s *Server) writeAffected(w http.ResponseWriter, r *http.Request, before string, beforeSnapshot *Snapshot, after string, afterSnapshot *Snapshot, diffErrorStatus int) {
+	result, err := Diff(beforeSnapshot, afterSnapshot, s.DiffOptions)
+	if err != nil {
+		http.Error(w, err.Error(), diffErrorStatus)
+		return
+	}
+	var response any = AffectedResponse{
+		Before:   before,
+		After:    after,
+		Added:    nonNil(result.Added),
+		Removed:  nonNil(result.Removed),
+		Changed:  nonNil(result.Changed),
+		Affected: nonNil(result.Affected()),
+	}
+	if labels := r.URL.Query()["is-affected"]; len(labels) > 0 {
+		affected, err := pkg.AffectedLabels(result.Affected(), labels)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response = IsAffectedResponse{Before: before, After: after, Affected: affected}
+	}
+	content, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(content, '\n'))
+}
+
+// load returns the snapshot for sha, which is the pinned baseline if it is for sha, or otherwise
+// read from s.Store, returning the HTTP status to respond with if it can't.
+func (s *Server) load(sha string) (*Snapshot, int, error) {
+	if baseline := s.pinnedBaseline(); baseline != nil && baseline.Revision == sha {
+		return baseline, http.StatusOK, nil
+	}
+	return s.readStored(sha)
+}
+
+// readStored reads the snapshot for sha from s.Store, returning the HTTP status to respond with if
+// it can't.
+func (s *Server) readStored(sha string) (*Snapshot, int, error) {
+	location := pkg.StoredHashesLocation(s.Store, sha)
+	exists, err := pkg.HashStoreFor(location).Exists(location)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to check for hashes for %s: %w", sha, err)
+	}
+	if !exists {
+		return nil, http.StatusNotFound, fmt.Errorf("no hashes stored for %s", sha)
+	}
+	snapshot, err := ReadFile(location, s.ReadOptions)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return snapshot, http.StatusOK, nil
+}
+
+func nonNil(labels []string) []string {
+	if labels == nil {
+		return []string{}
+	}
+	return labels
+}
@@ -0,0 +1,325 @@
+package snapshot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestServerAffected(t *testing.T) {
+	store := t.TempDir()
+	for _, s := range []*Snapshot{before, after} {
+		if err := WriteFile(pkg.StoredHashesLocation(store, s.Revision), s, WriteOptions{}); err != nil {
+			t.Fatalf("Failed to write snapshot: %v", err)
+		}
+	}
+	server := httptest.NewServer((&Server{Store: store}).Handler())
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/affected?before=" + before.Revision + "&after=" + after.Revision)
+	if err != nil {
+		t.Fatalf("Failed to query server: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Wrong status: want %v got %v", http.StatusOK, response.StatusCode)
+	}
+	var got AffectedResponse
+	if err := json.NewDecoder(response.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	want := AffectedResponse{
+		Before:   before.Revision,
+		After:    after.Revision,
+		Added:    []string{"//go/example:lib_test"},
+		Removed:  []string{"//java/example:Removed"},
+		Changed:  []string{"//java/example:GreetingLib", "//java/example:GreetingTest"},
+		Affected: []string{"//go/example:lib_test", "//java/example:GreetingLib", "//java/example:GreetingTest"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong response: want %+v got %+v", want, got)
+	}
+
+	for query, wantStatus := range map[string]int{
+		"before=" + before.Revision + "&after=" + before.Revision:                       http.StatusOK,
+		"before=" + before.Revision + "&after=main":                                     http.StatusBadRequest,
+		"before=../../etc/passwd&after=" + after.Revision:                               http.StatusBadRequest,
+		"before=" + before.Revision + "&after=ffffffffffffffffffffffffffffffffffffffff": http.StatusNotFound,
+	} {
+		response, err := http.Get(server.URL + "/affected?" + query)
+		if err != nil {
+			t.Fatalf("Failed to query server: %v", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != wantStatus {
+			t.Fatalf("Wrong status for %s: want %v got %v", query, wantStatus, response.StatusCode)
+		}
+	}
+}
+
+func TestServerIsAffected(t *testing.T) {
+	store := t.TempDir()
+	for _, s := range []*Snapshot{before, after} {
+		if err := WriteFile(pkg.StoredHashesLocation(store, s.Revision), s, WriteOptions{}); err != nil {
+			t.Fatalf("Failed to write snapshot: %v", err)
+		}
+	}
+	server := httptest.NewServer((&Server{Store: store}).Handler())
+	defer server.Close()
+
+	query := "/affected?before=" + before.Revision + "&after=" + after.Revision
+	response, err := http.Get(server.URL + query + "&is-affected=//java/example:GreetingLib&is-affected=//java/example:Removed&is-affected=//go/example:lib_test")
+	if err != nil {
+		t.Fatalf("Failed to query server: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Wrong status: want %v got %v", http.StatusOK, response.StatusCode)
+	}
+	var got IsAffectedResponse
+	if err := json.NewDecoder(response.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	want := IsAffectedResponse{
+		Before:   before.Revision,
+		After:    after.Revision,
+		Affected: map[string]bool{"//java/example:GreetingLib": true, "//java/example:Removed": false, "//go/example:lib_test": true},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong response: want %+v got %+v", want, got)
+	}
+
+	invalid, err := http.Get(server.URL + query + "&is-affected=//foo:bar:baz")
+	if err != nil {
+		t.Fatalf("Failed to query server: %v", err)
+	}
+	invalid.Body.Close()
+	if invalid.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Wrong status for an invalid label: want %v got %v", http.StatusBadRequest, invalid.StatusCode)
+	}
+}
+
+func TestServerSubmittedAffected(t *testing.T) {
+	store := t.TempDir()
+	if err := WriteFile(pkg.StoredHashesLocation(store, before.Revision), before, WriteOptions{}); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	s := &Server{Store: store, Token: "secret"}
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+	var submitted bytes.Buffer
+	if err := Write(&submitted, after, WriteOptions{Format: "proto"}); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	postWithAuthorization := func(path string, authorization string) *http.Response {
+		request, err := http.NewRequest(http.MethodPost, server.URL+path, bytes.NewReader(submitted.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Content-Type", "application/octet-stream")
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Failed to query server: %v", err)
+		}
+		return response
+	}
+	post := func(path string) *http.Response {
+		return postWithAuthorization(path, "Bearer secret")
+	}
+
+	for _, authorization := range []string{"", "Bearer wrong"} {
+		response := postWithAuthorization("/affected?before="+before.Revision, authorization)
+		response.Body.Close()
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Wrong status submitting a snapshot with authorization %q: want %v got %v", authorization, http.StatusUnauthorized, response.StatusCode)
+		}
+	}
+
+	response := post("/affected")
+	response.Body.Close()
+	if response.StatusCode != http.StatusConflict {
+		t.Fatalf("Wrong status without a baseline: want %v got %v", http.StatusConflict, response.StatusCode)
+	}
+
+	pinBaseline := func(authorization string) int {
+		request, err := http.NewRequest(http.MethodPost, server.URL+"/baseline?sha="+before.Revision, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("Failed to query server: %v", err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+	for authorization, want := range map[string]int{"": http.StatusUnauthorized, "Bearer wrong": http.StatusUnauthorized, "secret": http.StatusUnauthorized} {
+		if got := pinBaseline(authorization); got != want {
+			t.Fatalf("Wrong status pinning baseline with authorization %q: want %v got %v", authorization, want, got)
+		}
+	}
+	if got := pinBaseline("Bearer secret"); got != http.StatusNoContent {
+		t.Fatalf("Wrong status pinning baseline: want %v got %v", http.StatusNoContent, got)
+	}
+	// The pinned baseline is used even if the store no longer has it.
+	if err := os.Remove(pkg.StoredHashesLocation(store, before.Revision)); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/affected", "/affected?before=" + before.Revision} {
+		response = post(path)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("Wrong status for %s: want %v got %v", path, http.StatusOK, response.StatusCode)
+		}
+		var got AffectedResponse
+		if err := json.NewDecoder(response.Body).Decode(&got); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		response.Body.Close()
+		want := AffectedResponse{
+			Before:   before.Revision,
+			After:    after.Revision,
+			Added:    []string{"//go/example:lib_test"},
+			Removed:  []string{"//java/example:Removed"},
+			Changed:  []string{"//java/example:GreetingLib", "//java/example:GreetingTest"},
+			Affected: []string{"//go/example:lib_test", "//java/example:GreetingLib", "//java/example:GreetingTest"},
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong response for %s: want %+v got %+v", path, want, got)
+		}
+	}
+
+	if err := s.PinBaseline("ffffffffffffffffffffffffffffffffffffffff"); err == nil {
+		t.Fatalf("Wrong result pinning a missing baseline: want error got nil")
+	}
+}
+
+func TestServerBaselineDisabledWithoutToken(t *testing.T) {
+	server := httptest.NewServer((&Server{Store: t.TempDir()}).Handler())
+	defer server.Close()
+	request, err := http.NewRequest(http.MethodPost, server.URL+"/baseline?sha="+before.Revision, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer ")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Failed to query server: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Fatalf("Wrong status pinning baseline without a token configured: want %v got %v", http.StatusForbidden, response.StatusCode)
+	}
+}
+
+func TestServerLimitsConcurrentSubmissions(t *testing.T) {
+	s := &Server{Store: t.TempDir(), MaxConcurrentSubmissions: 1}
+	if err := WriteFile(pkg.StoredHashesLocation(s.Store, before.Revision), before, WriteOptions{}); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+	var submitted bytes.Buffer
+	if err := Write(&submitted, after, WriteOptions{Format: "json"}); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+
+	// The first submission is still being read while the second is made.
+	body, bodyWriter := io.Pipe()
+	firstStatus := make(chan int)
+	go func() {
+		response, err := http.Post(server.URL+"/affected?before="+before.Revision, "application/octet-stream", body)
+		if err != nil {
+			firstStatus <- 0
+			return
+		}
+		response.Body.Close()
+		firstStatus <- response.StatusCode
+	}()
+	if _, err := bodyWriter.Write(submitted.Bytes()[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first submission may not have reached the server yet, in which case others succeed.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		response, err := http.Post(server.URL+"/affected?before="+before.Revision, "application/octet-stream", bytes.NewReader(submitted.Bytes()))
+		if err != nil {
+			t.Fatalf("Failed to query server: %v", err)
+		}
+		response.Body.Close()
+		if response.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+		if response.StatusCode != http.StatusOK || time.Now().After(deadline) {
+			t.Fatalf("Wrong status submitting a snapshot while another is read: want %v got %v", http.StatusServiceUnavailable, response.StatusCode)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	bodyWriter.Write(submitted.Bytes()[1:])
+	bodyWriter.Close()
+	if got := <-firstStatus; got != http.StatusOK {
+		t.Fatalf("Wrong status of the first submission: want %v got %v", http.StatusOK, got)
+	}
+	response, err := http.Post(server.URL+"/affected?before="+before.Revision, "application/octet-stream", bytes.NewReader(submitted.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to query server: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("Wrong status submitting a snapshot after the first was read: want %v got %v", http.StatusOK, response.StatusCode)
+	}
+}
+
+func TestServerLimitsDecompressedSubmissions(t *testing.T) {
+	s := &Server{Store: t.TempDir(), MaxSubmittedBytes: 1 << 20}
+	if err := WriteFile(pkg.StoredHashesLocation(s.Store, before.Revision), before, WriteOptions{}); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+	var padded bytes.Buffer
+	if err := Write(&padded, after, WriteOptions{Format: "json"}); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	// Whitespace after the snapshot compresses to almost nothing.
+	padded.Write(bytes.Repeat([]byte(" "), 2<<20))
+	var gzipped bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	gzipWriter.Write(padded.Bytes())
+	gzipWriter.Close()
+	zstdEncoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zstdEncoder.Close()
+	for compression, compressed := range map[string][]byte{"gzip": gzipped.Bytes(), "zstd": zstdEncoder.EncodeAll(padded.Bytes(), nil)} {
+		if len(compressed) >= 1<<20 {
+			t.Fatalf("Compressed %s snapshot is too large to test with: %d bytes", compression, len(compressed))
+		}
+		response, err := http.Post(server.URL+"/affected?before="+before.Revision, "application/octet-stream", bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatalf("Failed to query server: %v", err)
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Wrong status submitting a %s snapshot which decompresses to more than the limit: want %v got %v", compression, http.StatusBadRequest, response.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,536 @@
+// Package snapshot is a library API for writing, reading and diffing snapshots of target hashes,
+// as written by target-determinator's -before-hashes-output and -after-hashes-output, so that other
+// Go tools can embed snapshot diffing without running target-determinator.
+package snapshot
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// Snapshot is the hashes of the matching targets at a single revision.
+type Snapshot = pkg.PersistedHashData
+
+// WriteOptions control how snapshots are encoded.
+type WriteOptions struct {
+	// Format is "json" (the default) or "proto".
+	Format string
+	// Compression is "none" (the default), "gzip" or "zstd". For WriteFile, "auto" chooses based on
+	// the extension of the path.
+	Compression string
+	// SigningKey, if set, is used by WriteFile to sign the snapshot, storing the signature alongside
+	// it. See pkg.PersistSignedHashesAs.
+	SigningKey ed25519.PrivateKey
+	// Shards, if more than 1, is how many files WriteFile splits the snapshot's hashes across,
+	// alongside an index at the path. See pkg.PersistShardedHashesAs.
+	Shards int
+}
+
+// ReadOptions control how snapshots are decoded.
+type ReadOptions struct {
+	// ConflictPolicy is how to handle a target with conflicting hashes for the same configuration:
+	// "fail" (the default), "first" or "last".
+	ConflictPolicy string
+	// VerifyKey, if set, is used by ReadFile to check that the snapshot and any bases it is a delta
+	// against were signed by the corresponding private key.
+	VerifyKey ed25519.PublicKey
+	// MaxDecompressedBytes, if positive, is the largest size Read decompresses a compressed snapshot
+	// to, so that reading untrusted snapshots can't exhaust memory. See pkg.Decompress.
+	MaxDecompressedBytes int64
+}
+
+// DiffOptions control which targets Diff reports. Options which depend on rule kinds, tags or
+// testonly only match targets in snapshots which recorded them.
+type DiffOptions struct {
+	// Scope, if set, is a target pattern (e.g. //mobile/...) restricting the comparison to the
+	// targets it matches, so that scoped pipelines can reuse snapshots of the whole repository. Both
+	// snapshots must cover it: their targets expression must match every target it does, or Diff
+	// fails, as targets outside what a snapshot hashed would otherwise be reported as added or
+	// removed. Snapshots which didn't record their targets expression can't be checked, and are
+	// assumed to cover it.
+	Scope string
+	// FilterPatterns, if non-empty, are target patterns (e.g. //foo/... or -//foo/bar:all) which
+	// reported targets must match. See pkg.NewTargetPatternFilter.
+	FilterPatterns []string
+	// Kinds, if non-empty, are rule kinds, which may contain wildcards (e.g. "*_test"), one of
+	// which reported targets must have.
+	Kinds []string
+	// ExcludeTags are tags which reported targets mustn't have.
+	ExcludeTags []string
+	// TestsOnly is whether to only report test rules, i.e. those whose kind ends in _test.
+	TestsOnly bool
+	// MatchConfigurationsByContent is whether to compare a target's hash in a configuration of
+	// after which before doesn't have with its hash in the configuration of before with the same
+	// summary (see pkg.PersistedConfiguration), e.g. when a change to an unrelated flag changed
+	// every configuration's checksum. Snapshots which didn't record summaries aren't matched.
+	MatchConfigurationsByContent bool
+	// Configurations, if non-empty, are the configurations to compare hashes in, and
+	// IgnoreConfigurations are configurations not to. Each is either a configuration checksum or a
+	// platform, which matches the configurations whose summary lists it in their platforms, by label
+	// (e.g. //platforms:linux_x86_64) or name (e.g. linux_x86_64). Targets without a configuration,
+	// e.g. source files, are always compared, and targets with no other hashes are skipped.
+	Configurations       []string
+	IgnoreConfigurations []string
+	// ExcludeRemoved is whether to leave out removed targets, which can't be built or tested after
+	// the change, so that every report of the result omits them.
+	ExcludeRemoved bool
+	// BazelVersionMismatch is what to do if the snapshots were computed with different Bazel
+	// releases, which generally changes every hash: "error" fails, "warn" logs a warning,
+	// "mark-all-changed" reports every target in both snapshots as changed, and "ignore" (the
+	// default) compares the hashes as usual. Either way, Result.BazelReleaseMismatch is set.
+	BazelVersionMismatch string
+}
+
+// Result is the difference between two snapshots. Each list of labels is sorted, and each target is
+// in at most one of them.
+// A target in both snapshots can differ in several ways at once, e.g. when its hash changed in one
+// configuration and it's no longer in another, so its status is the first of these which applies
+// to any of its configurations, in order of precedence:
+//  1. changed: its hash differs.
+//  2. added: it's in a configuration it wasn't in before.
+//  3. removed: it's no longer in a configuration it was in before.
+type Result struct {
+	// Added are the targets only in the "after" snapshot, and those in both which are in a new
+	// configuration, without their hash changing in any other.
+	Added []string
+	// Removed are the targets only in the "before" snapshot, and those in both which are no longer
+	// in a configuration, without their hash changing, or a configuration being added, in any
+	// other.
+	Removed []string
+	// Changed are the targets in both snapshots whose hash differs in any configuration.
+	Changed []string
+	// BazelReleaseMismatch is whether the snapshots were computed with different Bazel releases.
+	// Snapshots which didn't record their release don't mismatch.
+	BazelReleaseMismatch bool
+}
+
+// Affected returns the targets which should be built or tested after the change: those which were
+// added or changed.
+func (r *Result) Affected() []string {
+	affected := append(append([]string(nil), r.Added...), r.Changed...)
+	sort.Strings(affected)
+	return affected
+}
+
+// TargetsWithStatus returns the targets with status, one of StatusAdded, StatusRemoved or
+// StatusChanged, sorted, or nil for any other status.
+func (r *Result) TargetsWithStatus(status string) []string {
+	switch status {
+	case StatusAdded:
+		return r.Added
+	case StatusRemoved:
+		return r.Removed
+	case StatusChanged:
+		return r.Changed
+	}
+	return nil
+}
+
+// Write encodes s to w.
+func Write(w io.Writer, s *Snapshot, opts WriteOptions) error {
+	content, err := pkg.MarshalPersistedHashes(s, opts.Format, compressionOrDefault(opts.Compression))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// WriteCanonical encodes s to w as indented canonical JSON, so that snapshots with the same content
+// are always written as the same bytes, and can be compared line by line. See
+// pkg.MarshalCanonicalJSON.
+func WriteCanonical(w io.Writer, s *Snapshot) error {
+	content, err := pkg.MarshalCanonicalJSON(s)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// WriteFile writes s to path, which may be a local path, or an s3:// or gs:// URI.
+func WriteFile(path string, s *Snapshot, opts WriteOptions) error {
+	return pkg.PersistShardedHashesAs(path, s, opts.Shards, opts.Format, compressionOrDefault(opts.Compression), opts.SigningKey)
+}
+
+// Read decodes a snapshot from r, in either format and with any compression. Snapshots which are
+// deltas against another snapshot, or indexes of sharded snapshots, can't be read from a stream,
+// as their base and shards can't be found; use ReadFile instead.
+func Read(r io.Reader, opts ReadOptions) (*Snapshot, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if content, err = pkg.Decompress(content, opts.MaxDecompressedBytes); err != nil {
+		return nil, fmt.Errorf("failed to decompress snapshot: %w", err)
+	}
+	s, err := pkg.UnmarshalPersistedHashes(content, conflictPolicyOrDefault(opts.ConflictPolicy))
+	if err != nil {
+		return nil, err
+	}
+	if s.Base != "" {
+		return nil, fmt.Errorf("snapshot is a delta against %s, so must be read with ReadFile", s.Base)
+	}
+	if len(s.Shards) > 0 {
+		return nil, fmt.Errorf("snapshot is an index of %d shards, so must be read with ReadFile", len(s.Shards))
+	}
+	return s, nil
+}
+
+// ReadFile reads the snapshot at path, which may be a local path, or an s3:// or gs:// URI.
+// Deltas are applied to their bases and shards are merged, so the returned snapshot is always
+// complete.
+func ReadFile(path string, opts ReadOptions) (*Snapshot, error) {
+	return pkg.LoadVerifiedPersistedHashes(path, conflictPolicyOrDefault(opts.ConflictPolicy), opts.VerifyKey)
+}
+
+// Diff compares the snapshots before and after, which must have been computed with the same hash
+// function, and either both not be anonymized, or be anonymized with the same salt.
+func Diff(before *Snapshot, after *Snapshot, opts DiffOptions) (*Result, error) {
+	markAllChanged, err := opts.checkComparable(before, after)
+	if err != nil {
+		return nil, err
+	}
+	filter, scope, err := opts.labelFilters()
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{
+		BazelReleaseMismatch: bazelReleaseMismatch(before, after),
+	}
+	matches := func(s *Snapshot, labelString string) (bool, error) {
+		l, err := label.Parse(labelString)
+		if err != nil {
+			return false, fmt.Errorf("failed to parse label %s: %w", labelString, err)
+		}
+		return filter.Matches(l) && scope.Matches(l) && opts.matchesTarget(s.Targets[labelString]), nil
+	}
+
+	var equivalents map[string]string
+	if opts.MatchConfigurationsByContent {
+		equivalents = equivalentConfigurations(before, after)
+	}
+
+	beforeHashesByLabel := opts.selectedHashes(before)
+	afterHashesByLabel := opts.selectedHashes(after)
+
+	for labelString, afterHashes := range afterHashesByLabel {
+		ok, err := matches(after, labelString)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		beforeHashes, ok := beforeHashesByLabel[labelString]
+		if !ok {
+			result.Added = append(result.Added, labelString)
+			continue
+		}
+		if markAllChanged {
+			result.Changed = append(result.Changed, labelString)
+			continue
+		}
+		switch targetStatus(beforeHashes, afterHashes, equivalents) {
+		case StatusChanged:
+			result.Changed = append(result.Changed, labelString)
+		case StatusAdded:
+			result.Added = append(result.Added, labelString)
+		case StatusRemoved:
+			if !opts.ExcludeRemoved {
+				result.Removed = append(result.Removed, labelString)
+			}
+		}
+	}
+	for labelString := range beforeHashesByLabel {
+		if _, ok := afterHashesByLabel[labelString]; ok || opts.ExcludeRemoved {
+			continue
+		}
+		ok, err := matches(before, labelString)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		result.Removed = append(result.Removed, labelString)
+	}
+	sort.Strings(result.Added)
+	sort.Strings(result.Removed)
+	sort.Strings(result.Changed)
+	return result, nil
+}
+
+// checkComparable returns an error unless before and after can be compared with opts, as
+// documented on Diff and DiffOptions, and whether every target in both should be reported as
+// changed, because they were computed with different Bazel releases.
+func (opts DiffOptions) checkComparable(before *Snapshot, after *Snapshot) (bool, error) {
+	if before.EffectiveHashFunction() != after.EffectiveHashFunction() {
+		return false, fmt.Errorf("can't compare snapshots computed with different hash functions, %s and %s", before.EffectiveHashFunction(), after.EffectiveHashFunction())
+	}
+	if before.AnonymizationSaltDigest != after.AnonymizationSaltDigest {
+		if before.AnonymizationSaltDigest == "" || after.AnonymizationSaltDigest == "" {
+			return false, fmt.Errorf("can't compare an anonymized snapshot with one which isn't anonymized")
+		}
+		return false, fmt.Errorf("can't compare snapshots anonymized with different salts")
+	}
+	if opts.Scope != "" {
+		for _, s := range []struct {
+			name     string
+			snapshot *Snapshot
+		}{{"before", before}, {"after", after}} {
+			if err := checkCovers(s.snapshot, opts.Scope); err != nil {
+				return false, fmt.Errorf("%s snapshot: %w", s.name, err)
+			}
+		}
+	}
+	mismatch := bazelReleaseMismatch(before, after)
+	switch opts.BazelVersionMismatch {
+	case "error":
+		if mismatch {
+			return false, fmt.Errorf("can't compare snapshots computed with different Bazel releases, %s and %s", before.BazelRelease, after.BazelRelease)
+		}
+	case "warn":
+		if mismatch {
+			log.Printf("WARN: Comparing snapshots computed with different Bazel releases, %s and %s, so most targets are likely to differ", before.BazelRelease, after.BazelRelease)
+		}
+	case "mark-all-changed":
+		return mismatch, nil
+	case "", "ignore":
+	default:
+		return false, fmt.Errorf("unknown Bazel version mismatch policy %q", opts.BazelVersionMismatch)
+	}
+	return false, nil
+}
+
+// bazelReleaseMismatch returns whether before and after were computed with different Bazel
+// releases. Snapshots which didn't record their release don't mismatch.
+func bazelReleaseMismatch(before *Snapshot, after *Snapshot) bool {
+	return before.BazelRelease != "" && after.BazelRelease != "" && before.BazelRelease != after.BazelRelease
+}
+
+// labelFilters returns the filters for opts.FilterPatterns and opts.Scope, which is nil, matching
+// every label, if there's no scope.
+func (opts DiffOptions) labelFilters() (*pkg.TargetPatternFilter, *pkg.TargetPatternFilter, error) {
+	filter, err := pkg.NewTargetPatternFilter(opts.FilterPatterns)
+	if err != nil {
+		return nil, nil, err
+	}
+	var scope *pkg.TargetPatternFilter
+	if opts.Scope != "" {
+		if scope, err = pkg.NewTargetPatternFilter([]string{opts.Scope}); err != nil {
+			return nil, nil, err
+		}
+	}
+	return filter, scope, nil
+}
+
+// targetStatus returns the status of a target in both snapshots with beforeHashes and afterHashes,
+// by the precedence documented on Result, or "" if it's unchanged. equivalents are as returned by
+// equivalentConfigurations.
+func targetStatus(beforeHashes map[string]string, afterHashes map[string]string, equivalents map[string]string) string {
+	statuses := make(map[string]bool)
+	compared := make(map[string]bool)
+	for configuration, hash := range afterHashes {
+		beforeConfiguration := configuration
+		beforeHash, ok := beforeHashes[configuration]
+		if equivalent, isEquivalent := equivalents[configuration]; !ok && isEquivalent {
+			beforeConfiguration = equivalent
+			beforeHash, ok = beforeHashes[equivalent]
+		}
+		if !ok {
+			statuses[StatusAdded] = true
+			continue
+		}
+		compared[beforeConfiguration] = true
+		if beforeHash != hash {
+			statuses[StatusChanged] = true
+		}
+	}
+	for configuration := range beforeHashes {
+		if !compared[configuration] {
+			statuses[StatusRemoved] = true
+		}
+	}
+	for _, status := range []string{StatusChanged, StatusAdded, StatusRemoved} {
+		if statuses[status] {
+			return status
+		}
+	}
+	return ""
+}
+
+// checkCovers returns an error unless the targets expression recorded in s matches every target
+// scope does.
+func checkCovers(s *Snapshot, scope string) error {
+	if s.TargetsExpression == "" {
+		log.Printf("WARN: Snapshot at %s didn't record its targets expression, so it can't be checked to cover %s", s.Revision, scope)
+		return nil
+	}
+	targets, err := pkg.ParseTargetsList(s.TargetsExpression)
+	if err != nil {
+		return err
+	}
+	filter, err := targets.PatternFilter()
+	if err != nil {
+		return fmt.Errorf("can't check that it covers %s: %w", scope, err)
+	}
+	covered, err := filter.Covers(scope)
+	if err != nil {
+		return err
+	}
+	if !covered {
+		return fmt.Errorf("its targets %q don't cover %s", s.TargetsExpression, scope)
+	}
+	return nil
+}
+
+// selectedHashes returns the hashes of s in the configurations selected by opts.Configurations and
+// opts.IgnoreConfigurations, omitting targets which have none.
+func (opts DiffOptions) selectedHashes(s *Snapshot) map[string]map[string]string {
+	if len(opts.Configurations) == 0 && len(opts.IgnoreConfigurations) == 0 {
+		return s.Hashes
+	}
+	selected := make(map[string]map[string]string, len(s.Hashes))
+	for labelString, hashes := range s.Hashes {
+		if selectedHashes := opts.selectedTargetHashes(s, hashes); selectedHashes != nil {
+			selected[labelString] = selectedHashes
+		}
+	}
+	return selected
+}
+
+// selectedTargetHashes returns the hashes of a target of s in the configurations selected by
+// opts.Configurations and opts.IgnoreConfigurations, or nil if there are none.
+func (opts DiffOptions) selectedTargetHashes(s *Snapshot, hashes map[string]string) map[string]string {
+	if len(opts.Configurations) == 0 && len(opts.IgnoreConfigurations) == 0 {
+		return hashes
+	}
+	selected := make(map[string]string, len(hashes))
+	for configuration, hash := range hashes {
+		if configuration == "" || opts.selectsConfiguration(s, configuration) {
+			selected[configuration] = hash
+		}
+	}
+	if len(selected) == 0 {
+		return nil
+	}
+	return selected
+}
+
+// selectsConfiguration returns whether configuration of s is selected by opts.Configurations and
+// opts.IgnoreConfigurations.
+func (opts DiffOptions) selectsConfiguration(s *Snapshot, configuration string) bool {
+	if len(opts.Configurations) > 0 && !matchesAnyConfiguration(s, configuration, opts.Configurations) {
+		return false
+	}
+	return !matchesAnyConfiguration(s, configuration, opts.IgnoreConfigurations)
+}
+
+// matchesAnyConfiguration returns whether any of patterns is configuration, or a platform in its
+// summary in s.
+func matchesAnyConfiguration(s *Snapshot, configuration string, patterns []string) bool {
+	platforms := strings.Split(strings.Trim(s.Configurations[configuration].Platforms, "[]"), ",")
+	for _, pattern := range patterns {
+		if pattern == configuration {
+			return true
+		}
+		for _, platform := range platforms {
+			platform = strings.TrimSpace(platform)
+			if platform == "" {
+				continue
+			}
+			if pattern == platform {
+				return true
+			}
+			if l, err := label.Parse(platform); err == nil && pattern == l.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// equivalentConfigurations maps each configuration of after which before doesn't have to the
+// configuration of before, which after doesn't have, with the same summary, if there is exactly
+// one.
+func equivalentConfigurations(before *Snapshot, after *Snapshot) map[string]string {
+	candidates := make(map[string][]string)
+	for afterConfiguration, afterSummary := range after.Configurations {
+		if _, ok := before.Configurations[afterConfiguration]; ok || reflect.DeepEqual(afterSummary, pkg.PersistedConfiguration{}) {
+			continue
+		}
+		for beforeConfiguration, beforeSummary := range before.Configurations {
+			if _, ok := after.Configurations[beforeConfiguration]; ok {
+				continue
+			}
+			if reflect.DeepEqual(afterSummary, beforeSummary) {
+				candidates[afterConfiguration] = append(candidates[afterConfiguration], beforeConfiguration)
+			}
+		}
+	}
+	equivalents := make(map[string]string)
+	for afterConfiguration, beforeConfigurations := range candidates {
+		if len(beforeConfigurations) == 1 {
+			equivalents[afterConfiguration] = beforeConfigurations[0]
+		}
+	}
+	return equivalents
+}
+
+// matchesTarget returns whether a target with info should be reported.
+func (opts DiffOptions) matchesTarget(info pkg.PersistedTargetInfo) bool {
+	if opts.TestsOnly && !matchesAnyKind(info.Kind, []string{"*_test"}) {
+		return false
+	}
+	if len(opts.Kinds) > 0 && !matchesAnyKind(info.Kind, opts.Kinds) {
+		return false
+	}
+	for _, tag := range info.Tags {
+		for _, excluded := range opts.ExcludeTags {
+			if tag == excluded {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func matchesAnyKind(kind string, patterns []string) bool {
+	if kind == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, kind); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func compressionOrDefault(compression string) string {
+	if compression == "" {
+		return "none"
+	}
+	return compression
+}
+
+func conflictPolicyOrDefault(conflictPolicy string) string {
+	if conflictPolicy == "" {
+		return "fail"
+	}
+	return conflictPolicy
+}
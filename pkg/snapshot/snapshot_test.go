@@ -0,0 +1,371 @@
+package snapshot
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+var (
+	before = &Snapshot{
+		SchemaVersion: pkg.PersistedHashesSchemaVersion,
+		Revision:      "0123456789abcdef0123456789abcdef01234567",
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib":  {"cfg": "aa"},
+			"//java/example:GreetingTest": {"cfg": "bb"},
+			"//java/example:Removed":      {"cfg": "cc"},
+			"//java/example:Unchanged":    {"cfg": "dd"},
+		},
+		Targets: map[string]pkg.PersistedTargetInfo{
+			"//java/example:GreetingLib":  {Kind: "java_library"},
+			"//java/example:GreetingTest": {Kind: "java_test", Tags: []string{"flaky"}},
+			"//java/example:Removed":      {Kind: "java_binary"},
+			"//java/example:Unchanged":    {Kind: "java_library"},
+		},
+	}
+	after = &Snapshot{
+		SchemaVersion: pkg.PersistedHashesSchemaVersion,
+		Revision:      "89abcdef0123456789abcdef0123456789abcdef",
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib":  {"cfg": "ab"},
+			"//java/example:GreetingTest": {"cfg": "bc"},
+			"//java/example:Unchanged":    {"cfg": "dd"},
+			"//go/example:lib_test":       {"cfg": "ee"},
+		},
+		Targets: map[string]pkg.PersistedTargetInfo{
+			"//java/example:GreetingLib":  {Kind: "java_library"},
+			"//java/example:GreetingTest": {Kind: "java_test", Tags: []string{"flaky"}},
+			"//java/example:Unchanged":    {Kind: "java_library"},
+			"//go/example:lib_test":       {Kind: "go_test"},
+		},
+	}
+)
+
+func TestDiff(t *testing.T) {
+	for name, tc := range map[string]struct {
+		opts DiffOptions
+		want *Result
+	}{
+		"all": {
+			want: &Result{
+				Added:   []string{"//go/example:lib_test"},
+				Removed: []string{"//java/example:Removed"},
+				Changed: []string{"//java/example:GreetingLib", "//java/example:GreetingTest"},
+			},
+		},
+		"filter patterns": {
+			opts: DiffOptions{FilterPatterns: []string{"//java/...", "-//java/example:GreetingTest"}},
+			want: &Result{
+				Removed: []string{"//java/example:Removed"},
+				Changed: []string{"//java/example:GreetingLib"},
+			},
+		},
+		"exclude removed": {
+			opts: DiffOptions{ExcludeRemoved: true},
+			want: &Result{
+				Added:   []string{"//go/example:lib_test"},
+				Changed: []string{"//java/example:GreetingLib", "//java/example:GreetingTest"},
+			},
+		},
+		"tests only without flaky": {
+			opts: DiffOptions{TestsOnly: true, ExcludeTags: []string{"flaky"}},
+			want: &Result{
+				Added: []string{"//go/example:lib_test"},
+			},
+		},
+		"kinds": {
+			opts: DiffOptions{Kinds: []string{"java_*"}},
+			want: &Result{
+				Removed: []string{"//java/example:Removed"},
+				Changed: []string{"//java/example:GreetingLib", "//java/example:GreetingTest"},
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := Diff(before, after, tc.opts)
+			if err != nil {
+				t.Fatalf("Failed to diff: %v", err)
+			}
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("Wrong diff: want %+v got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestResultTargetsWithStatus(t *testing.T) {
+	result, err := Diff(before, after, DiffOptions{})
+	if err != nil {
+		t.Fatalf("Failed to diff: %v", err)
+	}
+	for status, want := range map[string][]string{
+		StatusAdded:   {"//go/example:lib_test"},
+		StatusRemoved: {"//java/example:Removed"},
+		StatusChanged: {"//java/example:GreetingLib", "//java/example:GreetingTest"},
+		"unchanged":   nil,
+	} {
+		if got := result.TargetsWithStatus(status); !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong targets with status %s: want %v got %v", status, want, got)
+		}
+	}
+}
+
+func TestDiffScope(t *testing.T) {
+	scoped := func(s *Snapshot, targetsExpression string) *Snapshot {
+		copied := *s
+		copied.TargetsExpression = targetsExpression
+		return &copied
+	}
+
+	got, err := Diff(scoped(before, "//java/... + //go/..."), scoped(after, "//..."), DiffOptions{Scope: "//java/example:all"})
+	if err != nil {
+		t.Fatalf("Failed to diff: %v", err)
+	}
+	want := &Result{
+		Removed: []string{"//java/example:Removed"},
+		Changed: []string{"//java/example:GreetingLib", "//java/example:GreetingTest"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong diff: want %+v got %+v", want, got)
+	}
+
+	for name, tc := range map[string]struct {
+		before *Snapshot
+		after  *Snapshot
+	}{
+		"before doesn't cover scope":   {scoped(before, "//go/..."), scoped(after, "//...")},
+		"after excludes part of scope": {scoped(before, "//..."), scoped(after, "//... - //java/example:GreetingLib")},
+		"after isn't target patterns":  {scoped(before, "//..."), scoped(after, "deps(//java/example:GreetingLib)")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Diff(tc.before, tc.after, DiffOptions{Scope: "//java/..."}); err == nil {
+				t.Fatalf("Expected an error diffing snapshots which don't cover the scope")
+			}
+		})
+	}
+}
+
+func TestDiffStatusPrecedence(t *testing.T) {
+	configurationsBefore := &Snapshot{
+		Hashes: map[string]map[string]string{
+			"//:changed_and_removed": {"cfg1": "aa", "cfg2": "bb"},
+			"//:added_and_removed":   {"cfg1": "aa"},
+			"//:changed_and_added":   {"cfg1": "aa"},
+			"//:removed":             {"cfg1": "aa", "cfg2": "bb"},
+			"//:unchanged":           {"cfg1": "aa"},
+		},
+	}
+	configurationsAfter := &Snapshot{
+		Hashes: map[string]map[string]string{
+			"//:changed_and_removed": {"cfg1": "ab"},
+			"//:added_and_removed":   {"cfg2": "aa"},
+			"//:changed_and_added":   {"cfg1": "ab", "cfg2": "bb"},
+			"//:removed":             {"cfg1": "aa"},
+			"//:unchanged":           {"cfg1": "aa"},
+		},
+	}
+	for name, tc := range map[string]struct {
+		opts DiffOptions
+		want *Result
+	}{
+		"all": {
+			want: &Result{
+				Added:   []string{"//:added_and_removed"},
+				Removed: []string{"//:removed"},
+				Changed: []string{"//:changed_and_added", "//:changed_and_removed"},
+			},
+		},
+		"exclude removed": {
+			opts: DiffOptions{ExcludeRemoved: true},
+			want: &Result{
+				Added:   []string{"//:added_and_removed"},
+				Changed: []string{"//:changed_and_added", "//:changed_and_removed"},
+			},
+		},
+	} {
+		got, err := Diff(configurationsBefore, configurationsAfter, tc.opts)
+		if err != nil {
+			t.Fatalf("Failed to diff %s: %v", name, err)
+		}
+		if !reflect.DeepEqual(tc.want, got) {
+			t.Fatalf("Wrong diff %s: want %+v got %+v", name, tc.want, got)
+		}
+	}
+}
+
+func TestDiffMatchConfigurationsByContent(t *testing.T) {
+	fastbuild := pkg.PersistedConfiguration{CompilationMode: "fastbuild", CPU: "k8"}
+	opt := pkg.PersistedConfiguration{CompilationMode: "opt", CPU: "k8"}
+	renamedBefore := &Snapshot{
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib":  {"cfg1": "aa", "cfg2": "bb"},
+			"//java/example:GreetingTest": {"cfg1": "cc"},
+		},
+		Configurations: map[string]pkg.PersistedConfiguration{"cfg1": fastbuild, "cfg2": opt},
+	}
+	renamedAfter := &Snapshot{
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib":  {"cfg3": "aa", "cfg4": "bc"},
+			"//java/example:GreetingTest": {"cfg3": "cc"},
+		},
+		Configurations: map[string]pkg.PersistedConfiguration{"cfg3": fastbuild, "cfg4": opt},
+	}
+	for name, tc := range map[string]struct {
+		opts DiffOptions
+		want *Result
+	}{
+		"by checksum": {
+			// Every configuration is new, so no hashes are compared.
+			want: &Result{Added: []string{"//java/example:GreetingLib", "//java/example:GreetingTest"}},
+		},
+		"by content": {
+			opts: DiffOptions{MatchConfigurationsByContent: true},
+			want: &Result{Changed: []string{"//java/example:GreetingLib"}},
+		},
+	} {
+		got, err := Diff(renamedBefore, renamedAfter, tc.opts)
+		if err != nil {
+			t.Fatalf("Failed to diff %s: %v", name, err)
+		}
+		if !reflect.DeepEqual(tc.want, got) {
+			t.Fatalf("Wrong diff %s: want %+v got %+v", name, tc.want, got)
+		}
+	}
+}
+
+func TestDiffConfigurations(t *testing.T) {
+	platformsBefore := &Snapshot{
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib":   {"linux": "aa", "macos": "bb"},
+			"//java/example:MacOnly":       {"macos": "cc"},
+			"//java/example:Greeting.java": {"": "dd"},
+		},
+		Configurations: map[string]pkg.PersistedConfiguration{
+			"linux": {Platforms: "[//platforms:linux_x86_64]"},
+			"macos": {Platforms: "[//platforms:macos_arm64]"},
+		},
+	}
+	platformsAfter := &Snapshot{
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib":   {"linux": "aa", "macos": "bc"},
+			"//java/example:Greeting.java": {"": "de"},
+		},
+		Configurations: platformsBefore.Configurations,
+	}
+	for name, tc := range map[string]struct {
+		opts DiffOptions
+		want *Result
+	}{
+		"all": {
+			want: &Result{
+				Removed: []string{"//java/example:MacOnly"},
+				Changed: []string{"//java/example:Greeting.java", "//java/example:GreetingLib"},
+			},
+		},
+		"platform name": {
+			opts: DiffOptions{Configurations: []string{"linux_x86_64"}},
+			want: &Result{Changed: []string{"//java/example:Greeting.java"}},
+		},
+		"ignored platform label": {
+			opts: DiffOptions{IgnoreConfigurations: []string{"//platforms:linux_x86_64"}},
+			want: &Result{
+				Removed: []string{"//java/example:MacOnly"},
+				Changed: []string{"//java/example:Greeting.java", "//java/example:GreetingLib"},
+			},
+		},
+		"ignored checksum": {
+			opts: DiffOptions{IgnoreConfigurations: []string{"macos"}},
+			want: &Result{Changed: []string{"//java/example:Greeting.java"}},
+		},
+	} {
+		got, err := Diff(platformsBefore, platformsAfter, tc.opts)
+		if err != nil {
+			t.Fatalf("Failed to diff %s: %v", name, err)
+		}
+		if !reflect.DeepEqual(tc.want, got) {
+			t.Fatalf("Wrong diff %s: want %+v got %+v", name, tc.want, got)
+		}
+	}
+}
+
+func TestDiffBazelVersionMismatch(t *testing.T) {
+	oldBazel := *before
+	oldBazel.BazelRelease = "release 7.1.0"
+	newBazel := *after
+	newBazel.BazelRelease = "release 8.0.0"
+	for policy, want := range map[string]*Result{
+		"ignore": {
+			Added:                []string{"//go/example:lib_test"},
+			Removed:              []string{"//java/example:Removed"},
+			Changed:              []string{"//java/example:GreetingLib", "//java/example:GreetingTest"},
+			BazelReleaseMismatch: true,
+		},
+		"mark-all-changed": {
+			Added:                []string{"//go/example:lib_test"},
+			Removed:              []string{"//java/example:Removed"},
+			Changed:              []string{"//java/example:GreetingLib", "//java/example:GreetingTest", "//java/example:Unchanged"},
+			BazelReleaseMismatch: true,
+		},
+	} {
+		got, err := Diff(&oldBazel, &newBazel, DiffOptions{BazelVersionMismatch: policy})
+		if err != nil {
+			t.Fatalf("Failed to diff with policy %s: %v", policy, err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong diff with policy %s: want %+v got %+v", policy, want, got)
+		}
+	}
+	if _, err := Diff(&oldBazel, &newBazel, DiffOptions{BazelVersionMismatch: "error"}); err == nil {
+		t.Fatalf("Wrong result diffing with policy error: want error got nil")
+	}
+	if _, err := Diff(&oldBazel, &oldBazel, DiffOptions{BazelVersionMismatch: "error"}); err != nil {
+		t.Fatalf("Wrong result diffing the same Bazel releases with policy error: want nil got %v", err)
+	}
+}
+
+func TestDiffAnonymized(t *testing.T) {
+	anonymizedBefore, err := before.Anonymized("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	anonymizedAfter, err := after.Anonymized("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSaltAfter, err := after.Anonymized("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Diff(anonymizedBefore, anonymizedAfter, DiffOptions{}); err != nil {
+		t.Fatalf("Failed to diff snapshots anonymized with the same salt: %v", err)
+	} else if len(got.Changed) != 2 {
+		t.Fatalf("Wrong number of changed targets: want 2 got %v", got.Changed)
+	}
+	for name, pair := range map[string][2]*Snapshot{
+		"before anonymized": {anonymizedBefore, after},
+		"after anonymized":  {before, anonymizedAfter},
+		"different salts":   {anonymizedBefore, otherSaltAfter},
+	} {
+		if _, err := Diff(pair[0], pair[1], DiffOptions{}); err == nil {
+			t.Errorf("Wrong result diffing with %s: want error got nil", name)
+		}
+	}
+}
+
+func TestWriteReadRoundTrips(t *testing.T) {
+	for _, opts := range []WriteOptions{{}, {Format: "proto", Compression: "gzip"}} {
+		var buf bytes.Buffer
+		if err := Write(&buf, after, opts); err != nil {
+			t.Fatalf("Failed to write snapshot with %+v: %v", opts, err)
+		}
+		got, err := Read(&buf, ReadOptions{})
+		if err != nil {
+			t.Fatalf("Failed to read snapshot with %+v: %v", opts, err)
+		}
+		if !reflect.DeepEqual(after, got) {
+			t.Fatalf("Wrong snapshot with %+v: want %+v got %+v", opts, after, got)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package snapshot
+
+import (
+	"fmt"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// DiffStream compares the snapshots in the files at beforePath and afterPath as Diff does, but
+// reads their hashes a target at a time rather than loading them, calling changed with each
+// target Diff would report, in label order, so that memory use doesn't grow with the number of
+// targets. If changed returns an error, the comparison stops and DiffStream returns it.
+// The files must be complete JSON snapshots in local files with sorted labels, as WriteFile writes
+// them (see pkg.PersistedHashesStream), and aren't verified. Options which need the targets' rule
+// information (Kinds, ExcludeTags and TestsOnly) aren't supported, as it's only available after
+// their hashes.
+func DiffStream(beforePath string, afterPath string, opts DiffOptions, changed func(Change) error) error {
+	if len(opts.Kinds) > 0 || len(opts.ExcludeTags) > 0 || opts.TestsOnly {
+		return fmt.Errorf("can't filter by kind, tags or tests when streaming snapshots")
+	}
+	before, err := pkg.OpenPersistedHashesStream(beforePath)
+	if err != nil {
+		return err
+	}
+	defer before.Close()
+	after, err := pkg.OpenPersistedHashesStream(afterPath)
+	if err != nil {
+		return err
+	}
+	defer after.Close()
+
+	markAllChanged, err := opts.checkComparable(before.Metadata, after.Metadata)
+	if err != nil {
+		return err
+	}
+	filter, scope, err := opts.labelFilters()
+	if err != nil {
+		return err
+	}
+	var equivalents map[string]string
+	if opts.MatchConfigurationsByContent {
+		equivalents = equivalentConfigurations(before.Metadata, after.Metadata)
+	}
+
+	beforeLabel, beforeHashes, inBefore, err := before.Next()
+	if err != nil {
+		return err
+	}
+	afterLabel, afterHashes, inAfter, err := after.Next()
+	if err != nil {
+		return err
+	}
+	for inBefore || inAfter {
+		change := Change{}
+		advanceBefore, advanceAfter := false, false
+		switch {
+		case !inBefore || (inAfter && afterLabel < beforeLabel):
+			change.Label, change.AfterHashes = afterLabel, afterHashes
+			advanceAfter = true
+		case !inAfter || beforeLabel < afterLabel:
+			change.Label, change.BeforeHashes = beforeLabel, beforeHashes
+			advanceBefore = true
+		default:
+			change.Label, change.BeforeHashes, change.AfterHashes = afterLabel, beforeHashes, afterHashes
+			advanceBefore, advanceAfter = true, true
+		}
+
+		// Selected hashes are only used for the status, and the change has all of them, as for Diff.
+		selectedBefore := opts.selectedTargetHashes(before.Metadata, change.BeforeHashes)
+		selectedAfter := opts.selectedTargetHashes(after.Metadata, change.AfterHashes)
+		switch {
+		case selectedBefore == nil && selectedAfter == nil:
+		case selectedBefore == nil:
+			change.Status = StatusAdded
+		case selectedAfter == nil:
+			change.Status = StatusRemoved
+		case markAllChanged:
+			change.Status = StatusChanged
+		default:
+			change.Status = targetStatus(selectedBefore, selectedAfter, equivalents)
+		}
+		if change.Status == StatusRemoved && opts.ExcludeRemoved {
+			change.Status = ""
+		}
+		if change.Status != "" {
+			l, err := label.Parse(change.Label)
+			if err != nil {
+				return fmt.Errorf("failed to parse label %s: %w", change.Label, err)
+			}
+			if filter.Matches(l) && scope.Matches(l) {
+				if err := changed(change); err != nil {
+					return err
+				}
+			}
+		}
+
+		if advanceBefore {
+			if beforeLabel, beforeHashes, inBefore, err = before.Next(); err != nil {
+				return err
+			}
+		}
+		if advanceAfter {
+			if afterLabel, afterHashes, inAfter, err = after.Next(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+func TestDiffStreamMatchesDiff(t *testing.T) {
+	dir := t.TempDir()
+	beforePath := filepath.Join(dir, "before.json")
+	afterPath := filepath.Join(dir, "after.json.gz")
+	if err := WriteFile(beforePath, before, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(afterPath, after, WriteOptions{Compression: "auto"}); err != nil {
+		t.Fatal(err)
+	}
+	for name, opts := range map[string]DiffOptions{
+		"all":             {},
+		"filter patterns": {FilterPatterns: []string{"//java/...", "-//java/example:GreetingTest"}},
+		"exclude removed": {ExcludeRemoved: true},
+		"configurations":  {IgnoreConfigurations: []string{"cfg"}},
+	} {
+		result, err := Diff(before, after, opts)
+		if err != nil {
+			t.Fatalf("Failed to diff %s: %v", name, err)
+		}
+		want := result.Changes(before, after)
+		var got []Change
+		if err := DiffStream(beforePath, afterPath, opts, func(change Change) error {
+			got = append(got, change)
+			return nil
+		}); err != nil {
+			t.Fatalf("Failed to diff %s by streaming: %v", name, err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong streamed diff %s: want %+v got %+v", name, want, got)
+		}
+	}
+
+	if err := DiffStream(beforePath, afterPath, DiffOptions{TestsOnly: true}, func(Change) error { return nil }); err == nil {
+		t.Fatalf("Expected an error streaming with a filter on kinds")
+	}
+}
+
+func TestDiffStreamMatchConfigurationsByContent(t *testing.T) {
+	dir := t.TempDir()
+	fastbuild := pkg.PersistedConfiguration{CompilationMode: "fastbuild", CPU: "k8"}
+	beforePath := filepath.Join(dir, "before.json")
+	afterPath := filepath.Join(dir, "after.json")
+	// Configurations are written after the hashes, so are read before streaming them.
+	if err := WriteFile(beforePath, &Snapshot{
+		Hashes:         map[string]map[string]string{"//java/example:GreetingLib": {"cfg1": "aa"}},
+		Configurations: map[string]pkg.PersistedConfiguration{"cfg1": fastbuild},
+	}, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(afterPath, &Snapshot{
+		Hashes:         map[string]map[string]string{"//java/example:GreetingLib": {"cfg2": "ab"}},
+		Configurations: map[string]pkg.PersistedConfiguration{"cfg2": fastbuild},
+	}, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	if err := DiffStream(beforePath, afterPath, DiffOptions{MatchConfigurationsByContent: true}, func(change Change) error {
+		got = append(got, change.Status+" "+change.Label)
+		return nil
+	}); err != nil {
+		t.Fatalf("Failed to diff by streaming: %v", err)
+	}
+	if want := []string{"changed //java/example:GreetingLib"}; !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong streamed diff: want %v got %v", want, got)
+	}
+}
+
+func TestDiffStreamRejectsUnstreamableSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	beforePath := filepath.Join(dir, "before.json")
+	if err := WriteFile(beforePath, before, WriteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	unsorted := filepath.Join(dir, "unsorted.json")
+	if err := os.WriteFile(unsorted, []byte(`{"revision": "abc", "hashes": {"//b:b": {"": "01"}, "//a:a": {"": "02"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	proto := filepath.Join(dir, "after.pb")
+	if err := WriteFile(proto, after, WriteOptions{Format: "proto"}); err != nil {
+		t.Fatal(err)
+	}
+	delta := filepath.Join(dir, "delta.json")
+	if err := pkg.PersistHashes(delta, after.DeltaFrom(before, beforePath)); err != nil {
+		t.Fatal(err)
+	}
+	for name, path := range map[string]string{"unsorted": unsorted, "proto": proto, "delta": delta} {
+		if err := DiffStream(beforePath, path, DiffOptions{}, func(Change) error { return nil }); err == nil {
+			t.Fatalf("Expected an error streaming a %s snapshot", name)
+		}
+	}
+}
@@ -3,15 +3,16 @@ package pkg
 import (
 	"bufio"
 	"bytes"
+	"crypto/ed25519"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"os/exec"
-	"os/user"
 	path2 "path"
 	"reflect"
 	"runtime"
@@ -19,6 +20,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/aristanetworks/goarista/path"
 	"github.com/bazel-contrib/target-determinator/common"
@@ -139,53 +141,362 @@ type Context struct {
 	FilterIncompatibleTargets bool
 	// EnforceCleanRepo controls whether we should fail if the repository is unclean.
 	EnforceCleanRepo bool
+	// ToolchainResolutionChanges describes how to handle targets which were only affected by changes
+	// to targets taking part in toolchain resolution or select() evaluation (e.g. `config_setting`,
+	// `platform` or `constraint_value` targets, but not `toolchain` targets, which also point at a
+	// toolchain implementation).
+	// Accepted values are:
+	// - "include" - treat these targets like any other affected target.
+	// - "report" - report these targets with a distinct ToolchainResolutionChanged difference, which
+	//   is passed to WalkCallback even if differences aren't otherwise being included.
+	// - "exclude" - don't report these targets as affected.
+	// Anything other than "include" requires computing a second hash for each matching target.
+	ToolchainResolutionChanges string
+	// IgnoredRepositories are external repositories whose contents shouldn't affect hashes, e.g.
+	// because they contain toolchains detected on the host machine which aren't used when building
+	// on remote executors.
+	IgnoredRepositories []string
+	// MaxBeforeRevisionAge is the maximum difference in commit time between the "before" revision and
+	// OriginalRevision. Zero means unlimited.
+	MaxBeforeRevisionAge time.Duration
+	// MaxBeforeRevisionCommits is the maximum number of commits between the "before" revision and
+	// OriginalRevision. Zero means unlimited.
+	MaxBeforeRevisionCommits int
+	// StaleBeforeRevisionBehavior describes how to handle a "before" revision which exceeds
+	// MaxBeforeRevisionAge or MaxBeforeRevisionCommits.
+	// Accepted values are:
+	// - "fatal" - fail.
+	// - "build-all" - don't process the "before" revision, and treat all matching targets from the
+	//   "after" revision as affected.
+	StaleBeforeRevisionBehavior string
+	// WarnBeforeRevisionAge and WarnBeforeRevisionCommits are thresholds above which a warning is
+	// logged about the distance between the "before" revision and OriginalRevision.
+	// Zero means never warn.
+	WarnBeforeRevisionAge     time.Duration
+	WarnBeforeRevisionCommits int
+	// BeforeHashesOutputFile and AfterHashesOutputFile are paths to write the hashes computed for
+	// the "before" and "after" revisions to, if non-empty. See PersistHashes.
+	BeforeHashesOutputFile string
+	AfterHashesOutputFile  string
+	// AnonymizeHashOutputs is whether to replace the names in the labels written to
+	// BeforeHashesOutputFile and AfterHashesOutputFile with opaque tokens derived from
+	// AnonymizationSalt. See PersistedHashData.Anonymized.
+	AnonymizeHashOutputs bool
+	AnonymizationSalt    string
+	// HashesOutputFormat and HashesOutputCompression are the format of BeforeHashesOutputFile and
+	// AfterHashesOutputFile, and how to compress them. See PersistHashesAs.
+	HashesOutputFormat      string
+	HashesOutputCompression string
+	// HashesOutputShards, if more than 1, is how many files to split each of BeforeHashesOutputFile
+	// and AfterHashesOutputFile across. See PersistShardedHashesAs.
+	HashesOutputShards int
+	// IncludeHashBreakdown is whether to record the components of each rule's hash in
+	// BeforeHashesOutputFile and AfterHashesOutputFile. See PersistedHashBreakdown.
+	IncludeHashBreakdown bool
+	// SourceFilesLimit, if positive, is the most source files to record each rule's hash as
+	// depending on in BeforeHashesOutputFile and AfterHashesOutputFile. Rules which depend on more
+	// have none recorded. See PersistedTargetInfo.SourceFiles.
+	SourceFilesLimit int
+	// HashesOutputBase, if set, is a hash file to write BeforeHashesOutputFile and
+	// AfterHashesOutputFile as deltas against. See PersistedHashData.DeltaFrom.
+	HashesOutputBase string
+	// HashesSigningKey, if set, is used to sign BeforeHashesOutputFile and AfterHashesOutputFile,
+	// and HashesVerifyKey, if set, is used to verify the signatures of BeforeHashesFile and
+	// HashesOutputBase. See PersistSignedHashesAs.
+	HashesSigningKey ed25519.PrivateKey
+	HashesVerifyKey  ed25519.PublicKey
+	// BeforeHashesFile is the path to hashes previously written by PersistHashes, which are used
+	// instead of checking out and processing the "before" revision if they were computed at it.
+	BeforeHashesFile string
+	// PersistedHashConflictPolicy is how to handle conflicting hashes for the same target in
+	// BeforeHashesFile. See LoadPersistedHashes.
+	PersistedHashConflictPolicy string
+	// ConfigurationEnumeration controls which configurations of each matching target are considered.
+	// Accepted values are:
+	// - "top-level" (or "") - only the configurations the target is configured in at the top level.
+	// - "include-exec" - also any exec configurations the target is depended on in.
+	// - "all" - every configuration the target is depended on in, including via transitions.
+	ConfigurationEnumeration string
+	// WorktreeCacheDir is the directory git worktrees are created in, if needed.
+	// Defaults to DefaultWorktreeCacheDir if empty.
+	WorktreeCacheDir string
+	// ProcessRevisionsConcurrently controls whether the "before" revision is processed in a git
+	// worktree with its own Bazel output base at the same time as the "after" revision, rather than
+	// sequentially. This is faster, but uses more disk, memory and CPU.
+	ProcessRevisionsConcurrently bool
+	// HashingWorkers is the number of workers used to hash targets. If revisions are processed
+	// concurrently, this is the combined number across both revisions.
+	// Zero means to use the TD_WORKER_COUNT environment variable, or a default based on the number
+	// of CPUs.
+	HashingWorkers int
+	// QueryChunkSize, if positive, is the maximum number of targets to cquery at once. Larger sets
+	// of targets are split into chunks by package which are queried in turn, so that Bazel doesn't
+	// run out of memory analyzing them all at once.
+	QueryChunkSize int
+
+	// BeforeBazelOutputBase, if non-empty, is a Bazel output base to process the "before" revision
+	// in, so that the analysis cache of BazelOutputBase isn't invalidated by processing it.
+	// If revisions are processed concurrently and this is empty, an output base next to
+	// BazelOutputBase is used.
+	BeforeBazelOutputBase string
+
+	// ManualTargets controls how targets tagged "manual" are treated. Accepted values are:
+	// - "include" (or "") - treat them like any other target.
+	// - "exclude-unless-listed" - like Bazel wildcards, only consider them if they are listed
+	//   explicitly in the targets, rather than being matched by a wildcard like `//...`.
+	ManualTargets string
+
+	// KeepGoing is whether to carry on when some packages fail to load or analyze, rather than
+	// failing. Targets in packages which failed are unknown, so those packages are reported in
+	// DegradedPackages as wholly affected.
+	KeepGoing bool
+
+	// InfraFilePolicies are how changes to infrastructure files are handled. If nil, only
+	// single-revision mode applies policies, using DefaultInfraFilePolicies.
+	InfraFilePolicies []InfraFilePolicy
+	// PolicyMarkers are the policies declared by policy marker files in the repository. They
+	// override InfraFilePolicies. See LoadPolicyMarkers.
+	PolicyMarkers []InfraFilePolicy
+
+	// ResourceAccounting, if non-nil, records the resources used while processing each revision.
+	ResourceAccounting *ResourceAccounting
+
+	// DegradedPackages records the packages which failed to load or analyze, with KeepGoing, rather
+	// than any of their targets being reported as affected. It must be non-nil if KeepGoing is set.
+	DegradedPackages *DegradedPackages
+
+	// forceGitWorktree controls whether revisions are always checked out in a git worktree.
+	forceGitWorktree bool
 }
 
 // FullyProcess returns the before and after metadata maps, with fully filled caches.
 func FullyProcess(context *Context, revBefore LabelledGitRev, revAfter LabelledGitRev, targets TargetsList) (*QueryResults, *QueryResults, error) {
-	log.Printf("Processing %s", revBefore)
-	queryInfoBefore, err := fullyProcessRevision(context, revBefore, targets)
+	queryInfoBefore, queryInfoAfter, err := fullyProcessForPlatforms(context, revBefore, revAfter, targets, []string{""})
 	if err != nil {
-		if queryInfoBefore == nil {
+		return nil, nil, err
+	}
+	return queryInfoBefore[0], queryInfoAfter[0], nil
+}
+
+// fullyProcessForPlatforms is like FullyProcess, but returns metadata for each of platforms, as if
+// `--platforms=<platform>` had been passed to Bazel, or for Bazel's default platforms for "".
+// Each revision is only checked out once, and queried and hashed for each platform in turn.
+func fullyProcessForPlatforms(context *Context, revBefore LabelledGitRev, revAfter LabelledGitRev, targets TargetsList, platforms []string) ([]*QueryResults, []*QueryResults, error) {
+	var queryInfoBefore []*QueryResults
+	if err := checkBeforeRevisionDistance(context, revBefore); err != nil {
+		if !errors.Is(err, ErrStaleBeforeRevision) || context.StaleBeforeRevisionBehavior != "build-all" {
 			return nil, nil, err
-		} else {
-			if context.BeforeQueryErrorBehavior == "ignore-and-build-all" {
-				log.Printf("A query error occurred querying %s - ignoring the error and treating all matching targets from the '%s' revision as affected. Error querying: %v", revBefore, revAfter.Label, err)
-			} else {
-				return nil, nil, fmt.Errorf("error occurred querying %s: %w", revBefore, err)
-			}
 		}
+		Progressf("Not processing %s - treating all matching targets from the '%s' revision as affected: %v", revBefore, revAfter.Label, err)
+		for range platforms {
+			queryInfoBefore = append(queryInfoBefore, &QueryResults{
+				MatchingTargets: &MatchingTargets{},
+				TargetHashCache: NewTargetHashCache(nil, &Normalizer{}, ""),
+				QueryError:      err,
+			})
+		}
+	} else if context.BeforeHashesFile != "" {
+		if len(platforms) != 1 {
+			return nil, nil, fmt.Errorf("hashes from %s can't be used for several platforms", context.BeforeHashesFile)
+		}
+		loaded, err := loadBeforeHashes(context, revBefore)
+		if err != nil {
+			return nil, nil, err
+		}
+		if loaded != nil {
+			Progressf("Using hashes from %s for %s", context.BeforeHashesFile, revBefore)
+			queryInfoBefore = []*QueryResults{loaded}
+		}
+	}
+	if queryInfoBefore == nil && context.ProcessRevisionsConcurrently {
+		return fullyProcessConcurrently(context, revBefore, revAfter, targets, platforms)
+	}
+	if queryInfoBefore == nil {
+		beforeContext := context
+		if context.BeforeBazelOutputBase != "" {
+			beforeContext = withBazelOutputBase(context, context.BeforeBazelOutputBase)
+		}
+		Progressf("Processing %s using output base %s", revBefore, beforeContext.BazelOutputBase)
+		var err error
+		queryInfoBefore, err = fullyProcessRevisionForPlatforms(beforeContext, revBefore, targets, platforms)
+		if err := checkBeforeQueryError(context, revBefore, revAfter, queryInfoBefore, err); err != nil {
+			return nil, nil, err
+		}
+		endProcessingPhase(context, "process-before", beforeContext)
 	}
 
 	// At this point, we assume that the working directory is back to its pristine state.
-	log.Printf("Processing %s", revAfter)
-	queryInfoAfter, err := fullyProcessRevision(context, revAfter, targets)
+	Progressf("Processing %s", revAfter)
+	queryInfoAfter, err := fullyProcessRevisionForPlatforms(context, revAfter, targets, platforms)
+	if err != nil {
+		return nil, nil, err
+	}
+	endProcessingPhase(context, "process-after", context)
+
+	return queryInfoBefore, queryInfoAfter, nil
+}
+
+// fullyProcessConcurrently processes revBefore in a git worktree with its own Bazel output base at
+// the same time as processing revAfter, splitting the hashing workers between them.
+//
+// git doesn't support concurrent commands in the same repository, so both revisions are checked out
+// one after the other first, and only querying and hashing them is done concurrently.
+func fullyProcessConcurrently(context *Context, revBefore LabelledGitRev, revAfter LabelledGitRev, targets TargetsList, platforms []string) (_ []*QueryResults, _ []*QueryResults, err error) {
+	workers, err := hashingWorkers(context.HashingWorkers)
 	if err != nil {
 		return nil, nil, err
 	}
+	beforeOutputBase := context.BeforeBazelOutputBase
+	if beforeOutputBase == "" {
+		beforeOutputBase = concurrentBeforeOutputBase(context)
+	}
+	beforeContext := *withBazelOutputBase(context, beforeOutputBase)
+	beforeContext.HashingWorkers = max(1, workers/2)
+	beforeContext.forceGitWorktree = true
+	afterContext := *context
+	afterContext.HashingWorkers = max(1, workers-beforeContext.HashingWorkers)
+
+	Progressf("Checking out %s", revBefore)
+	checkedOutBeforeContext, cleanupBefore, err := checkoutRevision(&beforeContext, revBefore)
+	defer cleanupBefore()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load metadata at %s: %w", revBefore, err)
+	}
+	defer func() {
+		innerErr := gitCheckout(context.WorkspacePath, context.OriginalRevision)
+		if innerErr != nil && err == nil {
+			err = fmt.Errorf("failed to check out original commit during cleanup: %v", innerErr)
+		}
+	}()
+	Progressf("Checking out %s", revAfter)
+	checkedOutAfterContext, cleanupAfter, err := checkoutRevision(&afterContext, revAfter)
+	defer cleanupAfter()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load metadata at %s: %w", revAfter, err)
+	}
 
+	var queryInfoBefore []*QueryResults
+	var beforeErr error
+	beforeDone := make(chan struct{})
+	go func() {
+		defer close(beforeDone)
+		Progressf("Processing %s using output base %s", revBefore, beforeContext.BazelOutputBase)
+		queryInfoBefore, beforeErr = queryAndHashRevision(checkedOutBeforeContext, revBefore, targets, platforms)
+	}()
+
+	Progressf("Processing %s", revAfter)
+	queryInfoAfter, afterErr := queryAndHashRevision(checkedOutAfterContext, revAfter, targets, platforms)
+	<-beforeDone
+
+	if err := checkBeforeQueryError(context, revBefore, revAfter, queryInfoBefore, beforeErr); err != nil {
+		return nil, nil, err
+	}
+	if afterErr != nil {
+		return nil, nil, afterErr
+	}
+	endProcessingPhase(context, "process-revisions-concurrently", &beforeContext, &afterContext)
 	return queryInfoBefore, queryInfoAfter, nil
 }
 
+// withBazelOutputBase returns a copy of context which uses outputBase as its Bazel output base.
+func withBazelOutputBase(context *Context, outputBase string) *Context {
+	newContext := *context
+	newContext.BazelOutputBase = outputBase
+	return &newContext
+}
+
+// withBazelCmd returns a copy of context which uses bazelCmd to run Bazel.
+func withBazelCmd(context *Context, bazelCmd BazelCmd) *Context {
+	newContext := *context
+	newContext.BazelCmd = bazelCmd
+	return &newContext
+}
+
+// checkBeforeQueryError returns the error which should be returned for an error processing
+// revBefore, if any, taking into account context.BeforeQueryErrorBehavior.
+func checkBeforeQueryError(context *Context, revBefore LabelledGitRev, revAfter LabelledGitRev, queryInfoBefore []*QueryResults, err error) error {
+	if err == nil {
+		return nil
+	}
+	if queryInfoBefore == nil {
+		return err
+	}
+	if context.BeforeQueryErrorBehavior == "ignore-and-build-all" {
+		log.Printf("A query error occurred querying %s - ignoring the error and treating all matching targets from the '%s' revision as affected. Error querying: %v", revBefore, revAfter.Label, err)
+		return nil
+	}
+	return fmt.Errorf("error occurred querying %s: %w", revBefore, err)
+}
+
 // fullyProcessRevision may return a nil error and a non-nil queryInfo.
 // This indicates that evaluating the initial query at this revision failed,
 // but that the user may want to use the results anyway, despite their query results being empty.
 // This may be useful when the "before" commit is broken for query, as it allows for running all
 // matching targets from the "after" query, despite the "before" being broken.
-func fullyProcessRevision(context *Context, rev LabelledGitRev, targets TargetsList) (queryInfo *QueryResults, err error) {
+func fullyProcessRevision(context *Context, rev LabelledGitRev, targets TargetsList) (*QueryResults, error) {
+	queryInfo, err := fullyProcessRevisionForPlatforms(context, rev, targets, []string{""})
+	if queryInfo == nil {
+		return nil, err
+	}
+	return queryInfo[0], err
+}
+
+// fullyProcessRevisionForPlatforms is like fullyProcessRevision, but returns metadata for each of
+// platforms. See fullyProcessForPlatforms.
+func fullyProcessRevisionForPlatforms(context *Context, rev LabelledGitRev, targets TargetsList, platforms []string) (queryInfo []*QueryResults, err error) {
 	defer func() {
+		// Revisions processed in a git worktree never change the original workspace.
+		if context.forceGitWorktree {
+			return
+		}
 		innerErr := gitCheckout(context.WorkspacePath, context.OriginalRevision)
 		if innerErr != nil && err == nil {
 			err = fmt.Errorf("failed to check out original commit during cleanup: %v", innerErr)
 		}
 	}()
-	queryInfo, loadMetadataCleanup, err := LoadIncompleteMetadata(context, rev, targets)
-	defer loadMetadataCleanup()
+	checkedOutContext, cleanup, err := checkoutRevision(context, rev)
+	defer cleanup()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load metadata at %s: %w", rev, err)
+	}
+	return queryAndHashRevision(checkedOutContext, rev, targets, platforms)
+}
+
+// queryAndHashRevision queries and hashes targets for each of platforms (see
+// fullyProcessForPlatforms) in the workspace of context, which must already have rev checked out.
+// See checkoutRevision.
+func queryAndHashRevision(context *Context, rev LabelledGitRev, targets TargetsList, platforms []string) ([]*QueryResults, error) {
+	queryInfos := make([]*QueryResults, 0, len(platforms))
+	for _, platform := range platforms {
+		platformContext := context
+		if platform != "" {
+			Progressf("Processing %s for platform %s", rev, platform)
+			platformContext = withBazelCmd(context, WithExtraBazelOpts(context.BazelCmd, "--platforms="+platform))
+		}
+		queryInfo, err := queryAndHashRevisionForPlatform(platformContext, rev, targets)
+		if err != nil {
+			if queryInfo == nil {
+				return nil, err
+			}
+			// The results of a failed query may still be used (see fullyProcessRevision), and the query
+			// would most likely fail in the same way for the remaining platforms.
+			for len(queryInfos) < len(platforms) {
+				queryInfos = append(queryInfos, queryInfo)
+			}
+			return queryInfos, err
+		}
+		queryInfos = append(queryInfos, queryInfo)
+	}
+	return queryInfos, nil
+}
+
+func queryAndHashRevisionForPlatform(context *Context, rev LabelledGitRev, targets TargetsList) (*QueryResults, error) {
+	queryInfo, err := queryRevision(context, rev, targets)
 	if err != nil {
 		return queryInfo, fmt.Errorf("failed to load metadata at %s: %w", rev, err)
 	}
 
-	log.Println("Hashing targets")
+	Progressf("Hashing targets")
 	if err := queryInfo.PrefillCache(); err != nil {
 		return nil, fmt.Errorf("failed to calculate hashes at %s: %w", rev, err)
 	}
@@ -204,6 +515,19 @@ func fullyProcessRevision(context *Context, rev LabelledGitRev, targets TargetsL
 // empty target-set, but may contain other useful information (e.g. the bazel release version).
 // Checking for nil-ness of the error is the true arbiter for whether the entire load was successful.
 func LoadIncompleteMetadata(context *Context, rev LabelledGitRev, targets TargetsList) (*QueryResults, func(), error) {
+	context, cleanupFunc, err := checkoutRevision(context, rev)
+	if err != nil {
+		return nil, cleanupFunc, err
+	}
+	queryInfo, err := queryRevision(context, rev, targets)
+	return queryInfo, cleanupFunc, err
+}
+
+// checkoutRevision checks out rev, and returns a copy of context whose WorkspacePath has it checked
+// out, which may be a git worktree, and a non-nil callback to clean up the worktree if it was
+// created. As for LoadIncompleteMetadata, the caller is responsible for checking out the original
+// commit.
+func checkoutRevision(context *Context, rev LabelledGitRev) (*Context, func(), error) {
 	// Create a temporary context to allow the workspace path to point to a git worktree if necessary.
 	context = &Context{
 		WorkspacePath:                          context.WorkspacePath,
@@ -217,6 +541,40 @@ func LoadIncompleteMetadata(context *Context, rev LabelledGitRev, targets Target
 		CompareQueriesAroundAnalysisCacheClear: context.CompareQueriesAroundAnalysisCacheClear,
 		FilterIncompatibleTargets:              context.FilterIncompatibleTargets,
 		EnforceCleanRepo:                       context.EnforceCleanRepo,
+		ToolchainResolutionChanges:             context.ToolchainResolutionChanges,
+		IgnoredRepositories:                    context.IgnoredRepositories,
+		MaxBeforeRevisionAge:                   context.MaxBeforeRevisionAge,
+		MaxBeforeRevisionCommits:               context.MaxBeforeRevisionCommits,
+		StaleBeforeRevisionBehavior:            context.StaleBeforeRevisionBehavior,
+		WarnBeforeRevisionAge:                  context.WarnBeforeRevisionAge,
+		WarnBeforeRevisionCommits:              context.WarnBeforeRevisionCommits,
+		BeforeHashesOutputFile:                 context.BeforeHashesOutputFile,
+		AfterHashesOutputFile:                  context.AfterHashesOutputFile,
+		AnonymizeHashOutputs:                   context.AnonymizeHashOutputs,
+		AnonymizationSalt:                      context.AnonymizationSalt,
+		HashesOutputFormat:                     context.HashesOutputFormat,
+		HashesOutputCompression:                context.HashesOutputCompression,
+		HashesOutputShards:                     context.HashesOutputShards,
+		IncludeHashBreakdown:                   context.IncludeHashBreakdown,
+		SourceFilesLimit:                       context.SourceFilesLimit,
+		HashesOutputBase:                       context.HashesOutputBase,
+		HashesSigningKey:                       context.HashesSigningKey,
+		HashesVerifyKey:                        context.HashesVerifyKey,
+		BeforeHashesFile:                       context.BeforeHashesFile,
+		PersistedHashConflictPolicy:            context.PersistedHashConflictPolicy,
+		ConfigurationEnumeration:               context.ConfigurationEnumeration,
+		WorktreeCacheDir:                       context.WorktreeCacheDir,
+		ProcessRevisionsConcurrently:           context.ProcessRevisionsConcurrently,
+		HashingWorkers:                         context.HashingWorkers,
+		QueryChunkSize:                         context.QueryChunkSize,
+		BeforeBazelOutputBase:                  context.BeforeBazelOutputBase,
+		ManualTargets:                          context.ManualTargets,
+		KeepGoing:                              context.KeepGoing,
+		InfraFilePolicies:                      context.InfraFilePolicies,
+		PolicyMarkers:                          context.PolicyMarkers,
+		ResourceAccounting:                     context.ResourceAccounting,
+		DegradedPackages:                       context.DegradedPackages,
+		forceGitWorktree:                       context.forceGitWorktree,
 	}
 	cleanupFunc := func() {}
 
@@ -226,12 +584,16 @@ func LoadIncompleteMetadata(context *Context, rev LabelledGitRev, targets Target
 
 		// A worktree was created by gitSafeCheckout(). Use it and set the cleanup callback even
 		// if gitSafeCheckout returns an error.
-		if newWorkspacePath != "" && context.DeleteCachedWorktree {
+		if newWorkspacePath != "" {
+			deleteWorktree := context.DeleteCachedWorktree
 			cleanupFunc = func() {
-				err := os.RemoveAll(newWorkspacePath)
-				if err != nil {
-					err = fmt.Errorf("failed to clean up temporary git worktree at %s: %v", newWorkspacePath, err)
+				if deleteWorktree {
+					err := os.RemoveAll(newWorkspacePath)
+					if err != nil {
+						err = fmt.Errorf("failed to clean up temporary git worktree at %s: %v", newWorkspacePath, err)
+					}
 				}
+				unlockWorktree(newWorkspacePath)
 			}
 			context.WorkspacePath = newWorkspacePath
 		}
@@ -240,37 +602,42 @@ func LoadIncompleteMetadata(context *Context, rev LabelledGitRev, targets Target
 			return nil, cleanupFunc, fmt.Errorf("failed to checkout %s in %v: %w", rev, context.WorkspacePath, err2)
 		}
 	}
+	return context, cleanupFunc, nil
+}
 
+// queryRevision queries targets in the workspace of context, which must already have rev checked
+// out. See checkoutRevision.
+func queryRevision(context *Context, rev LabelledGitRev, targets TargetsList) (*QueryResults, error) {
 	var queryInfoBeforeClear *QueryResults
 	if context.CompareQueriesAroundAnalysisCacheClear {
 		var err error
 		queryInfoBeforeClear, err = doQueryDeps(context, targets)
 		if err != nil {
-			return queryInfoBeforeClear, cleanupFunc, fmt.Errorf("failed to query[before] at %s in %v: %w", rev, context.WorkspacePath, err)
+			return queryInfoBeforeClear, fmt.Errorf("failed to query[before] at %s in %v: %w", rev, context.WorkspacePath, err)
 		}
 	}
 
 	// Clear analysis cache before each query, as cquery configurations leak across invocations.
 	// See https://github.com/bazelbuild/bazel/issues/14725
 	if err := clearAnalysisCache(context); err != nil {
-		return nil, cleanupFunc, err
+		return nil, err
 	}
 
 	queryInfo, err := doQueryDeps(context, targets)
 	if err != nil {
-		return queryInfo, cleanupFunc, fmt.Errorf("failed to query at %s in %v: %w", rev, context.WorkspacePath, err)
+		return queryInfo, fmt.Errorf("failed to query at %s in %v: %w", rev, context.WorkspacePath, err)
 	}
 
 	if context.CompareQueriesAroundAnalysisCacheClear {
 		if !reflect.DeepEqual(queryInfoBeforeClear.MatchingTargets, queryInfo.MatchingTargets) {
-			return nil, cleanupFunc, fmt.Errorf("inconsistent cquery results before and after analysis cache clear: MatchingTargets")
+			return nil, fmt.Errorf("inconsistent cquery results before and after analysis cache clear: MatchingTargets")
 		}
 		if !reflect.DeepEqual(queryInfoBeforeClear.TransitiveConfiguredTargets, queryInfo.TransitiveConfiguredTargets) {
-			return nil, cleanupFunc, fmt.Errorf("inconsistent cquery results before and after analysis cache clear: TransitiveConfiguredTargets")
+			return nil, fmt.Errorf("inconsistent cquery results before and after analysis cache clear: TransitiveConfiguredTargets")
 		}
 	}
 
-	return queryInfo, cleanupFunc, nil
+	return queryInfo, nil
 }
 
 // stringSliceContainsStartingWith returns whether slice contains items that are a path prefix of element.
@@ -289,10 +656,10 @@ func EnsureGitRepositoryClean(workingDirectory string, ignoredFiles []common.Rel
 		return false, err
 	}
 	if len(filteredUncleanStatuses) > 0 {
-		log.Printf("Current working tree has %v non-ignored untracked files:\n",
+		Progressf("Current working tree has %v non-ignored untracked files:\n",
 			len(filteredUncleanStatuses))
 		for _, status := range filteredUncleanStatuses {
-			log.Printf("%s\n", status)
+			Progressf("%s\n", status)
 		}
 		return false, nil
 	}
@@ -378,12 +745,14 @@ func gitSafeCheckout(context *Context, rev LabelledGitRev, ignoredFiles []common
 	if err != nil {
 		return "", fmt.Errorf("failed to check whether the repository is clean: %w", err)
 	}
-	if !isPreCheckoutClean {
+	if context.forceGitWorktree {
+		useGitWorktree = true
+	} else if !isPreCheckoutClean {
 		if context.EnforceCleanRepo {
 			return "", fmt.Errorf("repository was not clean before checking out %v", rev)
 		}
 
-		log.Printf("Workspace is unclean, using git worktree. This will be slower the first time. " +
+		Progressf("Workspace is unclean, using git worktree. This will be slower the first time. " +
 			"You can avoid this by committing local changes and ignoring untracked files.")
 		useGitWorktree = true
 	} else {
@@ -400,14 +769,18 @@ func gitSafeCheckout(context *Context, rev LabelledGitRev, ignoredFiles []common
 				return "", fmt.Errorf("repository was not clean after checking out %v", rev)
 			}
 
-			log.Printf("Detected unclean repository after checkout (likely due to submodule or " +
+			Progressf("Detected unclean repository after checkout (likely due to submodule or " +
 				".gitignore changes). Using git worktree to leave original repository pristine.")
 			useGitWorktree = true
 		}
 	}
 	newRepositoryPath := ""
 	if useGitWorktree {
-		newRepositoryPath, err = gitReuseOrCreateWorktree(context.WorkspacePath, rev)
+		cacheDir, err := worktreeCacheDir(context)
+		if err != nil {
+			return "", err
+		}
+		newRepositoryPath, err = gitReuseOrCreateWorktree(context.WorkspacePath, cacheDir, rev)
 		if err != nil {
 			return "", fmt.Errorf("failed to create or reuse worktree: %w", err)
 		}
@@ -435,26 +808,26 @@ func gitCheckout(workingDirectory string, rev LabelledGitRev) error {
 // If it can't, it removes the directory completely and re-creates the worktree.
 //
 // The return path to the worktree is stable between invocations.
-func gitReuseOrCreateWorktree(workingDirectory string, rev LabelledGitRev) (string, error) {
-	currentUser, err := user.Current()
-	if err != nil {
-		return "", fmt.Errorf("failed to determine current user: %w", err)
-	}
-	cacheDir := path2.Join(currentUser.HomeDir, ".cache", "target-determinator")
-	if err = os.MkdirAll(cacheDir, 0750); err != nil {
+func gitReuseOrCreateWorktree(workingDirectory string, cacheDir string, rev LabelledGitRev) (string, error) {
+	if err := os.MkdirAll(cacheDir, 0750); err != nil {
 		return "", fmt.Errorf("failed to create the .cache directory")
 	}
 	hashBuilder := sha1.New()
 	hashBuilder.Write([]byte(workingDirectory))
 	currentDirHash := hex.EncodeToString(hashBuilder.Sum(nil))
-	worktreeDirPath := path2.Join(cacheDir, fmt.Sprintf("td-worktree-%v-%v", path2.Base(workingDirectory), currentDirHash))
+	worktreeDirPath := path2.Join(cacheDir, fmt.Sprintf("%v%v-%v", worktreeDirPrefix, path2.Base(workingDirectory), currentDirHash))
+
+	// The caller is responsible for unlocking the worktree once it's finished with it.
+	if err := lockWorktree(worktreeDirPath); err != nil {
+		return "", err
+	}
 
 	if err := os.MkdirAll(cacheDir, 0750); err != nil {
 		return "", fmt.Errorf("failed to create cache directory %v for git worktree: %w", worktreeDirPath, err)
 	}
 
 	tryReuseDir := true
-	_, err = os.Stat(worktreeDirPath)
+	_, err := os.Stat(worktreeDirPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			tryReuseDir = false
@@ -468,7 +841,7 @@ func gitReuseOrCreateWorktree(workingDirectory string, rev LabelledGitRev) (stri
 			log.Printf("failed to reuse existing git worktree in %v: %v. Will re-create worktree.", worktreeDirPath, err)
 		} else {
 			// If we don't have any errors, our job is done.
-			log.Printf("Reusing git worktree in %v", worktreeDirPath)
+			Progressf("Reusing git worktree in %v", worktreeDirPath)
 			return worktreeDirPath, nil
 		}
 	}
@@ -477,11 +850,14 @@ func gitReuseOrCreateWorktree(workingDirectory string, rev LabelledGitRev) (stri
 	if err != nil {
 		return "", fmt.Errorf("failed to remove worktree directory %v: %w", worktreeDirPath, err)
 	}
+	if err := ensureSpaceForWorktree(workingDirectory, cacheDir, rev.GitRevision.Sha); err != nil {
+		return "", err
+	}
 	if err = gitCreateWorktree(workingDirectory, worktreeDirPath, rev.GitRevision.Sha); err != nil {
 		return worktreeDirPath, fmt.Errorf("failed to create temporary git worktree: %w", err)
 	}
 
-	log.Printf("Using fresh git worktree in %v", worktreeDirPath)
+	Progressf("Using fresh git worktree in %v", worktreeDirPath)
 	return worktreeDirPath, nil
 }
 
@@ -517,22 +893,32 @@ type QueryResults struct {
 	TransitiveConfiguredTargets map[label.Label]map[Configuration]*analysis.ConfiguredTarget
 	TargetHashCache             *TargetHashCache
 	BazelRelease                string
+	// IncompatibleTargets are the targets which matched the query, but were filtered out because
+	// they're incompatible with the target platform, with the configurations they were filtered out
+	// in. The configurations are unknown, so nil, for targets loaded from hash files written before
+	// they were recorded.
+	IncompatibleTargets map[label.Label][]Configuration
+	// DegradedPackages are the packages, formatted like "//foo/bar", which failed to load or
+	// analyze when Context.KeepGoing was set, so whose targets are unknown. Sorted.
+	DegradedPackages []string
 	// QueryError is whatever error was returned when running the cquery to get these results.
 	QueryError     error
 	configurations map[Configuration]singleConfigurationOutput
+	// toolchainResolutionChanges mirrors Context.ToolchainResolutionChanges.
+	toolchainResolutionChanges string
+	// hashingWorkers mirrors Context.HashingWorkers.
+	hashingWorkers int
+	// fromPersistedHashes is whether these results were loaded from PersistedHashData, and so only
+	// contain hashes rather than target metadata.
+	fromPersistedHashes bool
+	// targets is the targets expression which was queried.
+	targets TargetsList
 }
 
 func (queryInfo *QueryResults) PrefillCache() error {
-	var err error
-	var numWorkers int
-	workerCountEnv := os.Getenv("TD_WORKER_COUNT")
-	if workerCountEnv == "" {
-		numWorkers = runtime.NumCPU() * 8
-	} else {
-		numWorkers, err = strconv.Atoi(workerCountEnv)
-		if err != nil {
-			return fmt.Errorf("could not parse the TD_WORKER_COUNT env var into an int: %v", workerCountEnv)
-		}
+	numWorkers, err := hashingWorkers(queryInfo.hashingWorkers)
+	if err != nil {
+		return err
 	}
 
 	// Create a thread pool to hash the targets faster.
@@ -545,6 +931,9 @@ func (queryInfo *QueryResults) PrefillCache() error {
 		go func() {
 			for labelAndConfiguration := range labelAndConfigurationsChan {
 				_, err := queryInfo.TargetHashCache.Hash(labelAndConfiguration)
+				if err == nil && queryInfo.tracksToolchainResolutionChanges() {
+					_, err = queryInfo.TargetHashCache.HashIgnoringToolchainResolution(labelAndConfiguration)
+				}
 				if err != nil {
 					once.Do(func() { errorsChan <- err }) // We only return one error.
 				}
@@ -582,6 +971,27 @@ OUTER:
 	return nil
 }
 
+// hashingWorkers returns the number of workers to hash targets with, given a configured number
+// which may be zero to use the default.
+func hashingWorkers(configured int) (int, error) {
+	if configured > 0 {
+		return configured, nil
+	}
+	workerCountEnv := os.Getenv("TD_WORKER_COUNT")
+	if workerCountEnv == "" {
+		return runtime.NumCPU() * 8, nil
+	}
+	numWorkers, err := strconv.Atoi(workerCountEnv)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse the TD_WORKER_COUNT env var into an int: %v", workerCountEnv)
+	}
+	return numWorkers, nil
+}
+
+func (queryInfo *QueryResults) tracksToolchainResolutionChanges() bool {
+	return queryInfo.toolchainResolutionChanges != "" && queryInfo.toolchainResolutionChanges != "include"
+}
+
 type LabelAndConfigurations struct {
 	Label          label.Label
 	Configurations []Configuration
@@ -704,6 +1114,11 @@ func doQueryDeps(context *Context, targets TargetsList) (*QueryResults, error) {
 
 	normalizer := Normalizer{repoMapping}
 
+	chunks, err := queryChunks(context, targets)
+	if err != nil {
+		return nil, err
+	}
+
 	// Work around https://github.com/bazelbuild/bazel/issues/21010
 	var incompatibleTargetsToFilter map[label.Label]bool
 	hasIncompatibleTargetsBug, explanation := versions.ReleaseIsInRange(bazelRelease, version.Must(version.NewVersion("7.0.0-pre.20230628.2")), version.Must(version.NewVersion("7.4.0")))
@@ -711,21 +1126,24 @@ func doQueryDeps(context *Context, targets TargetsList) (*QueryResults, error) {
 		if !context.FilterIncompatibleTargets {
 			return nil, fmt.Errorf("requested not to filter incompatible targets, but bazel version %s has a bug requiring filtering incompatible targets - see https://github.com/bazelbuild/bazel/issues/21010", bazelRelease)
 		}
-		incompatibleTargetsToFilter, err = findCompatibleTargets(context, targets.String(), false, &normalizer, bazelRelease)
+		incompatibleTargetsToFilter, err = findCompatibleTargetsInChunks(context, chunks, false, &normalizer, bazelRelease)
 		if err != nil {
 			return nil, fmt.Errorf("failed to find incompatible targets: %w", err)
 		}
 	} else if hasIncompatibleTargetsBug == nil {
-		log.Printf("Couldn't detect whether current bazel version (%s) suffers from https://github.com/bazelbuild/bazel/issues/21010: %s - assuming it does not", bazelRelease, explanation)
+		Progressf("Couldn't detect whether current bazel version (%s) suffers from https://github.com/bazelbuild/bazel/issues/21010: %s - assuming it does not", bazelRelease, explanation)
 	}
 
-	depsPattern := fmt.Sprintf("deps(%s)", targets.String())
-	if len(incompatibleTargetsToFilter) > 0 {
-		depsPattern += " - " + strings.Join(sortedStringKeys(incompatibleTargetsToFilter), " - ")
+	depsPatternFor := func(chunk string) string {
+		depsPattern := fmt.Sprintf("deps(%s)", chunk)
+		if len(incompatibleTargetsToFilter) > 0 {
+			depsPattern += " - " + strings.Join(sortedStringKeys(incompatibleTargetsToFilter), " - ")
+		}
+		return depsPattern
 	}
-	transitiveResult, err := runToCqueryResult(context, depsPattern, true, bazelRelease)
+	transitiveResult, transitiveDegradedPackages, err := runToCqueryResultInChunks(context, chunks, depsPatternFor, true, bazelRelease)
 	if err != nil {
-		retErr := fmt.Errorf("failed to cquery %v: %w", depsPattern, err)
+		retErr := fmt.Errorf("failed to cquery %v: %w", depsPatternFor(targets.String()), err)
 		return &QueryResults{
 			MatchingTargets: &MatchingTargets{
 				labels:                 nil,
@@ -743,14 +1161,18 @@ func doQueryDeps(context *Context, targets TargetsList) (*QueryResults, error) {
 		return nil, fmt.Errorf("failed to parse cquery result: %w", err)
 	}
 
-	matchingTargetResults, err := runToCqueryResult(context, targets.String(), false, bazelRelease)
+	matchingTargetResults, matchingDegradedPackages, err := runToCqueryResultInChunks(context, chunks, func(chunk string) string { return chunk }, false, bazelRelease)
 	if err != nil {
 		return nil, fmt.Errorf("failed to run top-level cquery: %w", err)
 	}
+	degradedPackages := ss.NewSortedSet(append(transitiveDegradedPackages, matchingDegradedPackages...))
+	if degradedPackages.Len() > 0 {
+		log.Printf("WARN: Some packages failed to load or analyze, so all of their targets will be considered affected: %s", strings.Join(degradedPackages.SortedSlice(), ", "))
+	}
 
 	var compatibleTargets map[label.Label]bool
 	if context.FilterIncompatibleTargets {
-		if compatibleTargets, err = findCompatibleTargets(context, targets.String(), true, &normalizer, bazelRelease); err != nil {
+		if compatibleTargets, err = findCompatibleTargetsInChunks(context, chunks, true, &normalizer, bazelRelease); err != nil {
 			return nil, fmt.Errorf("failed to find compatible targets: %w", err)
 		}
 	}
@@ -761,23 +1183,38 @@ func doQueryDeps(context *Context, targets TargetsList) (*QueryResults, error) {
 		compatibleTargetsStrKey[k.String()] = v
 	}
 
-	log.Println("Matching labels to configurations")
+	Progressf("Matching labels to configurations")
 	labels := make([]label.Label, 0)
 	labelsToConfigurations := make(map[label.Label][]Configuration)
+	incompatibleTargets := make(map[label.Label][]Configuration)
+	excludeManualTargets := context.ManualTargets == "exclude-unless-listed"
+	explicitLabels := targets.ExplicitLabels()
+	excludedManualTargets := make(map[label.Label]bool)
 	for _, mt := range matchingTargetResults {
 		l, err := labelOf(mt.Target, &normalizer)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse label returned from query %s: %w", mt.Target, err)
 		}
 		if context.FilterIncompatibleTargets && !compatibleTargetsStrKey[l.String()] {
+			incompatibleTargets[l] = append(incompatibleTargets[l], NormalizeConfiguration(mt.Configuration.Checksum))
 			continue // Ignore incompatible targets
 		}
+		if excludeManualTargets && isManual(mt.Target) && !explicitLabels[l.String()] {
+			excludedManualTargets[l] = true
+			continue
+		}
 		labels = append(labels, l)
 
 		configuration := NormalizeConfiguration(mt.Configuration.Checksum)
 		labelsToConfigurations[l] = append(labelsToConfigurations[l], configuration)
 	}
 
+	enumerateConfigurations(context.ConfigurationEnumeration, labelsToConfigurations, transitiveConfiguredTargets)
+
+	if len(excludedManualTargets) > 0 {
+		Progressf("Excluded %d targets tagged manual which were only matched by wildcards", len(excludedManualTargets))
+	}
+
 	processedLabelsToConfigurations := make(map[label.Label]*ss.SortedSet[Configuration], len(labels))
 	for l, configurations := range labelsToConfigurations {
 		processedLabelsToConfigurations[l] = ss.NewSortedSetFn(configurations, ConfigurationLess)
@@ -793,13 +1230,21 @@ func doQueryDeps(context *Context, targets TargetsList) (*QueryResults, error) {
 		return nil, fmt.Errorf("failed to interpret configurations output: %w", err)
 	}
 
+	targetHashCache := NewTargetHashCache(transitiveConfiguredTargets, &normalizer, bazelRelease)
+	targetHashCache.IgnoreRepositories(context.IgnoredRepositories)
+
 	queryResults := &QueryResults{
 		MatchingTargets:             matchingTargets,
 		TransitiveConfiguredTargets: transitiveConfiguredTargets,
-		TargetHashCache:             NewTargetHashCache(transitiveConfiguredTargets, &normalizer, bazelRelease),
+		TargetHashCache:             targetHashCache,
 		BazelRelease:                bazelRelease,
+		IncompatibleTargets:         incompatibleTargets,
+		DegradedPackages:            degradedPackages.SortedSlice(),
 		QueryError:                  nil,
 		configurations:              configurations,
+		toolchainResolutionChanges:  context.ToolchainResolutionChanges,
+		hashingWorkers:              context.HashingWorkers,
+		targets:                     targets,
 	}
 	return queryResults, nil
 }
@@ -813,8 +1258,8 @@ func sortedStringKeys[V any](m map[label.Label]V) []string {
 	return keys
 }
 
-func runToCqueryResult(context *Context, pattern string, includeTransitions bool, bazelRelease string) ([]*analysis.ConfiguredTarget, error) {
-	log.Printf("Running cquery on %s", pattern)
+func runToCqueryResult(context *Context, pattern string, includeTransitions bool, bazelRelease string) ([]*analysis.ConfiguredTarget, []string, error) {
+	Progressf("Running cquery on %s", pattern)
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
 
@@ -829,6 +1274,17 @@ func runToCqueryResult(context *Context, pattern string, includeTransitions bool
 	if includeTransitions {
 		args = append(args, "--transitions=lite")
 	}
+	var buildEventsPath string
+	if context.KeepGoing {
+		buildEvents, err := os.CreateTemp("", "td-build-events-*.json")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create build events file: %w", err)
+		}
+		buildEvents.Close()
+		buildEventsPath = buildEvents.Name()
+		defer os.Remove(buildEventsPath)
+		args = append(args, "--keep_going", "--build_event_json_file="+buildEventsPath)
+	}
 	args = append(args, pattern)
 
 	returnVal, err := context.BazelCmd.Cquery(
@@ -837,8 +1293,18 @@ func runToCqueryResult(context *Context, pattern string, includeTransitions bool
 		[]string{"--output_base", context.BazelOutputBase},
 		args...)
 
-	if returnVal != 0 || err != nil {
-		return nil, fmt.Errorf("failed to run cquery on %s: %w. Stderr:\n%v", pattern, err, stderr.String())
+	var degradedPackages []string
+	// With --keep_going, Bazel exits with 3 if it only partially succeeded.
+	if context.KeepGoing && returnVal == 3 {
+		degradedPackages, err = failedPackagesFromBuildEvents(buildEventsPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cquery on %s partially failed, but the packages which failed couldn't be identified: %w. Stderr:\n%v", pattern, err, stderr.String())
+		}
+		if len(degradedPackages) == 0 {
+			return nil, nil, fmt.Errorf("cquery on %s partially failed, but the packages which failed couldn't be identified. Stderr:\n%v", pattern, stderr.String())
+		}
+	} else if returnVal != 0 || err != nil {
+		return nil, nil, fmt.Errorf("failed to run cquery on %s: %w. Stderr:\n%v", pattern, err, stderr.String())
 	}
 
 	if useStreamedProto {
@@ -849,22 +1315,22 @@ func runToCqueryResult(context *Context, pattern string, includeTransitions bool
 			if err = unmarshalOpts.UnmarshalFrom(&stdout, &target); err == io.EOF {
 				break
 			} else if err != nil {
-				return nil, fmt.Errorf("failed to unmarshal streamed cquery stdout: %w", err)
+				return nil, nil, fmt.Errorf("failed to unmarshal streamed cquery stdout: %w", err)
 			}
 			targets = append(targets, &target)
 		}
-		return targets, nil
+		return targets, degradedPackages, nil
 	} else {
 		var result analysis.CqueryResult
 		if err = proto.Unmarshal(stdout.Bytes(), &result); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal cquery stdout: %w", err)
+			return nil, nil, fmt.Errorf("failed to unmarshal cquery stdout: %w", err)
 		}
-		return result.GetResults(), nil
+		return result.GetResults(), degradedPackages, nil
 	}
 }
 
 func findCompatibleTargets(context *Context, pattern string, compatibility bool, n *Normalizer, bazelRelease string) (map[label.Label]bool, error) {
-	log.Printf("Finding compatible targets under %s", pattern)
+	Progressf("Finding compatible targets under %s", pattern)
 	compatibleTargets := make(map[label.Label]bool)
 
 	// Add the `or []` to work around https://github.com/bazelbuild/bazel/issues/17749 which was fixed in 6.2.0.
@@ -969,6 +1435,37 @@ func runToLines(workingDirectory string, arg0 string, args ...string) ([]string,
 	return strings.FieldsFunc(stdoutBuf.String(), func(r rune) bool { return r == '\n' }), nil
 }
 
+// isManual returns whether target is a rule tagged "manual".
+func isManual(target *build.Target) bool {
+	for _, attr := range target.GetRule().GetAttribute() {
+		if attr.GetName() != "tags" {
+			continue
+		}
+		for _, tag := range attr.GetStringListValue() {
+			if tag == "manual" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// enumerateConfigurations adds the other configurations each matching target in
+// labelsToConfigurations is configured in, according to configurationEnumeration (see
+// Context.ConfigurationEnumeration), to its top-level configurations.
+func enumerateConfigurations(configurationEnumeration string, labelsToConfigurations map[label.Label][]Configuration, transitiveConfiguredTargets map[label.Label]map[Configuration]*analysis.ConfiguredTarget) {
+	if configurationEnumeration != "include-exec" && configurationEnumeration != "all" {
+		return
+	}
+	for l := range labelsToConfigurations {
+		for configuration, configuredTarget := range transitiveConfiguredTargets[l] {
+			if configurationEnumeration == "all" || configuredTarget.GetConfiguration().GetIsTool() {
+				labelsToConfigurations[l] = append(labelsToConfigurations[l], configuration)
+			}
+		}
+	}
+}
+
 func ParseCqueryResult(targets []*analysis.ConfiguredTarget, n *Normalizer) (map[label.Label]map[Configuration]*analysis.ConfiguredTarget, error) {
 	configuredTargets := make(map[label.Label]map[Configuration]*analysis.ConfiguredTarget, len(targets))
 
@@ -1,9 +1,21 @@
 package pkg
 
 import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/bazel-contrib/target-determinator/common"
+	ss "github.com/bazel-contrib/target-determinator/common/sorted_set"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazelbuild/bazel-gazelle/label"
 )
 
 func Test_stringSliceContainsStartingWith(t *testing.T) {
@@ -98,3 +110,195 @@ func Test_ParseCanonicalLabel(t *testing.T) {
 		}
 	}
 }
+
+// revisionRecordingBazelCmd is a BazelCmd which records the contents of the file "revision" in the
+// directory each command is run in, waits for a command to be run in each of waitFor directories,
+// so that they must be run concurrently, then fails.
+type revisionRecordingBazelCmd struct {
+	waitFor int
+
+	mu        sync.Mutex
+	revisions map[string]string
+	arrived   chan struct{}
+}
+
+func (c *revisionRecordingBazelCmd) Execute(config BazelCmdConfig, startupArgs []string, command string, args ...string) (int, error) {
+	revision, err := os.ReadFile(filepath.Join(config.Dir, "revision"))
+	if err != nil {
+		return 1, err
+	}
+	c.mu.Lock()
+	c.revisions[config.Dir] = strings.TrimSpace(string(revision))
+	if len(c.revisions) == c.waitFor {
+		close(c.arrived)
+	}
+	c.mu.Unlock()
+	select {
+	case <-c.arrived:
+	case <-time.After(30 * time.Second):
+		return 1, fmt.Errorf("timed out waiting for concurrent bazel commands")
+	}
+	return 1, fmt.Errorf("fake bazel")
+}
+
+func (c *revisionRecordingBazelCmd) Cquery(bazelRelease string, config BazelCmdConfig, startupArgs []string, args ...string) (int, error) {
+	return c.Execute(config, startupArgs, "cquery", args...)
+}
+
+// runGit runs git with args in dir, failing the test if it fails, and returns its output.
+func runGit(t *testing.T, dir string, args ...string) string {
+	output, err := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=td", "-c", "user.email=td@example.com"}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to run git %v: %v. Output: %s", args, err, output)
+	}
+	return string(output)
+}
+
+// newGitRepository returns a git repository with a commit for each of commits, which map file names
+// to their new contents, and the revision of the last commit, which is checked out in a detached
+// HEAD, as OriginalRevision is when running on CI.
+func newGitRepository(t *testing.T, commits ...map[string]string) (string, LabelledGitRev) {
+	dir := t.TempDir()
+	runGit(t, dir, "init", "-q")
+	for i, contents := range commits {
+		for file, content := range contents {
+			if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		runGit(t, dir, "add", ".")
+		runGit(t, dir, "commit", "-q", "-m", fmt.Sprintf("commit %d", i))
+	}
+	head, err := GitRevParse(dir, "HEAD", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "checkout", "-q", head)
+	original, err := NewLabelledGitRev(dir, head, "original")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, original
+}
+
+func TestFullyProcessConcurrently(t *testing.T) {
+	dir, original := newGitRepository(t, map[string]string{"revision": "before"}, map[string]string{"revision": "after"}, map[string]string{"revision": "original"})
+	revBefore, err := NewLabelledGitRev(dir, "HEAD~2", "before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revAfter, err := NewLabelledGitRev(dir, "HEAD^", "after")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bazelCmd := &revisionRecordingBazelCmd{waitFor: 2, revisions: make(map[string]string), arrived: make(chan struct{})}
+	context := &Context{
+		WorkspacePath:                dir,
+		OriginalRevision:             original,
+		BazelCmd:                     bazelCmd,
+		BazelOutputBase:              filepath.Join(t.TempDir(), "output_base"),
+		DeleteCachedWorktree:         true,
+		BeforeQueryErrorBehavior:     "fatal",
+		AnalysisCacheClearStrategy:   "skip",
+		WorktreeCacheDir:             t.TempDir(),
+		ProcessRevisionsConcurrently: true,
+		HashingWorkers:               2,
+	}
+	if _, _, err := FullyProcess(context, revBefore, revAfter, TargetsList{}); err == nil || !strings.Contains(err.Error(), "fake bazel") {
+		t.Fatalf("Wrong error: want fake bazel got %v", err)
+	}
+
+	var revisions []string
+	for _, revision := range bazelCmd.revisions {
+		revisions = append(revisions, revision)
+	}
+	sort.Strings(revisions)
+	if want := []string{"after", "before"}; !reflect.DeepEqual(want, revisions) {
+		t.Fatalf("Wrong revisions bazel was run in: want %v got %v", want, revisions)
+	}
+	if _, ok := bazelCmd.revisions[dir]; !ok {
+		t.Fatalf("Wrong directories bazel was run in: want %v to be one of them got %v", dir, bazelCmd.revisions)
+	}
+	head, err := GitRevParse(dir, "HEAD", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != original.GitRevision.Sha {
+		t.Fatalf("Wrong revision checked out after processing: want %v got %v", original.GitRevision.Sha, head)
+	}
+}
+
+func TestEnumerateConfigurations(t *testing.T) {
+	lib := mustParseLabel("//java/example:GreetingLib")
+	const topLevel, exec, transitioned = "aaaa", "bbbb", "cccc"
+	transitiveConfiguredTargets := map[label.Label]map[Configuration]*analysis.ConfiguredTarget{
+		lib: {
+			NormalizeConfiguration(topLevel):     {Configuration: &analysis.Configuration{Checksum: topLevel}},
+			NormalizeConfiguration(exec):         {Configuration: &analysis.Configuration{Checksum: exec, IsTool: true}},
+			NormalizeConfiguration(transitioned): {Configuration: &analysis.Configuration{Checksum: transitioned}},
+		},
+	}
+	for configurationEnumeration, want := range map[string][]string{
+		"":             {topLevel},
+		"top-level":    {topLevel},
+		"include-exec": {topLevel, exec},
+		"all":          {topLevel, exec, transitioned},
+	} {
+		labelsToConfigurations := map[label.Label][]Configuration{lib: {NormalizeConfiguration(topLevel)}}
+		enumerateConfigurations(configurationEnumeration, labelsToConfigurations, transitiveConfiguredTargets)
+		var got []string
+		for _, configuration := range ss.NewSortedSetFn(labelsToConfigurations[lib], ConfigurationLess).SortedSlice() {
+			got = append(got, configuration.String())
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("Wrong configurations with configuration enumeration %q: want %v got %v", configurationEnumeration, want, got)
+		}
+	}
+}
+
+func TestFullyProcessUsesBeforeOutputBase(t *testing.T) {
+	dir, original := newGitRepository(t, map[string]string{"a.txt": "1"}, map[string]string{"a.txt": "2"})
+	revBefore, err := NewLabelledGitRev(dir, "HEAD^", "before")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revAfter, err := NewLabelledGitRev(dir, "", "after")
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err := ParseTargetsList("//...")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name                  string
+		beforeBazelOutputBase string
+		want                  []string
+	}{
+		{name: "shared", beforeBazelOutputBase: "", want: []string{"1 --output_base /output_base", "1 --output_base /output_base", "2 --output_base /output_base", "2 --output_base /output_base"}},
+		{name: "separate", beforeBazelOutputBase: "/before", want: []string{"1 --output_base /before", "1 --output_base /before", "2 --output_base /output_base", "2 --output_base /output_base"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			bazelCmd := &platformSourceFileBazelCmd{sourceFiles: map[string]string{"": "a.txt"}}
+			context := &Context{
+				WorkspacePath:              dir,
+				OriginalRevision:           original,
+				BazelCmd:                   bazelCmd,
+				BazelOutputBase:            "/output_base",
+				BeforeBazelOutputBase:      tc.beforeBazelOutputBase,
+				BeforeQueryErrorBehavior:   "fatal",
+				AnalysisCacheClearStrategy: "skip",
+				WorktreeCacheDir:           t.TempDir(),
+				HashingWorkers:             1,
+			}
+			if _, _, err := FullyProcess(context, revBefore, revAfter, targets); err != nil {
+				t.Fatalf("Error processing revisions: %v", err)
+			}
+			sort.Strings(bazelCmd.startupOptions)
+			if !reflect.DeepEqual(tc.want, bazelCmd.startupOptions) {
+				t.Fatalf("Wrong revisions and startup options of cqueries: want %v got %v", tc.want, bazelCmd.startupOptions)
+			}
+		})
+	}
+}
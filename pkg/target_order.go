@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"sort"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+)
+
+// DirectDependencies returns the labels of the targets configuredTarget directly depends on, as
+// formatted by label.Label.String, so that they can be compared with the labels of affected targets.
+// Rule inputs which can't be parsed are skipped.
+func DirectDependencies(configuredTarget *analysis.ConfiguredTarget) []string {
+	var normalizer Normalizer
+	var dependencies []string
+	for _, ruleInput := range configuredTarget.GetTarget().GetRule().GetRuleInput() {
+		l, err := normalizer.ParseCanonicalLabel(ruleInput)
+		if err != nil {
+			continue
+		}
+		dependencies = append(dependencies, l.String())
+	}
+	return dependencies
+}
+
+// DependencyDistances returns how many dependency edges each affected target is from a target which
+// was changed directly, given the direct dependencies of each affected target (see
+// DirectDependencies). A target none of whose dependencies were affected must itself have changed,
+// so is 0 edges away; otherwise a target is one edge further away than its closest affected
+// dependency. Targets which changed directly and also depend on affected targets are counted as
+// further away than they are, as only the dependency graph, not what changed, is known.
+// Bazel doesn't allow cycles in the configured target graph, but toolchains can make them appear in
+// rule inputs, so targets which depend on each other are treated as one target, and all have the
+// same distance, so that the result doesn't depend on the order targets are visited in.
+func DependencyDistances(dependencies map[string][]string) map[string]int {
+	targets := make([]string, 0, len(dependencies))
+	for target := range dependencies {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	affectedDependencies := func(target string) []string {
+		var affected []string
+		for _, dependency := range dependencies[target] {
+			if _, ok := dependencies[dependency]; ok && dependency != target {
+				affected = append(affected, dependency)
+			}
+		}
+		return affected
+	}
+
+	// Find the strongly connected components of the graph with Tarjan's algorithm, which finds each
+	// component after all of the components it depends on.
+	var components [][]string
+	component := make(map[string]int, len(targets))
+	index := make(map[string]int, len(targets))
+	lowLink := make(map[string]int, len(targets))
+	onStack := make(map[string]bool)
+	var stack []string
+	var connect func(target string)
+	connect = func(target string) {
+		index[target] = len(index)
+		lowLink[target] = index[target]
+		stack = append(stack, target)
+		onStack[target] = true
+		for _, dependency := range affectedDependencies(target) {
+			if _, visited := index[dependency]; !visited {
+				connect(dependency)
+				if lowLink[dependency] < lowLink[target] {
+					lowLink[target] = lowLink[dependency]
+				}
+			} else if onStack[dependency] && index[dependency] < lowLink[target] {
+				lowLink[target] = index[dependency]
+			}
+		}
+		if lowLink[target] != index[target] {
+			return
+		}
+		var members []string
+		for {
+			member := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[member] = false
+			component[member] = len(components)
+			members = append(members, member)
+			if member == target {
+				break
+			}
+		}
+		components = append(components, members)
+	}
+	for _, target := range targets {
+		if _, visited := index[target]; !visited {
+			connect(target)
+		}
+	}
+
+	componentDistances := make([]int, len(components))
+	distances := make(map[string]int, len(targets))
+	for i, members := range components {
+		d := -1
+		for _, member := range members {
+			for _, dependency := range affectedDependencies(member) {
+				if component[dependency] == i {
+					continue
+				}
+				if dependencyDistance := componentDistances[component[dependency]] + 1; d == -1 || dependencyDistance < d {
+					d = dependencyDistance
+				}
+			}
+		}
+		if d == -1 {
+			d = 0
+		}
+		componentDistances[i] = d
+		for _, member := range members {
+			distances[member] = d
+		}
+	}
+	return distances
+}
+
+// SortByDistance sorts labels so that those closest to a directly changed target come first, as
+// they're the most likely to be broken by a change, breaking ties by label. Labels without a
+// distance come last.
+func SortByDistance(labels []string, distances map[string]int) {
+	sort.SliceStable(labels, func(i, j int) bool {
+		return DistanceLess(labels[i], labels[j], distances)
+	})
+}
+
+// DistanceLess is whether a sorts before b in the order of SortByDistance.
+func DistanceLess(a string, b string, distances map[string]int) bool {
+	aDistance, aOk := distances[a]
+	bDistance, bOk := distances[b]
+	if aOk != bOk {
+		return aOk
+	}
+	if aDistance != bDistance {
+		return aDistance < bDistance
+	}
+	return a < b
+}
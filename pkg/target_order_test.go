@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDirectDependencies(t *testing.T) {
+	configuredTarget := &analysis.ConfiguredTarget{
+		Target: &build.Target{
+			Type: build.Target_RULE.Enum(),
+			Rule: &build.Rule{
+				Name:      proto.String("//java/example:GreetingTest"),
+				RuleClass: proto.String("java_test"),
+				RuleInput: []string{"//java/example:GreetingLib", "@//java/example:GreetingTest.java", "@rules_java//toolchains:current_java_runtime"},
+			},
+		},
+	}
+	want := []string{"//java/example:GreetingLib", "//java/example:GreetingTest.java", "@rules_java//toolchains:current_java_runtime"}
+	if got := DirectDependencies(configuredTarget); !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong direct dependencies: want %v got %v", want, got)
+	}
+}
+
+func TestDependencyDistances(t *testing.T) {
+	dependencies := map[string][]string{
+		"//lib:a":      {"//lib:a.go", "//lib:unaffected"},
+		"//lib:b":      {"//lib:a"},
+		"//lib:b_test": {"//lib:b", "//lib:a"},
+		"//app:c":      {"//lib:b"},
+		"//app:c_test": {"//app:c"},
+		"//other:d":    nil,
+		"//lib:a.go":   nil,
+		"//lib:c_test": {"//lib:b_test"},
+	}
+	want := map[string]int{
+		"//lib:a":      1,
+		"//lib:b":      2,
+		"//lib:b_test": 2,
+		"//app:c":      3,
+		"//app:c_test": 4,
+		"//other:d":    0,
+		"//lib:a.go":   0,
+		"//lib:c_test": 3,
+	}
+	if got := DependencyDistances(dependencies); !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong distances: want %v got %v", want, got)
+	}
+}
+
+func TestSortByDistance(t *testing.T) {
+	labels := []string{"//app:c_test", "//unknown:x", "//lib:b_test", "//lib:a_test", "//other:d_test"}
+	SortByDistance(labels, map[string]int{"//app:c_test": 2, "//lib:b_test": 1, "//lib:a_test": 1, "//other:d_test": 0})
+	want := []string{"//other:d_test", "//lib:a_test", "//lib:b_test", "//app:c_test", "//unknown:x"}
+	if !reflect.DeepEqual(want, labels) {
+		t.Fatalf("Wrong order: want %v got %v", want, labels)
+	}
+}
+
+func TestDependencyDistancesWithCycles(t *testing.T) {
+	dependencies := map[string][]string{
+		"//lib:a":      nil,
+		"//cycle:e":    {"//cycle:f", "//cycle:e"},
+		"//cycle:f":    {"//cycle:g"},
+		"//cycle:g":    {"//cycle:e", "//lib:a"},
+		"//app:h":      {"//cycle:f"},
+		"//island:i":   {"//island:j"},
+		"//island:j":   {"//island:i"},
+		"//island:k":   {"//island:i"},
+		"//island:all": {"//island:k", "//lib:a"},
+	}
+	want := map[string]int{
+		"//lib:a":      0,
+		"//cycle:e":    1,
+		"//cycle:f":    1,
+		"//cycle:g":    1,
+		"//app:h":      2,
+		"//island:i":   0,
+		"//island:j":   0,
+		"//island:k":   1,
+		"//island:all": 1,
+	}
+	// Map iteration order varies between runs, so compute the distances repeatedly.
+	for i := 0; i < 20; i++ {
+		if got := DependencyDistances(dependencies); !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong distances with cycles: want %v got %v", want, got)
+		}
+	}
+}
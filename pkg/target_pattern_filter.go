@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// TargetPatternFilter filters labels by an ordered list of target patterns, as Bazel does for the
+// target patterns on its command line: each pattern adds the labels it matches, or removes them if
+// it is prefixed with -.
+type TargetPatternFilter struct {
+	patterns []filterPattern
+}
+
+type filterPattern struct {
+	negative bool
+	// repo and pkg are the repository and package the pattern refers to.
+	repo string
+	pkg  string
+	// recursive is whether the pattern also matches subpackages of pkg (e.g. //foo/...), and
+	// allTargets is whether it matches every target in pkg (e.g. //foo:all). Otherwise it matches the
+	// single target name.
+	recursive  bool
+	allTargets bool
+	name       string
+}
+
+// NewTargetPatternFilter parses patterns, each of which is a label, //pkg:all, //pkg:*,
+// //pkg:all-targets or //pkg/..., optionally prefixed with - to exclude the labels it matches.
+// If the first pattern excludes labels, the remaining labels are all included.
+func NewTargetPatternFilter(patterns []string) (*TargetPatternFilter, error) {
+	filter := &TargetPatternFilter{}
+	for _, pattern := range patterns {
+		var p filterPattern
+		rest := pattern
+		if strings.HasPrefix(rest, "-") {
+			p.negative = true
+			rest = rest[1:]
+		}
+		switch {
+		case rest == "//..." || strings.HasSuffix(rest, "//..."):
+			p.recursive = true
+			rest = strings.TrimSuffix(rest, "...") + ":x"
+		case strings.HasSuffix(rest, "/..."):
+			p.recursive = true
+			rest = strings.TrimSuffix(rest, "/...") + ":x"
+		case strings.HasSuffix(rest, ":all") || strings.HasSuffix(rest, ":*") || strings.HasSuffix(rest, ":all-targets"):
+			p.allTargets = true
+			rest = rest[:strings.LastIndex(rest, ":")] + ":x"
+		}
+		l, err := label.Parse(rest)
+		if err != nil || l.Relative {
+			return nil, fmt.Errorf("failed to parse target pattern %s: must be absolute, e.g. //foo/... or -//foo:bar", pattern)
+		}
+		p.repo = l.Repo
+		p.pkg = l.Pkg
+		p.name = l.Name
+		filter.patterns = append(filter.patterns, p)
+	}
+	return filter, nil
+}
+
+// Matches returns whether l is included by the patterns. A nil filter, or one with no patterns,
+// matches every label.
+func (f *TargetPatternFilter) Matches(l label.Label) bool {
+	if f == nil || len(f.patterns) == 0 {
+		return true
+	}
+	included := f.patterns[0].negative
+	for _, p := range f.patterns {
+		if p.matches(l) {
+			included = !p.negative
+		}
+	}
+	return included
+}
+
+func (p filterPattern) matches(l label.Label) bool {
+	if l.Repo != p.repo {
+		return false
+	}
+	switch {
+	case p.recursive:
+		return p.pkg == "" || l.Pkg == p.pkg || strings.HasPrefix(l.Pkg, p.pkg+"/")
+	case p.allTargets:
+		return l.Pkg == p.pkg
+	}
+	return l.Pkg == p.pkg && l.Name == p.name
+}
+
+// Covers returns whether every label matched by pattern, which is a target pattern as accepted by
+// NewTargetPatternFilter but may not be negative, is also matched by f.
+func (f *TargetPatternFilter) Covers(pattern string) (bool, error) {
+	if strings.HasPrefix(pattern, "-") {
+		return false, fmt.Errorf("can't check whether the negative target pattern %s is covered", pattern)
+	}
+	parsed, err := NewTargetPatternFilter([]string{pattern})
+	if err != nil {
+		return false, err
+	}
+	if f == nil || len(f.patterns) == 0 {
+		return true, nil
+	}
+	q := parsed.patterns[0]
+	covered := f.patterns[0].negative
+	for _, p := range f.patterns {
+		switch {
+		case p.contains(q):
+			covered = !p.negative
+		case p.negative && q.contains(p):
+			// Some, but not all, of the labels matched by q are excluded.
+			covered = false
+		}
+	}
+	return covered, nil
+}
+
+// contains returns whether every label matched by q is matched by p, ignoring whether either is
+// negative.
+func (p filterPattern) contains(q filterPattern) bool {
+	if p.repo != q.repo {
+		return false
+	}
+	switch {
+	case p.recursive:
+		return p.pkg == "" || q.pkg == p.pkg || strings.HasPrefix(q.pkg, p.pkg+"/")
+	case p.allTargets:
+		return !q.recursive && q.pkg == p.pkg
+	}
+	return !q.recursive && !q.allTargets && q.pkg == p.pkg && q.name == p.name
+}
@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestTargetPatternFilter(t *testing.T) {
+	for _, tc := range []struct {
+		patterns []string
+		label    string
+		want     bool
+	}{
+		{nil, "//foo:bar", true},
+		{[]string{"//foo/..."}, "//foo:bar", true},
+		{[]string{"//foo/..."}, "//foo/baz:qux", true},
+		{[]string{"//foo/..."}, "//foobar:baz", false},
+		{[]string{"//..."}, "//foo/baz:qux", true},
+		{[]string{"//..."}, "@other//foo:bar", false},
+		{[]string{"@other//..."}, "@other//foo:bar", true},
+		{[]string{"//foo:all"}, "//foo:bar", true},
+		{[]string{"//foo:*"}, "//foo/baz:qux", false},
+		{[]string{"//foo"}, "//foo:foo", true},
+		{[]string{"//foo"}, "//foo:bar", false},
+		{[]string{"//foo/...", "-//foo/baz/..."}, "//foo/baz:qux", false},
+		{[]string{"//foo/...", "-//foo/baz/..."}, "//foo:bar", true},
+		{[]string{"//foo/...", "-//foo/baz/...", "//foo/baz:qux"}, "//foo/baz:qux", true},
+		{[]string{"-//foo/..."}, "//bar:baz", true},
+		{[]string{"-//foo/..."}, "//foo:bar", false},
+	} {
+		filter, err := NewTargetPatternFilter(tc.patterns)
+		if err != nil {
+			t.Fatalf("Failed to parse %v: %v", tc.patterns, err)
+		}
+		if got := filter.Matches(mustParseLabel(tc.label)); got != tc.want {
+			t.Fatalf("Wrong match of %s by %v: want %v got %v", tc.label, tc.patterns, tc.want, got)
+		}
+	}
+}
+
+func TestTargetPatternFilterRejectsRelativePatterns(t *testing.T) {
+	if _, err := NewTargetPatternFilter([]string{":bar"}); err == nil {
+		t.Fatalf("Expected an error for a relative pattern")
+	}
+}
+
+func TestTargetPatternFilterCovers(t *testing.T) {
+	for _, tc := range []struct {
+		patterns []string
+		pattern  string
+		want     bool
+	}{
+		{nil, "//foo/...", true},
+		{[]string{"//..."}, "//foo/...", true},
+		{[]string{"//..."}, "@other//foo/...", false},
+		{[]string{"//foo/..."}, "//foo/bar/...", true},
+		{[]string{"//foo/..."}, "//foobar/...", false},
+		{[]string{"//foo/bar/..."}, "//foo/...", false},
+		{[]string{"//foo:all"}, "//foo:bar", true},
+		{[]string{"//foo:all"}, "//foo/...", false},
+		{[]string{"//foo:bar"}, "//foo:all", false},
+		{[]string{"//...", "-//foo/bar/..."}, "//foo/...", false},
+		{[]string{"//...", "-//foo/bar/..."}, "//baz/...", true},
+		{[]string{"//...", "-//foo/...", "//foo/bar/..."}, "//foo/bar:all", true},
+		{[]string{"-//foo/..."}, "//bar/...", true},
+		{[]string{"-//foo/..."}, "//foo:bar", false},
+	} {
+		filter, err := NewTargetPatternFilter(tc.patterns)
+		if err != nil {
+			t.Fatalf("Failed to parse %v: %v", tc.patterns, err)
+		}
+		got, err := filter.Covers(tc.pattern)
+		if err != nil {
+			t.Fatalf("Failed to check whether %v covers %s: %v", tc.patterns, tc.pattern, err)
+		}
+		if got != tc.want {
+			t.Fatalf("Wrong coverage of %s by %v: want %v got %v", tc.pattern, tc.patterns, tc.want, got)
+		}
+	}
+}
@@ -1,5 +1,12 @@
 package pkg
 
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bazelbuild/bazel-gazelle/label"
+)
+
 type TargetsList struct {
 	targets string
 }
@@ -12,3 +19,65 @@ func ParseTargetsList(targets string) (TargetsList, error) {
 func (tl *TargetsList) String() string {
 	return tl.targets
 }
+
+// PatternFilter returns a filter matching the same labels as the targets, if they are a sequence of
+// target patterns combined with + (or union), - (or except) and whitespace, e.g.
+// `//foo/... - //foo/bar:all`. Other query expressions, e.g. `deps(//foo)`, return an error, as the
+// labels they match can't be known without running a query.
+func (tl *TargetsList) PatternFilter() (*TargetPatternFilter, error) {
+	var patterns []string
+	negative := false
+	for _, word := range strings.Fields(tl.targets) {
+		switch word {
+		case "+", "union":
+			negative = false
+			continue
+		case "-", "except":
+			negative = true
+			continue
+		}
+		pattern := strings.Trim(word, `"'`)
+		for _, suffix := range []string{"...:all-targets", "...:all", "...:*"} {
+			if strings.HasSuffix(pattern, suffix) {
+				pattern = strings.TrimSuffix(pattern, suffix) + "..."
+			}
+		}
+		if negative {
+			pattern = "-" + pattern
+		}
+		patterns = append(patterns, pattern)
+		negative = false
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("targets %q contain no target patterns", tl.targets)
+	}
+	filter, err := NewTargetPatternFilter(patterns)
+	if err != nil {
+		return nil, fmt.Errorf("targets %q aren't only target patterns: %w", tl.targets, err)
+	}
+	return filter, nil
+}
+
+// ExplicitLabels returns the labels which are listed individually in the targets, rather than
+// being matched by a wildcard such as `//...` or `//foo:all`, formatted with label.Label.String.
+func (tl *TargetsList) ExplicitLabels() map[string]bool {
+	explicit := make(map[string]bool)
+	words := strings.FieldsFunc(tl.targets, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '(' || r == ')' || r == ',' || r == '+' || r == '^'
+	})
+	for _, word := range words {
+		word = strings.Trim(word, `"'`)
+		if strings.HasSuffix(word, "...") || strings.HasSuffix(word, ":all") || strings.HasSuffix(word, ":*") || strings.HasSuffix(word, ":all-targets") {
+			continue
+		}
+		if !strings.Contains(word, "//") && !strings.HasPrefix(word, ":") {
+			continue
+		}
+		l, err := label.Parse(word)
+		if err != nil {
+			continue
+		}
+		explicit[l.String()] = true
+	}
+	return explicit
+}
@@ -0,0 +1,49 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExplicitLabels(t *testing.T) {
+	for targets, want := range map[string]map[string]bool{
+		"//...":                       {},
+		"//java/...:all + //foo:*":    {},
+		"//java/example:GreetingLib":  {"//java/example:GreetingLib": true},
+		"//foo //bar:baz - //foo/...": {"//foo": true, "//bar:baz": true},
+		"set(//foo:bar, //baz:all)":   {"//foo:bar": true},
+		"kind(java_library, //...)":   {},
+		"//foo:bar^//foo:all-targets": {"//foo:bar": true},
+	} {
+		if got := (&TargetsList{targets: targets}).ExplicitLabels(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("Wrong explicit labels for %q: want %v got %v", targets, want, got)
+		}
+	}
+}
+
+func TestPatternFilter(t *testing.T) {
+	for targets, want := range map[string]map[string]bool{
+		"//...":                         {"//foo:bar": true, "@other//foo:bar": false},
+		"//java/...:all + //go:*":       {"//java/example:lib": true, "//go:lib": true, "//go/example:lib": false},
+		"//foo/... - //foo/bar/...":     {"//foo:baz": true, "//foo/bar:baz": false},
+		"//foo/... except //foo:bar":    {"//foo:baz": true, "//foo:bar": false},
+		"'//foo:bar' union '//foo:baz'": {"//foo:bar": true, "//foo:baz": true, "//foo:qux": false},
+	} {
+		tl := &TargetsList{targets: targets}
+		filter, err := tl.PatternFilter()
+		if err != nil {
+			t.Fatalf("Failed to get pattern filter for %q: %v", targets, err)
+		}
+		for l, wantMatch := range want {
+			if got := filter.Matches(mustParseLabel(l)); got != wantMatch {
+				t.Fatalf("Wrong match of %s by %q: want %v got %v", l, targets, wantMatch, got)
+			}
+		}
+	}
+	for _, targets := range []string{"deps(//foo)", "kind(java_library, //...)", ""} {
+		tl := &TargetsList{targets: targets}
+		if _, err := tl.PatternFilter(); err == nil {
+			t.Fatalf("Expected an error getting a pattern filter for %q", targets)
+		}
+	}
+}
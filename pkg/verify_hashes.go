@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// HashMismatch is a target whose hash in a configuration, as recomputed by VerifyPersistedHashes,
+// differs from the one stored in a hash file.
+type HashMismatch struct {
+	Label         string
+	Configuration string
+	// Stored is the hash in the hash file, or "" if the target wasn't in Configuration there.
+	Stored string
+	// Recomputed is the recomputed hash, or "" if the target is no longer in Configuration.
+	Recomputed string
+}
+
+func (m HashMismatch) String() string {
+	configuration := m.Configuration
+	if configuration == "" {
+		configuration = "<none>"
+	}
+	switch {
+	case m.Stored == "":
+		return fmt.Sprintf("%s in configuration %s: not stored, recomputed as %s", m.Label, configuration, m.Recomputed)
+	case m.Recomputed == "":
+		return fmt.Sprintf("%s in configuration %s: stored as %s, no longer recomputed", m.Label, configuration, m.Stored)
+	default:
+		return fmt.Sprintf("%s in configuration %s: stored as %s, recomputed as %s", m.Label, configuration, m.Stored, m.Recomputed)
+	}
+}
+
+// VerifyPersistedHashes recomputes the hashes of the targets in the current working directory
+// state and returns those which differ from the ones stored in the hash file at path, sorted by
+// label and configuration. The hash file must have been computed at the current commit, with the
+// same hash function and configuration enumeration, and should have been computed for the same
+// targets, otherwise targets only in one of them are reported as mismatches.
+// Mismatches mean hashing is nondeterministic, e.g. because a rule's attributes depend on the
+// machine it is evaluated on, so that hash files can't be trusted as the before revision.
+func VerifyPersistedHashes(context *Context, path string, targets TargetsList) ([]HashMismatch, error) {
+	stored, err := LoadVerifiedPersistedHashes(path, context.PersistedHashConflictPolicy, context.HashesVerifyKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rev, err := NewLabelledGitRev(context.WorkspacePath, "", "current")
+	if err != nil {
+		return nil, fmt.Errorf("could not create \"current\" revision: %w", err)
+	}
+	Progressf("Processing %s", rev)
+	queryInfo, err := fullyProcessRevision(context, rev, targets)
+	if err != nil {
+		return nil, err
+	}
+	endProcessingPhase(context, "process-current", context)
+	recomputed, err := NewPersistedHashData(context, rev, queryInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect hashes of %s: %w", rev, err)
+	}
+
+	if err := checkVerifiable(stored, recomputed); err != nil {
+		return nil, fmt.Errorf("can't verify hashes from %s: %w", path, err)
+	}
+	if stored.Dirty || recomputed.Dirty {
+		log.Printf("WARN: Hashes from %s or of the current working directory state were computed with local changes (stored: %v, current: %v), which may cause mismatches", path, stored.Dirty, recomputed.Dirty)
+	}
+	return CompareHashes(stored, recomputed), nil
+}
+
+// checkVerifiable returns an error if the hashes in stored weren't computed in a way which makes
+// them comparable with recomputed.
+func checkVerifiable(stored *PersistedHashData, recomputed *PersistedHashData) error {
+	if stored.Revision != recomputed.Revision {
+		return fmt.Errorf("they were computed at %s, but the current commit is %s", stored.Revision, recomputed.Revision)
+	}
+	if got, want := stored.EffectiveHashFunction(), recomputed.EffectiveHashFunction(); got != want {
+		return fmt.Errorf("they were computed with hash function %s rather than %s", got, want)
+	}
+	if got, want := configurationEnumerationOrDefault(stored.ConfigurationEnumeration), configurationEnumerationOrDefault(recomputed.ConfigurationEnumeration); got != want {
+		return fmt.Errorf("they were computed with configuration enumeration %s rather than %s", got, want)
+	}
+	return nil
+}
+
+// CompareHashes returns each target whose hash in a configuration differs between stored and
+// recomputed, or which only has a hash in that configuration in one of them, sorted by label and
+// configuration.
+func CompareHashes(stored *PersistedHashData, recomputed *PersistedHashData) []HashMismatch {
+	var mismatches []HashMismatch
+	for labelString, storedHashes := range stored.Hashes {
+		recomputedHashes := recomputed.Hashes[labelString]
+		for configuration, storedHash := range storedHashes {
+			if recomputedHash := recomputedHashes[configuration]; recomputedHash != storedHash {
+				mismatches = append(mismatches, HashMismatch{Label: labelString, Configuration: configuration, Stored: storedHash, Recomputed: recomputedHash})
+			}
+		}
+	}
+	for labelString, recomputedHashes := range recomputed.Hashes {
+		storedHashes := stored.Hashes[labelString]
+		for configuration, recomputedHash := range recomputedHashes {
+			if _, ok := storedHashes[configuration]; !ok {
+				mismatches = append(mismatches, HashMismatch{Label: labelString, Configuration: configuration, Recomputed: recomputedHash})
+			}
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool {
+		if mismatches[i].Label != mismatches[j].Label {
+			return mismatches[i].Label < mismatches[j].Label
+		}
+		return mismatches[i].Configuration < mismatches[j].Configuration
+	})
+	return mismatches
+}
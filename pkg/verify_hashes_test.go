@@ -0,0 +1,64 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompareHashes(t *testing.T) {
+	stored := &PersistedHashData{
+		Revision: "abc",
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib":  {"cfg": "aa", "exec": "bb"},
+			"//java/example:GreetingTest": {"cfg": "cc"},
+			"//java/example:Removed":      {"cfg": "dd"},
+		},
+	}
+	recomputed := &PersistedHashData{
+		Revision: "abc",
+		Hashes: map[string]map[string]string{
+			"//java/example:GreetingLib":  {"cfg": "aa", "exec": "bc"},
+			"//java/example:GreetingTest": {"cfg": "cc"},
+			"//go/example:lib_test":       {"": "ee"},
+		},
+	}
+	want := []HashMismatch{
+		{Label: "//go/example:lib_test", Configuration: "", Recomputed: "ee"},
+		{Label: "//java/example:GreetingLib", Configuration: "exec", Stored: "bb", Recomputed: "bc"},
+		{Label: "//java/example:Removed", Configuration: "cfg", Stored: "dd"},
+	}
+	got := CompareHashes(stored, recomputed)
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("Wrong mismatches: want %v got %v", want, got)
+	}
+	wantStrings := []string{
+		"//go/example:lib_test in configuration <none>: not stored, recomputed as ee",
+		"//java/example:GreetingLib in configuration exec: stored as bb, recomputed as bc",
+		"//java/example:Removed in configuration cfg: stored as dd, no longer recomputed",
+	}
+	for i, mismatch := range got {
+		if mismatch.String() != wantStrings[i] {
+			t.Fatalf("Wrong mismatch description: want %q got %q", wantStrings[i], mismatch.String())
+		}
+	}
+
+	if got := CompareHashes(stored, stored); len(got) != 0 {
+		t.Fatalf("Wrong mismatches comparing hashes with themselves: want none got %v", got)
+	}
+}
+
+func TestCheckVerifiable(t *testing.T) {
+	current := &PersistedHashData{Revision: "abc", HashFunction: PersistedHashFunction}
+	for name, stored := range map[string]*PersistedHashData{
+		"different revision":                  {Revision: "def", HashFunction: PersistedHashFunction},
+		"different hash function":             {Revision: "abc", HashFunction: "sha256-v0"},
+		"different configuration enumeration": {Revision: "abc", ConfigurationEnumeration: "all"},
+	} {
+		if err := checkVerifiable(stored, current); err == nil {
+			t.Fatalf("Wrong result verifying hashes with %s: want error got nil", name)
+		}
+	}
+	if err := checkVerifiable(&PersistedHashData{Revision: "abc"}, current); err != nil {
+		t.Fatalf("Wrong result verifying hashes computed the same way: want nil got %v", err)
+	}
+}
@@ -2,6 +2,8 @@ package pkg
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 
@@ -14,7 +16,9 @@ type WalkCallback func(label.Label, []Difference, *analysis.ConfiguredTarget)
 // WalkAffectedTargets computes which targets have changed between two commits, and calls
 // callback once for each target which has changed.
 // Explanation of the differences may be expensive in both time and memory to compute, so if
-// includeDifferences is set to false, the []Difference parameter to the callback will always be nil.
+// includeDifferences is set to false, the []Difference parameter to the callback will be nil, except
+// that it contains a ToolchainResolutionChanged difference for targets only affected by toolchain
+// resolution changes if Context.ToolchainResolutionChanges is "report".
 func WalkAffectedTargets(context *Context, revBefore LabelledGitRev, targets TargetsList, includeDifferences bool, callback WalkCallback) error {
 	// The revAfter revision represents the current state of the working directory, which may contain local changes.
 	// It is distinct from context.OriginalRevision, which represents the original commit that we want to reset to before exiting.
@@ -28,16 +32,94 @@ func WalkAffectedTargets(context *Context, revBefore LabelledGitRev, targets Tar
 		return fmt.Errorf("failed to process change: %w", err)
 	}
 
+	if err := writeHashOutputs(context, revBefore, beforeMetadata, revAfter, afterMetadata); err != nil {
+		return err
+	}
+	return walkAffectedTargetsBetween(context, revBefore, beforeMetadata, afterMetadata, includeDifferences, callback)
+}
+
+// walkAffectedTargetsBetween calls callback once for each target which has changed between
+// beforeMetadata and afterMetadata.
+func walkAffectedTargetsBetween(context *Context, revBefore LabelledGitRev, beforeMetadata, afterMetadata *QueryResults, includeDifferences bool, callback WalkCallback) error {
 	if beforeMetadata.BazelRelease == afterMetadata.BazelRelease && beforeMetadata.BazelRelease == "development version" {
 		log.Printf("WARN: Bazel was detected to be a development version - if you're using different development versions at the before and after commits, differences between those versions may not be reflected in this output")
 	}
 
+	policies := preciseInfraFilePolicies(context)
+	callback = excludingSubtrees(ExcludedSubtrees(policies), callback)
+
+	reported := make(map[label.Label]bool)
+	reportingCallback := func(l label.Label, differences []Difference, configuredTarget *analysis.ConfiguredTarget) {
+		reported[l] = true
+		callback(l, differences, configuredTarget)
+	}
 	for _, l := range afterMetadata.MatchingTargets.Labels() {
-		if err := DiffSingleLabel(beforeMetadata, afterMetadata, includeDifferences, l, callback); err != nil {
+		if err := DiffSingleLabel(beforeMetadata, afterMetadata, includeDifferences, l, reportingCallback); err != nil {
 			return err
 		}
 	}
 
+	if len(policies) > 0 {
+		if err := walkInfraFileAffectedTargets(context, policies, revBefore, afterMetadata, includeDifferences, reported, callback); err != nil {
+			return err
+		}
+	}
+
+	// Targets in packages which failed to load or analyze are unknown, so the whole package is
+	// reported as affected.
+	if err := recordDegradedPackages(context, afterMetadata); err != nil {
+		return err
+	}
+
+	// Targets which became incompatible don't need to be built, but may be of interest.
+	for _, l := range beforeMetadata.MatchingTargets.Labels() {
+		if _, ok := afterMetadata.IncompatibleTargets[l]; ok {
+			Progressf("Target %s became incompatible", l)
+		}
+	}
+
+	return nil
+}
+
+// walkInfraFileAffectedTargets calls callback for each matching target in afterMetadata which
+// hasn't already been reported, but which policies consider affected by the files changed since
+// revBefore.
+func walkInfraFileAffectedTargets(context *Context, policies []InfraFilePolicy, revBefore LabelledGitRev, afterMetadata *QueryResults, includeDifferences bool, reported map[label.Label]bool, callback WalkCallback) error {
+	changedFiles, err := ChangedFilesSince(context.WorkspacePath, revBefore)
+	if err != nil {
+		return err
+	}
+	effect, err := ApplyInfraFilePolicies(policies, changedFiles)
+	if err != nil {
+		return err
+	}
+	labels := effect.Targets
+	if effect.AllAffectedBecause != "" {
+		Progressf("Considering all targets affected because %s changed", effect.AllAffectedBecause)
+		labels = afterMetadata.MatchingTargets.Labels()
+	} else if len(effect.Subtrees) > 0 {
+		for _, l := range afterMetadata.MatchingTargets.Labels() {
+			for _, subtree := range effect.Subtrees {
+				if isInSubtree(l, subtree) {
+					labels = append(labels, l)
+					break
+				}
+			}
+		}
+	}
+	for _, l := range labels {
+		if reported[l] {
+			continue
+		}
+		reported[l] = true
+		for _, configuration := range afterMetadata.MatchingTargets.ConfigurationsFor(l) {
+			var differences []Difference
+			if includeDifferences {
+				differences = append(differences, Difference{Category: "InfraFileChanged"})
+			}
+			callback(l, differences, afterMetadata.TransitiveConfiguredTargets[l][configuration])
+		}
+	}
 	return nil
 }
 
@@ -55,8 +137,12 @@ func DiffSingleLabel(beforeMetadata, afterMetadata *QueryResults, includeDiffere
 
 		if len(beforeMetadata.MatchingTargets.ConfigurationsFor(label)) == 0 {
 			category := "NewLabel"
-			if beforeMetadata.QueryError != nil {
+			if errors.Is(beforeMetadata.QueryError, ErrStaleBeforeRevision) {
+				category = "StaleBeforeRevision"
+			} else if beforeMetadata.QueryError != nil {
 				category = "ErrorInQueryBefore"
+			} else if _, ok := beforeMetadata.IncompatibleTargets[label]; ok {
+				category = "BecameCompatible"
 			}
 			collectDifference(Difference{
 				Category: category,
@@ -105,14 +191,51 @@ func DiffSingleLabel(beforeMetadata, afterMetadata *QueryResults, includeDiffere
 			if bytes.Equal(hashBefore, hashAfter) {
 				continue
 			}
-			if includeDifferences {
-				differences, err = WalkDiffs(beforeMetadata.TargetHashCache, afterMetadata.TargetHashCache, labelAndConfiguration)
+			onlyToolchainResolutionChanged := false
+			if afterMetadata.tracksToolchainResolutionChanges() && beforeMetadata.tracksToolchainResolutionChanges() {
+				onlyToolchainResolutionChanged, err = isOnlyToolchainResolutionChange(beforeMetadata, afterMetadata, labelAndConfiguration)
 				if err != nil {
 					return err
 				}
 			}
+			if onlyToolchainResolutionChanged {
+				if afterMetadata.toolchainResolutionChanges == "exclude" {
+					continue
+				}
+				// This is always included, as it's cheap to compute, and otherwise "report" would be
+				// indistinguishable from "include" without differences.
+				differences = append(differences, Difference{Category: "ToolchainResolutionChanged"})
+			}
+			if includeDifferences && beforeMetadata.fromPersistedHashes {
+				// We only have a hash for the "before" revision, so can't explain what changed.
+				differences = append(differences, Difference{
+					Category: "HashChanged",
+					Before:   hex.EncodeToString(hashBefore),
+					After:    hex.EncodeToString(hashAfter),
+				})
+			} else if includeDifferences {
+				walkedDifferences, err := WalkDiffs(beforeMetadata.TargetHashCache, afterMetadata.TargetHashCache, labelAndConfiguration)
+				if err != nil {
+					return err
+				}
+				differences = append(differences, walkedDifferences...)
+			}
 			callback(label, differences, configuredTarget)
 		}
 	}
 	return nil
 }
+
+// isOnlyToolchainResolutionChange returns whether a target whose hash changed would have been
+// unchanged if targets taking part in toolchain resolution were ignored.
+func isOnlyToolchainResolutionChange(beforeMetadata, afterMetadata *QueryResults, labelAndConfiguration LabelAndConfiguration) (bool, error) {
+	hashBefore, err := beforeMetadata.TargetHashCache.HashIgnoringToolchainResolution(labelAndConfiguration)
+	if err != nil {
+		return false, err
+	}
+	hashAfter, err := afterMetadata.TargetHashCache.HashIgnoringToolchainResolution(labelAndConfiguration)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(hashBefore, hashAfter), nil
+}
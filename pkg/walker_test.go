@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	ss "github.com/bazel-contrib/target-determinator/common/sorted_set"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"google.golang.org/protobuf/proto"
+)
+
+// queryResultsFor returns QueryResults for cqueryResult, in which only //HelloWorld:HelloWorld
+// matched the query.
+func queryResultsFor(t *testing.T, cqueryResult *analysis.CqueryResult, toolchainResolutionChanges string) *QueryResults {
+	n := Normalizer{}
+	transitiveConfiguredTargets, err := ParseCqueryResult(cqueryResult.Results, &n)
+	if err != nil {
+		t.Fatalf("Failed to parse cquery result: %v", err)
+	}
+	helloWorld := mustParseLabel("//HelloWorld:HelloWorld")
+	return &QueryResults{
+		MatchingTargets: &MatchingTargets{
+			labels: ss.NewSortedSetFn([]label.Label{helloWorld}, CompareLabels),
+			labelsToConfigurations: map[label.Label]*ss.SortedSet[Configuration]{
+				helloWorld: ss.NewSortedSetFn([]Configuration{NormalizeConfiguration(configurationChecksum)}, ConfigurationLess),
+			},
+		},
+		TransitiveConfiguredTargets: transitiveConfiguredTargets,
+		TargetHashCache:             NewTargetHashCache(transitiveConfiguredTargets, &n, "release 5.1.1"),
+		BazelRelease:                "release 5.1.1",
+		toolchainResolutionChanges:  toolchainResolutionChanges,
+	}
+}
+
+// withRuleInput adds a rule of ruleClass, with a single string attribute set to value, as an input
+// of //HelloWorld:GreetingLib.
+func withRuleInput(t *testing.T, ruleClass string, value string) *analysis.CqueryResult {
+	_, cqueryResult := layoutProject(t)
+	name := "//HelloWorld:" + ruleClass
+	greetingLib := cqueryResult.Results[1].GetTarget().GetRule()
+	greetingLib.RuleInput = append(greetingLib.RuleInput, name)
+	cqueryResult.Results = append(cqueryResult.Results, &analysis.ConfiguredTarget{
+		Target: &build.Target{
+			Type: build.Target_RULE.Enum(),
+			Rule: &build.Rule{
+				Name:      proto.String(name),
+				RuleClass: proto.String(ruleClass),
+				Attribute: []*build.Attribute{
+					{
+						Name:        proto.String("value"),
+						Type:        build.Attribute_STRING.Enum(),
+						StringValue: proto.String(value),
+					},
+				},
+			},
+		},
+		Configuration: cqueryResult.Results[0].Configuration,
+	})
+	return cqueryResult
+}
+
+func TestDiffSingleLabelToolchainResolutionChanges(t *testing.T) {
+	helloWorld := mustParseLabel("//HelloWorld:HelloWorld")
+	for name, tc := range map[string]struct {
+		ruleClass                  string
+		toolchainResolutionChanges string
+		// want is the differences reported for //HelloWorld:HelloWorld, or nil if it's not reported.
+		want []string
+	}{
+		"config_setting include": {ruleClass: "config_setting", toolchainResolutionChanges: "include", want: []string{}},
+		"config_setting report":  {ruleClass: "config_setting", toolchainResolutionChanges: "report", want: []string{"ToolchainResolutionChanged"}},
+		"config_setting exclude": {ruleClass: "config_setting", toolchainResolutionChanges: "exclude"},
+		"toolchain report":       {ruleClass: "toolchain", toolchainResolutionChanges: "report", want: []string{}},
+		"toolchain exclude":      {ruleClass: "toolchain", toolchainResolutionChanges: "exclude", want: []string{}},
+	} {
+		before := queryResultsFor(t, withRuleInput(t, tc.ruleClass, "before"), tc.toolchainResolutionChanges)
+		after := queryResultsFor(t, withRuleInput(t, tc.ruleClass, "after"), tc.toolchainResolutionChanges)
+		var got []string
+		err := DiffSingleLabel(before, after, false, helloWorld, func(l label.Label, differences []Difference, _ *analysis.ConfiguredTarget) {
+			got = []string{}
+			for _, difference := range differences {
+				got = append(got, difference.Category)
+			}
+		})
+		if err != nil {
+			t.Fatalf("Error diffing %s: %v", name, err)
+		}
+		if !reflect.DeepEqual(tc.want, got) {
+			t.Fatalf("Wrong differences %s: want %v got %v", name, tc.want, got)
+		}
+	}
+}
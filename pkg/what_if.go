@@ -0,0 +1,49 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WalkTargetsAffectedByBazelOpts computes which targets in the current working directory state
+// would be affected if extraBazelOpts (e.g. --define=FOO=1) were passed to Bazel, and calls callback
+// once for each target which would be. This estimates the cost of a configuration change, e.g. to
+// .bazelrc, before making it.
+// The matching targets are processed twice, with and without extraBazelOpts, so the cost is roughly
+// that of WalkAffectedTargets. Targets are compared as if the processing without extraBazelOpts was
+// the before revision, so options which change the configuration of a target report it as
+// affected, as Bazel would rebuild it.
+func WalkTargetsAffectedByBazelOpts(context *Context, extraBazelOpts []string, targets TargetsList, includeDifferences bool, callback WalkCallback) error {
+	rev, err := NewLabelledGitRev(context.WorkspacePath, "", "current")
+	if err != nil {
+		return fmt.Errorf("could not create \"current\" revision: %w", err)
+	}
+
+	Progressf("Processing %s", rev)
+	current, err := fullyProcessRevision(context, rev, targets)
+	if err != nil {
+		return err
+	}
+	endProcessingPhase(context, "process-current", context)
+
+	hypotheticalContext := *context
+	hypotheticalContext.BazelCmd = WithExtraBazelOpts(context.BazelCmd, extraBazelOpts...)
+	Progressf("Processing %s with %s", rev, strings.Join(extraBazelOpts, " "))
+	hypothetical, err := fullyProcessRevision(&hypotheticalContext, rev, targets)
+	if err != nil {
+		return fmt.Errorf("failed to process %s with %s: %w", rev, strings.Join(extraBazelOpts, " "), err)
+	}
+	endProcessingPhase(context, "process-hypothetical", &hypotheticalContext)
+
+	for _, l := range hypothetical.MatchingTargets.Labels() {
+		if err := DiffSingleLabel(current, hypothetical, includeDifferences, l, callback); err != nil {
+			return err
+		}
+	}
+	for _, l := range current.MatchingTargets.Labels() {
+		if _, ok := hypothetical.IncompatibleTargets[l]; ok {
+			Progressf("Target %s would become incompatible", l)
+		}
+	}
+	return recordDegradedPackages(context, hypothetical)
+}
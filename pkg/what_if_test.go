@@ -0,0 +1,114 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	"github.com/bazelbuild/bazel-gazelle/label"
+	"google.golang.org/protobuf/proto"
+)
+
+// optionsBazelCmd is a BazelCmd whose cquery results are source files, configured as
+// configurations[file], or as configurationsWithOption[file] if option was passed, and which
+// records whether option was passed to each cquery.
+type optionsBazelCmd struct {
+	option                   string
+	configurations           map[string]string
+	configurationsWithOption map[string]string
+	cqueries                 []string
+}
+
+func (c *optionsBazelCmd) Execute(config BazelCmdConfig, startupArgs []string, command string, args ...string) (int, error) {
+	switch command {
+	case "info":
+		if args[0] == "release" {
+			fmt.Fprintln(config.Stdout, "release 6.5.0")
+		}
+		return 0, nil
+	case "config":
+		fmt.Fprintln(config.Stdout, "[]")
+		return 0, nil
+	}
+	return 1, fmt.Errorf("unexpected bazel %s %v", command, args)
+}
+
+func (c *optionsBazelCmd) Cquery(bazelRelease string, config BazelCmdConfig, startupArgs []string, args ...string) (int, error) {
+	configurations := c.configurations
+	c.cqueries = append(c.cqueries, "without "+c.option)
+	for _, arg := range args {
+		if arg == c.option {
+			configurations = c.configurationsWithOption
+			c.cqueries[len(c.cqueries)-1] = "with " + c.option
+		}
+	}
+	var results []*analysis.ConfiguredTarget
+	for sourceFile, configuration := range configurations {
+		results = append(results, &analysis.ConfiguredTarget{
+			Target: &build.Target{
+				Type: build.Target_SOURCE_FILE.Enum(),
+				SourceFile: &build.SourceFile{
+					Name:     proto.String("//:" + sourceFile),
+					Location: proto.String(fmt.Sprintf("%s/BUILD.bazel:1:1", config.Dir)),
+				},
+			},
+			Configuration: &analysis.Configuration{Checksum: configuration},
+		})
+	}
+	result, err := proto.Marshal(&analysis.CqueryResult{Results: results})
+	if err != nil {
+		return 1, err
+	}
+	_, err = bytes.NewReader(result).WriteTo(config.Stdout)
+	return 0, err
+}
+
+func TestWalkTargetsAffectedByBazelOpts(t *testing.T) {
+	dir, original := newGitRepository(t, map[string]string{"a.txt": "1", "b.txt": "1", "c.txt": "1"})
+	targets, err := ParseTargetsList("//...")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bazelCmd := &optionsBazelCmd{
+		option:                   "--define=FOO=1",
+		configurations:           map[string]string{"a.txt": "default", "b.txt": "default"},
+		configurationsWithOption: map[string]string{"a.txt": "foo", "b.txt": "default", "c.txt": "foo"},
+	}
+	context := &Context{
+		WorkspacePath:              dir,
+		OriginalRevision:           original,
+		BazelCmd:                   bazelCmd,
+		BazelOutputBase:            filepath.Join(t.TempDir(), "output_base"),
+		BeforeQueryErrorBehavior:   "fatal",
+		AnalysisCacheClearStrategy: "skip",
+		WorktreeCacheDir:           t.TempDir(),
+		HashingWorkers:             1,
+	}
+	var affected []string
+	if err := WalkTargetsAffectedByBazelOpts(context, []string{"--define=FOO=1"}, targets, false, func(l label.Label, _ []Difference, _ *analysis.ConfiguredTarget) {
+		affected = append(affected, l.String())
+	}); err != nil {
+		t.Fatalf("Error walking targets affected by Bazel options: %v", err)
+	}
+	sort.Strings(affected)
+
+	// a.txt is configured differently with the option, and c.txt only exists with it.
+	if want := []string{"//:a.txt", "//:c.txt"}; !reflect.DeepEqual(want, affected) {
+		t.Fatalf("Wrong affected targets: want %v got %v", want, affected)
+	}
+	withOption := 0
+	for _, cquery := range bazelCmd.cqueries {
+		if cquery == "with --define=FOO=1" {
+			withOption++
+		}
+	}
+	if withOption == 0 || 2*withOption != len(bazelCmd.cqueries) {
+		t.Fatalf("Wrong cqueries: want as many with the option as without it, got %v", bazelCmd.cqueries)
+	}
+}
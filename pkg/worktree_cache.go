@@ -0,0 +1,154 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const worktreeDirPrefix = "td-worktree-"
+
+// DefaultWorktreeCacheDir is the directory git worktrees are created in if
+// Context.WorktreeCacheDir isn't set.
+func DefaultWorktreeCacheDir() (string, error) {
+	currentUser, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine current user: %w", err)
+	}
+	return filepath.Join(currentUser.HomeDir, ".cache", "target-determinator"), nil
+}
+
+func worktreeCacheDir(context *Context) (string, error) {
+	if context.WorktreeCacheDir != "" {
+		return context.WorktreeCacheDir, nil
+	}
+	return DefaultWorktreeCacheDir()
+}
+
+// lockWorktree marks the worktree at worktreeDirPath as in use by this process, so that
+// CleanWorktreeCache won't remove it. It should be released with unlockWorktree.
+func lockWorktree(worktreeDirPath string) error {
+	lockPath := worktreeDirPath + ".lock"
+	if err := os.WriteFile(lockPath, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+		return fmt.Errorf("failed to write worktree lock file %v: %w", lockPath, err)
+	}
+	return nil
+}
+
+func unlockWorktree(worktreeDirPath string) {
+	lockPath := worktreeDirPath + ".lock"
+	if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+		log.Printf("WARN: Failed to remove worktree lock file %v: %v", lockPath, err)
+	}
+}
+
+// ensureSpaceForWorktree returns an error if there clearly isn't enough free disk space in cacheDir
+// to check out rev from the repository in workingDirectory.
+// If either the required or available space can't be determined, the check is skipped.
+func ensureSpaceForWorktree(workingDirectory string, cacheDir string, rev string) error {
+	required, err := checkoutSize(workingDirectory, rev)
+	if err != nil {
+		log.Printf("WARN: Couldn't estimate the size of a worktree for %v, not checking free disk space: %v", rev, err)
+		return nil
+	}
+	available, err := freeDiskSpace(cacheDir)
+	if err != nil {
+		log.Printf("WARN: Couldn't determine free disk space, not checking it: %v", err)
+		return nil
+	}
+	if available < required {
+		return fmt.Errorf("not enough free disk space in %v to create a git worktree for %v: need about %s but only %s is available. "+
+			"Free up some space, e.g. by removing unused cached worktrees with --clean-cached-worktrees", cacheDir, rev, formatBytes(required), formatBytes(available))
+	}
+	return nil
+}
+
+// checkoutSize returns the total size of the files tracked in git at rev.
+func checkoutSize(workingDirectory string, rev string) (uint64, error) {
+	lines, err := runToLines(workingDirectory, "git", "ls-tree", "-r", "-l", rev)
+	if err != nil {
+		return 0, err
+	}
+	var size uint64
+	for _, line := range lines {
+		// Lines look like "<mode> <type> <object> <size>\t<path>", where size is "-" for submodules.
+		metadata, _, _ := strings.Cut(line, "\t")
+		fields := strings.Fields(metadata)
+		if len(fields) != 4 || fields[3] == "-" {
+			continue
+		}
+		fileSize, err := strconv.ParseUint(fields[3], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse size from git ls-tree output %q: %w", line, err)
+		}
+		size += fileSize
+	}
+	return size, nil
+}
+
+func formatBytes(b uint64) string {
+	return fmt.Sprintf("%.1f MiB", float64(b)/(1<<20))
+}
+
+// CleanWorktreeCache removes the git worktrees in cacheDir which aren't in use by a running
+// process, e.g. because they were left behind by a crashed run, or were kept for reuse.
+// It returns the paths which were removed.
+func CleanWorktreeCache(cacheDir string) ([]string, error) {
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list worktree cache directory %v: %w", cacheDir, err)
+	}
+	var removed []string
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), worktreeDirPrefix) {
+			continue
+		}
+		worktreeDirPath := filepath.Join(cacheDir, entry.Name())
+		lockPath := worktreeDirPath + ".lock"
+		if pid, ok := readLockPid(lockPath); ok && processIsRunning(pid) {
+			Progressf("Not removing worktree %v because it is in use by process %d", worktreeDirPath, pid)
+			continue
+		}
+		if err := os.RemoveAll(worktreeDirPath); err != nil {
+			return removed, fmt.Errorf("failed to remove worktree %v: %w", worktreeDirPath, err)
+		}
+		if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to remove worktree lock file %v: %w", lockPath, err)
+		}
+		removed = append(removed, worktreeDirPath)
+	}
+	return removed, nil
+}
+
+func readLockPid(lockPath string) (int, bool) {
+	content, err := os.ReadFile(lockPath)
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, false
+	}
+	return pid, true
+}
+
+func processIsRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// On Windows, FindProcess fails for processes which don't exist, and signals aren't supported.
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
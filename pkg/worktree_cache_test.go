@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestCleanWorktreeCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	mkdir := func(name string) string {
+		path := filepath.Join(cacheDir, name)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			t.Fatalf("Failed to create %s: %v", path, err)
+		}
+		return path
+	}
+
+	unlocked := mkdir("td-worktree-unlocked-abc")
+	inUse := mkdir("td-worktree-in-use-def")
+	if err := lockWorktree(inUse); err != nil {
+		t.Fatalf("Failed to lock worktree: %v", err)
+	}
+	notWorktree := mkdir("something-else")
+
+	removed, err := CleanWorktreeCache(cacheDir)
+	if err != nil {
+		t.Fatalf("Failed to clean worktree cache: %v", err)
+	}
+	if want := []string{unlocked}; !reflect.DeepEqual(want, removed) {
+		t.Fatalf("Wrong removed worktrees: want %v got %v", want, removed)
+	}
+	for _, path := range []string{inUse, inUse + ".lock", notWorktree} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("Expected %s to still exist: %v", path, err)
+		}
+	}
+
+	lockContent, err := os.ReadFile(inUse + ".lock")
+	if err != nil {
+		t.Fatalf("Failed to read lock file: %v", err)
+	}
+	if want := strconv.Itoa(os.Getpid()); string(lockContent) != want {
+		t.Fatalf("Wrong lock file content: want %v got %v", want, string(lockContent))
+	}
+
+	unlockWorktree(inUse)
+	removed, err = CleanWorktreeCache(cacheDir)
+	if err != nil {
+		t.Fatalf("Failed to clean worktree cache: %v", err)
+	}
+	if want := []string{inUse}; !reflect.DeepEqual(want, removed) {
+		t.Fatalf("Wrong removed worktrees: want %v got %v", want, removed)
+	}
+}
+
+func TestCheckoutSize(t *testing.T) {
+	dir := t.TempDir()
+	git := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=td", "GIT_AUTHOR_EMAIL=td@example.com", "GIT_COMMITTER_NAME=td", "GIT_COMMITTER_EMAIL=td@example.com")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Failed to run git %v: %v. Output: %s", args, err, output)
+		}
+	}
+	git("init", "-q")
+	if err := os.MkdirAll(filepath.Join(dir, "sub dir"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	for path, content := range map[string]string{"a.txt": "hello", "sub dir/b.txt": "goodbye!!"} {
+		if err := os.WriteFile(filepath.Join(dir, path), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+	git("add", ".")
+	git("commit", "-q", "-m", "files")
+
+	got, err := checkoutSize(dir, "HEAD")
+	if err != nil {
+		t.Fatalf("Failed to compute checkout size: %v", err)
+	}
+	if want := uint64(14); got != want {
+		t.Fatalf("Wrong checkout size: want %v got %v", want, got)
+	}
+}
@@ -0,0 +1,896 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bazel-contrib/target-determinator/cli"
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+type targetDeterminatorFlags struct {
+	commonFlags    *cli.CommonFlags
+	revisionBefore string
+	verbose        bool
+	platforms      cli.MultipleStrings
+	// summaryHistoryFile and summaryEndpoint are where to record a RunSummary, if set.
+	summaryHistoryFile string
+	summaryEndpoint    string
+	// beforeHashesOutput and afterHashesOutput are where to write the hashes computed for each
+	// revision, if set.
+	beforeHashesOutput string
+	afterHashesOutput  string
+	// anonymizeHashesOutput is whether to anonymize the labels in the hashes outputs, using
+	// anonymizationSalt.
+	anonymizeHashesOutput bool
+	anonymizationSalt     string
+	// hashesOutputFormat and hashesOutputCompression are the format of the hashes outputs and how to
+	// compress them.
+	hashesOutputFormat      string
+	hashesOutputCompression string
+	// hashesOutputShards, if more than 1, is how many files to split each hashes output across.
+	hashesOutputShards int
+	// includeBreakdown is whether to record the components of each rule's hash in the hashes outputs.
+	includeBreakdown bool
+	// sourceFilesLimit, if positive, is the most source files to record each rule's hash as
+	// depending on in the hashes outputs.
+	sourceFilesLimit int
+	// hashesOutputBase, if set, is a hash file to write the hashes outputs as deltas against.
+	hashesOutputBase string
+	// hashesSigningKey and hashesVerifyKey, if set, are PEM files of the ed25519 keys to sign the
+	// hashes outputs with, and to verify hash files read with.
+	hashesSigningKey string
+	hashesVerifyKey  string
+	// beforeHashFile is a file of hashes to use instead of processing the before revision.
+	beforeHashFile string
+	// beforeHashFileConflictPolicy is how to handle conflicting hashes in beforeHashFile.
+	beforeHashFileConflictPolicy string
+	// beforeHashStore, if set, is where to look for a hash file for the before revision or its
+	// closest first-parent ancestor with one, considering at most beforeHashStoreMaxAncestors.
+	beforeHashStore             string
+	beforeHashStoreMaxAncestors int
+	// runManifest is where to write a RunManifest, if set.
+	runManifest string
+	// replay is the RunManifest of a previous run to replay, if set.
+	replay       *pkg.RunManifest
+	replayRemote string
+	// args are the arguments to record in a RunManifest.
+	args []string
+	// singleRevision is whether to approximate affected targets using only the current working
+	// directory state, and changedFiles optionally lists the changed files to use.
+	singleRevision bool
+	changedFiles   string
+	// whatIf, if set, is a comma-separated list of hypothetical changed files to report the
+	// affected targets of, as for singleRevision.
+	whatIf string
+	// whatIfBazelOpts are hypothetical extra Bazel options to report the affected targets of.
+	whatIfBazelOpts cli.MultipleStrings
+	// verifyHashes, if set, is a hash file to check the hashes of the current working directory state
+	// against, instead of reporting affected targets.
+	verifyHashes string
+	// backfillHashStore, if set, is where to write hash files for the first-parent history since
+	// backfillSince, keeping every backfillEvery'th commit, or merge commit if backfillMerges is
+	// set, instead of reporting affected targets.
+	backfillHashStore string
+	backfillSince     string
+	backfillEvery     int
+	backfillMerges    bool
+	// watchBranch, if set, is a branch of watchRemote to poll every watchInterval, writing hash files
+	// for its new commits to backfillHashStore.
+	watchBranch   string
+	watchRemote   string
+	watchInterval time.Duration
+	// historyStore, if set, is a hash store to report when targets' hashes changed from, over the
+	// first-parent history of the current commit since historySince, instead of determining targets.
+	// targetHistory and lastChange are the labels of the targets to report every change to, and the
+	// most recent change to, respectively. noisyTargetsReport is whether to report the targets whose
+	// hashes changed without their package changing in at least noisyTargetsMinPercent percent of
+	// commits, and at least noisyTargetsMinChanges times.
+	historyStore           string
+	historySince           string
+	targetHistory          string
+	lastChange             string
+	noisyTargetsReport     bool
+	noisyTargetsMinPercent int
+	noisyTargetsMinChanges int
+	// fastResultsFile is where to write a quick approximation of the affected targets before
+	// computing the precise ones, if set.
+	fastResultsFile string
+	// resultCache is where to cache results, resultCacheTTL is how long cached results are valid
+	// for, and resultCacheFlags are the flags which affect the result.
+	resultCache      string
+	noResultCache    bool
+	resultCacheTTL   time.Duration
+	resultCacheFlags []string
+	// isAffected are labels to report whether they're affected, instead of outputting all of the
+	// affected targets.
+	isAffected cli.MultipleStrings
+	// format is how to output the affected targets, and bazelExprChunkSize and unionRdepsDepth
+	// control the bazel-expr format.
+	format             string
+	bazelExprChunkSize int
+	unionRdepsDepth    int
+	// order is how to order the affected targets in the output and shards.
+	order string
+	// languageSummary is whether to log how many affected targets there are per language, and
+	// languageTargetsDir is where to write a file of affected targets per language, if set.
+	languageSummary    bool
+	languageTargetsDir string
+	// shardBy is how to group affected targets into the files written to shardDir, if set.
+	shardBy  string
+	shardDir string
+	// deployableTargetsFile is where to write the affected targets whose rule kinds match
+	// deployableKinds, if set.
+	deployableTargetsFile string
+	deployableKinds       string
+	// apiReport is whether to log the affected targets whose rule kinds match apiKinds, and
+	// apiTargetsFile is where to write them, if set.
+	apiReport      bool
+	apiTargetsFile string
+	apiKinds       string
+	// complianceConfig, if set, is a pkg.ComplianceConfig file declaring compliance-relevant
+	// targets, and complianceExitCode, if non-zero, is the status to exit with if any are affected.
+	complianceConfig   string
+	complianceExitCode int
+	// legacyTargetsFile, if set, lists the targets selected by another mechanism to compare the
+	// affected targets against, and shadowReportFile is where to write the comparison, if set.
+	legacyTargetsFile string
+	shadowReportFile  string
+	// evidenceManifest, if set, is where to write an EvidenceManifest.
+	evidenceManifest string
+	// filterPatterns, if set, are target patterns which affected targets must match to be output.
+	filterPatterns cli.MultipleStrings
+	// excludeExternalTargets is whether to leave targets in external repositories out of the output.
+	excludeExternalTargets bool
+	// federation is the FederationConfig to determine affected targets across, if set.
+	federation *pkg.FederationConfig
+	// gitHubAction is whether to run as a GitHub Actions step, and gitHubActionEnvironment is the
+	// workflow run it's running in.
+	gitHubAction            bool
+	gitHubActionEnvironment *pkg.GitHubActionEnvironment
+	// compareResults are the two result files to compare instead of determining targets, if set.
+	compareResults []string
+	// diffSnapshots are the two hash files to compare instead of determining targets, if set,
+	// diffFormat is the format to print their differences in, and diffSort the order to print them
+	// in for the text and explain formats.
+	diffSnapshots []string
+	diffFormat    string
+	diffSort      string
+	// diffStreaming is whether to compare diffSnapshots a target at a time, rather than loading them.
+	diffStreaming bool
+	// diffSnapshotsBatch is a manifest of pairs of hash files to compare as for diffSnapshots,
+	// instead of determining targets, if set.
+	diffSnapshotsBatch string
+	// matchConfigurationsByContent is whether -diff-snapshots compares hashes in configurations
+	// with different checksums but the same summary.
+	matchConfigurationsByContent bool
+	// diffConfigurations and ignoreDiffConfigurations select which configurations -diff-snapshots
+	// compares hashes in.
+	diffConfigurations       cli.MultipleStrings
+	ignoreDiffConfigurations cli.MultipleStrings
+	// bazelVersionMismatch is what -diff-snapshots does with hash files computed with different
+	// Bazel releases.
+	bazelVersionMismatch string
+	// includeRemoved is whether -diff-snapshots reports removed targets.
+	includeRemoved bool
+	// diffScope, if set, is a target pattern restricting which targets -diff-snapshots compares,
+	// which both hash files must cover.
+	diffScope string
+	// exportSnapshot and exportResults are the hash file or result file to export, and the file to
+	// export it to, instead of determining targets, if set.
+	exportSnapshot []string
+	exportResults  []string
+	// canonicalizeSnapshot are the hash file to rewrite in canonical form, and optionally the file
+	// to write it to, instead of determining targets, if set.
+	canonicalizeSnapshot []string
+	// resultsDB, if set, is a SQLite database to append the affected targets to, and queryResults,
+	// if set, is a SQL query to run against it instead of determining targets.
+	resultsDB    string
+	queryResults string
+	// repositoryURL, if set, is a repository to clone and check out afterRevision of, rather than
+	// using an existing checkout.
+	repositoryURL string
+	afterRevision string
+}
+
+type config struct {
+	Context        *pkg.Context
+	RevisionBefore pkg.LabelledGitRev
+	Targets        pkg.TargetsList
+	Verbose        bool
+	// ShutdownBazelAfter is whether to shut down the Bazel servers used once affected targets have
+	// been computed.
+	ShutdownBazelAfter bool
+	// Platforms, if non-empty, are the platforms to separately compute affected targets for.
+	Platforms          []string
+	SummaryHistoryFile string
+	SummaryEndpoint    string
+	RunManifest        string
+	// Args and BazelStartupOpts are recorded in the RunManifest.
+	Args             []string
+	BazelStartupOpts []string
+	// SingleRevision is whether to approximate affected targets from ChangedFiles using only the
+	// current working directory state. If ChangedFiles is empty, the files changed since
+	// RevisionBefore are used.
+	SingleRevision bool
+	ChangedFiles   string
+	// WhatIf, if non-empty, are hypothetical changed files to use instead of ChangedFiles, relative
+	// to the workspace root. See pkg.NormalizeHypotheticalPaths.
+	WhatIf []string
+	// WhatIfBazelOpts, if non-empty, are options to report the targets affected by passing to Bazel
+	// in the current working directory state. See pkg.WalkTargetsAffectedByBazelOpts.
+	WhatIfBazelOpts []string
+	// VerifyHashes, if set, is a hash file whose hashes are recomputed in the current working
+	// directory state, reporting any which differ. See pkg.VerifyPersistedHashes.
+	VerifyHashes string
+	// BackfillHashStore, if set, is where to write hash files for the commits chosen by
+	// BackfillSince, BackfillEvery and BackfillMergesOnly, instead of reporting affected targets. See
+	// pkg.BackfillCommits and pkg.BackfillHashStore.
+	BackfillHashStore  string
+	BackfillSince      string
+	BackfillEvery      int
+	BackfillMergesOnly bool
+	// WatchBranch, if set, is a branch of WatchRemote to poll every WatchInterval, writing hash files
+	// for its new commits to BackfillHashStore, instead of backfilling once. See pkg.WatchBranch.
+	WatchBranch   string
+	WatchRemote   string
+	WatchInterval time.Duration
+	// FastResultsFile, if set, is where to write the affected targets approximated as for
+	// SingleRevision, before computing the precise affected targets.
+	FastResultsFile string
+	// ResultCache, if set, is where to look up and store the output, and ResultCacheTTL is how long
+	// cached output is valid for. ResultCacheFlags are the flags which affect the output.
+	ResultCache      string
+	ResultCacheTTL   time.Duration
+	ResultCacheFlags []string
+	// IsAffected, if non-empty, are the labels to report whether they're affected, instead of
+	// outputting all of the affected targets.
+	IsAffected []string
+	// Format is "labels" to output each affected target on its own line, or "bazel-expr" to output
+	// them as Bazel query expressions, split into expressions of at most BazelExprChunkSize labels
+	// if it is positive, and including their reverse dependencies up to UnionRdepsDepth edges away
+	// if it is positive. See pkg.BazelExpressions.
+	Format             string
+	BazelExprChunkSize int
+	UnionRdepsDepth    int
+	// Order is "distance" to output the affected targets, and list them in shards, closest to a
+	// directly changed target first (see pkg.DependencyDistances), or empty to output them as
+	// they're found.
+	Order string
+	// LanguageSummary is whether to log how many affected targets there are per language.
+	LanguageSummary bool
+	// LanguageTargetsDir, if set, is where to write a <language>.txt file of affected targets for
+	// each language.
+	LanguageTargetsDir string
+	// CodeOwners, if set, is used to write a file of affected targets for each owner to ShardDir,
+	// along with a matrix of them. See pkg.WriteShards.
+	CodeOwners *pkg.CodeOwners
+	ShardDir   string
+	// DeployableTargetsFile, if set, is where to write the affected targets whose rule kinds match
+	// DeployableKinds.
+	DeployableTargetsFile string
+	DeployableKinds       []string
+	// APIReport is whether to log the affected targets whose rule kinds match APIKinds, and
+	// APITargetsFile, if set, is where to write them.
+	APIReport      bool
+	APITargetsFile string
+	APIKinds       []string
+	// ComplianceConfig, if set, declares the compliance-relevant targets to log a section listing,
+	// and ComplianceExitCode, if non-zero, is the status to exit with if any are affected.
+	ComplianceConfig   *pkg.ComplianceConfig
+	ComplianceExitCode int
+	// LegacyTargetsFile, if set, lists the targets selected by another mechanism to compare the
+	// affected targets against, and ShadowReportFile is where to write the comparison, if set.
+	LegacyTargetsFile string
+	ShadowReportFile  string
+	// EvidenceManifest, if set, is where to write the changed files and the reasons targets were
+	// affected.
+	EvidenceManifest string
+	// FilterPatterns filters the affected targets which are output.
+	FilterPatterns *pkg.TargetPatternFilter
+	// ExcludeExternalTargets is whether to leave affected targets in external repositories out of
+	// the output. They are still used to find which targets depending on them are affected.
+	ExcludeExternalTargets bool
+	// ResultsDB, if set, is a SQLite database to append the affected targets to.
+	ResultsDB string
+	// GitHubAction, if set, is the GitHub Actions workflow run to write step outputs and a pull
+	// request comment for.
+	GitHubAction *pkg.GitHubActionEnvironment
+}
+
+func parseFlags() (*targetDeterminatorFlags, error) {
+	var flags targetDeterminatorFlags
+	flags.commonFlags = cli.RegisterCommonFlags()
+	flags.commonFlags.OutputFormats = []string{"labels", "verbose", "labels-with-platforms", "is-affected", "bazel-expr"}
+	flag.BoolVar(&flags.verbose, "verbose", false, "Whether to explain (messily) why each target is getting run")
+	flag.StringVar(&flags.summaryHistoryFile, "summary-history-file", "", "If set, appends a summary of this run (commits, timestamp, number of affected targets, duration) to this file. Files ending in .csv get CSV records, others get newline-delimited JSON.")
+	flag.StringVar(&flags.summaryEndpoint, "summary-endpoint", "", "If set, POSTs a JSON summary of this run to this URL.")
+	flag.StringVar(&flags.beforeHashesOutput, "before-hashes-output", "", "If set, writes the hashes computed for the before revision to this file, or to an s3:// or gs:// URI (using the aws or gcloud command).")
+	flag.StringVar(&flags.afterHashesOutput, "after-hashes-output", "", "If set, writes the hashes computed for the current working directory state to this file, or to an s3:// or gs:// URI (using the aws or gcloud command).")
+	flag.BoolVar(&flags.anonymizeHashesOutput, "anonymize-hashes-output", false, "If set, the labels written to -before-hashes-output and -after-hashes-output have each repository, package and target name component replaced with a stable opaque token, so that the files can be shared without revealing internal names. The digest of -anonymization-salt is recorded, and anonymized files can only be compared with files anonymized with the same salt, so can't be used as -before-hash-file.")
+	flag.StringVar(&flags.hashesOutputFormat, "hashes-output-format", "json", "The format to write -before-hashes-output and -after-hashes-output in. proto is a compact binary format (see pkg/persistedhashespb/persisted_hashes.proto) which is much faster to write and read for large repositories. -before-hash-file accepts either format. Accepted values: json,proto")
+	flag.StringVar(&flags.hashesOutputCompression, "hashes-output-compression", "auto", "How to compress -before-hashes-output and -after-hashes-output. auto uses gzip for files ending in .gz and zstd for files ending in .zst. Compressed files can be read by -before-hash-file directly. Accepted values: auto,none,gzip,zstd")
+	flag.IntVar(&flags.hashesOutputShards, "hashes-output-shards", 1, "If more than 1, splits each of -before-hashes-output and -after-hashes-output deterministically (by a hash of each label) across this many files, written alongside it with -NNNNN-of-NNNNN inserted before its extension, and writes an index of them to the output itself. This makes the outputs of huge workspaces quicker to write and upload. Reading the index (e.g. with -before-hash-file) transparently reads its shards, which must remain alongside it.")
+	flag.BoolVar(&flags.includeBreakdown, "include-breakdown", false, "If set, -before-hashes-output and -after-hashes-output also record, for each rule in each configuration, the components its hash was computed from: a hash of its rule implementation, a hash of its attributes, and the hashes of each source file and other target it directly depends on. This makes the outputs much larger, but lets -diff-format explain say which component of a target changed, and helps debug nondeterministic hashes.")
+	flag.IntVar(&flags.sourceFilesLimit, "source-files-limit", 0, "If positive, -before-hashes-output and -after-hashes-output also record, for each rule, the source files in the main repository its hash depends on, directly or through other targets, along with the hashes of those files, so that -diff-format files can say which changed files caused each target to be affected, e.g. to route failures to the files' owners. Rules which depend on more than this many source files have none recorded, to bound the size of the outputs.")
+	flag.StringVar(&flags.hashesOutputBase, "hashes-output-base", "", "If set, a hash file (or s3:// or gs:// URI) to write -before-hashes-output and -after-hashes-output as deltas against, containing only the targets whose hashes differ from it and a reference to it. Reading a delta transparently applies it to its base, which must remain available. With -anonymize-hashes-output, the base must have been anonymized with the same salt.")
+	flag.StringVar(&flags.hashesSigningKey, "hashes-signing-key", "", "If set, a PEM file containing an ed25519 private key (e.g. from \"openssl genpkey -algorithm ed25519\") to sign -before-hashes-output and -after-hashes-output, and results stored in a remote -result-cache, with. Each signature is written alongside its file, with a .sig suffix.")
+	flag.StringVar(&flags.hashesVerifyKey, "hashes-verify-key", "", "If set, a PEM file containing an ed25519 public key (e.g. from \"openssl pkey -pubout\"). Hash files read with -before-hash-file, -before-hash-store, -hashes-output-base, -export-snapshot or -diff-snapshots, and their bases, and results looked up in a remote -result-cache, must have valid signatures by the corresponding private key (see -hashes-signing-key), or the invocation fails, so that tampered files from shared caches are never trusted.")
+	flag.StringVar(&flags.anonymizationSalt, "anonymization-salt", "", "Secret mixed into the tokens used by -anonymize-hashes-output. Without one, tokens for guessable names can be reversed.")
+	flag.StringVar(&flags.beforeHashFile, "before-hash-file", "", "If set, a file (or s3:// or gs:// URI) previously written by -before-hashes-output or -after-hashes-output. If it was computed at the before revision, its hashes are used instead of checking out and processing the before revision. It must have been computed with the same flags and Bazel version as this invocation.")
+	flag.StringVar(&flags.backfillHashStore, "backfill-hash-store", "", "If set, a directory, or s3:// or gs:// URI, to write hash files named <commit>.json to, for use with -before-hash-store, instead of reporting affected targets. A hash file is written for each commit chosen by -backfill-since, -backfill-every and -backfill-merges which doesn't already have one, so an interrupted backfill resumes where it stopped when run again. Commits are processed in turn in the same output base (and -worktree-cache-dir), so Bazel's caches are reused. Each commit's location is printed once written. The before revision may be omitted, and is ignored.")
+	flag.StringVar(&flags.backfillSince, "backfill-since", "", "The oldest commit -backfill-hash-store writes hashes for. It and the commits after it on the first-parent history of the current commit are considered.")
+	flag.IntVar(&flags.backfillEvery, "backfill-every", 1, "Write hashes for every Nth commit considered by -backfill-hash-store, counting from -backfill-since, so that extending a backfill later chooses the same commits.")
+	flag.BoolVar(&flags.backfillMerges, "backfill-merges", false, "If set, -backfill-hash-store only considers merge commits, e.g. to backfill the merges of pull requests to the main branch.")
+	flag.StringVar(&flags.watchBranch, "watch-branch", "", "If set, a branch (e.g. main) of -watch-remote to poll every -watch-interval, instead of backfilling once: each poll fetches it, and writes hash files to -backfill-hash-store for its new first-parent commits, as -backfill-hash-store does. The commits with hash files are appended to an index, <branch>.commits in -backfill-hash-store, and polling resumes from its last commit when restarted. -backfill-since is optional, and the first poll only writes hashes for the branch's tip without it or an index. -backfill-merges applies. Polls which fail are logged and retried by the next poll. To trigger hash files from a webhook instead, run -backfill-hash-store with -backfill-since set to the pushed commit.")
+	flag.StringVar(&flags.watchRemote, "watch-remote", "origin", "The remote -watch-branch is fetched from.")
+	flag.DurationVar(&flags.watchInterval, "watch-interval", time.Minute, "How often -watch-branch is polled.")
+	flag.StringVar(&flags.historyStore, "history-store", "", "A directory, or s3:// or gs:// URI, containing hash files named <commit>.json (e.g. written by -backfill-hash-store or -after-hashes-output), for -target-history, -last-change and -noisy-targets-report. The hash files of the commits on the first-parent history of the current commit are used.")
+	flag.StringVar(&flags.historySince, "history-since", "", "If set, -target-history, -last-change and -noisy-targets-report only consider commits made after this date, or anything else git rev-list --since accepts, e.g. 2024-01-01 or \"3 months ago\".")
+	flag.StringVar(&flags.targetHistory, "target-history", "", "If set, a target label (e.g. //foo:bar) to print each change to the hashes of in -history-store, oldest first, instead of determining targets. Each change is printed as the commits it was made between, followed by the configurations whose hashes changed, e.g. to audit targets which change on every commit. Every hash file is read. -hashes-verify-key applies.")
+	flag.BoolVar(&flags.noisyTargetsReport, "noisy-targets-report", false, "If set, prints the targets in -history-store whose hashes changed without any file under their package changing between many consecutive hash files, a strong signal of nondeterministic or over-broad inputs, with suggested causes, instead of determining targets. Hash files written with -include-breakdown give more specific causes. Every hash file is read. -hashes-verify-key applies.")
+	flag.IntVar(&flags.noisyTargetsMinPercent, "noisy-targets-min-percent", 50, "The percentage of the pairs of consecutive hash files which had a target whose hashes must have changed without its package changing for -noisy-targets-report to report it.")
+	flag.IntVar(&flags.noisyTargetsMinChanges, "noisy-targets-min-changes", 3, "The number of times a target's hashes must have changed without its package changing for -noisy-targets-report to report it.")
+	flag.StringVar(&flags.lastChange, "last-change", "", "If set, a target label (e.g. //foo:bar) to find the most recent change to the hashes of in -history-store, instead of determining targets. The commits the change was made between, and the configurations whose hashes changed, are printed. The most recent hash files are compared in turn, and older ones bisected, so only a few are read however many there are; bisecting assumes the target's hashes didn't change and then change back. -hashes-verify-key applies.")
+	flag.StringVar(&flags.beforeHashStore, "before-hash-store", "", "If set, a directory, or s3:// or gs:// URI, containing hash files named <commit>.json (e.g. written by -after-hashes-output on each commit of the main branch). The hash file for the before revision is used as -before-hash-file. If there isn't one, the closest first-parent ancestor of the before revision which has one is used as the before revision instead.")
+	flag.IntVar(&flags.beforeHashStoreMaxAncestors, "before-hash-store-max-ancestors", 100, "The maximum number of first-parent ancestors of the before revision to look for in -before-hash-store. Zero means unlimited.")
+	flag.StringVar(&flags.beforeHashFileConflictPolicy, "before-hash-file-conflict-policy", "fail", "How to handle a target which appears in -before-hash-file more than once with different hashes (e.g. because of a bad merge). Accepted values: fail,first,last")
+	flag.StringVar(&flags.runManifest, "run-manifest", "", "If set, writes a JSON manifest of everything needed to reproduce this run (tool version, arguments, resolved revisions, Bazel version, bazelrc digests, relevant environment variables, and the affected targets) to this file.")
+	flag.BoolVar(&flags.singleRevision, "single-revision", false, "If set, quickly approximates the affected targets as those which depend on the files changed since the before revision, using only the build graph of the current working directory state. The before revision is never checked out or queried, so the result is less precise: it may include targets which weren't really affected, and excludes targets which were deleted.")
+	flag.StringVar(&flags.whatIf, "what-if", "", "If set, a comma-separated list of files, relative to the workspace root, to report the targets which would be affected by changing, as for -single-revision with -changed-files. The files needn't have been changed, or even exist, so this can be used to assess the impact of a change before making it. The before revision may be omitted, and defaults to HEAD.")
+	flag.Var(&flags.whatIfBazelOpts, "what-if-bazel-opt", "Bazel option, e.g. --define=FOO=1, to report the targets which would be affected by passing to Bazel (e.g. by adding it to .bazelrc); may be repeated. The current working directory state is processed with and without the options, so this estimates the cost of a configuration change before making it. The before revision may be omitted, and is ignored.")
+	flag.StringVar(&flags.verifyHashes, "verify-hashes", "", "If set, a file (or s3:// or gs:// URI) previously written by -before-hashes-output or -after-hashes-output at the current commit. Instead of reporting affected targets, the hashes of the targets in the current working directory state are recomputed, any which differ from the file are printed, and the exit code is non-zero if there are any. This checks that hashing is deterministic, e.g. before trusting files for -before-hash-file. The before revision may be omitted, and is ignored.")
+	flag.StringVar(&flags.changedFiles, "changed-files", "", "If set with -single-revision or -fast-results-file, a file listing the changed files, one per line relative to the workspace root, to use instead of comparing against the before revision.")
+	flag.StringVar(&flags.fastResultsFile, "fast-results-file", "", "If set, before computing the precise affected targets, quickly approximates them as for -single-revision and writes them to this file, one per line, so that e.g. CI can start preparing for them. The file is only created once it is complete. The precise affected targets are output as normal afterwards.")
+	flag.StringVar(&flags.resultCache, "result-cache", "", "If set, where to cache results, so that identical re-runs return immediately: either a local directory, an http(s) URL which supports GET and PUT of <url>/<key> and <url>/<key>.sig, or \"default\" for a directory in the user's cache directory. Results are only cached when there are no local changes, and only flags which affect which targets are output, or how, are set: other flags, e.g. -run-manifest or -summary-history-file, may have effects a cached result would skip. Results in a remote cache are signed and verified with -hashes-signing-key and -hashes-verify-key: a remote cache isn't used without -hashes-verify-key, and results aren't stored in it without -hashes-signing-key.")
+	flag.BoolVar(&flags.noResultCache, "no-result-cache", false, "If set, results are neither looked up in nor stored in the result cache.")
+	flag.DurationVar(&flags.resultCacheTTL, "result-cache-ttl", 24*time.Hour, "How long cached results are used for. 0 means forever.")
+	flag.Var(&flags.isAffected, "is-affected", "Label to report whether it is affected; may be repeated. If set, instead of the affected targets, each of these labels is output followed by true or false. Combined with the result cache, this answers repeated questions about the same revisions without recomputing anything.")
+	flag.StringVar(&flags.format, "format", "labels", "How to output the affected targets. labels outputs each on its own line, and bazel-expr outputs them as a Bazel query expression, e.g. set(//a:b //c:d), which can be passed directly to e.g. bazel test \"$(target-determinator ...)\". Accepted values: labels,bazel-expr")
+	flag.StringVar(&flags.order, "order", "", "If set, how to order the affected targets, both in the output and in the files written to -shard-dir. distance lists the targets closest in the dependency graph to a directly changed target first, as they're the most likely to be broken by the change, so that CI surfaces failures sooner; the targets are then output once they've all been found, rather than as they're found, and -shard-dir's matrix.json lists the shards with the closest targets first, with the distance of each shard's closest target as \"closest_distance\". Accepted values: distance")
+	flag.IntVar(&flags.bazelExprChunkSize, "bazel-expr-chunk-size", 0, "If positive, with -format=bazel-expr, the affected targets are split across expressions of at most this many targets, one per line, to stay within command line length limits.")
+	flag.IntVar(&flags.unionRdepsDepth, "union-rdeps-depth", 0, "If positive, with -format=bazel-expr, the expressions also include the reverse dependencies of the affected targets within --targets, up to this many edges away, e.g. to also test the direct dependents of affected targets. Unless -bazel-expr-chunk-size is set, each expression covers at most -query-chunk-size affected targets, if it is set.")
+	flag.BoolVar(&flags.languageSummary, "language-summary", false, "If set, logs how many affected targets there are for each language, as classified by the prefix of their rule kind (e.g. go_, java_, py_).")
+	flag.StringVar(&flags.shardBy, "shard-by", "", "If set, groups the affected targets into shards written to -shard-dir, e.g. so that each team's CI job runs exactly its own affected targets. With codeowners, each target belongs to the first owner of its package's BUILD file (or of the file itself, for source files) in the workspace's CODEOWNERS file, or to \"unowned\". Accepted values: codeowners")
+	flag.StringVar(&flags.shardDir, "shard-dir", "", "The directory to write a <owner>.txt file for each shard of -shard-by to, listing its affected targets one per line, along with a matrix.json file listing the shards under \"include\", in the format of a GitHub Actions matrix.")
+	flag.StringVar(&flags.languageTargetsDir, "language-targets-dir", "", "If set, writes a <language>.txt file to this directory for each language with affected targets, listing them one per line.")
+	flag.StringVar(&flags.deployableTargetsFile, "deployable-targets-file", "", "If set, writes the affected targets whose rule kinds match -deployable-kinds to this file, one per line, e.g. to only deploy affected services.")
+	flag.StringVar(&flags.deployableKinds, "deployable-kinds", strings.Join(pkg.DefaultDeployableKinds, ","), "Comma-separated rule kinds of targets to write to -deployable-targets-file. May contain * wildcards.")
+	flag.BoolVar(&flags.apiReport, "api-report", false, "If set, logs a section listing the affected targets whose rule kinds match -api-kinds, e.g. to decide whether to run API compatibility checks.")
+	flag.StringVar(&flags.apiTargetsFile, "api-targets-file", "", "If set, writes the affected targets whose rule kinds match -api-kinds to this file, one per line.")
+	flag.StringVar(&flags.apiKinds, "api-kinds", strings.Join(pkg.DefaultAPIKinds, ","), "Comma-separated rule kinds of targets which define APIs, for -api-report and -api-targets-file. May contain * wildcards.")
+	flag.StringVar(&flags.complianceConfig, "compliance-config", "", "If set, a JSON file declaring compliance-relevant targets, e.g. those whose changes need legal review, as \"kinds\" (rule kinds, which may contain * wildcards) and \"packages\" (target patterns, e.g. //third_party/...). A section listing the affected compliance-relevant targets is logged.")
+	flag.IntVar(&flags.complianceExitCode, "compliance-exit-code", 0, "If set, the status to exit with, after all outputs are written, if any compliance-relevant targets declared by -compliance-config are affected, so that review gates can be triggered automatically. Must be between 2 and 125, to be distinct from the status of failed runs.")
+	flag.StringVar(&flags.legacyTargetsFile, "legacy-targets-file", "", "If set, a file listing the targets selected for the same change by another mechanism (e.g. an existing CI selection being replaced), one per line. The affected targets are compared against them, and precision, recall and the targets only selected by each are logged.")
+	flag.StringVar(&flags.shadowReportFile, "shadow-report-file", "", "If set with -legacy-targets-file, writes the comparison to this file as JSON.")
+	flag.StringVar(&flags.evidenceManifest, "evidence-manifest", "", "If set, writes a JSON manifest to this file of the files which changed (with diffs of BUILD, .bzl, workspace and module files) the differences which caused each target to be affected, and the changed BUILD and .bzl files in the load closure of each target affected by how it's defined, e.g. to attach to audit records as evidence of why other targets weren't tested.")
+	flag.Var(&flags.filterPatterns, "filter-pattern", "Target pattern (e.g. //foo/...) which affected targets must match to be output; may be repeated. Patterns prefixed with - (e.g. -//foo/bar/...) exclude the targets they match. As for Bazel target patterns, later patterns take precedence, and if the first pattern is an exclusion, all other targets are included. Unlike --targets, this doesn't change which targets are analyzed.")
+	flag.BoolVar(&flags.excludeExternalTargets, "exclude-external-targets", false, "If set, affected targets in external repositories (e.g. @rules_go//go:stdlib) aren't output, as they can't usefully be built or tested by CI. Changes to them still cause the targets in the main repository which depend on them to be affected.")
+	flag.Var(&flags.platforms, "platforms", "Platform to compute affected targets for; may be repeated. If set, affected targets are computed separately for each platform, and each output line is the affected target followed by the platform it was affected for.")
+
+	var replayManifest string
+	flag.StringVar(&replayManifest, "replay-manifest", "", "If set, replays the run recorded in this file by -run-manifest using the same arguments and commits, and reports any differences from the recorded run. Other arguments shouldn't be passed.")
+	flag.StringVar(&flags.replayRemote, "replay-remote", "origin", "The git remote to fetch commits missing for -replay-manifest from.")
+
+	flag.StringVar(&flags.repositoryURL, "repository-url", "", "If set, rather than using an existing checkout, clones this repository (or reuses a previous clone) in the worktree cache directory, fetching only the commits needed, and checks out -after-revision. Revisions should be full commit hashes.")
+	flag.StringVar(&flags.afterRevision, "after-revision", "", "The revision to check out when using -repository-url.")
+
+	flag.BoolVar(&flags.gitHubAction, "github-action", false, "If set, runs as a step of a GitHub Actions workflow triggered by a pull_request, pull_request_target or push event: the before revision defaults to the head of the pull request's base branch, or the commit before the push. The commit the event is for must be checked out: GITHUB_SHA, or for pull_request_target, the pull request's head. If -before-hash-store is set, the hashes for that commit are also written to it, unless -after-hashes-output is set. The affected targets are written to the affected-targets (one per line) and affected-count step outputs, and, if GITHUB_TOKEN is set, a comment summarizing them is posted on the pull request.")
+
+	var federationConfig string
+	flag.StringVar(&federationConfig, "federation-config", "", "If set, a JSON file listing repositories to determine affected targets in, and dependencies between them. The affected targets of every repository are output, qualified with the repository's name. Other arguments shouldn't be passed.")
+
+	var compareResults bool
+	flag.BoolVar(&compareResults, "compare-results", false, "If set, compares the affected targets in the two files passed as positional arguments, each either the output of a run or a -run-manifest, e.g. from shadow runs of different versions of this tool. Targets only in the first file are printed prefixed with -, and targets only in the second prefixed with +. Exits with status 1 if they differ.")
+	flag.StringVar(&flags.resultsDB, "results-db", "", "If set, appends the affected targets of this run, with their packages, rule kinds and languages, to this SQLite database (which requires sqlite3 on the PATH), to be queried with -query-results.")
+	flag.StringVar(&flags.queryResults, "query-results", "", "If set, runs this SQL query (e.g. 'SELECT package, COUNT(*) FROM affected_targets GROUP BY package') against -results-db and prints the result as CSV, instead of determining targets. The database has tables runs(id, timestamp, before_revision, after_revision) and affected_targets(run_id, label, repository, package, name, platform, kind, language).")
+	var diffSnapshots bool
+	flag.BoolVar(&diffSnapshots, "diff-snapshots", false, "If set, compares the two hash files (e.g. written by -before-hashes-output and -after-hashes-output) passed as positional arguments and prints each added, removed and changed target, instead of determining targets. -filter-pattern and -hashes-verify-key apply. See -diff-format.")
+	flag.StringVar(&flags.diffFormat, "diff-format", "text", "The format to print -diff-snapshots in. text prints each target prefixed with + if added, - if removed and ~ if changed, junit prints a JUnit XML report with a test case per target, sarif prints a SARIF log with a result per target, each including the target's status and hashes, json prints a JSON object keyed by label whose values are each target's status and its before and after hashes in each configuration, summary prints a JSON object counting the added, removed and changed targets in total, by rule kind and by top-level directory, and explain prints text followed by why each target differs: which configurations' hashes changed, which components of them changed if both hash files were written with -include-breakdown, and which of its kind, tags and testonly changed, followed by the external dependencies which were added, removed or upgraded, if both hash files recorded them (other formats log them instead). files prints text followed by the source files which contributed to each target: those its hash depends on whose hashes differ between the hash files, if both were written with -source-files-limit. equal prints nothing, and exits with 0 if no targets differ and 1 otherwise, as a cheap gate: files with the same canonical digest are equal without comparing their targets. Accepted values: text,junit,sarif,json,summary,explain,files,equal")
+	flag.StringVar(&flags.diffSort, "sort", "label", "The order to print -diff-snapshots in with -diff-format text, explain or files. label sorts by label, package groups targets by package, kind by rule kind, status lists added targets, then changed, then removed, and impact lists the targets with the most direct dependents (as recorded in the hash files) first. Accepted values: label,package,kind,status,impact")
+	flag.StringVar(&flags.diffSnapshotsBatch, "diff-snapshots-batch", "", "If set, a JSON file containing an array of objects with \"before\", \"after\" and \"output\" keys: for each, the before and after hash files are compared as for -diff-snapshots, and the differences written to the output file, instead of determining targets. Relative paths are relative to the file. Each hash file is read once however many pairs it's in, so comparing e.g. a main branch commit with many pull requests is faster than running -diff-snapshots for each. -diff-format, -sort, -filter-pattern and -hashes-verify-key apply.")
+	flag.BoolVar(&flags.diffStreaming, "diff-streaming", false, "If set, -diff-snapshots reads the hash files a target at a time as it compares them, rather than loading them, so that its memory use doesn't grow with the number of targets. Only local, complete JSON hash files with sorted labels, as written by this tool, can be streamed: deltas, sharded files and proto files can't, and -hashes-verify-key can't be used. Only -diff-format text and equal are supported, with -sort label.")
+	flag.BoolVar(&flags.matchConfigurationsByContent, "match-configurations-by-content", false, "If set, -diff-snapshots compares a target's hash in a configuration which is only in the after hash file with its hash in the configuration only in the before hash file with the same platforms, compilation mode, CPU and key flags, rather than reporting it as changed, e.g. when an unrelated option changed every configuration's checksum. Only hash files which recorded configuration summaries are matched.")
+	flag.Var(&flags.diffConfigurations, "configurations", "Configuration to compare hashes in with -diff-snapshots; may be repeated. Either a configuration checksum, or a platform (by label, e.g. //platforms:linux_x86_64, or name, e.g. linux_x86_64) matching the configurations whose platforms include it, as recorded in the hash files. Targets without a configuration, e.g. source files, are always compared.")
+	flag.Var(&flags.ignoreDiffConfigurations, "ignore-configurations", "Configuration, as for -configurations, not to compare hashes in with -diff-snapshots; may be repeated.")
+	flag.BoolVar(&flags.includeRemoved, "include-removed", true, "Whether -diff-snapshots reports targets which were removed. If false, they are left out of every -diff-format, including counts and explanations, as they can't be built or tested after the change.")
+	flag.StringVar(&flags.diffScope, "diff-scope", "", "If set, a target pattern (e.g. //mobile/...) restricting which targets -diff-snapshots compares. Both hash files must have been computed with -targets which match every target it does, or the comparison fails, so that scoped pipelines can reuse hash files of the whole repository without reporting targets which were never hashed as added or removed. Hash files written before their -targets were recorded can't be checked.")
+	flag.StringVar(&flags.bazelVersionMismatch, "bazel-version-mismatch", "warn", "What -diff-snapshots does if the hash files were computed with different Bazel releases, which generally changes every hash. error fails, warn logs a warning, mark-all-changed reports every target in both hash files as changed, and ignore compares the hashes as usual. Accepted values: error,warn,mark-all-changed,ignore")
+	var exportSnapshot, exportResults bool
+	var canonicalizeSnapshot bool
+	flag.BoolVar(&canonicalizeSnapshot, "canonicalize-snapshot", false, "If set, rewrites the hash file passed as the first positional argument as canonical JSON, with sorted keys and one key per line, to the file passed as the second, or stdout if there isn't one, instead of determining targets. Deltas are applied to their bases and shards merged, so hash files with the same content are always written as the same bytes, for deduplicating, signing, or comparing with plain diff. -hashes-verify-key applies.")
+	flag.BoolVar(&exportSnapshot, "export-snapshot", false, "If set, exports the hash file passed as the first positional argument to the file passed as the second, with one row per target and configuration, for loading into analytics tools. The output is Parquet if it ends in .parquet (which requires duckdb on the PATH), and otherwise newline-delimited JSON.")
+	flag.BoolVar(&exportResults, "export-results", false, "If set, exports the affected targets in the file passed as the first positional argument (either the output of a run or a -run-manifest) to the file passed as the second, with one row per target, as for -export-snapshot.")
+
+	flag.Parse()
+	cli.ApplyOutputFlags(flags.commonFlags)
+	flags.args = os.Args[1:]
+
+	if compareResults {
+		if flag.NArg() != 2 {
+			return nil, fmt.Errorf("expected two positional arguments with -compare-results, <before-results> and <after-results>, but got %d", flag.NArg())
+		}
+		flags.compareResults = flag.Args()
+		return &flags, nil
+	}
+
+	if diffSnapshots || flags.diffSnapshotsBatch != "" {
+		if diffSnapshots && flags.diffSnapshotsBatch != "" {
+			return nil, fmt.Errorf("-diff-snapshots and -diff-snapshots-batch can't be used together")
+		}
+		if diffSnapshots && flag.NArg() != 2 {
+			return nil, fmt.Errorf("expected two positional arguments with -diff-snapshots, <before-hashes> and <after-hashes>, but got %d", flag.NArg())
+		}
+		if flags.diffSnapshotsBatch != "" && flag.NArg() != 0 {
+			return nil, fmt.Errorf("expected no positional arguments with -diff-snapshots-batch, but got %d", flag.NArg())
+		}
+		switch flags.diffFormat {
+		case "text", "junit", "sarif", "json", "summary", "explain", "files":
+		case "equal":
+			if !diffSnapshots {
+				return nil, fmt.Errorf("-diff-format equal can only be used with -diff-snapshots")
+			}
+		default:
+			return nil, fmt.Errorf("unexpected value for flag -diff-format - allowed values: text|junit|sarif|json|summary|explain|files|equal, saw: %s", flags.diffFormat)
+		}
+		switch flags.diffSort {
+		case "label", "package", "kind", "status", "impact":
+		default:
+			return nil, fmt.Errorf("unexpected value for flag -sort - allowed values: label|package|kind|status|impact, saw: %s", flags.diffSort)
+		}
+		switch flags.bazelVersionMismatch {
+		case "error", "warn", "mark-all-changed", "ignore":
+		default:
+			return nil, fmt.Errorf("unexpected value for flag -bazel-version-mismatch - allowed values: error|warn|mark-all-changed|ignore, saw: %s", flags.bazelVersionMismatch)
+		}
+		if flags.diffStreaming {
+			if !diffSnapshots {
+				return nil, fmt.Errorf("-diff-streaming can only be used with -diff-snapshots")
+			}
+			if (flags.diffFormat != "text" && flags.diffFormat != "equal") || flags.diffSort != "label" {
+				return nil, fmt.Errorf("-diff-streaming can only be used with -diff-format text or equal, and -sort label")
+			}
+			if flags.hashesVerifyKey != "" {
+				return nil, fmt.Errorf("-diff-streaming can't be used with -hashes-verify-key, as signatures can only be checked by loading the hash files")
+			}
+		}
+		if flags.diffSort != "label" && flags.diffFormat != "text" && flags.diffFormat != "explain" && flags.diffFormat != "files" {
+			return nil, fmt.Errorf("-sort can only be used with -diff-format text, explain or files")
+		}
+		if diffSnapshots {
+			flags.diffSnapshots = flag.Args()
+		}
+		return &flags, nil
+	}
+
+	if flags.targetHistory != "" || flags.lastChange != "" || flags.noisyTargetsReport {
+		modes := 0
+		for _, set := range []bool{flags.targetHistory != "", flags.lastChange != "", flags.noisyTargetsReport} {
+			if set {
+				modes++
+			}
+		}
+		if modes > 1 {
+			return nil, fmt.Errorf("only one of -target-history, -last-change and -noisy-targets-report can be used")
+		}
+		if flags.historyStore == "" {
+			return nil, fmt.Errorf("-target-history, -last-change and -noisy-targets-report require -history-store")
+		}
+		if flag.NArg() > 0 {
+			return nil, fmt.Errorf("positional arguments can't be used with -target-history, -last-change or -noisy-targets-report")
+		}
+		if flags.noisyTargetsMinPercent < 0 || flags.noisyTargetsMinPercent > 100 {
+			return nil, fmt.Errorf("-noisy-targets-min-percent must be between 0 and 100, saw: %d", flags.noisyTargetsMinPercent)
+		}
+		return &flags, nil
+	}
+	if flags.historyStore != "" || flags.historySince != "" {
+		return nil, fmt.Errorf("-history-store and -history-since can only be used with -target-history, -last-change or -noisy-targets-report")
+	}
+
+	if flags.queryResults != "" {
+		if flags.resultsDB == "" {
+			return nil, fmt.Errorf("-query-results requires -results-db")
+		}
+		if flag.NArg() > 0 {
+			return nil, fmt.Errorf("positional arguments can't be used with -query-results")
+		}
+		if err := pkg.RequireCommand("sqlite3", "-results-db"); err != nil {
+			return nil, err
+		}
+		return &flags, nil
+	}
+
+	if canonicalizeSnapshot {
+		if flag.NArg() != 1 && flag.NArg() != 2 {
+			return nil, fmt.Errorf("expected one or two positional arguments with -canonicalize-snapshot, <input> and optionally <output>, but got %d", flag.NArg())
+		}
+		flags.canonicalizeSnapshot = flag.Args()
+		return &flags, nil
+	}
+
+	if exportSnapshot || exportResults {
+		if exportSnapshot && exportResults {
+			return nil, fmt.Errorf("-export-snapshot and -export-results can't be used together")
+		}
+		if flag.NArg() != 2 {
+			return nil, fmt.Errorf("expected two positional arguments with -export-snapshot or -export-results, <input> and <output>, but got %d", flag.NArg())
+		}
+		if pkg.ExportsParquet(flag.Arg(1)) {
+			if err := pkg.RequireCommand("duckdb", "Exporting to Parquet"); err != nil {
+				return nil, err
+			}
+		}
+		if exportSnapshot {
+			flags.exportSnapshot = flag.Args()
+		} else {
+			flags.exportResults = flag.Args()
+		}
+		return &flags, nil
+	}
+
+	if federationConfig != "" {
+		if flag.NArg() > 0 {
+			return nil, fmt.Errorf("positional arguments can't be used with -federation-config")
+		}
+		var err error
+		if flags.federation, err = pkg.LoadFederationConfig(federationConfig); err != nil {
+			return nil, err
+		}
+		return &flags, nil
+	}
+
+	if replayManifest != "" {
+		if flag.NArg() > 0 {
+			return nil, fmt.Errorf("positional arguments can't be used with -replay-manifest")
+		}
+		var err error
+		if flags.replay, err = pkg.LoadRunManifest(replayManifest); err != nil {
+			return nil, err
+		}
+		if err := flag.CommandLine.Parse(flags.replay.Args); err != nil {
+			return nil, fmt.Errorf("failed to parse arguments from %s: %w", replayManifest, err)
+		}
+		flags.args = flags.replay.Args
+		// Replays shouldn't have side effects.
+		flags.runManifest = ""
+		flags.summaryHistoryFile = ""
+		flags.summaryEndpoint = ""
+		flags.beforeHashesOutput = ""
+		flags.afterHashesOutput = ""
+		flags.fastResultsFile = ""
+		flags.languageTargetsDir = ""
+		flags.shardDir = ""
+		flags.deployableTargetsFile = ""
+		flags.apiTargetsFile = ""
+		flags.shadowReportFile = ""
+		flags.evidenceManifest = ""
+		flags.resultsDB = ""
+	}
+	if flags.resultsDB != "" {
+		if err := pkg.RequireCommand("sqlite3", "-results-db"); err != nil {
+			return nil, err
+		}
+	}
+
+	if flags.gitHubAction {
+		if flags.replay != nil || flags.whatIf != "" || len(flags.whatIfBazelOpts) > 0 || flags.verifyHashes != "" || flags.backfillHashStore != "" || flags.singleRevision {
+			return nil, fmt.Errorf("-github-action can't be used with -replay-manifest, -what-if, -what-if-bazel-opt, -verify-hashes, -backfill-hash-store or -single-revision")
+		}
+		var err error
+		if flags.gitHubActionEnvironment, err = pkg.LoadGitHubActionEnvironment(os.Getenv); err != nil {
+			return nil, err
+		}
+		flags.commonFlags.DefaultBeforeRevision = flags.gitHubActionEnvironment.BeforeSHA
+		if flags.beforeHashStore != "" && flags.afterHashesOutput == "" {
+			flags.afterHashesOutput = pkg.StoredHashesLocation(flags.beforeHashStore, flags.gitHubActionEnvironment.SHA)
+		}
+	}
+
+	if flags.whatIf != "" {
+		if flags.changedFiles != "" {
+			return nil, fmt.Errorf("-what-if and -changed-files can't be used together")
+		}
+		flags.singleRevision = true
+		flags.commonFlags.DefaultBeforeRevision = "HEAD"
+	}
+	if flags.verifyHashes != "" {
+		if flags.singleRevision || len(flags.whatIfBazelOpts) > 0 || flags.fastResultsFile != "" || len(flags.platforms) > 0 || flags.beforeHashesOutput != "" || flags.afterHashesOutput != "" || flags.beforeHashFile != "" || flags.beforeHashStore != "" {
+			return nil, fmt.Errorf("-verify-hashes can't be used with -what-if, -what-if-bazel-opt, -single-revision, -fast-results-file, -platforms, -before-hashes-output, -after-hashes-output, -before-hash-file or -before-hash-store")
+		}
+		flags.commonFlags.DefaultBeforeRevision = "HEAD"
+	}
+	if flags.watchBranch != "" {
+		if flags.backfillHashStore == "" {
+			return nil, fmt.Errorf("-watch-branch requires -backfill-hash-store")
+		}
+		if flags.backfillEvery != 1 {
+			return nil, fmt.Errorf("-backfill-every can't be used with -watch-branch")
+		}
+		if flags.watchInterval <= 0 {
+			return nil, fmt.Errorf("-watch-interval must be positive, saw: %v", flags.watchInterval)
+		}
+	}
+	if flags.backfillHashStore != "" {
+		if flags.backfillSince == "" && flags.watchBranch == "" {
+			return nil, fmt.Errorf("-backfill-hash-store requires -backfill-since or -watch-branch")
+		}
+		if flags.backfillEvery < 1 {
+			return nil, fmt.Errorf("-backfill-every must be at least 1, saw: %d", flags.backfillEvery)
+		}
+		if flags.verifyHashes != "" || flags.singleRevision || len(flags.whatIfBazelOpts) > 0 || flags.fastResultsFile != "" || len(flags.platforms) > 0 || flags.beforeHashesOutput != "" || flags.afterHashesOutput != "" || flags.beforeHashFile != "" || flags.beforeHashStore != "" {
+			return nil, fmt.Errorf("-backfill-hash-store can't be used with -verify-hashes, -what-if, -what-if-bazel-opt, -single-revision, -fast-results-file, -platforms, -before-hashes-output, -after-hashes-output, -before-hash-file or -before-hash-store")
+		}
+		flags.commonFlags.DefaultBeforeRevision = "HEAD"
+	}
+	if len(flags.whatIfBazelOpts) > 0 {
+		if flags.singleRevision || flags.fastResultsFile != "" || len(flags.platforms) > 0 || flags.beforeHashesOutput != "" || flags.afterHashesOutput != "" || flags.beforeHashFile != "" || flags.beforeHashStore != "" {
+			return nil, fmt.Errorf("-what-if-bazel-opt can't be used with -what-if, -single-revision, -fast-results-file, -platforms, -before-hashes-output, -after-hashes-output, -before-hash-file or -before-hash-store")
+		}
+		flags.commonFlags.DefaultBeforeRevision = "HEAD"
+	}
+
+	if flags.noResultCache || flags.replay != nil {
+		flags.resultCache = ""
+	}
+	if flags.resultCache != "" {
+		if uncacheable := uncacheableFlags(flag.CommandLine); len(uncacheable) > 0 {
+			pkg.Progressf("Not using the result cache because %s may have effects beyond the output", strings.Join(uncacheable, ", "))
+			flags.resultCache = ""
+		} else {
+			if pkg.IsRemoteResultCache(flags.resultCache) && flags.hashesVerifyKey == "" {
+				// Anyone who can write to the cache could otherwise inject results.
+				log.Printf("WARN: Not using remote result cache %s because -hashes-verify-key isn't set, so cached results can't be verified", flags.resultCache)
+				flags.resultCache = ""
+			} else if flags.resultCache == "default" {
+				resultCache, err := pkg.DefaultResultCache()
+				if err != nil {
+					return nil, err
+				}
+				flags.resultCache = resultCache
+			}
+			flag.Visit(func(f *flag.Flag) {
+				switch f.Name {
+				case "result-cache", "no-result-cache", "result-cache-ttl", "is-affected", "hashes-signing-key", "hashes-verify-key":
+				default:
+					flags.resultCacheFlags = append(flags.resultCacheFlags, f.Name+"="+f.Value.String())
+				}
+			})
+		}
+	}
+
+	var err error
+	flags.revisionBefore, err = cli.ValidateCommonFlags("target-determinator", flags.commonFlags)
+	if err != nil {
+		return nil, err
+	}
+	if flags.replay != nil {
+		flags.revisionBefore = flags.replay.BeforeRevision.Sha
+	}
+	if (flags.repositoryURL == "") != (flags.afterRevision == "") {
+		return nil, fmt.Errorf("-repository-url and -after-revision must be used together")
+	}
+	if flags.repositoryURL != "" && flags.replay != nil {
+		return nil, fmt.Errorf("-repository-url can't be used with -replay-manifest")
+	}
+	if flags.hashesOutputFormat != "json" && flags.hashesOutputFormat != "proto" {
+		return nil, fmt.Errorf("unexpected value for flag -hashes-output-format - allowed values: json|proto, saw: %s", flags.hashesOutputFormat)
+	}
+	switch flags.hashesOutputCompression {
+	case "auto", "none", "gzip", "zstd":
+	default:
+		return nil, fmt.Errorf("unexpected value for flag -hashes-output-compression - allowed values: auto|none|gzip|zstd, saw: %s", flags.hashesOutputCompression)
+	}
+	switch flags.beforeHashFileConflictPolicy {
+	case "fail", "first", "last":
+	default:
+		return nil, fmt.Errorf("unexpected value for flag -before-hash-file-conflict-policy - allowed values: fail|first|last, saw: %s", flags.beforeHashFileConflictPolicy)
+	}
+	if flags.hashesOutputShards < 1 {
+		return nil, fmt.Errorf("-hashes-output-shards must be at least 1, saw: %d", flags.hashesOutputShards)
+	}
+	switch flags.format {
+	case "labels":
+		if flags.bazelExprChunkSize != 0 || flags.unionRdepsDepth != 0 {
+			return nil, fmt.Errorf("-bazel-expr-chunk-size and -union-rdeps-depth can only be used with -format=bazel-expr")
+		}
+	case "bazel-expr":
+		if flags.verbose || len(flags.platforms) > 0 || len(flags.isAffected) > 0 {
+			return nil, fmt.Errorf("-format=bazel-expr can't be used with -verbose, -platforms or -is-affected")
+		}
+		if flags.bazelExprChunkSize < 0 || flags.unionRdepsDepth < 0 {
+			return nil, fmt.Errorf("-bazel-expr-chunk-size and -union-rdeps-depth can't be negative")
+		}
+		// Each rdeps expression is evaluated by Bazel as a single query, so is bounded like ours.
+		if flags.unionRdepsDepth > 0 && flags.bazelExprChunkSize == 0 {
+			flags.bazelExprChunkSize = flags.commonFlags.QueryChunkSize
+		}
+	default:
+		return nil, fmt.Errorf("unexpected value for flag -format - allowed values: labels|bazel-expr, saw: %s", flags.format)
+	}
+	switch flags.order {
+	case "", "distance":
+	default:
+		return nil, fmt.Errorf("unexpected value for flag -order - allowed values: distance, saw: %s", flags.order)
+	}
+	if flags.includeBreakdown && flags.beforeHashesOutput == "" && flags.afterHashesOutput == "" {
+		return nil, fmt.Errorf("-include-breakdown can only be used with -before-hashes-output or -after-hashes-output")
+	}
+	if flags.sourceFilesLimit < 0 {
+		return nil, fmt.Errorf("-source-files-limit can't be negative")
+	}
+	if flags.sourceFilesLimit > 0 && flags.beforeHashesOutput == "" && flags.afterHashesOutput == "" {
+		return nil, fmt.Errorf("-source-files-limit can only be used with -before-hashes-output or -after-hashes-output")
+	}
+	if flags.hashesOutputBase != "" && flags.beforeHashesOutput == "" && flags.afterHashesOutput == "" {
+		return nil, fmt.Errorf("-hashes-output-base can only be used with -before-hashes-output or -after-hashes-output")
+	}
+	if flags.hashesSigningKey != "" && flags.beforeHashesOutput == "" && flags.afterHashesOutput == "" && !pkg.IsRemoteResultCache(flags.resultCache) {
+		return nil, fmt.Errorf("-hashes-signing-key can only be used with -before-hashes-output, -after-hashes-output or a remote -result-cache")
+	}
+	switch flags.shardBy {
+	case "":
+		if flags.shardDir != "" {
+			return nil, fmt.Errorf("-shard-dir can only be used with -shard-by")
+		}
+	case "codeowners":
+		if flags.shardDir == "" && flags.replay == nil {
+			return nil, fmt.Errorf("-shard-by requires -shard-dir")
+		}
+	default:
+		return nil, fmt.Errorf("unexpected value for flag -shard-by - allowed values: codeowners, saw: %s", flags.shardBy)
+	}
+	if flags.complianceExitCode != 0 {
+		if flags.complianceConfig == "" {
+			return nil, fmt.Errorf("-compliance-exit-code can only be used with -compliance-config")
+		}
+		if flags.complianceExitCode < 2 || flags.complianceExitCode > 125 {
+			return nil, fmt.Errorf("-compliance-exit-code must be between 2 and 125, saw: %d", flags.complianceExitCode)
+		}
+	}
+	if flags.shadowReportFile != "" && flags.legacyTargetsFile == "" {
+		return nil, fmt.Errorf("-shadow-report-file can only be used with -legacy-targets-file")
+	}
+	if flags.beforeHashStore != "" && flags.beforeHashFile != "" {
+		return nil, fmt.Errorf("-before-hash-store and -before-hash-file can't be used together")
+	}
+	if len(flags.platforms) > 0 && (flags.beforeHashesOutput != "" || flags.afterHashesOutput != "" || flags.beforeHashFile != "" || flags.beforeHashStore != "") {
+		return nil, fmt.Errorf("-before-hashes-output, -after-hashes-output, -before-hash-file and -before-hash-store can't be used with -platforms")
+	}
+	if flags.changedFiles != "" && !flags.singleRevision && flags.fastResultsFile == "" {
+		return nil, fmt.Errorf("-changed-files can only be used with -single-revision or -fast-results-file")
+	}
+	if flags.fastResultsFile != "" && flags.singleRevision {
+		return nil, fmt.Errorf("-fast-results-file can't be used with -single-revision")
+	}
+	if flags.singleRevision && (len(flags.platforms) > 0 || flags.beforeHashesOutput != "" || flags.afterHashesOutput != "" || flags.beforeHashFile != "" || flags.beforeHashStore != "") {
+		return nil, fmt.Errorf("-single-revision can't be used with -platforms, -before-hashes-output, -after-hashes-output, -before-hash-file or -before-hash-store")
+	}
+	return &flags, nil
+}
+
+func resolveConfig(flags targetDeterminatorFlags) (*config, error) {
+	if flags.beforeHashStore != "" {
+		sha, location, err := pkg.FindStoredHashes(*flags.commonFlags.WorkingDirectory, flags.beforeHashStore, flags.revisionBefore, flags.beforeHashStoreMaxAncestors)
+		if err != nil {
+			return nil, err
+		}
+		if sha == "" {
+			return nil, fmt.Errorf("no hashes found in %s for %s or its %d closest first-parent ancestors", flags.beforeHashStore, flags.revisionBefore, flags.beforeHashStoreMaxAncestors)
+		}
+		pkg.Progressf("Using hashes from %s, comparing against %s", location, sha)
+		flags.revisionBefore = sha
+		flags.beforeHashFile = location
+	}
+	filterPatterns, err := pkg.NewTargetPatternFilter(flags.filterPatterns)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -filter-pattern: %w", err)
+	}
+	var whatIf []string
+	if flags.whatIf != "" {
+		whatIf = strings.Split(flags.whatIf, ",")
+	}
+	commonArgs, err := cli.ResolveCommonConfig(flags.commonFlags, flags.revisionBefore)
+	if err != nil {
+		return nil, err
+	}
+	if flags.gitHubActionEnvironment != nil {
+		if err := pkg.CheckGitHubActionCheckout(commonArgs.Context.WorkspacePath, flags.gitHubActionEnvironment); err != nil {
+			return nil, err
+		}
+	}
+	var codeOwners *pkg.CodeOwners
+	if flags.shardBy == "codeowners" && flags.shardDir != "" {
+		if codeOwners, err = pkg.LoadCodeOwners(commonArgs.Context.WorkspacePath); err != nil {
+			return nil, err
+		}
+	}
+	var complianceConfig *pkg.ComplianceConfig
+	if flags.complianceConfig != "" {
+		if complianceConfig, err = pkg.LoadComplianceConfig(flags.complianceConfig); err != nil {
+			return nil, err
+		}
+	}
+	commonArgs.Context.BeforeHashesOutputFile = flags.beforeHashesOutput
+	commonArgs.Context.AfterHashesOutputFile = flags.afterHashesOutput
+	commonArgs.Context.AnonymizeHashOutputs = flags.anonymizeHashesOutput
+	commonArgs.Context.AnonymizationSalt = flags.anonymizationSalt
+	commonArgs.Context.HashesOutputFormat = flags.hashesOutputFormat
+	commonArgs.Context.HashesOutputCompression = flags.hashesOutputCompression
+	commonArgs.Context.HashesOutputShards = flags.hashesOutputShards
+	commonArgs.Context.IncludeHashBreakdown = flags.includeBreakdown
+	commonArgs.Context.SourceFilesLimit = flags.sourceFilesLimit
+	commonArgs.Context.HashesOutputBase = flags.hashesOutputBase
+	if flags.hashesSigningKey != "" {
+		if commonArgs.Context.HashesSigningKey, err = pkg.LoadSigningKey(flags.hashesSigningKey); err != nil {
+			return nil, err
+		}
+	}
+	if flags.hashesVerifyKey != "" {
+		if commonArgs.Context.HashesVerifyKey, err = pkg.LoadVerifyKey(flags.hashesVerifyKey); err != nil {
+			return nil, err
+		}
+	}
+	if flags.summaryHistoryFile != "" || flags.summaryEndpoint != "" {
+		commonArgs.Context.ResourceAccounting = pkg.NewResourceAccounting()
+	}
+	commonArgs.Context.BeforeHashesFile = flags.beforeHashFile
+	commonArgs.Context.PersistedHashConflictPolicy = flags.beforeHashFileConflictPolicy
+
+	return &config{
+		Context:                commonArgs.Context,
+		RevisionBefore:         commonArgs.RevisionBefore,
+		Targets:                commonArgs.Targets,
+		Verbose:                flags.verbose,
+		ShutdownBazelAfter:     commonArgs.ShutdownBazelAfter,
+		Platforms:              flags.platforms,
+		SummaryHistoryFile:     flags.summaryHistoryFile,
+		SummaryEndpoint:        flags.summaryEndpoint,
+		RunManifest:            flags.runManifest,
+		Args:                   flags.args,
+		BazelStartupOpts:       *flags.commonFlags.BazelStartupOpts,
+		SingleRevision:         flags.singleRevision,
+		ChangedFiles:           flags.changedFiles,
+		WhatIf:                 whatIf,
+		WhatIfBazelOpts:        flags.whatIfBazelOpts,
+		VerifyHashes:           flags.verifyHashes,
+		BackfillHashStore:      flags.backfillHashStore,
+		BackfillSince:          flags.backfillSince,
+		BackfillEvery:          flags.backfillEvery,
+		BackfillMergesOnly:     flags.backfillMerges,
+		WatchBranch:            flags.watchBranch,
+		WatchRemote:            flags.watchRemote,
+		WatchInterval:          flags.watchInterval,
+		FastResultsFile:        flags.fastResultsFile,
+		ResultCache:            flags.resultCache,
+		ResultCacheTTL:         flags.resultCacheTTL,
+		ResultCacheFlags:       flags.resultCacheFlags,
+		IsAffected:             flags.isAffected,
+		Format:                 flags.format,
+		BazelExprChunkSize:     flags.bazelExprChunkSize,
+		UnionRdepsDepth:        flags.unionRdepsDepth,
+		Order:                  flags.order,
+		LanguageSummary:        flags.languageSummary,
+		LanguageTargetsDir:     flags.languageTargetsDir,
+		CodeOwners:             codeOwners,
+		ShardDir:               flags.shardDir,
+		DeployableTargetsFile:  flags.deployableTargetsFile,
+		DeployableKinds:        strings.Split(flags.deployableKinds, ","),
+		APIReport:              flags.apiReport,
+		APITargetsFile:         flags.apiTargetsFile,
+		APIKinds:               strings.Split(flags.apiKinds, ","),
+		ComplianceConfig:       complianceConfig,
+		ComplianceExitCode:     flags.complianceExitCode,
+		LegacyTargetsFile:      flags.legacyTargetsFile,
+		ShadowReportFile:       flags.shadowReportFile,
+		EvidenceManifest:       flags.evidenceManifest,
+		FilterPatterns:         filterPatterns,
+		ExcludeExternalTargets: flags.excludeExternalTargets,
+		ResultsDB:              flags.resultsDB,
+		GitHubAction:           flags.gitHubActionEnvironment,
+	}, nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+)
+
+// runStandaloneMode runs the mode flags selects if it's one which doesn't determine affected
+// targets in a workspace, but e.g. compares or exports the outputs of earlier runs, and returns
+// whether it did.
+func runStandaloneMode(flags *targetDeterminatorFlags) bool {
+	if flags.compareResults != nil {
+		differ, err := printResultDifferences(flags.compareResults[0], flags.compareResults[1], flags.commonFlags.NoColor)
+		if err != nil {
+			log.Fatalf("Failed to compare results: %v", err)
+		}
+		if differ {
+			os.Exit(1)
+		}
+		return true
+	}
+
+	if flags.diffSnapshots != nil && flags.diffFormat == "equal" {
+		equal, err := snapshotsEqual(flags)
+		if err != nil {
+			log.Fatalf("Failed to compare hashes: %v", err)
+		}
+		if !equal {
+			os.Exit(1)
+		}
+		return true
+	}
+
+	if flags.diffSnapshots != nil {
+		if err := printSnapshotDifferences(flags); err != nil {
+			log.Fatalf("Failed to compare hashes: %v", err)
+		}
+		return true
+	}
+
+	if flags.diffSnapshotsBatch != "" {
+		if err := writeBatchSnapshotDifferences(flags); err != nil {
+			log.Fatalf("Failed to compare hashes: %v", err)
+		}
+		return true
+	}
+
+	if flags.targetHistory != "" {
+		if err := printTargetHistory(flags); err != nil {
+			log.Fatalf("Failed to find the changes to %s: %v", flags.targetHistory, err)
+		}
+		return true
+	}
+
+	if flags.noisyTargetsReport {
+		if err := printNoisyTargets(flags); err != nil {
+			log.Fatalf("Failed to find noisy targets: %v", err)
+		}
+		return true
+	}
+
+	if flags.lastChange != "" {
+		if err := printLastChange(flags); err != nil {
+			log.Fatalf("Failed to find the last change to %s: %v", flags.lastChange, err)
+		}
+		return true
+	}
+
+	if flags.queryResults != "" {
+		output, err := pkg.QueryResultsDB(flags.resultsDB, flags.queryResults)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(output)
+		return true
+	}
+
+	if flags.exportSnapshot != nil {
+		var verifyKey ed25519.PublicKey
+		if flags.hashesVerifyKey != "" {
+			var err error
+			if verifyKey, err = pkg.LoadVerifyKey(flags.hashesVerifyKey); err != nil {
+				log.Fatal(err)
+			}
+		}
+		data, err := pkg.LoadVerifiedPersistedHashes(flags.exportSnapshot[0], "fail", verifyKey)
+		if err == nil {
+			err = pkg.ExportSnapshot(flags.exportSnapshot[1], data)
+		}
+		if err != nil {
+			log.Fatalf("Failed to export hashes: %v", err)
+		}
+		return true
+	}
+
+	if flags.canonicalizeSnapshot != nil {
+		if err := writeCanonicalSnapshot(flags); err != nil {
+			log.Fatalf("Failed to canonicalize hashes: %v", err)
+		}
+		return true
+	}
+
+	if flags.exportResults != nil {
+		targets, err := pkg.LoadResults(flags.exportResults[0])
+		if err == nil {
+			err = pkg.ExportResults(flags.exportResults[1], targets)
+		}
+		if err != nil {
+			log.Fatalf("Failed to export results: %v", err)
+		}
+		return true
+	}
+
+	if flags.federation != nil {
+		affected, err := determineFederatedTargets(flags.federation)
+		if err != nil {
+			fmt.Println("Target Determinator invocation Error")
+			log.Fatal(err)
+		}
+		for _, target := range affected {
+			fmt.Println(target)
+		}
+		return true
+	}
+	return false
+}
+
+// verifyHashes prints the targets whose hashes in the working directory differ from those in
+// config.VerifyHashes, and fails if there are any.
+func verifyHashes(config *config, finishReplay func()) {
+	mismatches, err := pkg.VerifyPersistedHashes(config.Context, config.VerifyHashes, config.Targets)
+	shutdownBazelServers(config)
+	finishReplay()
+	if err != nil {
+		fmt.Println("Target Determinator invocation Error")
+		log.Fatal(err)
+	}
+	for _, mismatch := range mismatches {
+		fmt.Println(mismatch)
+	}
+	if len(mismatches) > 0 {
+		log.Fatalf("%d target hashes differ from %s", len(mismatches), config.VerifyHashes)
+	}
+	pkg.Progressf("All target hashes match %s", config.VerifyHashes)
+}
+
+// backfillHashStore writes hashes for the commits selected by the -backfill-* flags to
+// config.BackfillHashStore, and prints the locations it wrote.
+func backfillHashStore(config *config, finishReplay func()) {
+	commits, err := pkg.BackfillCommits(config.Context.WorkspacePath, config.BackfillSince, config.Context.OriginalRevision.GitRevision.Sha, config.BackfillEvery, config.BackfillMergesOnly)
+	var written []string
+	if err == nil {
+		written, err = pkg.BackfillHashStore(config.Context, config.BackfillHashStore, commits, config.Targets)
+	}
+	shutdownBazelServers(config)
+	finishReplay()
+	for _, location := range written {
+		fmt.Println(location)
+	}
+	if err != nil {
+		fmt.Println("Target Determinator invocation Error")
+		log.Fatal(err)
+	}
+	pkg.Progressf("Wrote hashes for %d of %d commits to %s; the others already had them", len(written), len(commits), config.BackfillHashStore)
+}
+
+// watchBranch writes hashes for the new commits on config.WatchBranch to config.BackfillHashStore
+// every config.WatchInterval, forever.
+func watchBranch(config *config, finishReplay func()) {
+	err := pkg.WatchBranch(config.Context, config.BackfillHashStore, config.WatchRemote, config.WatchBranch, config.BackfillSince, config.BackfillMergesOnly, config.WatchInterval, 0, config.Targets)
+	shutdownBazelServers(config)
+	finishReplay()
+	if err != nil {
+		fmt.Println("Target Determinator invocation Error")
+		log.Fatal(err)
+	}
+}
+
+// determineFederatedTargets runs this binary in each repository in federation, and combines the
+// results.
+func determineFederatedTargets(federation *pkg.FederationConfig) ([]string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find executable: %w", err)
+	}
+	affected := make(map[string][]string, len(federation.Repositories))
+	for _, repository := range federation.Repositories {
+		pkg.Progressf("Determining affected targets in repository %s at %s", repository.Name, repository.Path)
+		args := append([]string{"-working-directory", repository.Path}, repository.Args...)
+		args = append(args, repository.BeforeRevision)
+		cmd := exec.Command(executable, args...)
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("failed to determine affected targets in repository %s: %w", repository.Name, err)
+		}
+		for _, line := range strings.Split(stdout.String(), "\n") {
+			if target, _, _ := strings.Cut(line, " "); target != "" {
+				affected[repository.Name] = append(affected[repository.Name], target)
+			}
+		}
+	}
+	return pkg.CombineFederatedResults(federation, affected), nil
+}
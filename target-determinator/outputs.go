@@ -0,0 +1,638 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/version"
+	gazelle_label "github.com/bazelbuild/bazel-gazelle/label"
+)
+
+// seenKey identifies an affected target which has been output.
+type seenKey struct {
+	platform string
+	label    gazelle_label.Label
+}
+
+// affectedTargets collects the affected targets as they're found, and everything which is output
+// about them once they all have been.
+type affectedTargets struct {
+	config     *config
+	seenLabels map[seenKey]struct{}
+	// outputLines are the lines to output, and outputLabels the label of each of them.
+	outputLines  []string
+	outputLabels []string
+	// languageTargets are the affected targets of each language.
+	languageTargets map[string]map[string]bool
+	// shards are the affected targets of each owner, with -shard-dir.
+	shards            map[string]map[string]bool
+	deployableTargets map[string]bool
+	apiTargets        map[string]bool
+	complianceTargets map[string]bool
+	// toolchainResolutionTargets are the targets only affected by toolchain resolution changes, with
+	// -toolchain-resolution-changes=report.
+	toolchainResolutionTargets map[string]bool
+	resultsDBTargets           []pkg.ResultsDBTarget
+	// evidence maps each affected target to the differences which caused it to be affected, when
+	// writing an evidence manifest.
+	evidence map[string][]string
+	// dependencies are the direct dependencies of each affected target, including those which aren't
+	// output, when ordering by distance.
+	dependencies map[string][]string
+}
+
+func newAffectedTargets(config *config) *affectedTargets {
+	return &affectedTargets{
+		config:                     config,
+		seenLabels:                 make(map[seenKey]struct{}),
+		languageTargets:            make(map[string]map[string]bool),
+		shards:                     make(map[string]map[string]bool),
+		deployableTargets:          make(map[string]bool),
+		apiTargets:                 make(map[string]bool),
+		complianceTargets:          make(map[string]bool),
+		toolchainResolutionTargets: make(map[string]bool),
+		evidence:                   make(map[string][]string),
+		dependencies:               make(map[string][]string),
+	}
+}
+
+// add records an affected target, and prints it straight away if nothing needs to be known about
+// the other affected targets to do so.
+func (a *affectedTargets) add(platform string, label gazelle_label.Label, differences []pkg.Difference, configuredTarget *analysis.ConfiguredTarget) {
+	if a.config.Order == "distance" {
+		a.dependencies[label.String()] = append(a.dependencies[label.String()], pkg.DirectDependencies(configuredTarget)...)
+	}
+	if !a.config.outputs(label) {
+		return
+	}
+	key := seenKey{platform: platform, label: label}
+	if a.config.EvidenceManifest != "" {
+		for _, difference := range differences {
+			a.evidence[label.String()] = appendIfMissing(a.evidence[label.String()], difference.String())
+		}
+		if _, ok := a.evidence[label.String()]; !ok {
+			a.evidence[label.String()] = []string{}
+		}
+	}
+	if !a.config.Verbose {
+		if _, seen := a.seenLabels[key]; seen {
+			return
+		}
+	}
+	var line strings.Builder
+	line.WriteString(label.String())
+	if platform != "" {
+		fmt.Fprintf(&line, " %s", platform)
+	}
+	if len(differences) > 0 && a.config.Verbose {
+		line.WriteString(" Changes:")
+		for i, difference := range differences {
+			if i > 0 {
+				line.WriteString(",")
+			}
+			fmt.Fprintf(&line, " %v", difference.String())
+		}
+	}
+	if len(a.config.IsAffected) == 0 && a.config.Format == "labels" && a.config.Order == "" {
+		fmt.Println(line.String())
+	}
+	a.outputLines = append(a.outputLines, line.String())
+	a.outputLabels = append(a.outputLabels, label.String())
+	_, alreadySeen := a.seenLabels[key]
+	a.seenLabels[key] = struct{}{}
+	language := pkg.LanguageOf(configuredTarget)
+	if a.languageTargets[language] == nil {
+		a.languageTargets[language] = make(map[string]bool)
+	}
+	a.languageTargets[language][label.String()] = true
+	if a.config.CodeOwners != nil {
+		owner := a.config.CodeOwners.ShardFor(label, configuredTarget)
+		if a.shards[owner] == nil {
+			a.shards[owner] = make(map[string]bool)
+		}
+		a.shards[owner][label.String()] = true
+	}
+	if a.config.DeployableTargetsFile != "" && pkg.RuleKindMatches(configuredTarget, a.config.DeployableKinds) {
+		a.deployableTargets[label.String()] = true
+	}
+	if (a.config.APIReport || a.config.APITargetsFile != "") && pkg.RuleKindMatches(configuredTarget, a.config.APIKinds) {
+		a.apiTargets[label.String()] = true
+	}
+	if a.config.ComplianceConfig != nil && a.config.ComplianceConfig.Matches(label, configuredTarget) {
+		a.complianceTargets[label.String()] = true
+	}
+	for _, difference := range differences {
+		if difference.Category == "ToolchainResolutionChanged" {
+			a.toolchainResolutionTargets[label.String()] = true
+		}
+	}
+	if a.config.ResultsDB != "" && !alreadySeen {
+		a.resultsDBTargets = append(a.resultsDBTargets, pkg.ResultsDBTarget{
+			Label:    label,
+			Platform: platform,
+			Kind:     configuredTarget.GetTarget().GetRule().GetRuleClass(),
+			Language: language,
+		})
+	}
+}
+
+// writeOutputs prints the affected targets which weren't printed as they were found, and writes
+// everything else which is output about them, e.g. -shard-dir and -run-manifest, once they all have
+// been found. If replay is set, this run is compared with it, and finishReplay called once it has
+// been. Results are cached under resultCacheKey, unless it's empty.
+func (a *affectedTargets) writeOutputs(start time.Time, resultCacheKey string, replay *pkg.RunManifest, finishReplay func()) {
+	config := a.config
+	var distances map[string]int
+	if config.Order == "distance" {
+		distances = pkg.DependencyDistances(a.dependencies)
+		a.outputLines = sortLinesByDistance(a.outputLines, a.outputLabels, distances)
+		if len(config.IsAffected) == 0 && config.Format == "labels" {
+			for _, line := range a.outputLines {
+				fmt.Println(line)
+			}
+		}
+	}
+
+	// Which targets in packages which failed to load or analyze are affected is unknown, so they're
+	// output as patterns matching all of their targets, after the affected targets.
+	degradedPatterns := config.Context.DegradedPackages.Patterns()
+	if len(degradedPatterns) > 0 {
+		if len(config.IsAffected) == 0 && config.Format == "labels" {
+			for _, pattern := range degradedPatterns {
+				if config.Verbose {
+					fmt.Printf("%s Degraded: failed to load or analyze\n", pattern)
+				} else {
+					fmt.Println(pattern)
+				}
+			}
+		}
+		// The result cache only records affected targets.
+		resultCacheKey = ""
+	}
+
+	if len(config.IsAffected) > 0 {
+		if err := printIsAffected(config.IsAffected, a.outputLines, config.Context.DegradedPackages); err != nil {
+			log.Fatal(err)
+		}
+	} else if config.Format == "bazel-expr" {
+		printBazelExpressions(config, append(a.outputLines, degradedPatterns...))
+	}
+
+	if config.LanguageSummary {
+		logLanguageSummary(a.languageTargets)
+	}
+	if config.LanguageTargetsDir != "" {
+		if err := writeLanguageTargets(config.LanguageTargetsDir, a.languageTargets); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+	}
+
+	if config.ShardDir != "" {
+		if err := pkg.WriteShards(config.ShardDir, a.shards, distances); err != nil {
+			log.Printf("WARN: %v", err)
+		} else {
+			pkg.Progressf("Wrote affected targets for %d owners to %s", len(a.shards), config.ShardDir)
+		}
+	}
+
+	if config.DeployableTargetsFile != "" {
+		if err := writeTargetsFile(config.DeployableTargetsFile, a.deployableTargets); err != nil {
+			log.Printf("WARN: %v", err)
+		} else {
+			pkg.Progressf("Wrote %d affected deployable targets to %s", len(a.deployableTargets), config.DeployableTargetsFile)
+		}
+	}
+
+	if config.APIReport {
+		logAPITargets(a.apiTargets)
+	}
+	if config.APITargetsFile != "" {
+		if err := writeTargetsFile(config.APITargetsFile, a.apiTargets); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+	}
+
+	if config.ComplianceConfig != nil {
+		logComplianceTargets(a.complianceTargets)
+	}
+	if len(a.toolchainResolutionTargets) > 0 {
+		logToolchainResolutionTargets(a.toolchainResolutionTargets)
+	}
+
+	if config.EvidenceManifest != "" {
+		manifest, err := pkg.NewEvidenceManifest(config.Context, config.RevisionBefore, a.evidence)
+		if err == nil {
+			err = pkg.WriteEvidenceManifest(config.EvidenceManifest, manifest)
+		}
+		if err != nil {
+			log.Printf("WARN: %v", err)
+		}
+	}
+
+	if config.ResultsDB != "" {
+		run := pkg.ResultsDBRun{
+			Timestamp:      start,
+			BeforeRevision: config.RevisionBefore.GitRevision.Sha,
+			AfterRevision:  config.Context.OriginalRevision.GitRevision.Sha,
+			Targets:        a.resultsDBTargets,
+		}
+		if err := pkg.StoreResultsInDB(config.ResultsDB, run); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+	}
+
+	if config.LegacyTargetsFile != "" {
+		if err := reportShadowComparison(config, seenLabelStrings(a.seenLabels)); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+	}
+
+	// Results can only be stored in remote caches when they can be signed.
+	if resultCacheKey != "" && (config.Context.HashesSigningKey != nil || !pkg.IsRemoteResultCache(config.ResultCache)) {
+		if err := pkg.StoreCachedResult(config.ResultCache, resultCacheKey, &pkg.CachedResult{Created: start, Lines: a.outputLines}, config.Context.HashesSigningKey); err != nil {
+			log.Printf("WARN: Failed to cache result: %v", err)
+		}
+	}
+
+	if config.RunManifest != "" {
+		if err := writeRunManifest(config, seenLabelStrings(a.seenLabels)); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+	}
+
+	if replay != nil {
+		diverged, err := reportReplayDivergence(config, replay, seenLabelStrings(a.seenLabels))
+		finishReplay()
+		if err != nil {
+			log.Fatalf("Failed to compare replay: %v", err)
+		}
+		if diverged {
+			log.Fatalf("Replay of %s diverged from the recorded run", replay.AfterRevision.Sha)
+		}
+		pkg.Progressf("Replay matched the recorded run")
+	}
+
+	if config.SummaryHistoryFile != "" || config.SummaryEndpoint != "" {
+		writeRunSummary(config, start, len(a.seenLabels))
+	}
+
+	if config.GitHubAction != nil {
+		if err := reportToGitHub(config, seenLabelStrings(a.seenLabels)); err != nil {
+			log.Fatalf("Failed to report affected targets to GitHub: %v", err)
+		}
+	}
+
+	if config.ComplianceExitCode != 0 && len(a.complianceTargets) > 0 {
+		pkg.Progressf("Exiting with status %d because compliance-relevant targets are affected", config.ComplianceExitCode)
+		os.Exit(config.ComplianceExitCode)
+	}
+}
+
+// writeRunSummary appends a summary of this run, which found affectedTargets, to
+// config.SummaryHistoryFile, and posts it to config.SummaryEndpoint, if they're set.
+func writeRunSummary(config *config, start time.Time, affectedTargets int) {
+	config.Context.ResourceAccounting.EndPhase("outputs", 0)
+	summary := pkg.RunSummary{
+		Timestamp:       start,
+		BeforeCommit:    config.RevisionBefore.GitRevision.Sha,
+		AfterCommit:     config.Context.OriginalRevision.GitRevision.Sha,
+		AffectedTargets: affectedTargets,
+		DurationSeconds: time.Since(start).Seconds(),
+		Phases:          config.Context.ResourceAccounting.Phases(),
+	}
+	if usage, ok := pkg.TotalResourceUsage(); ok {
+		summary.ResourceUsage = &usage
+	}
+	if summary.BeforeCommit != "" && summary.AfterCommit != "" {
+		distance, err := pkg.ComputeRevisionDistance(config.Context.WorkspacePath, summary.BeforeCommit, summary.AfterCommit)
+		if err != nil {
+			log.Printf("WARN: %v", err)
+		} else {
+			summary.CommitsBetween = distance.Commits
+			summary.DaysBetween = distance.Age.Hours() / 24
+		}
+	}
+	if config.SummaryHistoryFile != "" {
+		if err := pkg.AppendRunSummary(config.SummaryHistoryFile, summary); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+	}
+	if config.SummaryEndpoint != "" {
+		if err := pkg.PostRunSummary(config.SummaryEndpoint, summary); err != nil {
+			log.Printf("WARN: %v", err)
+		}
+	}
+}
+
+// seenLabelStrings formats seenLabels as they were output, without any changes, sorted.
+func seenLabelStrings(seenLabels map[seenKey]struct{}) []string {
+	labels := make([]string, 0, len(seenLabels))
+	for key := range seenLabels {
+		s := key.label.String()
+		if key.platform != "" {
+			s += " " + key.platform
+		}
+		labels = append(labels, s)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// outputs returns whether the affected target l should be output.
+func (c *config) outputs(l gazelle_label.Label) bool {
+	if c.ExcludeExternalTargets && l.Repo != "" {
+		return false
+	}
+	return c.FilterPatterns.Matches(l)
+}
+
+// sortLinesByDistance returns lines, each of which is output for the corresponding label in labels,
+// sorted as by pkg.SortByDistance, keeping lines for the same label in the order they were output.
+func sortLinesByDistance(lines []string, labels []string, distances map[string]int) []string {
+	indexes := make([]int, len(lines))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return pkg.DistanceLess(labels[indexes[i]], labels[indexes[j]], distances)
+	})
+	sorted := make([]string, 0, len(lines))
+	for _, i := range indexes {
+		sorted = append(sorted, lines[i])
+	}
+	return sorted
+}
+
+// printIsAffected outputs each of labels followed by whether it is affected according to lines,
+// which are the lines which would otherwise have been output, or because it is in one of
+// degradedPackages, which may be nil.
+func printIsAffected(labels []string, lines []string, degradedPackages *pkg.DegradedPackages) error {
+	affected, err := pkg.AffectedLabels(lines, labels)
+	if err != nil {
+		return err
+	}
+	for _, l := range labels {
+		parsed, err := gazelle_label.Parse(l)
+		if err != nil {
+			return fmt.Errorf("failed to parse label %s: %w", l, err)
+		}
+		fmt.Printf("%s %v\n", l, affected[l] || degradedPackages.Contains(parsed))
+	}
+	return nil
+}
+
+// printBazelExpressions outputs the affected targets in lines, which are the lines which would
+// otherwise have been output, as Bazel query expressions, one per line.
+func printBazelExpressions(config *config, lines []string) {
+	for _, expression := range pkg.BazelExpressions(lines, config.BazelExprChunkSize, config.Targets.String(), config.UnionRdepsDepth) {
+		fmt.Println(expression)
+	}
+}
+
+// logLanguageSummary logs how many affected targets there are for each language in
+// languageTargets.
+func logLanguageSummary(languageTargets map[string]map[string]bool) {
+	languages := make([]string, 0, len(languageTargets))
+	for language := range languageTargets {
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	counts := make([]string, 0, len(languages))
+	for _, language := range languages {
+		counts = append(counts, fmt.Sprintf("%s=%d", language, len(languageTargets[language])))
+	}
+	pkg.Progressf("Affected targets by language: %s", strings.Join(counts, ", "))
+}
+
+// writeLanguageTargets writes the affected targets for each language in languageTargets to
+// dir/<language>.txt, one per line, sorted.
+func writeLanguageTargets(dir string, languageTargets map[string]map[string]bool) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	for language, targets := range languageTargets {
+		if err := writeTargetsFile(filepath.Join(dir, language+".txt"), targets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logAPITargets logs a section listing apiTargets, sorted.
+func logAPITargets(apiTargets map[string]bool) {
+	if len(apiTargets) == 0 {
+		pkg.Progressf("No affected API targets")
+		return
+	}
+	labels := make([]string, 0, len(apiTargets))
+	for l := range apiTargets {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	pkg.Progressf("Affected API targets (%d):", len(labels))
+	for _, l := range labels {
+		pkg.Progressf("  %s", l)
+	}
+}
+
+// logComplianceTargets logs a section listing the affected compliance-relevant targets.
+func logComplianceTargets(complianceTargets map[string]bool) {
+	if len(complianceTargets) == 0 {
+		pkg.Progressf("No affected compliance-relevant targets")
+		return
+	}
+	labels := make([]string, 0, len(complianceTargets))
+	for l := range complianceTargets {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	pkg.Progressf("Affected compliance-relevant targets (%d):", len(labels))
+	for _, l := range labels {
+		pkg.Progressf("  %s", l)
+	}
+}
+
+// logToolchainResolutionTargets logs the affected targets which were only affected by toolchain
+// resolution changes, so that -toolchain-resolution-changes=report is visible without -verbose.
+func logToolchainResolutionTargets(targets map[string]bool) {
+	labels := make([]string, 0, len(targets))
+	for l := range targets {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	pkg.Progressf("Targets only affected by toolchain resolution changes (%d):", len(labels))
+	for _, l := range labels {
+		pkg.Progressf("  %s", l)
+	}
+}
+
+// writeTargetsFile writes targets to path, one per line, sorted.
+func writeTargetsFile(path string, targets map[string]bool) error {
+	labels := make([]string, 0, len(targets))
+	for l := range targets {
+		labels = append(labels, l+"\n")
+	}
+	sort.Strings(labels)
+	if err := os.WriteFile(path, []byte(strings.Join(labels, "")), 0644); err != nil {
+		return fmt.Errorf("failed to write affected targets to %s: %w", path, err)
+	}
+	return nil
+}
+
+// appendIfMissing appends s to values if it isn't already there.
+func appendIfMissing(values []string, s string) []string {
+	for _, value := range values {
+		if value == s {
+			return values
+		}
+	}
+	return append(values, s)
+}
+
+// reportShadowComparison logs how the targets in config.LegacyTargetsFile compare with
+// affectedTargets, and writes the comparison to config.ShadowReportFile if set.
+func reportShadowComparison(config *config, affectedTargets []string) error {
+	legacy, err := pkg.LoadResults(config.LegacyTargetsFile)
+	if err != nil {
+		return err
+	}
+	determined := make([]string, 0, len(affectedTargets))
+	seen := make(map[string]bool, len(affectedTargets))
+	for _, line := range affectedTargets {
+		// With -platforms, the same target may be affected for several platforms.
+		if target, _, _ := strings.Cut(line, " "); !seen[target] {
+			seen[target] = true
+			determined = append(determined, target)
+		}
+	}
+	comparison := pkg.CompareShadow(legacy, determined)
+	pkg.Progressf("Compared with %d legacy targets: %d affected targets, %d in both, precision %.3f, recall %.3f", comparison.LegacyTargets, comparison.DeterminedTargets, comparison.BothTargets, comparison.Precision, comparison.Recall)
+	for _, target := range comparison.OnlyLegacy {
+		pkg.Progressf("  Only selected by legacy mechanism: %s", target)
+	}
+	for _, target := range comparison.OnlyDetermined {
+		pkg.Progressf("  Only determined to be affected: %s", target)
+	}
+	if config.ShadowReportFile == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(comparison, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal shadow comparison: %w", err)
+	}
+	if err := os.WriteFile(config.ShadowReportFile, content, 0644); err != nil {
+		return fmt.Errorf("failed to write shadow comparison to %s: %w", config.ShadowReportFile, err)
+	}
+	return nil
+}
+
+func newRunManifest(config *config, affectedTargets []string) (*pkg.RunManifest, error) {
+	manifest, err := pkg.NewRunManifest(config.Context, config.RevisionBefore, config.BazelStartupOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create run manifest: %w", err)
+	}
+	manifest.ToolVersion = version.Version
+	manifest.Args = config.Args
+	manifest.AffectedTargets = affectedTargets
+	return manifest, nil
+}
+
+func writeRunManifest(config *config, affectedTargets []string) error {
+	manifest, err := newRunManifest(config, affectedTargets)
+	if err != nil {
+		return err
+	}
+	return pkg.WriteRunManifest(config.RunManifest, manifest)
+}
+
+// reportReplayDivergence logs how this run differed from the recorded run, and returns whether the
+// affected targets differed.
+func reportReplayDivergence(config *config, recorded *pkg.RunManifest, affectedTargets []string) (bool, error) {
+	replayed, err := newRunManifest(config, affectedTargets)
+	if err != nil {
+		return false, err
+	}
+	for _, difference := range recorded.InputDifferences(replayed) {
+		pkg.Progressf("Replay input differed from the recorded run - %s", difference)
+	}
+	added, removed := recorded.AffectedTargetDifferences(replayed)
+	for _, target := range added {
+		pkg.Progressf("Replay found affected target which the recorded run didn't: %s", target)
+	}
+	for _, target := range removed {
+		pkg.Progressf("Replay didn't find affected target which the recorded run did: %s", target)
+	}
+	return len(added) > 0 || len(removed) > 0, nil
+}
+
+// reportToGitHub writes targets to the step outputs of config.GitHubAction, and posts a comment
+// summarizing them on its pull request, if it has one and a token to post with.
+func reportToGitHub(config *config, targets []string) error {
+	env := config.GitHubAction
+	if env.OutputFile != "" {
+		if err := pkg.WriteGitHubOutputs(env.OutputFile, targets); err != nil {
+			return err
+		}
+	}
+	if env.PullRequest == 0 {
+		return nil
+	}
+	if env.Token == "" {
+		log.Printf("WARN: Not commenting on pull request #%d because GITHUB_TOKEN isn't set", env.PullRequest)
+		return nil
+	}
+	comment := pkg.GitHubSummaryComment(targets, config.RevisionBefore.GitRevision.Sha, env.SHA)
+	if err := pkg.PostGitHubComment(env, comment); err != nil {
+		log.Printf("WARN: %v", err)
+	}
+	return nil
+}
+
+// writeFastResults approximates the affected targets as for -single-revision, and writes them to
+// config.FastResultsFile, one per line, sorted.
+// The file is written atomically, so that anything waiting for it to appear never sees a partial
+// result.
+func writeFastResults(config *config) error {
+	affected := make(map[string]bool)
+	if err := walkAffectedTargetsSingleRevision(config, func(label gazelle_label.Label, _ []pkg.Difference, _ *analysis.ConfiguredTarget) {
+		if config.outputs(label) {
+			affected[label.String()] = true
+		}
+	}); err != nil {
+		return err
+	}
+	if err := replaceTargetsFile(config.FastResultsFile, affected); err != nil {
+		return err
+	}
+	pkg.Progressf("Wrote %d approximate affected targets to %s", len(affected), config.FastResultsFile)
+	return nil
+}
+
+// replaceTargetsFile is like writeTargetsFile, but atomically replaces path, so that anything
+// reading it while it's written, e.g. a CI system which starts building the approximate affected
+// targets early, sees either the old or the new targets.
+func replaceTargetsFile(path string, targets map[string]bool) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write affected targets to %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write affected targets to %s: %w", path, err)
+	}
+	if err := writeTargetsFile(tmp.Name(), targets); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write affected targets to %s: %w", path, err)
+	}
+	return nil
+}
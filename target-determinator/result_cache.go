@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+	"github.com/bazel-contrib/target-determinator/version"
+)
+
+// resultCacheableFlags are the flags which only affect which targets are output, or how, so can be
+// used with the result cache, which skips everything but printing the output on a hit. Runs with
+// any other flag aren't cached, so that new flags, which may have other effects, such as writing
+// files, have to be considered before being cached.
+var resultCacheableFlags = map[string]bool{
+	// Common flags.
+	"working-directory":             true,
+	"bazel":                         true,
+	"bazel-startup-opts":            true,
+	"bazel-opts":                    true,
+	"enforce-clean":                 true,
+	"delete-cached-worktree":        true,
+	"worktree-cache-dir":            true,
+	"ignore-file":                   true,
+	"before-query-error-behavior":   true,
+	"targets":                       true,
+	"analysis-cache-clear-strategy": true,
+	"compare-queries-around-analysis-cache-clear": true,
+	"filter-incompatible-targets":                 true,
+	"ignore-host-toolchains":                      true,
+	"host-toolchain-repository":                   true,
+	"toolchain-resolution-changes":                true,
+	"configuration-enumeration":                   true,
+	"process-revisions-concurrently":              true,
+	"hashing-workers":                             true,
+	"query-chunk-size":                            true,
+	"before-output-base":                          true,
+	"manual-targets":                              true,
+	"keep-going":                                  true,
+	"infra-files-config":                          true,
+	"bazel-server":                                true,
+	"bazel-server-max-heap":                       true,
+	"quiet":                                       true,
+	"no-color":                                    true,
+	// target-determinator flags.
+	"verbose":                          true,
+	"before-hash-file":                 true,
+	"before-hash-store":                true,
+	"before-hash-store-max-ancestors":  true,
+	"before-hash-file-conflict-policy": true,
+	"hashes-signing-key":               true,
+	"hashes-verify-key":                true,
+	"is-affected":                      true,
+	"format":                           true,
+	"order":                            true,
+	"bazel-expr-chunk-size":            true,
+	"union-rdeps-depth":                true,
+	"filter-pattern":                   true,
+	"exclude-external-targets":         true,
+	"platforms":                        true,
+	// The result cache's own flags.
+	"result-cache":     true,
+	"no-result-cache":  true,
+	"result-cache-ttl": true,
+}
+
+// uncacheableFlags returns the flags set in flagSet, formatted like -flag, which prevent the result
+// from being cached. See resultCacheableFlags.
+func uncacheableFlags(flagSet *flag.FlagSet) []string {
+	var uncacheable []string
+	flagSet.Visit(func(f *flag.Flag) {
+		if !resultCacheableFlags[f.Name] {
+			uncacheable = append(uncacheable, "-"+f.Name)
+		}
+	})
+	return uncacheable
+}
+
+// resultCacheKeyFor returns the key to cache the output of config under, or an empty string if it
+// shouldn't be cached.
+func resultCacheKeyFor(config *config) string {
+	if config.ResultCache == "" {
+		return ""
+	}
+	key, err := pkg.ResultCacheKey(config.Context, config.RevisionBefore, config.Targets, config.ResultCacheFlags, config.BazelStartupOpts, version.Version)
+	if err != nil {
+		log.Printf("WARN: Not using result cache: %v", err)
+		return ""
+	}
+	if key == "" {
+		pkg.Progressf("Not using result cache because the working directory has local changes")
+	}
+	return key
+}
+
+// printCachedResult prints the result cached under key, as the run it was cached by did, and
+// returns whether there was one.
+func printCachedResult(config *config, key string) bool {
+	cached, err := pkg.LookupCachedResult(config.ResultCache, key, config.ResultCacheTTL, config.Context.HashesVerifyKey)
+	if err != nil {
+		log.Printf("WARN: Failed to look up cached result: %v", err)
+		return false
+	}
+	if cached == nil {
+		return false
+	}
+	pkg.Progressf("Using result cached at %v in %s", cached.Created.Format(time.RFC3339), config.ResultCache)
+	if len(config.IsAffected) > 0 {
+		if err := printIsAffected(config.IsAffected, cached.Lines, nil); err != nil {
+			log.Fatal(err)
+		}
+	} else if config.Format == "bazel-expr" {
+		printBazelExpressions(config, cached.Lines)
+	} else {
+		for _, line := range cached.Lines {
+			fmt.Println(line)
+		}
+	}
+	return true
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+	"github.com/bazel-contrib/target-determinator/pkg/snapshot"
+)
+
+// printResultDifferences prints the affected targets only in the results in beforePath prefixed
+// with -, and those only in afterPath prefixed with +, and returns whether there were any.
+func printResultDifferences(beforePath string, afterPath string, noColor bool) (bool, error) {
+	before, err := pkg.LoadResults(beforePath)
+	if err != nil {
+		return false, err
+	}
+	after, err := pkg.LoadResults(afterPath)
+	if err != nil {
+		return false, err
+	}
+	added, removed := pkg.DiffTargetLists(before, after)
+	removedColor, addedColor := "", ""
+	if pkg.ShouldColor(os.Stdout, noColor) {
+		removedColor, addedColor = pkg.ColorRed, pkg.ColorGreen
+	}
+	for _, target := range removed {
+		fmt.Println(pkg.Colorize("- "+target, removedColor))
+	}
+	for _, target := range added {
+		fmt.Println(pkg.Colorize("+ "+target, addedColor))
+	}
+	pkg.Progressf("%d affected targets in %s, %d in %s: %d only in %s, %d only in %s", len(before), beforePath, len(after), afterPath, len(removed), beforePath, len(added), afterPath)
+	return len(added) > 0 || len(removed) > 0, nil
+}
+
+// snapshotReadOptions returns the options to read the hash files compared by -diff-snapshots
+// with.
+func snapshotReadOptions(flags *targetDeterminatorFlags) (snapshot.ReadOptions, error) {
+	opts := snapshot.ReadOptions{}
+	if flags.hashesVerifyKey != "" {
+		var err error
+		if opts.VerifyKey, err = pkg.LoadVerifyKey(flags.hashesVerifyKey); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// printSnapshotDifferences prints the targets which differ between the two hash files in
+// flags.diffSnapshots in flags.diffFormat.
+func printSnapshotDifferences(flags *targetDeterminatorFlags) error {
+	if flags.diffStreaming {
+		return printStreamedSnapshotDifferences(flags)
+	}
+	opts, err := snapshotReadOptions(flags)
+	if err != nil {
+		return err
+	}
+	before, err := snapshot.ReadFile(flags.diffSnapshots[0], opts)
+	if err != nil {
+		return err
+	}
+	after, err := snapshot.ReadFile(flags.diffSnapshots[1], opts)
+	if err != nil {
+		return err
+	}
+	return writeSnapshotDifferences(os.Stdout, before, after, flags, pkg.ShouldColor(os.Stdout, flags.commonFlags.NoColor))
+}
+
+// snapshotsEqual returns whether no targets differ between the two hash files in
+// flags.diffSnapshots, for -diff-format equal. Files with the same CanonicalDigest are equal
+// without comparing their targets, which is only needed if their digests differ, e.g. because they
+// were computed at different revisions.
+func snapshotsEqual(flags *targetDeterminatorFlags) (bool, error) {
+	if flags.diffStreaming {
+		return streamedSnapshotsEqual(flags)
+	}
+	opts, err := snapshotReadOptions(flags)
+	if err != nil {
+		return false, err
+	}
+	before, err := snapshot.ReadFile(flags.diffSnapshots[0], opts)
+	if err != nil {
+		return false, err
+	}
+	after, err := snapshot.ReadFile(flags.diffSnapshots[1], opts)
+	if err != nil {
+		return false, err
+	}
+	beforeDigest, err := pkg.CanonicalDigest(before)
+	if err != nil {
+		return false, err
+	}
+	afterDigest, err := pkg.CanonicalDigest(after)
+	if err != nil {
+		return false, err
+	}
+	if beforeDigest == afterDigest {
+		pkg.Progressf("%s and %s have the same canonical digest %s", flags.diffSnapshots[0], flags.diffSnapshots[1], beforeDigest)
+		return true, nil
+	}
+	result, err := snapshot.Diff(before, after, snapshotDiffOptions(flags))
+	if err != nil {
+		return false, err
+	}
+	pkg.Progressf("%d targets added, %d removed and %d changed", len(result.Added), len(result.Removed), len(result.Changed))
+	return len(result.Added) == 0 && len(result.Removed) == 0 && len(result.Changed) == 0, nil
+}
+
+// printStreamedSnapshotDifferences prints the targets which differ between the two hash files in
+// flags.diffSnapshots as text, as they're found by streaming the files.
+func printStreamedSnapshotDifferences(flags *targetDeterminatorFlags) error {
+	color := pkg.ShouldColor(os.Stdout, flags.commonFlags.NoColor)
+	counts := make(map[string]int)
+	err := snapshot.DiffStream(flags.diffSnapshots[0], flags.diffSnapshots[1], snapshotDiffOptions(flags), func(change snapshot.Change) error {
+		counts[change.Status]++
+		if color {
+			return snapshot.WriteColorText(os.Stdout, []snapshot.Change{change})
+		}
+		return snapshot.WriteText(os.Stdout, []snapshot.Change{change})
+	})
+	if err != nil {
+		return err
+	}
+	pkg.Progressf("%d targets added, %d removed and %d changed", counts[snapshot.StatusAdded], counts[snapshot.StatusRemoved], counts[snapshot.StatusChanged])
+	return nil
+}
+
+// errSnapshotsDiffer stops streaming hash files at the first difference, for -diff-format equal.
+var errSnapshotsDiffer = errors.New("snapshots differ")
+
+// streamedSnapshotsEqual returns whether no targets differ between the two hash files in
+// flags.diffSnapshots, streaming them only until the first difference.
+func streamedSnapshotsEqual(flags *targetDeterminatorFlags) (bool, error) {
+	err := snapshot.DiffStream(flags.diffSnapshots[0], flags.diffSnapshots[1], snapshotDiffOptions(flags), func(change snapshot.Change) error {
+		pkg.Progressf("%s is %s", change.Label, change.Status)
+		return errSnapshotsDiffer
+	})
+	if errors.Is(err, errSnapshotsDiffer) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// writeCanonicalSnapshot writes the hash file flags.canonicalizeSnapshot[0] in canonical form to
+// flags.canonicalizeSnapshot[1], or stdout if it isn't set.
+func writeCanonicalSnapshot(flags *targetDeterminatorFlags) error {
+	opts, err := snapshotReadOptions(flags)
+	if err != nil {
+		return err
+	}
+	s, err := snapshot.ReadFile(flags.canonicalizeSnapshot[0], opts)
+	if err != nil {
+		return err
+	}
+	if len(flags.canonicalizeSnapshot) == 1 {
+		return snapshot.WriteCanonical(os.Stdout, s)
+	}
+	content, err := pkg.MarshalCanonicalJSON(s)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(flags.canonicalizeSnapshot[1], content, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", flags.canonicalizeSnapshot[1], err)
+	}
+	return nil
+}
+
+// writeBatchSnapshotDifferences writes the targets which differ between each pair of hash files in
+// the manifest flags.diffSnapshotsBatch to the pair's output file, in flags.diffFormat.
+func writeBatchSnapshotDifferences(flags *targetDeterminatorFlags) error {
+	entries, err := snapshot.LoadBatchManifest(flags.diffSnapshotsBatch)
+	if err != nil {
+		return err
+	}
+	opts, err := snapshotReadOptions(flags)
+	if err != nil {
+		return err
+	}
+	return snapshot.DiffBatch(entries, opts, func(entry snapshot.BatchEntry, before *snapshot.Snapshot, after *snapshot.Snapshot) error {
+		if err := os.MkdirAll(filepath.Dir(entry.Output), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", entry.Output, err)
+		}
+		f, err := os.Create(entry.Output)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", entry.Output, err)
+		}
+		if err := writeSnapshotDifferences(f, before, after, flags, false); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to write %s: %w", entry.Output, err)
+		}
+		pkg.Progressf("Wrote differences between %s and %s to %s", entry.Before, entry.After, entry.Output)
+		return nil
+	})
+}
+
+// snapshotDiffOptions returns the options to compare the hash files in flags with.
+func snapshotDiffOptions(flags *targetDeterminatorFlags) snapshot.DiffOptions {
+	return snapshot.DiffOptions{
+		FilterPatterns:               flags.filterPatterns,
+		MatchConfigurationsByContent: flags.matchConfigurationsByContent,
+		Configurations:               flags.diffConfigurations,
+		IgnoreConfigurations:         flags.ignoreDiffConfigurations,
+		BazelVersionMismatch:         flags.bazelVersionMismatch,
+		Scope:                        flags.diffScope,
+		ExcludeRemoved:               !flags.includeRemoved,
+	}
+}
+
+// writeSnapshotDifferences writes the targets which differ between before and after to w in
+// flags.diffFormat.
+func writeSnapshotDifferences(w io.Writer, before *snapshot.Snapshot, after *snapshot.Snapshot, flags *targetDeterminatorFlags, color bool) error {
+	result, err := snapshot.Diff(before, after, snapshotDiffOptions(flags))
+	if err != nil {
+		return err
+	}
+	changes := result.Changes(before, after)
+	if err := snapshot.SortChanges(changes, flags.diffSort, before, after); err != nil {
+		return err
+	}
+	pkg.Progressf("%d targets added, %d removed and %d changed", len(result.Added), len(result.Removed), len(result.Changed))
+	dependencyChanges := snapshot.DiffDependencies(before, after)
+	switch flags.diffFormat {
+	case "explain":
+		if err := snapshot.WriteExplanation(w, changes, before, after, color); err != nil {
+			return err
+		}
+		return snapshot.WriteDependencyChanges(w, dependencyChanges, color)
+	case "files":
+		if err := snapshot.WriteSourceFileAttribution(w, changes, before, after, color); err != nil {
+			return err
+		}
+		return snapshot.WriteDependencyChanges(w, dependencyChanges, color)
+	}
+	// Other formats are read by tools which expect only targets, so dependency changes are logged.
+	if len(dependencyChanges) > 0 {
+		pkg.Progressf("Dependency changes:")
+		for _, change := range dependencyChanges {
+			pkg.Progressf("%v", change)
+		}
+	}
+	switch flags.diffFormat {
+	case "junit":
+		return snapshot.WriteJUnit(w, changes)
+	case "sarif":
+		return snapshot.WriteSARIF(w, changes)
+	case "json":
+		return snapshot.WriteJSON(w, changes)
+	case "summary":
+		return snapshot.WriteSummary(w, changes, before, after)
+	case "text":
+		if color {
+			return snapshot.WriteColorText(w, changes)
+		}
+	}
+	return snapshot.WriteText(w, changes)
+}
+
+// newHashHistory returns the hash files in flags.historyStore for the first-parent history of the
+// current commit, since flags.historySince.
+func newHashHistory(flags *targetDeterminatorFlags) (*pkg.HashHistory, error) {
+	opts, err := snapshotReadOptions(flags)
+	if err != nil {
+		return nil, err
+	}
+	return pkg.NewHashHistory(*flags.commonFlags.WorkingDirectory, flags.historyStore, "HEAD", flags.historySince, "fail", opts.VerifyKey)
+}
+
+// printTargetHistory prints each change to the hashes of the target flags.targetHistory in
+// flags.historyStore, oldest first.
+func printTargetHistory(flags *targetDeterminatorFlags) error {
+	history, err := newHashHistory(flags)
+	if err != nil {
+		return err
+	}
+	changes, err := history.TargetChanges(flags.targetHistory)
+	if err != nil {
+		return err
+	}
+	for i := range changes {
+		if err := writeHashChange(os.Stdout, &changes[i]); err != nil {
+			return err
+		}
+	}
+	pkg.Progressf("The hashes of %s changed %d times in %d hash files", flags.targetHistory, len(changes), len(history.Commits))
+	return nil
+}
+
+// printNoisyTargets prints the targets in flags.historyStore whose hashes often changed without
+// their package changing, each followed by the suggested causes, indented on the following lines.
+func printNoisyTargets(flags *targetDeterminatorFlags) error {
+	history, err := newHashHistory(flags)
+	if err != nil {
+		return err
+	}
+	noisy, err := history.NoisyTargets(flags.noisyTargetsMinPercent, flags.noisyTargetsMinChanges)
+	if err != nil {
+		return err
+	}
+	for _, target := range noisy {
+		fmt.Printf("%s changed without its package changing in %d of %d comparisons (%d%%)\n", target.Label, target.UnexplainedChanges, target.Comparisons, target.UnexplainedChanges*100/target.Comparisons)
+		for _, cause := range target.Causes {
+			fmt.Printf("  %s (%d of them)\n", cause.Description, cause.Changes)
+		}
+	}
+	pkg.Progressf("Found %d noisy targets in %d hash files", len(noisy), len(history.Commits))
+	return nil
+}
+
+// printLastChange prints the most recent change to the hashes of the target flags.lastChange in
+// flags.historyStore.
+func printLastChange(flags *targetDeterminatorFlags) error {
+	history, err := newHashHistory(flags)
+	if err != nil {
+		return err
+	}
+	change, err := history.LastChange(flags.lastChange)
+	if err != nil {
+		return err
+	}
+	if change == nil {
+		pkg.Progressf("The hashes of %s are the same in all %d hash files", flags.lastChange, len(history.Commits))
+		return nil
+	}
+	return writeHashChange(os.Stdout, change)
+}
+
+// writeHashChange writes the commits change was made between, followed by how the target's hash
+// changed in each configuration, indented on the following lines.
+func writeHashChange(w io.Writer, change *pkg.HashChange) error {
+	line := fmt.Sprintf("%s..%s", change.Before, change.After)
+	if change.BazelReleaseChanged {
+		line += " (Bazel release changed)"
+	}
+	if _, err := fmt.Fprintln(w, line); err != nil {
+		return err
+	}
+	for _, configuration := range change.Configurations() {
+		name := configuration
+		if name == "" {
+			name = "<none>"
+		}
+		beforeHash, inBefore := change.BeforeHashes[configuration]
+		afterHash, inAfter := change.AfterHashes[configuration]
+		var description string
+		switch {
+		case !inBefore:
+			description = fmt.Sprintf("now in configuration %s", name)
+		case !inAfter:
+			description = fmt.Sprintf("no longer in configuration %s", name)
+		default:
+			description = fmt.Sprintf("hash in configuration %s changed from %s to %s", name, beforeHash, afterHash)
+		}
+		if _, err := fmt.Fprintf(w, "  %s\n", description); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@
 // over-building rather than under-building.
 // In verbose mode, the first token per line will be the target to run, and after a space character,
 // additional information may be printed explaining why a target was detected to be affected.
+// If -platforms is passed, the platform the target was affected for is printed after the target.
 
 package main
 
@@ -15,28 +16,14 @@ import (
 	"path/filepath"
 	"time"
 
-	"github.com/bazel-contrib/target-determinator/cli"
 	"github.com/bazel-contrib/target-determinator/pkg"
 	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
 	gazelle_label "github.com/bazelbuild/bazel-gazelle/label"
 )
 
-type targetDeterminatorFlags struct {
-	commonFlags    *cli.CommonFlags
-	revisionBefore string
-	verbose        bool
-}
-
-type config struct {
-	Context        *pkg.Context
-	RevisionBefore pkg.LabelledGitRev
-	Targets        pkg.TargetsList
-	Verbose        bool
-}
-
 func main() {
 	start := time.Now()
-	defer func() { log.Printf("Finished after %v", time.Since(start)) }()
+	defer func() { pkg.Progressf("Finished after %v", time.Since(start)) }()
 
 	flags, err := parseFlags()
 	if err != nil {
@@ -49,70 +36,148 @@ func main() {
 		os.Exit(1)
 	}
 
+	if runStandaloneMode(flags) {
+		return
+	}
+
+	if flags.repositoryURL != "" {
+		cacheDir := *flags.commonFlags.WorktreeCacheDir
+		if cacheDir == "" {
+			if cacheDir, err = pkg.DefaultWorktreeCacheDir(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		clonePath, err := pkg.PrepareRemoteWorkspace(cacheDir, flags.repositoryURL, flags.afterRevision, []string{flags.revisionBefore})
+		if err != nil {
+			fmt.Println("Target Determinator invocation Error")
+			log.Fatalf("Error preparing workspace: %v", err)
+		}
+		*flags.commonFlags.WorkingDirectory = clonePath
+	}
+
+	// When replaying, the recorded "after" revision is checked out until we're done.
+	finishReplay := func() {}
+	if flags.replay != nil {
+		workingDirectory, err := filepath.Abs(*flags.commonFlags.WorkingDirectory)
+		if err != nil {
+			log.Fatalf("Failed to get working directory from %v: %v", *flags.commonFlags.WorkingDirectory, err)
+		}
+		restore, err := pkg.PrepareReplay(workingDirectory, flags.replay, flags.replayRemote)
+		if err != nil {
+			fmt.Println("Target Determinator invocation Error")
+			log.Fatalf("Error preparing replay: %v", err)
+		}
+		finishReplay = func() {
+			if err := restore(); err != nil {
+				log.Printf("WARN: %v", err)
+			}
+		}
+	}
+
 	// Print something on stdout that will make bazel fail when passed as a target.
 	config, err := resolveConfig(*flags)
 	if err != nil {
+		finishReplay()
 		fmt.Println("Target Determinator invocation Error")
 		log.Fatalf("Error during preprocessing: %v", err)
 	}
 
-	seenLabels := make(map[gazelle_label.Label]struct{})
-	callback := func(label gazelle_label.Label, differences []pkg.Difference, configuredTarget *analysis.ConfiguredTarget) {
-		if !config.Verbose {
-			if _, seen := seenLabels[label]; seen {
-				return
-			}
-		}
-		fmt.Print(label)
-		if len(differences) > 0 {
-			fmt.Printf(" Changes:")
-			for i, difference := range differences {
-				if i > 0 {
-					fmt.Print(",")
-				}
-				fmt.Printf(" %v", difference.String())
-			}
+	if config.VerifyHashes != "" {
+		verifyHashes(config, finishReplay)
+		return
+	}
+
+	if config.WatchBranch != "" {
+		watchBranch(config, finishReplay)
+		return
+	}
+
+	if config.BackfillHashStore != "" {
+		backfillHashStore(config, finishReplay)
+		return
+	}
+
+	resultCacheKey := resultCacheKeyFor(config)
+	if resultCacheKey != "" && printCachedResult(config, resultCacheKey) {
+		return
+	}
+
+	affected := newAffectedTargets(config)
+
+	if config.FastResultsFile != "" {
+		if err := writeFastResults(config); err != nil {
+			log.Printf("WARN: Failed to write approximate affected targets to %s: %v", config.FastResultsFile, err)
 		}
-		fmt.Println("")
-		seenLabels[label] = struct{}{}
 	}
 
-	if err := pkg.WalkAffectedTargets(config.Context,
-		config.RevisionBefore,
-		config.Targets,
-		config.Verbose,
-		callback); err != nil {
+	err = walkAffectedTargets(config, affected.add)
+	shutdownBazelServers(config)
+	if err != nil {
+		finishReplay()
 		// Print something on stdout that will make bazel fail when passed as a target.
 		fmt.Println("Target Determinator invocation Error")
 		log.Fatal(err)
 	}
-}
 
-func parseFlags() (*targetDeterminatorFlags, error) {
-	var flags targetDeterminatorFlags
-	flags.commonFlags = cli.RegisterCommonFlags()
-	flag.BoolVar(&flags.verbose, "verbose", false, "Whether to explain (messily) why each target is getting run")
+	config.Context.ResourceAccounting.EndPhase("compare", 0)
 
-	flag.Parse()
+	affected.writeOutputs(start, resultCacheKey, flags.replay, finishReplay)
+}
 
-	var err error
-	flags.revisionBefore, err = cli.ValidateCommonFlags("target-determinator", flags.commonFlags)
-	if err != nil {
-		return nil, err
+// walkAffectedTargets calls callback for each affected target, walking them as config's mode
+// requires. The platform is only non-empty with -platforms.
+func walkAffectedTargets(config *config, callback func(platform string, label gazelle_label.Label, differences []pkg.Difference, configuredTarget *analysis.ConfiguredTarget)) error {
+	includeDifferences := config.Verbose || config.EvidenceManifest != ""
+	withoutPlatform := func(label gazelle_label.Label, differences []pkg.Difference, configuredTarget *analysis.ConfiguredTarget) {
+		callback("", label, differences, configuredTarget)
 	}
-	return &flags, nil
+	if config.SingleRevision {
+		return walkAffectedTargetsSingleRevision(config, withoutPlatform)
+	} else if len(config.WhatIfBazelOpts) > 0 {
+		return pkg.WalkTargetsAffectedByBazelOpts(config.Context,
+			config.WhatIfBazelOpts,
+			config.Targets,
+			includeDifferences,
+			withoutPlatform)
+	} else if len(config.Platforms) > 0 {
+		return pkg.WalkAffectedTargetsForPlatforms(config.Context,
+			config.RevisionBefore,
+			config.Targets,
+			config.Platforms,
+			includeDifferences,
+			callback)
+	}
+	return pkg.WalkAffectedTargets(config.Context,
+		config.RevisionBefore,
+		config.Targets,
+		includeDifferences,
+		withoutPlatform)
 }
 
-func resolveConfig(flags targetDeterminatorFlags) (*config, error) {
-	commonArgs, err := cli.ResolveCommonConfig(flags.commonFlags, flags.revisionBefore)
+func walkAffectedTargetsSingleRevision(config *config, callback pkg.WalkCallback) error {
+	var changedFiles []string
+	var err error
+	if len(config.WhatIf) > 0 {
+		changedFiles, err = pkg.NormalizeHypotheticalPaths(config.Context.WorkspacePath, config.WhatIf)
+	} else if config.ChangedFiles != "" {
+		changedFiles, err = pkg.ReadChangedFiles(config.ChangedFiles)
+	} else {
+		changedFiles, err = pkg.ChangedFilesSince(config.Context.WorkspacePath, config.RevisionBefore)
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
+	pkg.Progressf("Approximating affected targets from %d changed files using only the current working directory state", len(changedFiles))
+	includeDifferences := config.Verbose || config.EvidenceManifest != ""
+	return pkg.WalkAffectedTargetsSingleRevision(config.Context, config.RevisionBefore, changedFiles, config.Targets, includeDifferences, callback)
+}
 
-	return &config{
-		Context:        commonArgs.Context,
-		RevisionBefore: commonArgs.RevisionBefore,
-		Targets:        commonArgs.Targets,
-		Verbose:        flags.verbose,
-	}, nil
+// shutdownBazelServers shuts down the Bazel servers config used, if -shutdown-bazel-after is set.
+func shutdownBazelServers(config *config) {
+	if !config.ShutdownBazelAfter {
+		return
+	}
+	if err := pkg.ShutdownBazelServers(config.Context); err != nil {
+		log.Printf("WARN: %v", err)
+	}
 }
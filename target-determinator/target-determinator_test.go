@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bazel-contrib/target-determinator/pkg"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/analysis"
+	"github.com/bazel-contrib/target-determinator/third_party/protobuf/bazel/build"
+	gazelle_label "github.com/bazelbuild/bazel-gazelle/label"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestUncacheableFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{name: "none", args: nil, want: nil},
+		{name: "cacheable", args: []string{"-result-cache=default", "-verbose", "-targets=//..."}, want: nil},
+		{name: "output file", args: []string{"-result-cache=default", "-run-manifest=manifest.json"}, want: []string{"-run-manifest"}},
+		{name: "unknown to the cache", args: []string{"-new-flag", "-verbose"}, want: []string{"-new-flag"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			flagSet := flag.NewFlagSet("target-determinator", flag.ContinueOnError)
+			flagSet.String("result-cache", "", "")
+			flagSet.Bool("verbose", false, "")
+			flagSet.String("targets", "", "")
+			flagSet.String("run-manifest", "", "")
+			flagSet.Bool("new-flag", false, "")
+			if err := flagSet.Parse(tc.args); err != nil {
+				t.Fatalf("Error parsing flags: %v", err)
+			}
+			if got := uncacheableFlags(flagSet); !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("Wrong uncacheable flags: want %v got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestReplaceTargetsFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "fast_results.txt")
+	if err := os.WriteFile(path, []byte("//stale:target\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := replaceTargetsFile(path, map[string]bool{"//b:b": true, "//a:a": true}); err != nil {
+		t.Fatalf("Error replacing targets file: %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "//a:a\n//b:b\n", string(content); want != got {
+		t.Fatalf("Wrong targets file content: want %q got %q", want, got)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Wrong number of files after replacing targets file: want 1 got %d", len(entries))
+	}
+
+	if err := replaceTargetsFile(filepath.Join(dir, "missing", "fast_results.txt"), map[string]bool{"//a:a": true}); err == nil {
+		t.Fatalf("Wrong error replacing targets file in a missing directory: want error got nil")
+	}
+}
+
+// sourceFilesBazelCmd is a BazelCmd whose cquery results are sourceFiles, in the package at the root
+// of the workspace.
+type sourceFilesBazelCmd struct {
+	sourceFiles []string
+}
+
+func (c sourceFilesBazelCmd) Execute(config pkg.BazelCmdConfig, startupArgs []string, command string, args ...string) (int, error) {
+	switch command {
+	case "info":
+		if args[0] == "release" {
+			fmt.Fprintln(config.Stdout, "release 6.5.0")
+		}
+		return 0, nil
+	case "config":
+		fmt.Fprintln(config.Stdout, "[]")
+		return 0, nil
+	}
+	return 1, fmt.Errorf("unexpected bazel %s %v", command, args)
+}
+
+func (c sourceFilesBazelCmd) Cquery(bazelRelease string, config pkg.BazelCmdConfig, startupArgs []string, args ...string) (int, error) {
+	var result analysis.CqueryResult
+	for _, sourceFile := range c.sourceFiles {
+		result.Results = append(result.Results, &analysis.ConfiguredTarget{
+			Target: &build.Target{
+				Type: build.Target_SOURCE_FILE.Enum(),
+				SourceFile: &build.SourceFile{
+					Name:     proto.String("//:" + sourceFile),
+					Location: proto.String(fmt.Sprintf("%s/BUILD.bazel:1:1", config.Dir)),
+				},
+			},
+			Configuration: &analysis.Configuration{},
+		})
+	}
+	content, err := proto.Marshal(&result)
+	if err != nil {
+		return 1, err
+	}
+	_, err = bytes.NewReader(content).WriteTo(config.Stdout)
+	return 0, err
+}
+
+func TestWriteFastResults(t *testing.T) {
+	dir := t.TempDir()
+	changedFiles := filepath.Join(t.TempDir(), "changed_files.txt")
+	if err := os.WriteFile(changedFiles, []byte("b.txt\nc.txt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	targets, err := pkg.ParseTargetsList("//...")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filterPatterns, err := pkg.NewTargetPatternFilter([]string{"-//:c.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fastResultsFile := filepath.Join(t.TempDir(), "fast_results.txt")
+	config := &config{
+		Context: &pkg.Context{
+			WorkspacePath:              dir,
+			BazelCmd:                   sourceFilesBazelCmd{sourceFiles: []string{"a.txt", "b.txt", "c.txt"}},
+			BazelOutputBase:            "/output_base",
+			AnalysisCacheClearStrategy: "skip",
+			HashingWorkers:             1,
+		},
+		Targets:         targets,
+		ChangedFiles:    changedFiles,
+		FastResultsFile: fastResultsFile,
+		FilterPatterns:  filterPatterns,
+	}
+	if err := writeFastResults(config); err != nil {
+		t.Fatalf("Error writing fast results: %v", err)
+	}
+	content, err := os.ReadFile(fastResultsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "//:b.txt\n", string(content); want != got {
+		t.Fatalf("Wrong fast results: want %q got %q", want, got)
+	}
+}
+
+func TestConfigOutputs(t *testing.T) {
+	filterPatterns, err := pkg.NewTargetPatternFilter([]string{"-//excluded/..."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		label                  string
+		excludeExternalTargets bool
+		want                   bool
+	}{
+		{label: "//java/example:lib", excludeExternalTargets: false, want: true},
+		{label: "//java/example:lib", excludeExternalTargets: true, want: true},
+		{label: "@rules_go//go:stdlib", excludeExternalTargets: false, want: true},
+		{label: "@rules_go//go:stdlib", excludeExternalTargets: true, want: false},
+		{label: "@@rules_go~//go:stdlib", excludeExternalTargets: true, want: false},
+		{label: "//excluded/example:lib", excludeExternalTargets: false, want: false},
+	} {
+		l, err := gazelle_label.Parse(tc.label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &config{FilterPatterns: filterPatterns, ExcludeExternalTargets: tc.excludeExternalTargets}
+		if got := config.outputs(l); got != tc.want {
+			t.Errorf("Wrong result for whether %s is output with -exclude-external-targets=%v: want %v got %v", tc.label, tc.excludeExternalTargets, tc.want, got)
+		}
+	}
+}
+
+func TestSnapshotsEqual(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, revision string, hash string) string {
+		path := filepath.Join(dir, name)
+		if err := pkg.PersistHashes(path, &pkg.PersistedHashData{
+			SchemaVersion: pkg.PersistedHashesSchemaVersion,
+			Revision:      revision,
+			Hashes:        map[string]map[string]string{"//java/example:GreetingLib": {"cfg": hash}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	const revision = "0123456789abcdef0123456789abcdef01234567"
+	const otherRevision = "89abcdef0123456789abcdef0123456789abcdef"
+	base := write("base.json", revision, "aa")
+	for name, tc := range map[string]struct {
+		after string
+		want  bool
+	}{
+		"same content":                          {after: write("same.json", revision, "aa"), want: true},
+		"same hashes":                           {after: write("moved.json", otherRevision, "aa"), want: true},
+		"different hashes":                      {after: write("changed.json", otherRevision, "bb"), want: false},
+		"different hashes at the same revision": {after: write("changed-same-revision.json", revision, "bb"), want: false},
+	} {
+		for _, streaming := range []bool{false, true} {
+			flags := &targetDeterminatorFlags{diffSnapshots: []string{base, tc.after}, diffStreaming: streaming, bazelVersionMismatch: "ignore", includeRemoved: true}
+			got, err := snapshotsEqual(flags)
+			if err != nil {
+				t.Fatalf("Failed to compare snapshots with %s (streaming: %v): %v", name, streaming, err)
+			}
+			if got != tc.want {
+				t.Errorf("Wrong result for whether snapshots with %s are equal (streaming: %v): want %v got %v", name, streaming, tc.want, got)
+			}
+		}
+	}
+}
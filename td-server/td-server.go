@@ -0,0 +1,118 @@
+// td-server is a binary which serves the affected targets between commits over HTTP, from the hash
+// files written for each commit by target-determinator's -after-hashes-output, so that CI systems
+// and bots can integrate without running target-determinator (or Bazel) on every runner.
+//
+// It serves GET /affected?before=<sha>&after=<sha>, responding with a JSON object listing the
+// added, removed, changed and affected targets, or saying whether each label given with
+// is-affected=<label> is affected. See snapshot.AffectedResponse and snapshot.IsAffectedResponse.
+// Clients can also POST a hash file, e.g. for a pull request which isn't in the hash store, to
+// /affected to compare it with a baseline, such as the latest main branch commit, which is kept in
+// memory rather than read for each request. See snapshot.Server. The baseline can be re-pinned with
+// POST /baseline only by clients with the token in -token-file, which POSTs to /affected must
+// also have if it's set.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bazel-contrib/target-determinator/cli"
+	"github.com/bazel-contrib/target-determinator/pkg"
+	"github.com/bazel-contrib/target-determinator/pkg/snapshot"
+	"github.com/bazel-contrib/target-determinator/version"
+)
+
+type serverFlags struct {
+	version         bool
+	describe        bool
+	listen          string
+	hashStore       string
+	hashesVerifyKey string
+	baseline        string
+	token           string
+}
+
+func main() {
+	flags, err := parseFlags()
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "Failed to parse flags: %v\n", err)
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s -hash-store=<store>\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(flag.CommandLine.Output(), "Optional flags:\n")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	server := &snapshot.Server{Store: flags.hashStore, Token: flags.token}
+	if flags.hashesVerifyKey != "" {
+		if server.ReadOptions.VerifyKey, err = pkg.LoadVerifyKey(flags.hashesVerifyKey); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if flags.baseline != "" {
+		if err := server.PinBaseline(flags.baseline); err != nil {
+			log.Fatalf("Failed to pin baseline: %v", err)
+		}
+		pkg.Progressf("Pinned hashes for %s as the baseline", flags.baseline)
+	}
+	pkg.Progressf("Serving affected targets from %s on %s", flags.hashStore, flags.listen)
+	httpServer := &http.Server{
+		Addr:    flags.listen,
+		Handler: server.Handler(),
+		// Slow clients mustn't be able to hold connections, and the memory of submitted hash files,
+		// forever.
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       2 * time.Minute,
+		WriteTimeout:      5 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+	log.Fatal(httpServer.ListenAndServe())
+}
+
+func parseFlags() (*serverFlags, error) {
+	var flags serverFlags
+	flag.BoolVar(&flags.version, "version", false, "Print the version of the tool")
+	flag.BoolVar(&flags.describe, "describe", false, "Print a JSON document describing the tool's version, supported hash file schema versions, output formats and flags, and exit.")
+	flag.StringVar(&flags.listen, "listen", ":8080", "The address to listen for HTTP requests on.")
+	flag.StringVar(&flags.hashStore, "hash-store", "", "A directory, or s3:// or gs:// URI, containing hash files named <commit>.json, e.g. written by target-determinator's -after-hashes-output on each commit. Required.")
+	flag.StringVar(&flags.hashesVerifyKey, "hashes-verify-key", "", "If set, a PEM file containing an ed25519 public key. Hash files must have valid signatures by the corresponding private key (see target-determinator's -hashes-signing-key), or requests for them fail.")
+	flag.StringVar(&flags.baseline, "baseline", "", "If set, the full commit sha whose hash file to keep in memory as the baseline which hash files POSTed to /affected without a before parameter are compared with. It can be changed while serving with POST /baseline?sha=<sha>, e.g. when the main branch moves, if -token-file is set.")
+	var tokenFile string
+	flag.StringVar(&tokenFile, "token-file", "", "If set, a file containing a token which POST /baseline and POST /affected requests must pass as \"Authorization: Bearer <token>\". If not set, the baseline can't be changed while serving, and anyone can POST hash files to /affected.")
+	flag.Parse()
+
+	if flags.version {
+		fmt.Printf("td-server %s\n", version.Version)
+		os.Exit(0)
+	}
+	if flags.describe {
+		if err := cli.PrintDescription("td-server", []string{"json"}); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to describe td-server: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if flag.NArg() > 0 {
+		return nil, fmt.Errorf("expected no positional arguments, but got %d", flag.NArg())
+	}
+	if flags.hashStore == "" {
+		return nil, fmt.Errorf("-hash-store is required")
+	}
+	if tokenFile != "" {
+		content, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read -token-file: %w", err)
+		}
+		if flags.token = strings.TrimSpace(string(content)); flags.token == "" {
+			return nil, fmt.Errorf("-token-file %s is empty", tokenFile)
+		}
+	}
+	return &flags, nil
+}